@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// Status of a command. pending -> delivered -> succeeded/failed, a command not
+// finished before its ExpiresAt becomes expired.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusExpired   Status = "expired"
+)
+
+const (
+	DefaultTTL      = 24 * time.Hour
+	MaxTTL          = 7 * 24 * time.Hour
+	MaxPayloadBytes = 16 << 10 //for payloads and results
+	MaxNameLength   = 64
+)
+
+// Command is a cloud to device message with the device's answer
+type Command struct {
+	ID          uuid.UUID       `json:"id"`
+	CompanyID   uuid.UUID       `json:"company_id"`
+	DeviceID    uuid.UUID       `json:"device_id"`
+	GrpID       *uuid.UUID      `json:"grp_id,omitempty"` //set when sent to a whole group
+	Name        string          `json:"name"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Status      Status          `json:"status"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// Finished reports whether s is a final status
+func (s Status) Finished() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusExpired
+}
+
+// Valid reports whether s is a known status
+func (s Status) Valid() bool {
+	switch s {
+	case StatusPending, StatusDelivered, StatusSucceeded, StatusFailed, StatusExpired:
+		return true
+	}
+	return false
+}
+
+// CommandStore persists commands and their status
+type CommandStore interface {
+	// Enqueue stores pending commands atomically, filling in ID, Status and CreatedAt
+	Enqueue(ctx context.Context, cmds []*Command) error
+	// Get returns a command of a company
+	Get(ctx context.Context, companyID, id uuid.UUID) (*Command, error)
+	// ListByDevice returns the latest commands of a device, newest first. An empty status lists all.
+	ListByDevice(ctx context.Context, companyID, deviceID uuid.UUID, status Status, limit int) ([]*Command, error)
+
+	// ListPending returns the unexpired pending commands of a device, oldest first
+	ListPending(ctx context.Context, deviceID uuid.UUID, limit int) ([]*Command, error)
+	// FetchPending is ListPending that also marks the commands delivered
+	FetchPending(ctx context.Context, deviceID uuid.UUID, limit int) ([]*Command, error)
+	// Ack marks a command delivered, acking a delivered command again is a no-op
+	Ack(ctx context.Context, deviceID, id uuid.UUID) (*Command, error)
+	// Complete records the outcome a device reported, status is StatusSucceeded or StatusFailed
+	Complete(ctx context.Context, deviceID, id uuid.UUID, status Status, result json.RawMessage) (*Command, error)
+
+	// ExpireDue marks unfinished commands past their ExpiresAt expired
+	ExpireDue(ctx context.Context, now time.Time) (int64, error)
+}
+
+// Notifier pushes a new command to its device, e.g. over MQTT. It is best
+// effort, devices can always poll for pending commands.
+type Notifier interface {
+	Notify(d *metadata.Device, cmd *Command)
+}
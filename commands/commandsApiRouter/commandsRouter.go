@@ -0,0 +1,71 @@
+package commandsrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/commands"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+)
+
+type CommandsRouter struct {
+	logger     *log.Logger
+	MdataStore metadata.MetadataReader
+	Commands   commands.CommandStore
+	Notifier   commands.Notifier //optional, pushes new commands to connected devices
+}
+
+func NewCommandsRouter(mdataStore metadata.MetadataReader, commandStore commands.CommandStore, logger *log.Logger) *CommandsRouter {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &CommandsRouter{
+		logger:     logger,
+		MdataStore: mdataStore,
+		Commands:   commandStore,
+	}
+}
+
+// AddRoutes registers the command routes on router. Companies send and track
+// commands with userAuth, sending needs an operator. Devices poll and answer
+// them with deviceAuth.
+func (c *CommandsRouter) AddRoutes(router *mux.Router, deviceAuth, userAuth mux.MiddlewareFunc) error {
+	if router == nil || deviceAuth == nil || userAuth == nil {
+		return fmt.Errorf("command routes need a router and auth middlewares")
+	}
+
+	companyRouter := router.PathPrefix("/api/commands").Subrouter()
+	companyRouter.Use(userAuth)
+	companyRouter.HandleFunc("/device/{deviceID}", metadatarouter.RequireRole(metadata.RoleOperator, c.sendDeviceHandler)).Methods("POST")
+	companyRouter.HandleFunc("/device/{deviceID}", c.listDeviceHandler).Methods("GET")
+	companyRouter.HandleFunc("/group/{groupID}", metadatarouter.RequireRole(metadata.RoleOperator, c.sendGroupHandler)).Methods("POST")
+	companyRouter.HandleFunc("/{commandID}", c.getHandler).Methods("GET")
+
+	deviceRouter := router.PathPrefix("/api/device/commands").Subrouter()
+	deviceRouter.Use(deviceAuth)
+	deviceRouter.HandleFunc("", c.pollHandler).Methods("GET")
+	deviceRouter.HandleFunc("/{commandID}/ack", c.ackHandler).Methods("POST")
+	deviceRouter.HandleFunc("/{commandID}/result", c.resultHandler).Methods("POST")
+	return nil
+}
+
+// notify pushes cmds to d when a Notifier is set
+func (c *CommandsRouter) notify(d *metadata.Device, cmds ...*commands.Command) {
+	if c.Notifier == nil {
+		return
+	}
+	for _, cmd := range cmds {
+		c.Notifier.Notify(d, cmd)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,241 @@
+package commandsrouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/commands"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+)
+
+const maxCommandBodyBytes = commands.MaxPayloadBytes + 1<<10
+
+type sendRequest struct {
+	Name       string          `json:"name"`
+	Payload    json.RawMessage `json:"payload"`
+	TTLSeconds int             `json:"ttl"` //DefaultTTL when left out
+}
+
+type commandList struct {
+	Commands []*commands.Command `json:"commands"`
+}
+
+// sendDeviceHandler queues a command for one device
+func (c *CommandsRouter) sendDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(mux.Vars(r)["deviceID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid device id")
+		return
+	}
+	req, expiresAt, ok := decodeSend(w, r)
+	if !ok {
+		return
+	}
+
+	device, err := c.MdataStore.GetDeviceByID(r.Context(), deviceID.String())
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch device")
+		c.logger.Println("[sendDeviceHandler] error:", err)
+		return
+	}
+	if !metadatarouter.AuthorizeGroup(w, r, device.CompanyID, device.GrpID) {
+		return
+	}
+
+	cmd := &commands.Command{
+		CompanyID: device.CompanyID,
+		DeviceID:  device.ID,
+		Name:      req.Name,
+		Payload:   req.Payload,
+		ExpiresAt: expiresAt,
+	}
+	if err := c.Commands.Enqueue(r.Context(), []*commands.Command{cmd}); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to queue command")
+		c.logger.Println("[sendDeviceHandler] error:", err)
+		return
+	}
+	c.notify(device, cmd)
+	writeJSON(w, http.StatusCreated, cmd)
+}
+
+// sendGroupHandler queues one command per device of a group, all or none
+func (c *CommandsRouter) sendGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, err := uuid.Parse(mux.Vars(r)["groupID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid group id")
+		return
+	}
+	req, expiresAt, ok := decodeSend(w, r)
+	if !ok {
+		return
+	}
+
+	group, err := c.MdataStore.GetGroupByID(r.Context(), groupID.String())
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch group")
+		c.logger.Println("[sendGroupHandler] error:", err)
+		return
+	}
+	if !metadatarouter.AuthorizeGroup(w, r, group.CompanyID, group.ID) {
+		return
+	}
+
+	devices, err := c.groupDevices(r, groupID.String())
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch devices")
+		c.logger.Println("[sendGroupHandler] error:", err)
+		return
+	}
+	if len(devices) == 0 {
+		metadatarouter.WriteJSONError(w, http.StatusNotFound, "Group has no devices")
+		return
+	}
+
+	cmds := make([]*commands.Command, len(devices))
+	for i, d := range devices {
+		cmds[i] = &commands.Command{
+			CompanyID: group.CompanyID,
+			DeviceID:  d.ID,
+			GrpID:     &group.ID,
+			Name:      req.Name,
+			Payload:   req.Payload,
+			ExpiresAt: expiresAt,
+		}
+	}
+	if err := c.Commands.Enqueue(r.Context(), cmds); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to queue commands")
+		c.logger.Println("[sendGroupHandler] error:", err)
+		return
+	}
+	for i, d := range devices {
+		c.notify(d, cmds[i])
+	}
+	writeJSON(w, http.StatusCreated, commandList{Commands: cmds})
+}
+
+// listDeviceHandler serves GET /api/commands/device/{deviceID}?status=&limit=, newest first
+func (c *CommandsRouter) listDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(mux.Vars(r)["deviceID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid device id")
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	device, err := c.MdataStore.GetDeviceByID(r.Context(), deviceID.String())
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch device")
+		c.logger.Println("[listDeviceHandler] error:", err)
+		return
+	}
+	if !metadatarouter.AuthorizeGroup(w, r, device.CompanyID, device.GrpID) {
+		return
+	}
+
+	status := commands.Status(r.URL.Query().Get("status"))
+	cmds, err := c.Commands.ListByDevice(r.Context(), device.CompanyID, device.ID, status, limit)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch commands")
+		c.logger.Println("[listDeviceHandler] error:", err)
+		return
+	}
+	if cmds == nil {
+		cmds = []*commands.Command{}
+	}
+	writeJSON(w, http.StatusOK, commandList{Commands: cmds})
+}
+
+func (c *CommandsRouter) getHandler(w http.ResponseWriter, r *http.Request) {
+	commandID, err := uuid.Parse(mux.Vars(r)["commandID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid command id")
+		return
+	}
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	// Scoped to the caller's company, someone else's command is a 404
+	cmd, err := c.Commands.Get(r.Context(), companyID, commandID)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch command")
+		c.logger.Println("[getHandler] error:", err)
+		return
+	}
+	// A key scoped to a group only sees commands of the group's devices
+	if key, ok := metadatarouter.APIKeyFromContext(r.Context()); ok && key.GrpID != uuid.Nil {
+		device, err := c.MdataStore.GetDeviceByID(r.Context(), cmd.DeviceID.String())
+		if err != nil {
+			metadatarouter.StoreError(w, err, "Failed to fetch device")
+			c.logger.Println("[getHandler] error:", err)
+			return
+		}
+		if !metadatarouter.AuthorizeGroup(w, r, device.CompanyID, device.GrpID) {
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// decodeSend reads and validates a send request. On failure it has already written the response.
+func decodeSend(w http.ResponseWriter, r *http.Request) (*sendRequest, time.Time, bool) {
+	var req sendRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCommandBodyBytes)).Decode(&req); err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return nil, time.Time{}, false
+	}
+	err := commands.ValidateName(req.Name)
+	if err == nil {
+		err = commands.ValidatePayload(req.Payload)
+	}
+	ttl, ttlErr := commands.TTL(req.TTLSeconds)
+	if err == nil {
+		err = ttlErr
+	}
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return nil, time.Time{}, false
+	}
+	return &req, time.Now().Add(ttl), true
+}
+
+// groupDevices returns every device of a group, following the list pages
+func (c *CommandsRouter) groupDevices(r *http.Request, groupID string) ([]*metadata.Device, error) {
+	opts := &metadata.ListOptions{Limit: metadata.MaxListLimit}
+	var all []*metadata.Device
+	for {
+		devices, next, err := c.MdataStore.ListDevicesByGroup(r.Context(), groupID, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, devices...)
+		if next == "" {
+			return all, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// parseLimit reads the optional limit query parameter. On failure it has already written the response.
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 || limit > metadata.MaxListLimit {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid limit")
+		return 0, false
+	}
+	return limit, true
+}
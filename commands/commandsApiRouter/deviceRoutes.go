@@ -0,0 +1,93 @@
+package commandsrouter
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/commands"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+)
+
+type resultRequest struct {
+	Status commands.Status `json:"status"` //succeeded or failed
+	Result json.RawMessage `json:"result"`
+}
+
+// pollHandler hands the device its pending commands, oldest first, and marks them delivered
+func (c *CommandsRouter) pollHandler(w http.ResponseWriter, r *http.Request) {
+	device, ok := metadatarouter.DeviceFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	cmds, err := c.Commands.FetchPending(r.Context(), device.ID, limit)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch commands")
+		c.logger.Println("[pollHandler] error:", err)
+		return
+	}
+	if cmds == nil {
+		cmds = []*commands.Command{}
+	}
+	writeJSON(w, http.StatusOK, commandList{Commands: cmds})
+}
+
+// ackHandler confirms a pushed command arrived
+func (c *CommandsRouter) ackHandler(w http.ResponseWriter, r *http.Request) {
+	device, commandID, ok := deviceCommand(w, r)
+	if !ok {
+		return
+	}
+
+	cmd, err := c.Commands.Ack(r.Context(), device.ID, commandID)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to ack command")
+		c.logger.Println("[ackHandler] error:", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// resultHandler records whether the device carried out a command
+func (c *CommandsRouter) resultHandler(w http.ResponseWriter, r *http.Request) {
+	device, commandID, ok := deviceCommand(w, r)
+	if !ok {
+		return
+	}
+	var req resultRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCommandBodyBytes)).Decode(&req); err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	cmd, err := c.Commands.Complete(r.Context(), device.ID, commandID, req.Status, req.Result)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to record command result")
+		c.logger.Println("[resultHandler] error:", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
+
+// deviceCommand reads the authenticated device and the command id. On failure it has already written the response.
+func deviceCommand(w http.ResponseWriter, r *http.Request) (*metadata.Device, uuid.UUID, bool) {
+	device, ok := metadatarouter.DeviceFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return nil, uuid.Nil, false
+	}
+	commandID, err := uuid.Parse(mux.Vars(r)["commandID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid command id")
+		return nil, uuid.Nil, false
+	}
+	return device, commandID, true
+}
@@ -0,0 +1,14 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+var (
+	ErrInvalidCommand  = metadata.NewError(metadata.ErrValidation, "invalid command")
+	ErrCommandNotFound = metadata.NewError(metadata.ErrNotFound, "command not found")
+	ErrCommandFinished = metadata.NewError(metadata.ErrConflict, "command already finished or expired")
+	ErrDbErrorGeneric  = errors.New("database error")
+)
@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RunExpiry marks overdue commands expired every interval until ctx is done
+func RunExpiry(ctx context.Context, store CommandStore, interval time.Duration, logger *log.Logger) {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := store.ExpireDue(ctx, now)
+			if err != nil {
+				logger.Println("[RunExpiry] error:", err)
+				continue
+			}
+			if n > 0 {
+				logger.Printf("[RunExpiry] expired %d commands", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package commands
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	auditlog "github.com/mukundvijay123/KCloud/metadata/auditLog"
+)
+
+const commandColumns = `id, company_id, device_id, grp_id, name, payload, status, result,
+	created_at, expires_at, delivered_at, completed_at`
+
+// PgCommandStore keeps commands in the postgres "command" table
+type PgCommandStore struct {
+	dbConn *sql.DB
+	logger *log.Logger
+}
+
+func NewPgCommandStore(db *sql.DB, logger *log.Logger) *PgCommandStore {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &PgCommandStore{
+		dbConn: db,
+		logger: logger,
+	}
+}
+
+func (s *PgCommandStore) Enqueue(ctx context.Context, cmds []*Command) (err error) {
+	if len(cmds) == 0 {
+		return nil
+	}
+	for _, c := range cmds {
+		if c.CompanyID == uuid.Nil || c.DeviceID == uuid.Nil {
+			return fmt.Errorf("%w: company and device are required", ErrInvalidCommand)
+		}
+		if err := ValidateName(c.Name); err != nil {
+			return err
+		}
+		if err := ValidatePayload(c.Payload); err != nil {
+			return err
+		}
+		if c.ExpiresAt.IsZero() {
+			return fmt.Errorf("%w: expiry is required", ErrInvalidCommand)
+		}
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[Enqueue] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO command (company_id, device_id, grp_id, name, payload, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, status, created_at
+	`)
+	if err != nil {
+		s.logger.Println("[Enqueue] failed to prepare insert:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer stmt.Close()
+
+	for _, c := range cmds {
+		var status string
+		err = stmt.QueryRowContext(ctx, c.CompanyID, c.DeviceID, c.GrpID, c.Name, nullJSON(c.Payload), c.ExpiresAt).
+			Scan(&c.ID, &status, &c.CreatedAt)
+		if err != nil {
+			s.logger.Println("[Enqueue] failed to insert command:", err)
+			return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		c.Status = Status(status)
+
+		err = auditlog.Write(ctx, tx, c.CompanyID, metadata.AuditCommandCreate, c.ID, nil, c)
+		if err != nil {
+			s.logger.Println("[Enqueue] failed to write audit event:", err)
+			return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[Enqueue] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgCommandStore) Get(ctx context.Context, companyID, id uuid.UUID) (*Command, error) {
+	row := s.dbConn.QueryRowContext(ctx, `
+		SELECT `+commandColumns+` FROM command WHERE id = $1 AND company_id = $2
+	`, id, companyID)
+	c, err := scanCommand(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrCommandNotFound, id)
+	}
+	if err != nil {
+		s.logger.Println("[Get] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return c, nil
+}
+
+func (s *PgCommandStore) ListByDevice(ctx context.Context, companyID, deviceID uuid.UUID, status Status, limit int) ([]*Command, error) {
+	if status != "" && !status.Valid() {
+		return nil, fmt.Errorf("%w: unknown status %q", ErrInvalidCommand, status)
+	}
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT `+commandColumns+` FROM command
+		WHERE company_id = $1 AND device_id = $2 AND ($3 = '' OR status = $3)
+		ORDER BY created_at DESC, id
+		LIMIT $4
+	`, companyID, deviceID, string(status), listLimit(limit))
+	if err != nil {
+		s.logger.Println("[ListByDevice] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return s.scanCommands(rows, "ListByDevice")
+}
+
+func (s *PgCommandStore) ListPending(ctx context.Context, deviceID uuid.UUID, limit int) ([]*Command, error) {
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT `+commandColumns+` FROM command
+		WHERE device_id = $1 AND status = 'pending' AND expires_at > now()
+		ORDER BY created_at, id
+		LIMIT $2
+	`, deviceID, listLimit(limit))
+	if err != nil {
+		s.logger.Println("[ListPending] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return s.scanCommands(rows, "ListPending")
+}
+
+func (s *PgCommandStore) FetchPending(ctx context.Context, deviceID uuid.UUID, limit int) ([]*Command, error) {
+	// SKIP LOCKED keeps two concurrent polls from handing out the same command
+	rows, err := s.dbConn.QueryContext(ctx, `
+		UPDATE command SET status = 'delivered', delivered_at = now()
+		WHERE id IN (
+			SELECT id FROM command
+			WHERE device_id = $1 AND status = 'pending' AND expires_at > now()
+			ORDER BY created_at, id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+commandColumns,
+		deviceID, listLimit(limit))
+	if err != nil {
+		s.logger.Println("[FetchPending] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	cmds, err := s.scanCommands(rows, "FetchPending")
+	if err != nil {
+		return nil, err
+	}
+	//RETURNING has no order
+	sortByCreated(cmds)
+	return cmds, nil
+}
+
+func (s *PgCommandStore) Ack(ctx context.Context, deviceID, id uuid.UUID) (*Command, error) {
+	row := s.dbConn.QueryRowContext(ctx, `
+		UPDATE command SET status = 'delivered', delivered_at = now()
+		WHERE id = $1 AND device_id = $2 AND status = 'pending' AND expires_at > now()
+		RETURNING `+commandColumns,
+		id, deviceID)
+	c, err := scanCommand(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.unchanged(ctx, deviceID, id, StatusDelivered)
+	}
+	if err != nil {
+		s.logger.Println("[Ack] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return c, nil
+}
+
+func (s *PgCommandStore) Complete(ctx context.Context, deviceID, id uuid.UUID, status Status, result json.RawMessage) (*Command, error) {
+	if status != StatusSucceeded && status != StatusFailed {
+		return nil, fmt.Errorf("%w: status must be %s or %s", ErrInvalidCommand, StatusSucceeded, StatusFailed)
+	}
+	if err := ValidatePayload(result); err != nil {
+		return nil, err
+	}
+
+	row := s.dbConn.QueryRowContext(ctx, `
+		UPDATE command SET status = $3, result = $4, completed_at = now(),
+			delivered_at = COALESCE(delivered_at, now())
+		WHERE id = $1 AND device_id = $2 AND status IN ('pending', 'delivered') AND expires_at > now()
+		RETURNING `+commandColumns,
+		id, deviceID, string(status), nullJSON(result))
+	c, err := scanCommand(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.unchanged(ctx, deviceID, id, "")
+	}
+	if err != nil {
+		s.logger.Println("[Complete] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return c, nil
+}
+
+func (s *PgCommandStore) ExpireDue(ctx context.Context, now time.Time) (int64, error) {
+	res, err := s.dbConn.ExecContext(ctx, `
+		UPDATE command SET status = 'expired', completed_at = $1
+		WHERE status IN ('pending', 'delivered') AND expires_at <= $1
+	`, now)
+	if err != nil {
+		s.logger.Println("[ExpireDue] error:", err)
+		return 0, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// unchanged explains why an update matched no row: the command is not the
+// device's, or it is past the status the update moves it to. A command that
+// already has status same is returned as is.
+func (s *PgCommandStore) unchanged(ctx context.Context, deviceID, id uuid.UUID, same Status) (*Command, error) {
+	row := s.dbConn.QueryRowContext(ctx, `
+		SELECT `+commandColumns+` FROM command WHERE id = $1 AND device_id = $2
+	`, id, deviceID)
+	c, err := scanCommand(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrCommandNotFound, id)
+	}
+	if err != nil {
+		s.logger.Println("[unchanged] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if same != "" && c.Status == same && c.ExpiresAt.After(time.Now()) {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: %s is %s", ErrCommandFinished, id, c.Status)
+}
+
+func (s *PgCommandStore) scanCommands(rows *sql.Rows, fn string) ([]*Command, error) {
+	defer rows.Close()
+
+	var cmds []*Command
+	for rows.Next() {
+		c, err := scanCommand(rows)
+		if err != nil {
+			s.logger.Printf("[%s] scan error: %v", fn, err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		cmds = append(cmds, c)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Printf("[%s] rows error: %v", fn, err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return cmds, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCommand(row scanner) (*Command, error) {
+	var (
+		c                   Command
+		grpID               uuid.NullUUID
+		payload, result     []byte
+		status              string
+		delivered, complete sql.NullTime
+	)
+	err := row.Scan(&c.ID, &c.CompanyID, &c.DeviceID, &grpID, &c.Name, &payload, &status, &result,
+		&c.CreatedAt, &c.ExpiresAt, &delivered, &complete)
+	if err != nil {
+		return nil, err
+	}
+	if grpID.Valid {
+		c.GrpID = &grpID.UUID
+	}
+	c.Payload = payload
+	c.Result = result
+	c.Status = Status(status)
+	if delivered.Valid {
+		c.DeliveredAt = &delivered.Time
+	}
+	if complete.Valid {
+		c.CompletedAt = &complete.Time
+	}
+	return &c, nil
+}
+
+// nullJSON stores an empty payload as NULL
+func nullJSON(raw json.RawMessage) any {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return []byte(raw)
+}
+
+// listLimit clamps limit to metadata.MaxListLimit, 0 means metadata.DefaultListLimit
+func listLimit(limit int) int {
+	if limit <= 0 {
+		return metadata.DefaultListLimit
+	}
+	return min(limit, metadata.MaxListLimit)
+}
+
+func sortByCreated(cmds []*Command) {
+	sort.Slice(cmds, func(i, j int) bool {
+		if cmds[i].CreatedAt.Equal(cmds[j].CreatedAt) {
+			return cmds[i].ID.String() < cmds[j].ID.String()
+		}
+		return cmds[i].CreatedAt.Before(cmds[j].CreatedAt)
+	})
+}
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+	metadatatest "github.com/mukundvijay123/KCloud/metadata/metadataTest"
+)
+
+func TestPgCommandStoreAudit(t *testing.T) {
+	db := metadatatest.OpenTestDb(t)
+	logger := log.New(io.Discard, "", 0)
+	mdb := metadatastore.NewMetadataDb(db, logger)
+	store := NewPgCommandStore(db, logger)
+
+	d := metadatatest.MustDevice(t, mdb)
+	userID := uuid.New()
+	ctx := metadata.WithActor(context.Background(), metadata.Actor{UserID: userID, RequestID: "req-commands"})
+
+	cmds := []*Command{
+		{CompanyID: d.CompanyID, DeviceID: d.ID, Name: "reboot", ExpiresAt: time.Now().Add(time.Hour)},
+		{CompanyID: d.CompanyID, DeviceID: d.ID, Name: "blink", Payload: json.RawMessage(`{"times":3}`), ExpiresAt: time.Now().Add(time.Hour)},
+	}
+	if err := store.Enqueue(ctx, cmds); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	// Devices working through their commands are not audited
+	if _, err := store.Ack(context.Background(), d.ID, cmds[0].ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	events, _ := metadatatest.AuditActions(t, mdb, d.CompanyID.String())
+	byResource := map[uuid.UUID]*metadata.AuditEvent{}
+	for _, e := range events {
+		if e.Action == metadata.AuditCommandCreate {
+			byResource[e.ResourceID] = e
+		} else if e.ResourceID == cmds[0].ID {
+			t.Errorf("unexpected %s event of a command", e.Action)
+		}
+	}
+	for _, c := range cmds {
+		e, ok := byResource[c.ID]
+		if !ok {
+			t.Errorf("no command.create event for %s", c.Name)
+			continue
+		}
+		if e.ActorUserID != userID || e.RequestID != "req-commands" || e.Before != nil || e.After == nil {
+			t.Errorf("command.create event = %+v, want actor, request id and only after", e)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// ValidateName checks a command name, e.g. "reboot" or "set_interval"
+func ValidateName(name string) error {
+	if len(name) == 0 || len(name) > MaxNameLength || !nameRe.MatchString(name) {
+		return fmt.Errorf("%w: name must be 1-%d letters, digits, '_', '.' or '-'", ErrInvalidCommand, MaxNameLength)
+	}
+	return nil
+}
+
+// ValidatePayload checks a payload or result is a JSON object of at most MaxPayloadBytes.
+// An empty one is fine.
+func ValidatePayload(raw json.RawMessage) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if len(raw) > MaxPayloadBytes {
+		return fmt.Errorf("%w: payload exceeds %d bytes", ErrInvalidCommand, MaxPayloadBytes)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return fmt.Errorf("%w: payload must be a JSON object", ErrInvalidCommand)
+	}
+	return nil
+}
+
+// TTL returns the time to live for ttlSeconds, DefaultTTL when 0
+func TTL(ttlSeconds int) (time.Duration, error) {
+	if ttlSeconds == 0 {
+		return DefaultTTL, nil
+	}
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if ttlSeconds < 0 || ttl > MaxTTL {
+		return 0, fmt.Errorf("%w: ttl must be between 1 and %d seconds", ErrInvalidCommand, int(MaxTTL.Seconds()))
+	}
+	return ttl, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything needed to run the KCloud server
+type Config struct {
+	Database DatabaseConfig `yaml:"database"`
+	Server   ServerConfig   `yaml:"server"`
+	JWT      JWTConfig      `yaml:"jwt"`
+	MQTT     MQTTConfig     `yaml:"mqtt"`
+}
+
+type DatabaseConfig struct {
+	DSN          string `yaml:"dsn"` //postgres connection string for the kcloud database
+	MaxOpenConns int    `yaml:"max_open_conns"`
+	MaxIdleConns int    `yaml:"max_idle_conns"`
+}
+
+type ServerConfig struct {
+	ListenAddr      string        `yaml:"listen_addr"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	RequestTimeout  time.Duration `yaml:"request_timeout"`  //deadline for the store calls of one request, 0 disables it
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` //time given to in-flight requests on shutdown
+}
+
+type JWTConfig struct {
+	Secret        string         `yaml:"secret"`
+	SigningMethod string         `yaml:"signing_method"` //HS256, HS384 or HS512
+	AccessTTL     time.Duration  `yaml:"access_ttl"`     //lifetime of access tokens
+	RefreshTTL    time.Duration  `yaml:"refresh_ttl"`    //a session ends after this long without a refresh
+	Keys          []JWTKeyConfig `yaml:"keys"`           //asymmetric keys, once set the secret only verifies old tokens
+}
+
+// JWTKeyConfig is one scheduled signing key, see metadatarouter.SigningKey
+type JWTKeyConfig struct {
+	ID             string    `yaml:"id"`
+	Algorithm      string    `yaml:"algorithm"`        //RS256, RS384, RS512, PS256, ES256, ES384, ES512 or EdDSA
+	PrivateKeyFile string    `yaml:"private_key_file"` //PEM encoded
+	NotBefore      time.Time `yaml:"not_before"`       //signs from then on, unset signs right away
+	NotAfter       time.Time `yaml:"not_after"`        //tokens signed with it are rejected from then on
+}
+
+type MQTTConfig struct {
+	ListenAddr string `yaml:"listen_addr"` //empty disables the broker
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Database: DatabaseConfig{
+			MaxOpenConns: 20,
+			MaxIdleConns: 5,
+		},
+		Server: ServerConfig{
+			ListenAddr:      ":8080",
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			RequestTimeout:  10 * time.Second,
+			ShutdownTimeout: 20 * time.Second,
+		},
+		JWT: JWTConfig{
+			SigningMethod: "HS256",
+			AccessTTL:     15 * time.Minute,
+			RefreshTTL:    30 * 24 * time.Hour,
+		},
+		MQTT: MQTTConfig{
+			ListenAddr: ":1883",
+		},
+	}
+}
+
+// loadConfig reads the yaml config file and applies environment overrides.
+// Secrets can be kept out of the file with KCLOUD_DB_DSN and KCLOUD_JWT_SECRET.
+func loadConfig(filename string) (*Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Join(errors.New("error reading config file"), err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, errors.Join(errors.New("error unmarshalling config yaml file"), err)
+		}
+	}
+
+	if dsn := os.Getenv("KCLOUD_DB_DSN"); dsn != "" {
+		cfg.Database.DSN = dsn
+	}
+	if secret := os.Getenv("KCLOUD_JWT_SECRET"); secret != "" {
+		cfg.JWT.Secret = secret
+	}
+	if addr := os.Getenv("KCLOUD_LISTEN_ADDR"); addr != "" {
+		cfg.Server.ListenAddr = addr
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if c.Database.DSN == "" {
+		return errors.New("database dsn is required")
+	}
+	if c.Server.ListenAddr == "" {
+		return errors.New("server listen_addr is required")
+	}
+	// The secret can be left out once keys are configured
+	if (len(c.JWT.Keys) == 0 || c.JWT.Secret != "") && len(c.JWT.Secret) < 32 {
+		return fmt.Errorf("jwt secret must be at least 32 characters, got %d", len(c.JWT.Secret))
+	}
+	for i, k := range c.JWT.Keys {
+		if k.ID == "" || k.Algorithm == "" || k.PrivateKeyFile == "" {
+			return fmt.Errorf("jwt key %d needs an id, algorithm and private_key_file", i)
+		}
+	}
+	if c.JWT.AccessTTL <= 0 || c.JWT.RefreshTTL < c.JWT.AccessTTL {
+		return errors.New("jwt access_ttl must be positive and refresh_ttl at least as long")
+	}
+	return nil
+}
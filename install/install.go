@@ -6,12 +6,27 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 
 	_ "github.com/lib/pq"
+	"github.com/mukundvijay123/KCloud/migrations"
 	"gopkg.in/yaml.v3"
 )
 
+const usage = `usage: go run install.go [command]
+
+commands:
+  install      create the kcloud database if needed and apply all migrations (default)
+  up           apply all pending migrations
+  down [n]     revert the last n migrations (default 1)
+  status       list migrations and whether they are applied`
+
 func main() {
+	command := "install"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
 	credentialsFilename := "credentials.yaml"
 	credentials, err := getCredentials(credentialsFilename)
 	if err != nil {
@@ -35,10 +50,11 @@ func main() {
 
 	//Connected to datbase
 	fmt.Println("Succesfully connected to postgres")
-	//Setup is done
-	err = setupDB(db1)
-	if err != nil {
-		log.Fatal(err)
+	if command == "install" {
+		err = setupDB(db1)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	//Connecting to new database and making tables
@@ -55,12 +71,45 @@ func main() {
 	}
 	//connected to kcloud db
 	fmt.Println("Connected to kcloud DB")
-	err = createTables(db2)
+
+	migrator, err := migrations.NewMigrator(db2, nil)
 	if err != nil {
-		log.Fatalf("Creating tables failed :%v", err)
+		log.Fatalf("Loading migrations failed :%v", err)
 	}
-	fmt.Println("Tables created installation successful")
 
+	switch command {
+	case "install", "up":
+		if err := migrator.Up(); err != nil {
+			log.Fatalf("Applying migrations failed :%v", err)
+		}
+		fmt.Println("Migrations applied, installation successful")
+	case "down":
+		steps := 1
+		if len(os.Args) > 2 {
+			steps, err = strconv.Atoi(os.Args[2])
+			if err != nil {
+				log.Fatal(usage)
+			}
+		}
+		if err := migrator.Down(steps); err != nil {
+			log.Fatalf("Reverting migrations failed :%v", err)
+		}
+		fmt.Printf("Reverted %d migration(s)\n", steps)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.Fatalf("Reading migration status failed :%v", err)
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		log.Fatal(usage)
+	}
 }
 
 // This function fetches credentals from the yaml file
@@ -88,116 +137,26 @@ func getCredentials(filename string) (map[string]interface{}, error) {
 
 }
 
-// setupDB creates the two databases (kcloud and kcloud_data).
+// setupDB creates the kcloud database, an existing one is kept so install can be rerun
 func setupDB(db *sql.DB) error {
 
 	// Defining the database names
 	DbName := "kcloud"
 
-	// Create the metadata database (kcloud)
-	_, err := db.Exec(fmt.Sprintf(`CREATE DATABASE %s`, DbName))
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, DbName).Scan(&exists)
 	if err != nil {
-		return fmt.Errorf("error creating database %s: %v", DbName, err)
+		return fmt.Errorf("error checking database %s: %v", DbName, err)
 	}
-
-	return nil
-}
-
-func createTables(db *sql.DB) error {
-	// Lambda function to generate the query for checking if a table exists
-	generateQuery := func(tableName string) string {
-		return fmt.Sprintf(
-			"SELECT EXISTS (\n  SELECT 1\n  FROM   information_schema.tables\n  WHERE  table_schema = 'public'\n  AND    table_name = '%s'\n);",
-			tableName,
-		)
-	}
-
-	// Function to check if the table exists and create it if necessary
-	checkAndCreateTable := func(tableName, createQuery string) error {
-		// Generate the query to check if the table exists
-		query := generateQuery(tableName)
-
-		// Execute the query to check if the table exists
-		var exists bool
-		err := db.QueryRow(query).Scan(&exists)
-		if err != nil {
-			return fmt.Errorf("error checking if table %s exists: %v", tableName, err)
-		}
-
-		// If the table exists, return an error
-		if exists {
-			return fmt.Errorf("table %s already exists", tableName)
-		}
-
-		// If the table doesn't exist, execute the create table query
-		_, err = db.Exec(createQuery)
-		if err != nil {
-			return fmt.Errorf("error creating table %s: %v", tableName, err)
-		}
-
-		log.Printf("Table %s created successfully", tableName)
+	if exists {
+		fmt.Printf("Database %s exists, upgrading it\n", DbName)
 		return nil
 	}
 
-	// Queries to create tables
-	companyCreateQuery := `CREATE TABLE "company"(
-		id SERIAL PRIMARY KEY,
-		company_name VARCHAR(32) NOT NULL,
-		username VARCHAR(32) NOT NULL UNIQUE,
-		company_password VARCHAR(64) NOT NULL,
-		no_of_grps INT NOT NULL,
-		no_of_devices INT NOT NULL
-	);`
-	groupCreateQuery := `CREATE TABLE grp (
-		id SERIAL PRIMARY KEY,
-		group_name VARCHAR(32) ,
-		no_of_devices INT NOT NULL,
-		company_id INT,
-		FOREIGN KEY (company_id) REFERENCES company(id)
-			ON DELETE CASCADE 
-	);`
-	devicesCreateQuery := `CREATE TABLE devices (
-		id SERIAL PRIMARY KEY,
-		device_secret CHAR(64) NOT NULL UNIQUE,
-		device_name VARCHAR(32) NOT NULL ,
-		group_id INT NOT NULL,
-		company_id INT NOT NULL,
-		telemetry_data_schema JSONB NOT NULL,
-		device_description VARCHAR(100),
-		device_type VARCHAR(32) NOT NULL,
-		longitude DOUBLE PRECISION,
-		latitude DOUBLE PRECISION,
-		FOREIGN KEY (group_id) REFERENCES grp(id) 
-			ON DELETE CASCADE,
-		FOREIGN KEY (company_id) REFERENCES company(id)
-			ON DELETE CASCADE
-		
-		
-	);`
-
-	telemetryCreateQuery := `CREATE TABLE data(
-		company_id INT NOT NULL,
-		device_id INT NOT NULL,
-		timestamp TIMESTAMPTZ NOT NULL,
-		telemetry_data JSONB NOT NULL,
-		PRIMARY KEY(company_id,device_id,timestamp)
-	) PARTITION BY LIST (company_id);`
-
-	// Check and create each table
-	if err := checkAndCreateTable("company", companyCreateQuery); err != nil {
-		return err
-	}
-
-	if err := checkAndCreateTable("group", groupCreateQuery); err != nil {
-		return err
-	}
-
-	if err := checkAndCreateTable("devices", devicesCreateQuery); err != nil {
-		return err
-	}
-
-	if err := checkAndCreateTable("data", telemetryCreateQuery); err != nil {
-		return err
+	// Create the metadata database (kcloud)
+	_, err = db.Exec(fmt.Sprintf(`CREATE DATABASE %s`, DbName))
+	if err != nil {
+		return fmt.Errorf("error creating database %s: %v", DbName, err)
 	}
 
 	return nil
@@ -32,5 +32,5 @@ else
     exit 1
 fi
 cd install
-go run install.go
+go run install.go "$@"
 cd ..
\ No newline at end of file
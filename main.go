@@ -1,5 +1,244 @@
 package main
 
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	_ "github.com/lib/pq"
+	"github.com/mukundvijay123/KCloud/commands"
+	commandsrouter "github.com/mukundvijay123/KCloud/commands/commandsApiRouter"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	"github.com/mukundvijay123/KCloud/migrations"
+	mqttbroker "github.com/mukundvijay123/KCloud/mqttBroker"
+	"github.com/mukundvijay123/KCloud/presence"
+	"github.com/mukundvijay123/KCloud/rules"
+	rulesrouter "github.com/mukundvijay123/KCloud/rules/rulesApiRouter"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+	telemetryrouter "github.com/mukundvijay123/KCloud/telemetry/telemetryApiRouter"
+	"github.com/mukundvijay123/KCloud/webhooks"
+	webhooksrouter "github.com/mukundvijay123/KCloud/webhooks/webhooksApiRouter"
+)
+
+const (
+	commandExpiryInterval = time.Minute      //how often overdue commands are marked expired
+	ruleReloadInterval    = 30 * time.Second //how often rules changed on other instances are picked up
+	webhookPollInterval   = 5 * time.Second  //how often due webhook deliveries are sent
+	presenceFlushInterval = 10 * time.Second //how often last seen times are written and quiet devices marked offline
+	sessionPurgeInterval  = time.Hour        //how often expired sessions and denied tokens are dropped
+)
+
 func main() {
+	configFilename := flag.String("config", "kcloud.yaml", "path to the KCloud config file")
+	migrate := flag.Bool("migrate", false, "apply pending database migrations before serving")
+	flag.Parse()
+
+	logger := log.New(os.Stdout, "[kcloud] ", log.LstdFlags)
+
+	cfg, err := loadConfig(*configFilename)
+	if err != nil {
+		logger.Fatal("Couldnt load config: ", err)
+	}
+
+	if err := run(cfg, *migrate, logger); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// run wires the server together and blocks until it has shut down
+func run(cfg *Config, migrate bool, logger *log.Logger) error {
+	//Connecting to the database
+	db, err := sql.Open("postgres", cfg.Database.DSN)
+	if err != nil {
+		return fmt.Errorf("error connecting to postgres: %w", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("ping to postgres failed: %w", err)
+	}
+	logger.Println("Connected to kcloud DB")
+
+	if migrate {
+		migrator, err := migrations.NewMigrator(db, logger)
+		if err != nil {
+			return err
+		}
+		if err := migrator.Up(); err != nil {
+			return err
+		}
+	}
+
+	jwtMiddleWare := &metadatarouter.JWTMiddleWare{}
+	if cfg.JWT.Secret != "" {
+		signingMethod := jwt.GetSigningMethod(cfg.JWT.SigningMethod)
+		if _, ok := signingMethod.(*jwt.SigningMethodHMAC); !ok {
+			return fmt.Errorf("unsupported jwt signing method %q", cfg.JWT.SigningMethod)
+		}
+		jwtMiddleWare.SetSigningMethod(signingMethod)
+		jwtMiddleWare.SetSecretKey([]byte(cfg.JWT.Secret))
+	}
+	for _, kc := range cfg.JWT.Keys {
+		pemData, err := os.ReadFile(kc.PrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("error reading jwt key %q: %w", kc.ID, err)
+		}
+		key, err := metadatarouter.ParseSigningKey(kc.ID, kc.Algorithm, pemData)
+		if err != nil {
+			return err
+		}
+		key.NotBefore, key.NotAfter = kc.NotBefore, kc.NotAfter
+		if err := jwtMiddleWare.AddSigningKey(key); err != nil {
+			return err
+		}
+	}
+	jwtMiddleWare.SetLogger(logger)
+	jwtMiddleWare.AccessTTL = cfg.JWT.AccessTTL
+	jwtMiddleWare.RefreshTTL = cfg.JWT.RefreshTTL
+	if err := jwtMiddleWare.CheckSigningKeys(time.Now()); err != nil {
+		return err
+	}
+
+	metadataRouter := metadatarouter.NewMetadataRouter(db, logger)
+	if err := metadataRouter.AddJWTMiddleWare(jwtMiddleWare); err != nil {
+		return err
+	}
+	if err := metadataRouter.CreateRouter(); err != nil {
+		return err
+	}
+	if cfg.Server.RequestTimeout > 0 {
+		metadataRouter.Router.Use(metadatarouter.RequestTimeout(cfg.Server.RequestTimeout))
+	}
+
+	dataStore := storageengine.NewPgDataStore(db, logger)
+	telemetryRouter := telemetryrouter.NewTelemetryRouter(metadataRouter.MdataStore, dataStore, logger)
+	deviceAuth := metadatarouter.NewDeviceAuthMiddleWare(metadataRouter.MdataStore, logger)
+	if err := telemetryRouter.AddRoutes(metadataRouter.Router, deviceAuth.DeviceMiddleware, jwtMiddleWare.JWTMiddleware); err != nil {
+		return err
+	}
+	if err := metadataRouter.AddDeviceShadowRoutes(deviceAuth.DeviceMiddleware); err != nil {
+		return err
+	}
+
+	ruleStore := rules.NewPgRuleStore(db, logger)
+	ruleEngine := rules.NewEngine(ruleStore, logger)
+	telemetryRouter.Rules = ruleEngine
+	webhookStore := webhooks.NewPgWebhookStore(db, logger)
+	dispatcher := webhooks.NewDispatcher(webhookStore, logger)
+	ruleEngine.Handler = dispatcher
+	presenceTracker := presence.NewTracker(metadataRouter.MdataStore, logger)
+	presenceTracker.Handler = dispatcher
+	deviceAuth.Presence = presenceTracker
+	webhooksRouter := webhooksrouter.NewWebhooksRouter(webhookStore, logger)
+	if err := webhooksRouter.AddRoutes(metadataRouter.Router, jwtMiddleWare.JWTMiddleware); err != nil {
+		return err
+	}
+	rulesRouter := rulesrouter.NewRulesRouter(metadataRouter.MdataStore, ruleStore, logger)
+	rulesRouter.Engine = ruleEngine
+	if err := rulesRouter.AddRoutes(metadataRouter.Router, jwtMiddleWare.JWTMiddleware); err != nil {
+		return err
+	}
+
+	commandStore := commands.NewPgCommandStore(db, logger)
+	commandsRouter := commandsrouter.NewCommandsRouter(metadataRouter.MdataStore, commandStore, logger)
+	if err := commandsRouter.AddRoutes(metadataRouter.Router, deviceAuth.DeviceMiddleware, jwtMiddleWare.JWTMiddleware); err != nil {
+		return err
+	}
+
+	var broker *mqttbroker.Broker
+	if cfg.MQTT.ListenAddr != "" {
+		broker, err = mqttbroker.NewBroker(metadataRouter.MdataStore, dataStore, logger)
+		if err != nil {
+			return err
+		}
+		broker.Commands = commandStore
+		broker.Shadows = metadataRouter.MdataStore
+		broker.Rules = ruleEngine
+		broker.Presence = presenceTracker
+		commandsRouter.Notifier = broker
+		metadataRouter.ShadowNotifier = broker
+		metadataRouter.DeviceNotifier = broker
+		if err := broker.ListenTCP(cfg.MQTT.ListenAddr); err != nil {
+			return err
+		}
+		if err := broker.Serve(); err != nil {
+			return fmt.Errorf("mqtt broker failed: %w", err)
+		}
+		logger.Println("MQTT broker listening on", cfg.MQTT.ListenAddr)
+	}
+
+	srv := &http.Server{
+		Addr:         cfg.Server.ListenAddr,
+		Handler:      metadataRouter.Router,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		ErrorLog:     logger,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The background loops outlive the signal so in-flight requests can still
+	// use them. Once the servers stopped they are cancelled and waited for, the
+	// presence tracker flushing last seen times, before the deferred db.Close.
+	loopCtx, stopLoops := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	defer func() {
+		if broker != nil {
+			broker.Close()
+		}
+		stopLoops()
+		loops.Wait()
+	}()
+	runLoop := func(loop func(ctx context.Context)) {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			loop(loopCtx)
+		}()
+	}
+
+	runLoop(func(ctx context.Context) { commands.RunExpiry(ctx, commandStore, commandExpiryInterval, logger) })
+	runLoop(func(ctx context.Context) { ruleEngine.RunReload(ctx, ruleReloadInterval) })
+	runLoop(func(ctx context.Context) { dispatcher.Run(ctx, webhookPollInterval) })
+	runLoop(func(ctx context.Context) { presenceTracker.Run(ctx, presenceFlushInterval) })
+	runLoop(func(ctx context.Context) { jwtMiddleWare.RunSessionPurge(ctx, sessionPurgeInterval) })
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Println("Listening on", cfg.Server.ListenAddr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("server failed: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Stop accepting connections and let in-flight requests drain
+	logger.Println("Shutting down, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("graceful shutdown failed: %w", err)
+	}
 
+	logger.Println("Server stopped")
+	return nil
 }
@@ -0,0 +1,54 @@
+package metadata
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKeyPrefix starts every API key, it tells them apart from access tokens
+const APIKeyPrefix = "kck_"
+
+var (
+	ErrInvalidAPIKey  = NewError(ErrUnauthorized, "invalid api key")
+	ErrAPIKeyNotFound = NewError(ErrNotFound, "api key not found")
+)
+
+// APIKey lets a machine call the API without a user. A key is scoped to its
+// company or to one group of it, read-only keys act as a viewer and read-write
+// keys as an operator. Only the hash of the key is stored.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CompanyID  uuid.UUID  `json:"company_id"`
+	GrpID      uuid.UUID  `json:"grp_id"` //uuid.Nil for a company wide key
+	Name       string     `json:"name"`
+	ReadOnly   bool       `json:"read_only"`
+	CreatedBy  uuid.UUID  `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` //nil never expires
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Role is what the key may do, see Role.Allows
+func (k *APIKey) Role() Role {
+	if k.ReadOnly {
+		return RoleViewer
+	}
+	return RoleOperator
+}
+
+// APIKeyStore keeps the API keys of companies. Keys go with their company and
+// group.
+type APIKeyStore interface {
+	//Stores a key whose secret hashes to keyHash, sets its ID and CreatedAt
+	CreateAPIKey(ctx context.Context, k *APIKey, keyHash string) error
+	//Returns the usable key with the hash and records its use at now. Unknown,
+	//expired and revoked keys are ErrInvalidAPIKey.
+	VerifyAPIKey(ctx context.Context, keyHash string, now time.Time) (*APIKey, error)
+	//Lists all keys of a company, revoked and expired ones included, oldest first
+	ListAPIKeysByCompany(ctx context.Context, companyID string) ([]*APIKey, error)
+	//Revokes a key, k.ID and k.CompanyID pick it. Sets k to the revoked key.
+	RevokeAPIKey(ctx context.Context, k *APIKey) error
+}
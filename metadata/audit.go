@@ -0,0 +1,198 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Audit actions, <resource>.<change>
+const (
+	AuditCompanyCreate       = "company.create"
+	AuditCompanyDelete       = "company.delete"
+	AuditGroupCreate         = "group.create"
+	AuditGroupDelete         = "group.delete"
+	AuditGroupHeartbeat      = "group.update_heartbeat"
+	AuditDeviceCreate        = "device.create"
+	AuditDeviceDelete        = "device.delete"
+	AuditDeviceLocation      = "device.update_location"
+	AuditDeviceSchema        = "device.update_schema"
+	AuditDeviceSecretRotate  = "device.rotate_secret"
+	AuditDeviceSecretRevoke  = "device.revoke_secret"
+	AuditDeviceShadowDesired = "device.update_shadow"
+	AuditUserCreate          = "user.create"
+	AuditUserDelete          = "user.delete"
+	AuditUserPassword        = "user.update_password"
+	AuditUserRole            = "user.update_role"
+	AuditInviteCreate        = "invite.create"
+	AuditInviteDelete        = "invite.delete"
+	AuditAPIKeyCreate        = "api_key.create"
+	AuditAPIKeyRevoke        = "api_key.revoke"
+	AuditRuleCreate          = "rule.create"
+	AuditRuleUpdate          = "rule.update"
+	AuditRuleDelete          = "rule.delete"
+	AuditWebhookCreate       = "webhook.create"
+	AuditWebhookUpdate       = "webhook.update"
+	AuditWebhookDelete       = "webhook.delete"
+	AuditWebhookSecretRotate = "webhook.rotate_secret"
+	AuditCommandCreate       = "command.create"
+)
+
+// AuditEvent records one change of a company's metadata. Events are written in
+// the transaction of the change and never updated or deleted, not even with
+// their company.
+type AuditEvent struct {
+	ID            uuid.UUID       `json:"id"`
+	CompanyID     uuid.UUID       `json:"company_id"`
+	ActorUserID   uuid.UUID       `json:"actor_user_id"`    //uuid.Nil unless a user made the change
+	ActorAPIKeyID uuid.UUID       `json:"actor_api_key_id"` //uuid.Nil unless an API key made the change
+	Action        string          `json:"action"`
+	ResourceID    uuid.UUID       `json:"resource_id"`
+	Before        json.RawMessage `json:"before,omitempty"` //the resource before the change, left out for creates
+	After         json.RawMessage `json:"after,omitempty"`  //the resource after the change, left out for deletes
+	RequestID     string          `json:"request_id,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// Actor is who makes the changes of a request, see WithActor
+type Actor struct {
+	UserID    uuid.UUID
+	APIKeyID  uuid.UUID
+	RequestID string
+}
+
+type actorCtxKey struct{}
+
+// WithActor tells the stores who makes the changes done with ctx, for their audit events
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorCtxKey{}, a)
+}
+
+// ActorFromContext returns the actor of ctx, the zero Actor for changes the system makes
+func ActorFromContext(ctx context.Context) Actor {
+	a, _ := ctx.Value(actorCtxKey{}).(Actor)
+	return a
+}
+
+// WithDefaultActor makes userID the actor of ctx unless it has one, for changes
+// nobody logged in makes, like signups. The request ID is kept.
+func WithDefaultActor(ctx context.Context, userID uuid.UUID) context.Context {
+	actor := ActorFromContext(ctx)
+	if actor.UserID != uuid.Nil || actor.APIKeyID != uuid.Nil {
+		return ctx
+	}
+	actor.UserID = userID
+	return WithActor(ctx, actor)
+}
+
+// NewAuditEvent builds the event of a change made with ctx. before and after
+// are marshalled to JSON, nil leaves them out.
+func NewAuditEvent(ctx context.Context, companyID uuid.UUID, action string, resourceID uuid.UUID, before, after any) (*AuditEvent, error) {
+	actor := ActorFromContext(ctx)
+	e := &AuditEvent{
+		CompanyID:     companyID,
+		ActorUserID:   actor.UserID,
+		ActorAPIKeyID: actor.APIKeyID,
+		Action:        action,
+		ResourceID:    resourceID,
+		RequestID:     actor.RequestID,
+	}
+	var err error
+	if before != nil {
+		if e.Before, err = json.Marshal(before); err != nil {
+			return nil, fmt.Errorf("error marshalling audit state: %w", err)
+		}
+	}
+	if after != nil {
+		if e.After, err = json.Marshal(after); err != nil {
+			return nil, fmt.Errorf("error marshalling audit state: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// CompanyState is c as audit events keep it, without the password
+func CompanyState(c *Company) Company {
+	s := *c
+	s.CompanyPassword = ""
+	return s
+}
+
+// DeviceState is d as audit events keep it, without its secret and without the
+// state that changes on its own, the shadow and presence
+func DeviceState(d *Device) Device {
+	s := *d
+	s.DeviceSecret = ""
+	s.Shadow = Shadow{}
+	s.LastSeenAt = nil
+	s.Status = ""
+	return s
+}
+
+// DesiredShadowState is the part of s audit events keep, devices report the
+// rest too often to audit
+func DesiredShadowState(s Shadow) map[string]interface{} {
+	return map[string]interface{}{"desired": s.Desired, "version": s.Version}
+}
+
+// AuditFilter pages and filters ListAuditEvents, events come newest first
+type AuditFilter struct {
+	Limit      int       //rows per page, DefaultListLimit when 0
+	Cursor     string    //NextCursor of the previous page, empty for the first
+	Action     string    //only this action
+	ResourceID uuid.UUID //only changes of this resource
+	ActorID    uuid.UUID //only changes by this user or API key
+	Since      time.Time //only events at or after it
+	Until      time.Time //only events before it
+}
+
+// Normalize fills in defaults and validates f. A nil f lists the first default page.
+func (f *AuditFilter) Normalize() (*AuditFilter, error) {
+	n := AuditFilter{}
+	if f != nil {
+		n = *f
+	}
+
+	if n.Limit == 0 {
+		n.Limit = DefaultListLimit
+	}
+	if n.Limit < 0 || n.Limit > MaxListLimit {
+		return nil, NewError(ErrValidation, fmt.Sprintf("limit must be between 1 and %d", MaxListLimit))
+	}
+	if len(n.Action) > 64 {
+		return nil, NewError(ErrValidation, "invalid action")
+	}
+	if n.Cursor != "" {
+		if _, _, err := DecodeAuditCursor(n.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	return &n, nil
+}
+
+// AuditCursor is the position of e in the audit log
+func AuditCursor(e *AuditEvent) Cursor {
+	return Cursor{Key: e.CreatedAt.UTC().Format(time.RFC3339Nano), ID: e.ID}
+}
+
+// DecodeAuditCursor reads a cursor of AuditCursor, its key is a time
+func DecodeAuditCursor(s string) (time.Time, uuid.UUID, error) {
+	c, err := DecodeCursor(s)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	at, err := time.Parse(time.RFC3339Nano, c.Key)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidCursor
+	}
+	return at, c.ID, nil
+}
+
+// AuditStore reads the audit log, the other stores write it
+type AuditStore interface {
+	//Lists a page of a company's events, newest first, and the cursor of the next page
+	ListAuditEvents(ctx context.Context, companyID string, f *AuditFilter) ([]*AuditEvent, string, error)
+}
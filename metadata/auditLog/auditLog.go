@@ -0,0 +1,39 @@
+// Package auditlog writes audit events into the "audit_event" table, for every
+// store that keeps its tables in the metadata database
+package auditlog
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// Write records a change made with ctx in tx, so the event commits or rolls
+// back with the change. before and after are the resource around it, see
+// metadata.NewAuditEvent.
+func Write(ctx context.Context, tx *sql.Tx, companyID uuid.UUID, action string, resourceID uuid.UUID, before, after any) error {
+	e, err := metadata.NewAuditEvent(ctx, companyID, action, resourceID, before, after)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_event (company_id, actor_user_id, actor_api_key_id, action, resource_id, before, after, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, e.CompanyID, nullUUID(e.ActorUserID), nullUUID(e.ActorAPIKeyID), e.Action, e.ResourceID,
+		nullJSON(e.Before), nullJSON(e.After), sql.NullString{String: e.RequestID, Valid: e.RequestID != ""})
+	return err
+}
+
+func nullUUID(id uuid.UUID) uuid.NullUUID {
+	return uuid.NullUUID{UUID: id, Valid: id != uuid.Nil}
+}
+
+func nullJSON(raw []byte) interface{} {
+	if raw == nil {
+		return nil
+	}
+	return string(raw)
+}
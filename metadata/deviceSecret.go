@@ -0,0 +1,25 @@
+package metadata
+
+import "github.com/google/uuid"
+
+// DeviceSecretBytes is the amount of randomness in a device secret
+const DeviceSecretBytes = TokenBytes
+
+// NewDeviceSecret generates a random device secret, hex encoded
+func NewDeviceSecret() (string, error) {
+	return NewToken()
+}
+
+// HashDeviceSecret returns the stored form of a device secret, see HashToken
+func HashDeviceSecret(secret string) string {
+	return HashToken(secret)
+}
+
+// DeviceNotifier is told about changes to devices that transports keeping
+// them connected, e.g. MQTT, verified only once on connect
+type DeviceNotifier interface {
+	DeviceChanged(d *Device)               //the device's schema changed
+	DisconnectDevice(deviceID uuid.UUID)   //its secret was rotated or revoked, or it was deleted
+	DisconnectGroup(grpID uuid.UUID)       //the group was deleted with its devices
+	DisconnectCompany(companyID uuid.UUID) //the company was deleted
+}
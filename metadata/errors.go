@@ -0,0 +1,31 @@
+package metadata
+
+import "errors"
+
+// Kinds of metadata errors, every error of the metadata packages wraps one of
+// them so callers can tell them apart with errors.Is
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrValidation   = errors.New("validation failed")
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// Error is a metadata error of one Kind. Compare against the package sentinels
+// with errors.Is, or use errors.As to get at the Kind.
+type Error struct {
+	Kind error //one of ErrNotFound, ErrConflict, ErrValidation, ErrUnauthorized
+	Msg  string
+}
+
+func NewError(kind error, msg string) *Error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
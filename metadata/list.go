@@ -0,0 +1,124 @@
+package metadata
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// Sort orders for list calls, a leading '-' sorts descending
+const (
+	SortName     = "name"
+	SortNameDesc = "-name"
+	SortType     = "type" //devices only
+	SortTypeDesc = "-type"
+)
+
+var ErrInvalidCursor = NewError(ErrValidation, "invalid cursor")
+
+// ListOptions pages, filters and sorts a list call. Pages are keyset based:
+// pass the NextCursor of a page as Cursor, with the same filters and sort, to
+// get the one after it.
+type ListOptions struct {
+	Limit      int    //rows per page, DefaultListLimit when 0
+	Cursor     string //NextCursor of the previous page, empty for the first
+	NamePrefix string //only names starting with it
+	DeviceType string //only devices of this type (device lists only)
+	Sort       string //one of the Sort constants, SortName when empty
+}
+
+// Cursor is the decoded position after the last row of a page
+type Cursor struct {
+	Key string //value of the sort column
+	ID  uuid.UUID
+}
+
+// Normalize fills in defaults and validates opts. typeSort tells whether the
+// list can be sorted by device type. A nil opts lists the first default page.
+func (o *ListOptions) Normalize(typeSort bool) (*ListOptions, error) {
+	n := ListOptions{}
+	if o != nil {
+		n = *o
+	}
+
+	if n.Limit == 0 {
+		n.Limit = DefaultListLimit
+	}
+	if n.Limit < 0 || n.Limit > MaxListLimit {
+		return nil, NewError(ErrValidation, fmt.Sprintf("limit must be between 1 and %d", MaxListLimit))
+	}
+	if n.NamePrefix != "" && !IsValidName(n.NamePrefix) {
+		return nil, NewError(ErrValidation, "invalid name prefix")
+	}
+	if len(n.DeviceType) > 255 {
+		return nil, NewError(ErrValidation, "invalid device type")
+	}
+
+	switch n.Sort {
+	case "":
+		n.Sort = SortName
+	case SortName, SortNameDesc:
+	case SortType, SortTypeDesc:
+		if !typeSort {
+			return nil, NewError(ErrValidation, fmt.Sprintf("cant sort by %q here", n.Sort))
+		}
+	default:
+		return nil, NewError(ErrValidation, fmt.Sprintf("unknown sort %q", n.Sort))
+	}
+
+	if n.Cursor != "" {
+		if _, err := DecodeCursor(n.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	return &n, nil
+}
+
+// Descending reports whether the sort order is descending
+func (o *ListOptions) Descending() bool {
+	return strings.HasPrefix(o.Sort, "-")
+}
+
+func EncodeCursor(c Cursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.ID.String() + ":" + c.Key))
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, key, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Key: key, ID: parsed}, nil
+}
+
+// CompanyCursor is the position of c in a company list, sorted by username
+func CompanyCursor(c *Company) Cursor {
+	return Cursor{Key: c.Username, ID: c.ID}
+}
+
+func GroupCursor(g *Grp) Cursor {
+	return Cursor{Key: g.GroupName, ID: g.ID}
+}
+
+// DeviceCursor is the position of d in a device list sorted by sort
+func DeviceCursor(d *Device, sort string) Cursor {
+	if sort == SortType || sort == SortTypeDesc {
+		return Cursor{Key: d.DeviceType, ID: d.ID}
+	}
+	return Cursor{Key: d.DeviceName, ID: d.ID}
+}
@@ -0,0 +1,102 @@
+package metadatarouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+type apiKeyRequest struct {
+	Name             string    `json:"name"`
+	GrpID            uuid.UUID `json:"grp_id"` //left out for a company wide key
+	ReadOnly         bool      `json:"read_only"`
+	ExpiresInSeconds int       `json:"expires_in"` //0 never expires
+}
+
+// addAPIKeyRoutes adds API key management to the post login router. Keys act
+// as operators at most, so only users manage keys.
+func (m *MetadataRouter) addAPIKeyRoutes(postLoginRouter *mux.Router) {
+	postLoginRouter.HandleFunc("/createAPIKey", RequireRole(metadata.RoleAdmin, m.createAPIKeyHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/getAPIKeys", RequireRole(metadata.RoleAdmin, m.getAPIKeysHandler)).Methods("GET")
+	postLoginRouter.HandleFunc("/revokeAPIKey", RequireRole(metadata.RoleAdmin, m.revokeAPIKeyHandler)).Methods("POST")
+}
+
+// createAPIKeyHandler mints a key for the caller's company or one of its groups.
+// The response carries the key, it is never shown again.
+func (m *MetadataRouter) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.ExpiresInSeconds < 0 {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	key, err := NewAPIKey()
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, "Error creating api key")
+		m.logger.Println("[createAPIKeyHandler] error:", err)
+		return
+	}
+
+	apiKey := metadata.APIKey{Name: req.Name, GrpID: req.GrpID, ReadOnly: req.ReadOnly}
+	apiKey.CompanyID, _ = CompanyIDFromContext(r.Context())
+	apiKey.CreatedBy, _ = UserIDFromContext(r.Context())
+	if req.ExpiresInSeconds > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		apiKey.ExpiresAt = &expiresAt
+	}
+	// CreateAPIKey checks the group belongs to the company
+	if err := m.MdataStore.CreateAPIKey(r.Context(), &apiKey, metadata.HashToken(key)); err != nil {
+		StoreError(w, err, "Error creating api key")
+		m.logger.Println("[createAPIKeyHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"api_key": apiKey,
+		"key":     key,
+	})
+}
+
+// getAPIKeysHandler lists every key of the caller's company, revoked ones included
+func (m *MetadataRouter) getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, _ := CompanyIDFromContext(r.Context())
+	keys, err := m.MdataStore.ListAPIKeysByCompany(r.Context(), companyID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch api keys")
+		m.logger.Println("[getAPIKeysHandler] error:", err)
+		return
+	}
+	if keys == nil {
+		keys = []*metadata.APIKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*metadata.APIKey{"api_keys": keys})
+}
+
+func (m *MetadataRouter) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req userIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// RevokeAPIKey matches on id and company_id, another company's key is never touched
+	apiKey := metadata.APIKey{ID: req.ID}
+	apiKey.CompanyID, _ = CompanyIDFromContext(r.Context())
+	if err := m.MdataStore.RevokeAPIKey(r.Context(), &apiKey); err != nil {
+		StoreError(w, err, "Error revoking api key")
+		m.logger.Println("[revokeAPIKeyHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKey)
+}
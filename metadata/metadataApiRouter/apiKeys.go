@@ -0,0 +1,63 @@
+package metadatarouter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// NewAPIKey returns a random API key, only metadata.HashToken of it is stored
+func NewAPIKey() (string, error) {
+	secret, err := metadata.NewToken()
+	if err != nil {
+		return "", err
+	}
+	return metadata.APIKeyPrefix + secret, nil
+}
+
+// apiKeyFromRequest reads the key from "X-API-Key" or "Authorization: Bearer kck_..."
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer "+metadata.APIKeyPrefix) {
+		return strings.TrimSpace(authHeader[len("Bearer "):])
+	}
+	return ""
+}
+
+// serveAPIKey authorizes a request by API key. The caller in the ctx has the
+// key's company and role but no user, MiddlewareFunc is not asked.
+func (j *JWTMiddleWare) serveAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, key string, start time.Time) {
+	apiKey, err := j.APIKeys.VerifyAPIKey(r.Context(), metadata.HashToken(key), start)
+	if errors.Is(err, metadata.ErrUnauthorized) {
+		WriteJSONError(w, http.StatusUnauthorized, "Invalid API key")
+		if j.logger != nil {
+			j.logger.Printf("[WARN] Invalid API key from %s", r.RemoteAddr)
+		}
+		return
+	}
+	if err != nil {
+		StoreError(w, err, "Error verifying API key")
+		if j.logger != nil {
+			j.logger.Printf("[ERROR] API key lookup failed: %v", err)
+		}
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), companyCtxKey{}, apiKey.CompanyID)
+	ctx = context.WithValue(ctx, callerCtxKey{}, caller{role: apiKey.Role(), apiKey: apiKey})
+	r = r.WithContext(withActor(ctx))
+
+	if j.logger != nil {
+		j.logger.Printf("[INFO] Authorized request from %s (api_key_id=%v) in %v",
+			r.RemoteAddr, apiKey.ID, time.Since(start))
+	}
+
+	next.ServeHTTP(w, r)
+}
@@ -0,0 +1,67 @@
+package metadatarouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// addAuditRoutes adds the audit log of the caller's company, only owners read it
+func (m *MetadataRouter) addAuditRoutes() {
+	auditRouter := m.Router.PathPrefix("/api/audit").Subrouter()
+	auditRouter.Use(m.JWTMiddleWare.JWTMiddleware)
+	auditRouter.HandleFunc("", RequireRole(metadata.RoleOwner, m.getAuditHandler)).Methods("GET")
+}
+
+// getAuditHandler lists the changes made to the caller's company, newest first
+func (m *MetadataRouter) getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r.URL.Query())
+	if err != nil {
+		StoreError(w, err, "Invalid query")
+		return
+	}
+
+	companyID, _ := CompanyIDFromContext(r.Context())
+	events, next, err := m.MdataStore.ListAuditEvents(r.Context(), companyID.String(), f)
+	if err != nil {
+		StoreError(w, err, "Failed to fetch audit events")
+		m.logger.Println("[getAuditHandler] error:", err)
+		return
+	}
+	if events == nil {
+		events = []*metadata.AuditEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(auditPage{Events: events, NextCursor: next})
+}
+
+// auditFilter reads the limit, cursor, action, resource_id, actor_id, since
+// and until query params, times are RFC 3339
+func auditFilter(v url.Values) (*metadata.AuditFilter, error) {
+	opts, err := listOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	f := &metadata.AuditFilter{Limit: opts.Limit, Cursor: opts.Cursor, Action: v.Get("action")}
+
+	for name, dst := range map[string]*uuid.UUID{"resource_id": &f.ResourceID, "actor_id": &f.ActorID} {
+		if s := v.Get(name); s != "" {
+			if *dst, err = uuid.Parse(s); err != nil {
+				return nil, metadata.NewError(metadata.ErrValidation, "invalid "+name)
+			}
+		}
+	}
+	for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if s := v.Get(name); s != "" {
+			if *dst, err = time.Parse(time.RFC3339, s); err != nil {
+				return nil, metadata.NewError(metadata.ErrValidation, name+" must be an RFC 3339 time")
+			}
+		}
+	}
+	return f, nil
+}
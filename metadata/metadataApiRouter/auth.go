@@ -2,21 +2,58 @@ package metadatarouter
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
 )
 
 type JWTMiddleWare struct {
-	secretKey      interface{}
-	signingMethod  jwt.SigningMethod
+	secretKey      interface{}       //HMAC secret, signs only while no SigningKey is configured
+	signingMethod  jwt.SigningMethod //method of the HMAC secret
+	keys           []*SigningKey
 	MiddlewareFunc func(jwt.MapClaims, context.Context) (context.Context, bool, error) // return enriched ctx
 	logger         *log.Logger
+
+	Sessions   metadata.SessionStore //refresh tokens and revocation, AddJWTMiddleWare defaults it to the MetadataStore
+	AccessTTL  time.Duration         //defaults to metadata.DefaultAccessTokenTTL
+	RefreshTTL time.Duration         //defaults to metadata.DefaultRefreshTokenTTL
+	APIKeys    metadata.APIKeyStore  //accepted besides tokens when set, AddJWTMiddleWare defaults it to the MetadataStore
+}
+
+// TokenPair is handed out by login and refresh. The refresh token is opaque,
+// only its hash is stored, and it can be used once.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` //seconds until the access token expires
+}
+
+// TokenInfo describes the access token of a request, see TokenFromContext
+type TokenInfo struct {
+	ID        string //jti
+	SessionID uuid.UUID
+	ExpiresAt time.Time
 }
 
+type tokenCtxKey struct{}
+
+// TokenFromContext returns the access token the request was authorized with
+func TokenFromContext(ctx context.Context) (*TokenInfo, bool) {
+	info, ok := ctx.Value(tokenCtxKey{}).(*TokenInfo)
+	return info, ok
+}
+
+var (
+	errNoSessionStore = errors.New("jwt middleware has no session store")
+	errNoSigningKey   = errors.New("jwt middleware has no key valid for signing")
+)
+
 // SetSigningMethod sets the signing method (e.g., jwt.SigningMethodHS256)
 func (j *JWTMiddleWare) SetSigningMethod(method jwt.SigningMethod) {
 	j.signingMethod = method
@@ -37,45 +74,170 @@ func (j *JWTMiddleWare) SetLogger(l *log.Logger) {
 	j.logger = l
 }
 
-// GenerateToken creates a JWT for a given user_id
-func (j *JWTMiddleWare) GenerateToken(userID string) (string, error) {
-	if j.signingMethod == nil {
-		j.signingMethod = jwt.SigningMethodHS256
+// IssueTokens starts a session for the user and returns its first token pair
+func (j *JWTMiddleWare) IssueTokens(ctx context.Context, userID uuid.UUID) (*TokenPair, error) {
+	if j.Sessions == nil {
+		return nil, errNoSessionStore
+	}
+	refreshToken, err := metadata.NewToken()
+	if err != nil {
+		return nil, err
 	}
+	session, err := j.Sessions.CreateSession(ctx, userID, metadata.HashToken(refreshToken), time.Now().Add(j.refreshTTL()))
+	if err != nil {
+		return nil, err
+	}
+	return j.tokenPair(session, refreshToken)
+}
 
+// RefreshTokens trades a refresh token for a new pair. Reusing a refresh token
+// revokes its session, the thief and the owner are both logged out.
+func (j *JWTMiddleWare) RefreshTokens(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	if j.Sessions == nil {
+		return nil, errNoSessionStore
+	}
+	next, err := metadata.NewToken()
+	if err != nil {
+		return nil, err
+	}
+	session, err := j.Sessions.RotateRefreshToken(ctx, metadata.HashToken(refreshToken), metadata.HashToken(next), time.Now().Add(j.refreshTTL()))
+	if err != nil {
+		return nil, err
+	}
+	return j.tokenPair(session, next)
+}
+
+// RevokeToken denies the access token and ends its session, logging it out
+func (j *JWTMiddleWare) RevokeToken(ctx context.Context, info *TokenInfo) error {
+	if j.Sessions == nil {
+		return errNoSessionStore
+	}
+	if err := j.Sessions.DenyToken(ctx, info.ID, info.ExpiresAt); err != nil {
+		return err
+	}
+	return j.Sessions.RevokeSession(ctx, info.SessionID)
+}
+
+// RunSessionPurge drops expired sessions and denylist entries every interval until ctx is done
+func (j *JWTMiddleWare) RunSessionPurge(ctx context.Context, interval time.Duration) {
+	if j.Sessions == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.Sessions.PurgeSessions(ctx, time.Now()); err != nil && j.logger != nil {
+				j.logger.Printf("[ERROR] Purging sessions failed: %v", err)
+			}
+		}
+	}
+}
+
+func (j *JWTMiddleWare) tokenPair(session *metadata.Session, refreshToken string) (*TokenPair, error) {
+	now := time.Now()
+	ttl := j.accessTTL()
 	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-		"iat":     time.Now().Unix(),
+		"user_id":    session.UserID.String(),
+		"company_id": session.CompanyID.String(),
+		"role":       string(session.Role),
+		"sid":        session.ID.String(),
+		"jti":        uuid.NewString(),
+		"exp":        now.Add(ttl).Unix(),
+		"iat":        now.Unix(),
 	}
 
-	token := jwt.NewWithClaims(j.signingMethod, claims)
-	return token.SignedString(j.secretKey)
+	var accessToken string
+	var err error
+	key := j.currentKey(now)
+	switch {
+	case key != nil:
+		token := jwt.NewWithClaims(key.Method, claims)
+		token.Header["kid"] = key.ID
+		accessToken, err = token.SignedString(key.Key)
+	case len(j.keys) > 0:
+		// Verifiers trust the JWKS, the HMAC secret must not take over when the keys run out
+		if j.logger != nil {
+			j.logger.Printf("[ERROR] No jwt signing key stays valid for the next %v, logins fail until a new key is configured", ttl)
+		}
+		err = errNoSigningKey
+	case j.secretKey != nil && j.signingMethod != nil: //AddJWTMiddleWare defaults the method
+		accessToken, err = jwt.NewWithClaims(j.signingMethod, claims).SignedString(j.secretKey)
+	default:
+		err = errNoSigningKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(ttl / time.Second),
+	}, nil
 }
 
-// JWTMiddleware validates the JWT and passes the request to the next handler
+func (j *JWTMiddleWare) accessTTL() time.Duration {
+	if j.AccessTTL <= 0 {
+		return metadata.DefaultAccessTokenTTL
+	}
+	return j.AccessTTL
+}
+
+func (j *JWTMiddleWare) refreshTTL() time.Duration {
+	if j.RefreshTTL <= 0 {
+		return metadata.DefaultRefreshTokenTTL
+	}
+	return j.RefreshTTL
+}
+
+// tokenInfo reads the jti, sid and exp claims every access token carries
+func tokenInfo(claims jwt.MapClaims) (*TokenInfo, bool) {
+	jti, ok := claims["jti"].(string)
+	if !ok || jti == "" {
+		return nil, false
+	}
+	sid, ok := claims["sid"].(string)
+	if !ok {
+		return nil, false
+	}
+	sessionID, err := uuid.Parse(sid)
+	if err != nil {
+		return nil, false
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, false
+	}
+	return &TokenInfo{ID: jti, SessionID: sessionID, ExpiresAt: time.Unix(int64(exp), 0)}, true
+}
+
+// JWTMiddleware validates the JWT, or the API key when the request carries one,
+// and passes the request to the next handler
 func (j *JWTMiddleWare) JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
+		if key := apiKeyFromRequest(r); key != "" && j.APIKeys != nil {
+			j.serveAPIKey(w, r, next, key, start)
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			WriteJSONError(w, http.StatusUnauthorized, "Missing Authorization header")
 			if j.logger != nil {
 				j.logger.Printf("[WARN] Missing Authorization header from %s", r.RemoteAddr)
 			}
 			return
 		}
 
-		tokenString := authHeader[len("Bearer "):]
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if token.Method != j.signingMethod {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return j.secretKey, nil
-		})
+		tokenString := strings.TrimSpace(authHeader[len("Bearer "):])
+		token, err := jwt.Parse(tokenString, j.verificationKey)
 		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			WriteJSONError(w, http.StatusUnauthorized, "Invalid token")
 			if j.logger != nil {
 				j.logger.Printf("[ERROR] Invalid token from %s: %v", r.RemoteAddr, err)
 			}
@@ -84,27 +246,53 @@ func (j *JWTMiddleWare) JWTMiddleware(next http.Handler) http.Handler {
 
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+			WriteJSONError(w, http.StatusUnauthorized, "Invalid token claims")
 			if j.logger != nil {
 				j.logger.Printf("[ERROR] Invalid token claims from %s", r.RemoteAddr)
 			}
 			return
 		}
 
+		info, ok := tokenInfo(claims)
+		if !ok {
+			WriteJSONError(w, http.StatusUnauthorized, "Invalid token claims")
+			if j.logger != nil {
+				j.logger.Printf("[WARN] Token without session claims from %s", r.RemoteAddr)
+			}
+			return
+		}
+		if j.Sessions != nil {
+			revoked, err := j.Sessions.TokenRevoked(r.Context(), info.ID, info.SessionID)
+			if err != nil {
+				StoreError(w, err, "Error verifying token")
+				if j.logger != nil {
+					j.logger.Printf("[ERROR] Revocation check failed: %v", err)
+				}
+				return
+			}
+			if revoked {
+				WriteJSONError(w, http.StatusUnauthorized, "Token revoked")
+				if j.logger != nil {
+					j.logger.Printf("[WARN] Revoked token from %s (session=%s)", r.RemoteAddr, info.SessionID)
+				}
+				return
+			}
+		}
+
 		// start with existing request ctx
-		ctx := r.Context()
+		ctx := context.WithValue(r.Context(), tokenCtxKey{}, info)
 		if j.MiddlewareFunc != nil {
 			var valid bool
 			ctx, valid, err = j.MiddlewareFunc(claims, ctx)
 			if err != nil {
-				http.Error(w, "Error verifying token", http.StatusInternalServerError)
+				WriteJSONError(w, http.StatusInternalServerError, "Error verifying token")
 				if j.logger != nil {
 					j.logger.Printf("[ERROR] MiddlewareFunc failed: %v", err)
 				}
 				return
 			}
 			if !valid {
-				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+				WriteJSONError(w, http.StatusUnauthorized, "Invalid token claims")
 				if j.logger != nil {
 					j.logger.Printf("[WARN] Token claims rejected for %s", r.RemoteAddr)
 				}
@@ -112,7 +300,7 @@ func (j *JWTMiddleWare) JWTMiddleware(next http.Handler) http.Handler {
 			}
 		}
 
-		r = r.WithContext(ctx)
+		r = r.WithContext(withActor(ctx))
 
 		if j.logger != nil {
 			j.logger.Printf("[INFO] Authorized request from %s (user_id=%v) in %v",
@@ -0,0 +1,87 @@
+package metadatarouter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+type deviceCtxKey struct{}
+
+// DeviceAuthMiddleWare authenticates device traffic by the secret issued in CreateDevice.
+// It is separate from JWTMiddleWare, devices never hold a company token.
+type DeviceAuthMiddleWare struct {
+	mdataReader metadata.MetadataReader
+	logger      *log.Logger
+	Presence    metadata.PresenceRecorder //optional, told about every authenticated request
+}
+
+func NewDeviceAuthMiddleWare(mdataReader metadata.MetadataReader, logger *log.Logger) *DeviceAuthMiddleWare {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &DeviceAuthMiddleWare{
+		mdataReader: mdataReader,
+		logger:      logger,
+	}
+}
+
+// DeviceFromContext returns the device authenticated by DeviceMiddleware
+func DeviceFromContext(ctx context.Context) (*metadata.Device, bool) {
+	d, ok := ctx.Value(deviceCtxKey{}).(*metadata.Device)
+	return d, ok
+}
+
+// DeviceMiddleware reads the secret from "X-Device-Key" or "Authorization: Device <secret>"
+// and puts the matching device into the request ctx
+func (d *DeviceAuthMiddleWare) DeviceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		secret := deviceSecretFromRequest(r)
+		if secret == "" {
+			WriteJSONError(w, http.StatusUnauthorized, "Missing device key")
+			d.logger.Printf("[WARN] Missing device key from %s", r.RemoteAddr)
+			return
+		}
+
+		device, err := d.mdataReader.GetDeviceBySecret(r.Context(), secret)
+		if errors.Is(err, metadata.ErrNotFound) {
+			WriteJSONError(w, http.StatusUnauthorized, "Invalid device key")
+			d.logger.Printf("[WARN] Invalid device key from %s", r.RemoteAddr)
+			return
+		}
+		if err != nil {
+			StoreError(w, err, "Error verifying device key")
+			d.logger.Printf("[ERROR] Device lookup failed: %v", err)
+			return
+		}
+
+		if d.Presence != nil {
+			d.Presence.DeviceSeen(device, start)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), deviceCtxKey{}, device))
+
+		d.logger.Printf("[INFO] Authorized device request from %s (device_id=%v) in %v",
+			r.RemoteAddr, device.ID, time.Since(start))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func deviceSecretFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-Device-Key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Device ") {
+		return strings.TrimSpace(authHeader[len("Device "):])
+	}
+	return ""
+}
@@ -0,0 +1,318 @@
+package metadatarouter
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+const (
+	maxDeviceTypeLength        = 255
+	maxDeviceDescriptionLength = 1024
+)
+
+type deviceIDRequest struct {
+	ID uuid.UUID `json:"id"`
+}
+
+type deviceLocationRequest struct {
+	ID       uuid.UUID         `json:"id"`
+	Location metadata.Location `json:"device_location"`
+}
+
+type deviceSchemaRequest struct {
+	ID     uuid.UUID                `json:"id"`
+	Schema metadata.TelemetrySchema `json:"telemetry_data_schema"`
+	Force  bool                     `json:"force"` //allow changing or removing fields
+}
+
+type schemaHistory struct {
+	ID       uuid.UUID                  `json:"id"`
+	Versions []*metadata.SchemaRevision `json:"versions"`
+}
+
+// addDeviceRoutes adds device management routes to the post login router
+func (m *MetadataRouter) addDeviceRoutes(postLoginRouter *mux.Router) {
+	postLoginRouter.HandleFunc("/createDevice", RequireRole(metadata.RoleOperator, m.createDeviceHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/getDevice", m.getDeviceByIDHandler).Methods("GET")
+	postLoginRouter.HandleFunc("/getDevices", m.getDevicesHandler).Methods("GET")
+	postLoginRouter.HandleFunc("/deleteDevice", RequireRole(metadata.RoleOperator, m.deleteDeviceHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/updateDeviceLocation", RequireRole(metadata.RoleOperator, m.updateDeviceLocationHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/updateDeviceSchema", RequireRole(metadata.RoleOperator, m.updateDeviceSchemaHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/getDeviceSchemaHistory", m.getDeviceSchemaHistoryHandler).Methods("GET")
+	postLoginRouter.HandleFunc("/rotateDeviceSecret", RequireRole(metadata.RoleOperator, m.rotateDeviceSecretHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/revokeDeviceSecret", RequireRole(metadata.RoleOperator, m.revokeDeviceSecretHandler)).Methods("POST")
+	m.addShadowRoutes(postLoginRouter)
+}
+
+// createDeviceHandler provisions a device in one of the caller's groups.
+// The response carries the device secret, it is never shown again.
+func (m *MetadataRouter) createDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var device metadata.Device
+	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if device.GrpID == uuid.Nil || device.DeviceName == "" ||
+		len(device.DeviceType) > maxDeviceTypeLength ||
+		len(device.DeviceDescription) > maxDeviceDescriptionLength ||
+		!isValidLocation(device.DeviceLocation) {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !AuthorizeGroup(w, r, device.CompanyID, device.GrpID) {
+		return
+	}
+	device.CompanyID, _ = CompanyIDFromContext(r.Context())
+	device.ID = uuid.Nil
+	device.DeviceSecret = ""
+
+	if err := m.MdataStore.CreateDevice(r.Context(), &device); err != nil {
+		StoreError(w, err, "Error creating device")
+		m.logger.Println("[createDeviceHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(device)
+}
+
+func (m *MetadataRouter) getDeviceByIDHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(r.URL.Query().Get("id"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "id query parameter is required")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, deviceID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(device); err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+}
+
+// getDevicesHandler lists a page of the devices of a group when group_id is given, else of all the caller's devices.
+// Keys scoped to a group get its devices.
+func (m *MetadataRouter) getDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, _ := CompanyIDFromContext(r.Context())
+	opts, err := listOptions(r.URL.Query())
+	if err != nil {
+		StoreError(w, err, "Invalid list options")
+		return
+	}
+
+	var page devicePage
+	if s := r.URL.Query().Get("group_id"); s != "" {
+		groupID, parseErr := uuid.Parse(s)
+		if parseErr != nil {
+			WriteJSONError(w, http.StatusBadRequest, "Invalid group_id")
+			return
+		}
+		group, groupErr := m.MdataStore.GetGroupByID(r.Context(), groupID.String())
+		if groupErr != nil {
+			StoreError(w, groupErr, "Failed to fetch group")
+			m.logger.Println("[getDevicesHandler] error:", groupErr)
+			return
+		}
+		if !AuthorizeGroup(w, r, group.CompanyID, group.ID) {
+			return
+		}
+		page.Devices, page.NextCursor, err = m.MdataStore.ListDevicesByGroup(r.Context(), groupID.String(), opts)
+	} else if key, ok := APIKeyFromContext(r.Context()); ok && key.GrpID != uuid.Nil {
+		// A key scoped to a group only lists the group
+		page.Devices, page.NextCursor, err = m.MdataStore.ListDevicesByGroup(r.Context(), key.GrpID.String(), opts)
+	} else {
+		page.Devices, page.NextCursor, err = m.MdataStore.ListDevicesByCompany(r.Context(), companyID.String(), opts)
+	}
+	if err != nil {
+		StoreError(w, err, "Failed to fetch devices")
+		m.logger.Println("[getDevicesHandler] error:", err)
+		return
+	}
+	if page.Devices == nil {
+		page.Devices = []*metadata.Device{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+}
+
+func (m *MetadataRouter) deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var req deviceIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	if err := m.MdataStore.DeleteDevice(r.Context(), device); err != nil {
+		StoreError(w, err, "Error deleting device")
+		m.logger.Println("[deleteDeviceHandler] error:", err)
+		return
+	}
+	if m.DeviceNotifier != nil {
+		m.DeviceNotifier.DisconnectDevice(device.ID)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (m *MetadataRouter) updateDeviceLocationHandler(w http.ResponseWriter, r *http.Request) {
+	var req deviceLocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil || !isValidLocation(req.Location) {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	if err := m.MdataStore.UpdateDeviceLocation(r.Context(), device, &req.Location); err != nil {
+		StoreError(w, err, "Error updating device location")
+		m.logger.Println("[updateDeviceLocationHandler] error:", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateDeviceSchemaHandler saves a new schema version. Changes other than
+// added fields answer 409 unless force is set.
+func (m *MetadataRouter) updateDeviceSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	var req deviceSchemaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil || req.Schema == nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	if err := m.MdataStore.UpdateDeviceSchema(r.Context(), device, &req.Schema, req.Force); err != nil {
+		StoreError(w, err, "Error updating device schema")
+		m.logger.Println("[updateDeviceSchemaHandler] error:", err)
+		return
+	}
+	if m.DeviceNotifier != nil {
+		m.DeviceNotifier.DeviceChanged(device)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// getDeviceSchemaHistoryHandler lists every schema version of a device, newest first
+func (m *MetadataRouter) getDeviceSchemaHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(r.URL.Query().Get("id"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "id query parameter is required")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, deviceID)
+	if !ok {
+		return
+	}
+
+	versions, err := m.MdataStore.ListDeviceSchemas(r.Context(), device.ID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch schema history")
+		m.logger.Println("[getDeviceSchemaHistoryHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schemaHistory{ID: device.ID, Versions: versions})
+}
+
+// rotateDeviceSecretHandler issues a new device secret, it is only ever shown in this response
+func (m *MetadataRouter) rotateDeviceSecretHandler(w http.ResponseWriter, r *http.Request) {
+	var req deviceIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	secret, err := m.MdataStore.RotateDeviceSecret(r.Context(), device)
+	if err != nil {
+		StoreError(w, err, "Error rotating device secret")
+		m.logger.Println("[rotateDeviceSecretHandler] error:", err)
+		return
+	}
+	if m.DeviceNotifier != nil {
+		m.DeviceNotifier.DisconnectDevice(device.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":            device.ID.String(),
+		"device_secret": secret,
+	})
+}
+
+func (m *MetadataRouter) revokeDeviceSecretHandler(w http.ResponseWriter, r *http.Request) {
+	var req deviceIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	if err := m.MdataStore.RevokeDeviceSecret(r.Context(), device); err != nil {
+		StoreError(w, err, "Error revoking device secret")
+		m.logger.Println("[revokeDeviceSecretHandler] error:", err)
+		return
+	}
+	if m.DeviceNotifier != nil {
+		m.DeviceNotifier.DisconnectDevice(device.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fetchDevice loads a device owned by the caller and in scope of its API key. On failure it has already written the response.
+func (m *MetadataRouter) fetchDevice(w http.ResponseWriter, r *http.Request, deviceID uuid.UUID) (*metadata.Device, bool) {
+	device, err := m.MdataStore.GetDeviceByID(r.Context(), deviceID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch device")
+		m.logger.Println("[fetchDevice] error:", err)
+		return nil, false
+	}
+	if !AuthorizeGroup(w, r, device.CompanyID, device.GrpID) {
+		return nil, false
+	}
+	return device, true
+}
+
+func isValidLocation(l metadata.Location) bool {
+	return l.Latitude >= -90 && l.Latitude <= 90 && l.Longitude >= -180 && l.Longitude <= 180
+}
@@ -0,0 +1,89 @@
+package metadatarouter_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	metadatamemstore "github.com/mukundvijay123/KCloud/metadata/metadataMemStore"
+)
+
+// recordingNotifier writes down what connected devices were told
+type recordingNotifier struct {
+	calls []string
+}
+
+func (n *recordingNotifier) DeviceChanged(d *metadata.Device) {
+	n.calls = append(n.calls, fmt.Sprintf("changed v%d", d.SchemaVersion))
+}
+func (n *recordingNotifier) DisconnectDevice(deviceID uuid.UUID) {
+	n.calls = append(n.calls, "device")
+}
+func (n *recordingNotifier) DisconnectGroup(grpID uuid.UUID) { n.calls = append(n.calls, "group") }
+func (n *recordingNotifier) DisconnectCompany(companyID uuid.UUID) {
+	n.calls = append(n.calls, "company")
+}
+
+func TestDeviceNotifier(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	m := metadatarouter.NewMetadataRouterWithStore(metadatamemstore.NewMemStore(logger), logger)
+	notifier := &recordingNotifier{}
+	m.DeviceNotifier = notifier
+	j := &metadatarouter.JWTMiddleWare{}
+	j.SetSecretKey([]byte("notifier-test-secret"))
+	if err := m.AddJWTMiddleWare(j); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreateRouter(); err != nil {
+		t.Fatal(err)
+	}
+	h := m.Router
+	token := signupAndLogin(t, h, "companya")
+
+	if rec := do(t, h, "POST", "/api/user/createGroup", token, map[string]string{"group_name": "plant"}); rec.Code != http.StatusCreated {
+		t.Fatalf("createGroup: %d %s", rec.Code, rec.Body)
+	}
+	var groups struct {
+		Groups []*metadata.Grp `json:"groups"`
+	}
+	decode(t, do(t, h, "GET", "/api/user/getGroups", token, nil), &groups)
+	grp := groups.Groups[0]
+	rec := do(t, h, "POST", "/api/user/createDevice", token, map[string]any{
+		"grp_id": grp.ID, "device_name": "boiler", "device_type": "sensor",
+		"telemetry_data_schema": map[string]string{"temp": "float"},
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("createDevice: %d %s", rec.Code, rec.Body)
+	}
+	var device metadata.Device
+	decode(t, rec, &device)
+
+	steps := []struct {
+		path string
+		body any
+		want string
+	}{
+		{"/api/user/updateDeviceSchema", map[string]any{"id": device.ID, "telemetry_data_schema": map[string]string{"temp": "float", "rpm": "int"}}, "changed v2"},
+		{"/api/user/updateDeviceLocation", map[string]any{"id": device.ID, "device_location": map[string]float64{"latitude": 1, "longitude": 1}}, ""},
+		{"/api/user/rotateDeviceSecret", map[string]any{"id": device.ID}, "device"},
+		{"/api/user/revokeDeviceSecret", map[string]any{"id": device.ID}, "device"},
+		{"/api/user/deleteDevice", map[string]any{"id": device.ID}, "device"},
+		{"/api/user/deleteGroup", map[string]any{"id": grp.ID}, "group"},
+		{"/api/user/deleteCompany", map[string]string{"username": "companya", "company_password": "password-companya"}, "company"},
+	}
+	for _, s := range steps {
+		notifier.calls = nil
+		if rec := do(t, h, "POST", s.path, token, s.body); rec.Code >= 300 {
+			t.Fatalf("%s: %d %s", s.path, rec.Code, rec.Body)
+		}
+		if got := strings.Join(notifier.calls, " "); got != s.want {
+			t.Errorf("%s told devices %q, want %q", s.path, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package metadatarouter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// WriteJSONError answers with status and a {"error": msg} body
+func WriteJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
+
+// StoreError answers a failed store call with the status matching the error kind.
+// msg is only sent for unexpected errors, their details stay in the logs.
+func StoreError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, metadata.ErrValidation):
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, metadata.ErrUnauthorized):
+		WriteJSONError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, metadata.ErrNotFound):
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, metadata.ErrConflict):
+		WriteJSONError(w, http.StatusConflict, err.Error())
+	case isTimeout(err):
+		WriteJSONError(w, http.StatusGatewayTimeout, "Request timed out")
+	default:
+		WriteJSONError(w, http.StatusInternalServerError, msg)
+	}
+}
+
+// sqlStateError is implemented by the postgres driver's errors
+type sqlStateError interface {
+	SQLState() string
+}
+
+// isTimeout reports whether err comes from the request deadline. A query
+// cancelled mid-flight fails with postgres' query_canceled rather than ctx.Err().
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var sqlErr sqlStateError
+	return errors.As(err, &sqlErr) && sqlErr.SQLState() == "57014"
+}
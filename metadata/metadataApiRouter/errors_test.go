@@ -0,0 +1,87 @@
+package metadatarouter_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	metadatamemstore "github.com/mukundvijay123/KCloud/metadata/metadataMemStore"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+func TestStoreErrorDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		err  func(ctxErr error) error
+	}{
+		{"context deadline", func(ctxErr error) error {
+			return fmt.Errorf("%w: %w", metadatastore.ErrDbErrorGeneric, ctxErr)
+		}},
+		// lib/pq cancels the query and returns the server's error, not ctx.Err()
+		{"query cancelled by postgres", func(error) error {
+			return fmt.Errorf("%w: %w", metadatastore.ErrDbErrorGeneric,
+				&pq.Error{Code: "57014", Message: "canceling statement due to user request"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				metadatarouter.StoreError(w, tt.err(r.Context().Err()), "Failed to fetch")
+			})
+			h := metadatarouter.RequestTimeout(10 * time.Millisecond)(slow)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != http.StatusGatewayTimeout {
+				t.Errorf("got %d %s, want 504", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestStoreErrorOtherDbErrors(t *testing.T) {
+	rec := httptest.NewRecorder()
+	metadatarouter.StoreError(rec, fmt.Errorf("%w: %w", metadatastore.ErrDbErrorGeneric,
+		&pq.Error{Code: "53300", Message: "too many connections"}), "Failed to fetch")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", rec.Code)
+	}
+}
+
+// timeoutSessions times out every revocation check
+type timeoutSessions struct {
+	metadata.SessionStore
+}
+
+func (timeoutSessions) TokenRevoked(ctx context.Context, jti string, sessionID uuid.UUID) (bool, error) {
+	return false, fmt.Errorf("%w: %w", metadatastore.ErrDbErrorGeneric, context.DeadlineExceeded)
+}
+
+func TestRevocationCheckStoreError(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	store := metadatamemstore.NewMemStore(logger)
+	m := metadatarouter.NewMetadataRouterWithStore(store, logger)
+	j := &metadatarouter.JWTMiddleWare{Sessions: timeoutSessions{store}}
+	j.SetSecretKey([]byte("revocation-test-secret"))
+	if err := m.AddJWTMiddleWare(j); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreateRouter(); err != nil {
+		t.Fatal(err)
+	}
+
+	token := signupAndLogin(t, m.Router, "companya")
+	if rec := do(t, m.Router, "GET", "/api/user/getGroups", token, nil); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d %s, want 504", rec.Code, rec.Body)
+	}
+}
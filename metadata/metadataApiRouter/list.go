@@ -0,0 +1,42 @@
+package metadatarouter
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+type groupPage struct {
+	Groups     []*metadata.Grp `json:"groups"`
+	NextCursor string          `json:"next_cursor,omitempty"` //empty on the last page
+}
+
+type devicePage struct {
+	Devices    []*metadata.Device `json:"devices"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+type auditPage struct {
+	Events     []*metadata.AuditEvent `json:"events"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
+}
+
+// listOptions reads limit, cursor, prefix, type and sort query params. The
+// values are checked by the store, which answers validation errors.
+func listOptions(v url.Values) (*metadata.ListOptions, error) {
+	opts := &metadata.ListOptions{
+		Cursor:     v.Get("cursor"),
+		NamePrefix: v.Get("prefix"),
+		DeviceType: v.Get("type"),
+		Sort:       v.Get("sort"),
+	}
+	if s := v.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return nil, metadata.NewError(metadata.ErrValidation, "limit must be a positive integer")
+		}
+		opts.Limit = limit
+	}
+	return opts, nil
+}
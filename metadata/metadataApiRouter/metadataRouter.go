@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 	"github.com/mukundvijay123/KCloud/metadata"
 	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
@@ -16,6 +17,9 @@ type MetadataRouter struct {
 	MdataStore    metadata.MetadataStore
 	JWTMiddleWare *JWTMiddleWare
 	Router        *mux.Router
+
+	ShadowNotifier metadata.ShadowNotifier //optional, pushes shadow deltas to connected devices
+	DeviceNotifier metadata.DeviceNotifier //optional, updates or disconnects connected devices
 }
 
 func NewMetadataRouter(dbConn *sql.DB, logger *log.Logger) *MetadataRouter {
@@ -30,10 +34,25 @@ func NewMetadataRouter(dbConn *sql.DB, logger *log.Logger) *MetadataRouter {
 	}
 }
 
-//Function to add JWT middleware here
+// NewMetadataRouterWithStore builds a router over any MetadataStore, e.g. the in-memory one
+func NewMetadataRouterWithStore(store metadata.MetadataStore, logger *log.Logger) *MetadataRouter {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &MetadataRouter{
+		logger:     logger,
+		MdataStore: store,
+	}
+}
 
 func (m *MetadataRouter) CreateRouter() error {
+	if m.JWTMiddleWare == nil {
+		return fmt.Errorf("jwt middleware must be added before creating the router")
+	}
+
 	m.Router = mux.NewRouter()
+	m.Router.Use(RequestID)
 	err := m.AddRoutes()
 	if err != nil {
 		return fmt.Errorf("error initialising router")
@@ -42,7 +61,27 @@ func (m *MetadataRouter) CreateRouter() error {
 	return nil
 }
 
-func (m *MetadataRouter) AddJWTMiddleWare() error {
+// AddJWTMiddleWare sets the middleware guarding the post login routes
+func (m *MetadataRouter) AddJWTMiddleWare(j *JWTMiddleWare) error {
+	if j == nil || (j.secretKey == nil && len(j.keys) == 0) {
+		return fmt.Errorf("jwt middleware needs a secret or a signing key")
+	}
+	if j.signingMethod == nil {
+		j.signingMethod = jwt.SigningMethodHS256
+	}
+	if j.logger == nil {
+		j.logger = m.logger
+	}
+	if j.MiddlewareFunc == nil {
+		j.MiddlewareFunc = CompanyClaimsFunc
+	}
+	if j.Sessions == nil {
+		j.Sessions = m.MdataStore
+	}
+	if j.APIKeys == nil {
+		j.APIKeys = m.MdataStore
+	}
 
+	m.JWTMiddleWare = j
 	return nil
 }
@@ -0,0 +1,75 @@
+package metadatarouter
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+type groupHeartbeatRequest struct {
+	ID               uuid.UUID `json:"id"`
+	HeartbeatSeconds int       `json:"heartbeat_timeout"` //0 for the default
+}
+
+// addPresenceRoutes adds group heartbeat and stale device routes to the post login router
+func (m *MetadataRouter) addPresenceRoutes(postLoginRouter *mux.Router) {
+	postLoginRouter.HandleFunc("/updateGroupHeartbeat", RequireRole(metadata.RoleAdmin, m.updateGroupHeartbeatHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/getStaleDevices", RequireCompanyScope(m.getStaleDevicesHandler)).Methods("GET")
+}
+
+func (m *MetadataRouter) updateGroupHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var req groupHeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	group, err := m.MdataStore.GetGroupByID(r.Context(), req.ID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch group")
+		m.logger.Println("[updateGroupHeartbeatHandler] error:", err)
+		return
+	}
+	if !AuthorizeCompany(w, r, group.CompanyID) {
+		return
+	}
+
+	if err := m.MdataStore.UpdateGroupHeartbeat(r.Context(), group, req.HeartbeatSeconds); err != nil {
+		StoreError(w, err, "Error updating group heartbeat")
+		m.logger.Println("[updateGroupHeartbeatHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// getStaleDevicesHandler lists a page of the caller's devices that are offline or were never seen
+func (m *MetadataRouter) getStaleDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, _ := CompanyIDFromContext(r.Context())
+	opts, err := listOptions(r.URL.Query())
+	if err != nil {
+		StoreError(w, err, "Invalid list options")
+		return
+	}
+
+	var page devicePage
+	page.Devices, page.NextCursor, err = m.MdataStore.ListStaleDevices(r.Context(), companyID.String(), opts)
+	if err != nil {
+		StoreError(w, err, "Failed to fetch devices")
+		m.logger.Println("[getStaleDevicesHandler] error:", err)
+		return
+	}
+	if page.Devices == nil {
+		page.Devices = []*metadata.Device{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+}
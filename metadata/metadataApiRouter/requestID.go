@@ -0,0 +1,41 @@
+package metadatarouter
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// RequestIDHeader carries the id of a request, clients may send their own
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLen = 64
+
+// RequestID gives every request an id, the client's when it is usable, and
+// echoes it in the response. The stores record it in the audit events of the request.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := metadata.WithActor(r.Context(), metadata.Actor{RequestID: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID allows printable ASCII without spaces, ids end up in logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
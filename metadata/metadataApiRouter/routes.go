@@ -13,6 +13,10 @@ type loginRequest struct {
 	Password string `json:"password"`
 }
 
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type passwordChangeRequest struct {
 	CompanyId   uuid.UUID `json:"company_id"`
 	NewPassword string    `json:"new_password"`
@@ -20,10 +24,14 @@ type passwordChangeRequest struct {
 }
 
 func (m *MetadataRouter) AddRoutes() error {
+	// Public keys for services verifying our tokens, see JWTMiddleWare.AddSigningKey
+	m.Router.HandleFunc("/.well-known/jwks.json", m.JWTMiddleWare.JWKSHandler).Methods("GET")
+
 	err := m.addCompanyRoutes()
 	if err != nil {
 		return err
 	}
+	m.addAuditRoutes()
 	return nil
 }
 
@@ -32,16 +40,24 @@ func (m *MetadataRouter) addCompanyRoutes() error {
 	companySubRouter := m.Router.PathPrefix("/api/user").Subrouter()
 	companySubRouter.HandleFunc("/signup", m.signupHandler).Methods("POST") // use Methods("POST")
 	companySubRouter.HandleFunc("/login", m.loginHandler).Methods("POST")
+	companySubRouter.HandleFunc("/refresh", m.refreshHandler).Methods("POST")
+	companySubRouter.HandleFunc("/acceptInvite", m.acceptInviteHandler).Methods("POST")
 
+	// Every role may read, routes that change something name the least role they need.
+	// API keys are accepted here too, see JWTMiddleWare.APIKeys.
 	postLoginRouter := companySubRouter.NewRoute().Subrouter()
 	postLoginRouter.Use(m.JWTMiddleWare.JWTMiddleware)
-	postLoginRouter.HandleFunc("/deleteCompany", m.DeleteComapnyHandler).Methods("POST")
-	postLoginRouter.HandleFunc("/changePassword", m.updatePasswordHandle).Methods("POST")
-	postLoginRouter.HandleFunc("/createGroup", m.createGroupHandler).Methods("POST")
-	postLoginRouter.HandleFunc("/deleteGroup", m.deleteGroupHandler).Methods("POST")
+	postLoginRouter.HandleFunc("/logout", m.logoutHandler).Methods("POST")
+	postLoginRouter.HandleFunc("/deleteCompany", RequireRole(metadata.RoleOwner, m.DeleteComapnyHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/changePassword", RequireUser(m.updatePasswordHandle)).Methods("POST")
+	postLoginRouter.HandleFunc("/createGroup", RequireRole(metadata.RoleAdmin, m.createGroupHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/deleteGroup", RequireRole(metadata.RoleAdmin, m.deleteGroupHandler)).Methods("POST")
 	postLoginRouter.HandleFunc("/getGroup", m.getGroupByIDHandler).Methods("GET")
-	postLoginRouter.HandleFunc("/getGroups", m.getGroupsHandler).Methods("GET")
-	postLoginRouter.HandleFunc("/createDevice", m.createDeviceHandler).Methods("POST")
+	postLoginRouter.HandleFunc("/getGroups", RequireCompanyScope(m.getGroupsHandler)).Methods("GET")
+	m.addDeviceRoutes(postLoginRouter)
+	m.addPresenceRoutes(postLoginRouter)
+	m.addUserRoutes(postLoginRouter)
+	m.addAPIKeyRoutes(postLoginRouter)
 	return nil
 }
 
@@ -51,13 +67,13 @@ func (m *MetadataRouter) signupHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request body
 	if err := json.NewDecoder(r.Body).Decode(&company); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
 	// Save company using metadata store
-	if err := m.MdataStore.CreateCompany(&company); err != nil {
-		http.Error(w, "Failed to create company: "+err.Error(), http.StatusInternalServerError)
+	if err := m.MdataStore.CreateCompany(r.Context(), &company); err != nil {
+		StoreError(w, err, "Failed to create company")
 		return
 	}
 
@@ -74,99 +90,134 @@ func (m *MetadataRouter) loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode JSON body
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
 	// Validate fields
 	if req.Username == "" || req.Password == "" {
-		http.Error(w, "Username and password required", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "Username and password required")
 		return
 	}
 
 	// Verify credentials
-	ok, err := m.MdataStore.VerifyCompany(req.Username, req.Password)
+	user, err := m.MdataStore.VerifyUser(r.Context(), req.Username, req.Password)
 	if err != nil {
-		http.Error(w, "Error verifying credentials", http.StatusInternalServerError)
+		StoreError(w, err, "Error verifying credentials")
 		return
 	}
-	if !ok {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+	if user == nil {
+		WriteJSONError(w, http.StatusUnauthorized, "Invalid username or password")
 		return
 	}
 
-	// Lookup company to get ID (for JWT payload)
-	company, err := m.MdataStore.GetCompanyByUsername(req.Username)
+	// Start a session, the response carries its first token pair
+	tokens, err := m.JWTMiddleWare.IssueTokens(r.Context(), user.ID)
 	if err != nil {
-		http.Error(w, "Failed to fetch company info", http.StatusInternalServerError)
+		StoreError(w, err, "Failed to generate token")
 		return
 	}
 
-	// Generate JWT token
-	token, err := m.JWTMiddleWare.GenerateToken(company.ID.String())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// refreshHandler trades a refresh token for a new token pair, no access token needed
+func (m *MetadataRouter) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	tokens, err := m.JWTMiddleWare.RefreshTokens(r.Context(), req.RefreshToken)
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		StoreError(w, err, "Failed to refresh token")
 		return
 	}
 
-	// Return token
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": token,
-	})
-	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tokens)
+}
 
+// logoutHandler revokes the caller's access token and its session
+func (m *MetadataRouter) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	info, ok := TokenFromContext(r.Context())
+	if !ok {
+		WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+	if err := m.JWTMiddleWare.RevokeToken(r.Context(), info); err != nil {
+		StoreError(w, err, "Failed to log out")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (m *MetadataRouter) DeleteComapnyHandler(w http.ResponseWriter, r *http.Request) {
 	var company metadata.Company
 	err := json.NewDecoder(r.Body).Decode(&company)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
 	if company.Username == "" {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	err = m.MdataStore.DeleteCompany(&company)
+	// Only the logged in company can delete itself, the username confirms it.
+	// Other usernames are never looked up, so they can't be probed
+	callerID, ok := CompanyIDFromContext(r.Context())
+	if !ok {
+		WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+	existing, err := m.MdataStore.GetCompanyByID(r.Context(), callerID.String())
 	if err != nil {
-		http.Error(w, "error deleting the company", http.StatusInternalServerError)
+		StoreError(w, err, "error deleting the company")
+		return
+	}
+	if existing.Username != company.Username {
+		WriteJSONError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	// company_password is the password of the calling owner
+	if !m.verifyCaller(w, r, company.CompanyPassword) {
 		return
 	}
 
+	err = m.MdataStore.DeleteCompany(r.Context(), existing)
+	if err != nil {
+		StoreError(w, err, "error deleting the company")
+		return
+	}
+	if m.DeviceNotifier != nil {
+		m.DeviceNotifier.DisconnectCompany(existing.ID)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (m *MetadataRouter) updatePasswordHandle(w http.ResponseWriter, r *http.Request) {
 	var req passwordChangeRequest
-	var company *metadata.Company
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
-	}
-	company, err = m.MdataStore.GetCompanyByID(req.CompanyId.String())
-	if err != nil {
-		http.Error(w, "Cant find company", http.StatusInternalServerError)
-		return
-	}
-	valid, err := m.MdataStore.VerifyCompany(company.Username, req.OldPassword)
-	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	if !valid {
-		http.Error(w, "Unauthorised", http.StatusUnauthorized)
+	if !AuthorizeCompany(w, r, req.CompanyId) {
 		return
 	}
+	userID, _ := UserIDFromContext(r.Context())
 
-	err = m.MdataStore.UpdatePassword(company, req.NewPassword)
+	// Changes the caller's own password, UpdateUserPassword verifies the current one
+	err = m.MdataStore.UpdateUserPassword(r.Context(), &metadata.User{ID: userID}, req.OldPassword, req.NewPassword)
 	if err != nil {
-		http.Error(w, "Error updating password", http.StatusInternalServerError)
+		StoreError(w, err, "Error updating password")
 		return
 	}
 
@@ -176,18 +227,22 @@ func (m *MetadataRouter) createGroupHandler(w http.ResponseWriter, r *http.Reque
 	var grp metadata.Grp
 	err := json.NewDecoder(r.Body).Decode(&grp)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	if grp.CompanyID == uuid.Nil || grp.GroupName == "" {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	if grp.GroupName == "" {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !AuthorizeCompany(w, r, grp.CompanyID) {
 		return
 	}
+	grp.CompanyID, _ = CompanyIDFromContext(r.Context())
 	grp.NoOfDevices = 0
-	err = m.MdataStore.CreateGroup(&grp)
+	err = m.MdataStore.CreateGroup(r.Context(), &grp)
 	if err != nil {
-		http.Error(w, "Error creating a group", http.StatusInternalServerError)
+		StoreError(w, err, "Error creating a group")
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
@@ -197,42 +252,79 @@ func (m *MetadataRouter) deleteGroupHandler(w http.ResponseWriter, r *http.Reque
 	var grp metadata.Grp
 	err := json.NewDecoder(r.Body).Decode(&grp)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	if grp.CompanyID == uuid.Nil || grp.GroupName == "" {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	if grp.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !AuthorizeCompany(w, r, grp.CompanyID) {
+		return
+	}
+	// Another company's group answers 403 like the other group routes,
+	// whatever company_id the body claims
+	existing, err := m.MdataStore.GetGroupByID(r.Context(), grp.ID.String())
+	if err != nil {
+		StoreError(w, err, "Error deleting the group")
+		m.logger.Println("[deleteGroupHandler] error:", err)
+		return
+	}
+	if !AuthorizeGroup(w, r, existing.CompanyID, existing.ID) {
 		return
 	}
+	// DeleteGroup matches on id and company_id, another company's group is never touched
+	grp.CompanyID, _ = CompanyIDFromContext(r.Context())
 	grp.NoOfDevices = 0
-	err = m.MdataStore.DeleteGroup(&grp)
+	err = m.MdataStore.DeleteGroup(r.Context(), &grp)
 	if err != nil {
-		http.Error(w, "Error creating a group", http.StatusInternalServerError)
+		StoreError(w, err, "Error deleting the group")
 		return
 	}
+	if m.DeviceNotifier != nil {
+		m.DeviceNotifier.DisconnectGroup(grp.ID)
+	}
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (m *MetadataRouter) getGroupsHandler(w http.ResponseWriter, r *http.Request) {
-	companyID := r.URL.Query().Get("company_id")
-	if companyID == "" {
-		http.Error(w, "company_id is required", http.StatusBadRequest)
+	// company_id is optional, when given it has to be the caller's
+	requestedID := uuid.Nil
+	if s := r.URL.Query().Get("company_id"); s != "" {
+		var err error
+		if requestedID, err = uuid.Parse(s); err != nil {
+			WriteJSONError(w, http.StatusBadRequest, "Invalid company_id")
+			return
+		}
+	}
+	if !AuthorizeCompany(w, r, requestedID) {
+		return
+	}
+	companyID, _ := CompanyIDFromContext(r.Context())
+	opts, err := listOptions(r.URL.Query())
+	if err != nil {
+		StoreError(w, err, "Invalid list options")
 		return
 	}
 
-	// Fetch groups from DB
-	groups, err := m.MdataStore.ListGroupsByCompany(companyID)
+	// Fetch one page of groups from DB
+	var page groupPage
+	page.Groups, page.NextCursor, err = m.MdataStore.ListGroupsByCompany(r.Context(), companyID.String(), opts)
 	if err != nil {
-		http.Error(w, "Failed to fetch groups", http.StatusInternalServerError)
+		StoreError(w, err, "Failed to fetch groups")
 		m.logger.Println("[getGroupsHandler] error:", err)
 		return
 	}
 
+	if page.Groups == nil {
+		page.Groups = []*metadata.Grp{}
+	}
+
 	// Respond with JSON
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(groups); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to encode response")
 		return
 	}
 }
@@ -241,31 +333,25 @@ func (m *MetadataRouter) getGroupByIDHandler(w http.ResponseWriter, r *http.Requ
 	// Extract "id" query param
 	groupID := r.URL.Query().Get("id")
 	if groupID == "" {
-		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		WriteJSONError(w, http.StatusBadRequest, "id query parameter is required")
 		return
 	}
 
 	// Fetch group from store
-	group, err := m.MdataStore.GetGroupByID(groupID)
+	group, err := m.MdataStore.GetGroupByID(r.Context(), groupID)
 	if err != nil {
-		http.Error(w, "Failed to fetch group", http.StatusInternalServerError)
+		StoreError(w, err, "Failed to fetch group")
 		m.logger.Println("[getGroupByIDHandler] error:", err)
 		return
 	}
-
-	if group == nil {
-		http.Error(w, "Group not found", http.StatusNotFound)
+	if !AuthorizeGroup(w, r, group.CompanyID, group.ID) {
 		return
 	}
 
 	// Respond with JSON
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(group); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		WriteJSONError(w, http.StatusInternalServerError, "Failed to encode response")
 		return
 	}
 }
-
-func (m *MetadataRouter) createDeviceHandler(w http.ResponseWriter, r *http.Request) {
-	
-}
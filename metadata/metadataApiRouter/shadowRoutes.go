@@ -0,0 +1,128 @@
+package metadatarouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+const maxShadowBodyBytes = 2 * metadata.MaxShadowBytes
+
+type desiredShadowRequest struct {
+	ID      uuid.UUID            `json:"id"`
+	Desired metadata.ShadowState `json:"desired"`
+	Version int64                `json:"version"` //0 skips the version check
+}
+
+type reportedShadowRequest struct {
+	Reported metadata.ShadowState `json:"reported"`
+	Version  int64                `json:"version"`
+}
+
+// addShadowRoutes adds the app side of device shadows to the post login router
+func (m *MetadataRouter) addShadowRoutes(postLoginRouter *mux.Router) {
+	postLoginRouter.HandleFunc("/getDeviceShadow", m.getDeviceShadowHandler).Methods("GET")
+	postLoginRouter.HandleFunc("/updateDeviceShadow", RequireRole(metadata.RoleOperator, m.updateDesiredShadowHandler)).Methods("POST")
+}
+
+// AddDeviceShadowRoutes adds the device side of shadows under /api/device/shadow, guarded by deviceAuth
+func (m *MetadataRouter) AddDeviceShadowRoutes(deviceAuth mux.MiddlewareFunc) error {
+	if m.Router == nil || deviceAuth == nil {
+		return fmt.Errorf("shadow routes need the router created and a device auth middleware")
+	}
+
+	shadowRouter := m.Router.PathPrefix("/api/device/shadow").Subrouter()
+	shadowRouter.Use(deviceAuth)
+	shadowRouter.HandleFunc("", m.getOwnShadowHandler).Methods("GET")
+	shadowRouter.HandleFunc("", m.updateReportedShadowHandler).Methods("POST")
+	return nil
+}
+
+func (m *MetadataRouter) getDeviceShadowHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(r.URL.Query().Get("id"))
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "id query parameter is required")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, deviceID)
+	if !ok {
+		return
+	}
+	writeShadow(w, device)
+}
+
+// updateDesiredShadowHandler merges into the desired state and pushes the new delta to the device
+func (m *MetadataRouter) updateDesiredShadowHandler(w http.ResponseWriter, r *http.Request) {
+	var req desiredShadowRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxShadowBodyBytes)).Decode(&req); err != nil ||
+		req.ID == uuid.Nil || req.Desired == nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	device, ok := m.fetchDevice(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	if err := m.MdataStore.UpdateDeviceShadow(r.Context(), device, metadata.ShadowDesired, req.Desired, req.Version); err != nil {
+		StoreError(w, err, "Error updating device shadow")
+		m.logger.Println("[updateDesiredShadowHandler] error:", err)
+		return
+	}
+	if m.ShadowNotifier != nil && len(device.Shadow.Delta) > 0 {
+		m.ShadowNotifier.NotifyShadow(device)
+	}
+	writeShadow(w, device)
+}
+
+// getOwnShadowHandler lets a device read its shadow, e.g. after being offline
+func (m *MetadataRouter) getOwnShadowHandler(w http.ResponseWriter, r *http.Request) {
+	device, ok := DeviceFromContext(r.Context())
+	if !ok {
+		WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	// The device in the ctx was loaded at authentication, read the shadow fresh
+	device, err := m.MdataStore.GetDeviceByID(r.Context(), device.ID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch device")
+		m.logger.Println("[getOwnShadowHandler] error:", err)
+		return
+	}
+	writeShadow(w, device)
+}
+
+func (m *MetadataRouter) updateReportedShadowHandler(w http.ResponseWriter, r *http.Request) {
+	device, ok := DeviceFromContext(r.Context())
+	if !ok {
+		WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+	var req reportedShadowRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxShadowBodyBytes)).Decode(&req); err != nil || req.Reported == nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := m.MdataStore.UpdateDeviceShadow(r.Context(), device, metadata.ShadowReported, req.Reported, req.Version); err != nil {
+		StoreError(w, err, "Error updating device shadow")
+		m.logger.Println("[updateReportedShadowHandler] error:", err)
+		return
+	}
+	writeShadow(w, device)
+}
+
+func writeShadow(w http.ResponseWriter, d *metadata.Device) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     d.ID,
+		"shadow": d.Shadow,
+	})
+}
@@ -0,0 +1,215 @@
+package metadatarouter
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SigningKey is one asymmetric key of a JWTMiddleWare, tokens name it in their
+// kid header. Keys rotate on a schedule: a key is published in the JWKS as soon
+// as it is added, signs from NotBefore on and is dropped at NotAfter. Giving the
+// next key a NotBefore well before NotAfter of the current one is the overlap
+// other services need to fetch it before it shows up in tokens.
+// Keys are only added at startup, rotating in a new one takes a restart.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod //RS256, RS384, RS512, PS256, ES256, ES384, ES512 or EdDSA
+	Key       interface{}       //*rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey
+	NotBefore time.Time         //zero signs right away
+	NotAfter  time.Time         //zero never retires
+}
+
+// ParseSigningKey reads a PEM encoded private key for the named algorithm
+func ParseSigningKey(id string, alg string, pemData []byte) (*SigningKey, error) {
+	method := jwt.GetSigningMethod(alg)
+	k := &SigningKey{ID: id, Method: method}
+	var err error
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		k.Key, err = jwt.ParseRSAPrivateKeyFromPEM(pemData)
+	case *jwt.SigningMethodECDSA:
+		k.Key, err = jwt.ParseECPrivateKeyFromPEM(pemData)
+	case *jwt.SigningMethodEd25519:
+		k.Key, err = jwt.ParseEdPrivateKeyFromPEM(pemData)
+	default:
+		return nil, fmt.Errorf("unsupported signing key algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key %q: %w", id, err)
+	}
+	return k, nil
+}
+
+// publicKey returns the key tokens signed with k are verified with
+func (k *SigningKey) publicKey() interface{} {
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey
+	case ed25519.PrivateKey:
+		return key.Public()
+	}
+	return nil
+}
+
+// validate checks that the key type fits the method
+func (k *SigningKey) validate() error {
+	if k.ID == "" {
+		return fmt.Errorf("signing key needs an id")
+	}
+	ok := false
+	switch m := k.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		key, isRSA := k.Key.(*rsa.PrivateKey)
+		ok = isRSA && key.N.BitLen() >= 2048
+	case *jwt.SigningMethodECDSA:
+		key, isEC := k.Key.(*ecdsa.PrivateKey)
+		ok = isEC && key.Curve.Params().BitSize == m.CurveBits
+	case *jwt.SigningMethodEd25519:
+		_, ok = k.Key.(ed25519.PrivateKey)
+	}
+	if !ok {
+		return fmt.Errorf("signing key %q does not fit its method, RSA keys need 2048 bits and EC keys the curve of the method", k.ID)
+	}
+	if !k.NotAfter.IsZero() && !k.NotAfter.After(k.NotBefore) {
+		return fmt.Errorf("signing key %q retires before it starts signing", k.ID)
+	}
+	return nil
+}
+
+// retired reports whether tokens signed with k are no longer accepted
+func (k *SigningKey) retired(now time.Time) bool {
+	return !k.NotAfter.IsZero() && !now.Before(k.NotAfter)
+}
+
+// AddSigningKey adds an asymmetric key, before the middleware serves requests
+func (j *JWTMiddleWare) AddSigningKey(k *SigningKey) error {
+	if err := k.validate(); err != nil {
+		return err
+	}
+	for _, existing := range j.keys {
+		if existing.ID == k.ID {
+			return fmt.Errorf("duplicate signing key id %q", k.ID)
+		}
+	}
+	j.keys = append(j.keys, k)
+	return nil
+}
+
+// CheckSigningKeys returns an error unless a token can be signed at now. Keys
+// are only added at startup, the server refuses to start without a usable one.
+func (j *JWTMiddleWare) CheckSigningKeys(now time.Time) error {
+	if len(j.keys) == 0 {
+		if j.secretKey == nil {
+			return errNoSigningKey
+		}
+		return nil
+	}
+	if j.currentKey(now) == nil {
+		return fmt.Errorf("%w: every key is upcoming or retires within the access token lifetime of %v", errNoSigningKey, j.accessTTL())
+	}
+	return nil
+}
+
+// currentKey picks the key that signs now: the one with the latest NotBefore
+// that has started and stays valid for a whole access token lifetime. Nil
+// means no key can sign, the HMAC secret signs only when there are no keys.
+func (j *JWTMiddleWare) currentKey(now time.Time) *SigningKey {
+	var current *SigningKey
+	for _, k := range j.keys {
+		if now.Before(k.NotBefore) || k.retired(now.Add(j.accessTTL())) {
+			continue
+		}
+		if current == nil || !k.NotBefore.Before(current.NotBefore) {
+			current = k
+		}
+	}
+	return current
+}
+
+// verificationKey is the jwt.Keyfunc of JWTMiddleware. Tokens with a kid are
+// checked against that key, tokens without one against the HMAC secret.
+func (j *JWTMiddleWare) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if j.secretKey == nil || token.Method != j.signingMethod {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return j.secretKey, nil
+	}
+	for _, k := range j.keys {
+		if k.ID != kid {
+			continue
+		}
+		if token.Method != k.Method {
+			return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+		}
+		if k.retired(time.Now()) {
+			return nil, fmt.Errorf("signing key %q is retired", kid)
+		}
+		return k.publicKey(), nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jwk is one public key of the JWKS, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func newJWK(k *SigningKey) jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	key := jwk{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch pub := k.publicKey().(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = b64(pub.N.Bytes())
+		key.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// Coordinates are padded to the curve size
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		key.Kty = "EC"
+		key.Crv = pub.Curve.Params().Name
+		key.X = b64(pub.X.FillBytes(make([]byte, size)))
+		key.Y = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		key.Kty = "OKP"
+		key.Crv = "Ed25519"
+		key.X = b64(pub)
+	}
+	return key
+}
+
+// JWKSHandler publishes the public keys that are not retired, upcoming ones
+// included. The HMAC secret is never published.
+func (j *JWTMiddleWare) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	keys := make([]jwk, 0, len(j.keys))
+	for _, k := range j.keys {
+		if !k.retired(now) {
+			keys = append(keys, newJWK(k))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+}
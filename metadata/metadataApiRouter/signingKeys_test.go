@@ -0,0 +1,83 @@
+package metadatarouter_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	metadatamemstore "github.com/mukundvijay123/KCloud/metadata/metadataMemStore"
+)
+
+// newKeyedMiddleware has the HMAC secret and an Ed25519 key valid from notBefore to notAfter
+func newKeyedMiddleware(t *testing.T, notBefore, notAfter time.Time) (*metadatarouter.JWTMiddleWare, uuid.UUID) {
+	t.Helper()
+	store := metadatamemstore.NewMemStore(log.New(io.Discard, "", 0))
+	c := &metadata.Company{CompanyName: "acme", Username: "acme", CompanyPassword: "correcthorse"}
+	if err := store.CreateCompany(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := store.VerifyUser(context.Background(), c.Username, "correcthorse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &metadatarouter.JWTMiddleWare{Sessions: store, AccessTTL: 15 * time.Minute}
+	j.SetSecretKey([]byte("signing-keys-test-secret"))
+	key := &metadatarouter.SigningKey{ID: "k1", Method: jwt.SigningMethodEdDSA, Key: priv, NotBefore: notBefore, NotAfter: notAfter}
+	if err := j.AddSigningKey(key); err != nil {
+		t.Fatal(err)
+	}
+	return j, owner.ID
+}
+
+func TestCurrentKeySigns(t *testing.T) {
+	j, userID := newKeyedMiddleware(t, time.Time{}, time.Now().Add(time.Hour))
+	if err := j.CheckSigningKeys(time.Now()); err != nil {
+		t.Fatalf("CheckSigningKeys: %v", err)
+	}
+	pair, err := j.IssueTokens(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(pair.AccessToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != "k1" || token.Method != jwt.SigningMethodEdDSA {
+		t.Errorf("token header %v, want it signed by k1", token.Header)
+	}
+}
+
+func TestNoHMACFallback(t *testing.T) {
+	tests := []struct {
+		name                string
+		notBefore, notAfter time.Time
+	}{
+		{"key retires within the access ttl", time.Time{}, time.Now().Add(5 * time.Minute)},
+		{"key retired", time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Hour)},
+		{"key upcoming", time.Now().Add(time.Hour), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, userID := newKeyedMiddleware(t, tt.notBefore, tt.notAfter)
+			if err := j.CheckSigningKeys(time.Now()); err == nil {
+				t.Error("CheckSigningKeys accepted keys that cannot sign")
+			}
+			if pair, err := j.IssueTokens(context.Background(), userID); err == nil {
+				t.Errorf("IssueTokens signed %q, want an error", pair.AccessToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package metadatarouter
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+type companyCtxKey struct{}
+
+type callerCtxKey struct{}
+
+// caller is a user or, when apiKey is set, a machine with no user
+type caller struct {
+	userID uuid.UUID
+	role   metadata.Role
+	apiKey *metadata.APIKey
+}
+
+// CompanyClaimsFunc is the default JWTMiddleWare.MiddlewareFunc. It rejects tokens
+// without valid user_id, company_id and role claims and puts them into the request ctx.
+func CompanyClaimsFunc(claims jwt.MapClaims, ctx context.Context) (context.Context, bool, error) {
+	userID, ok := uuidClaim(claims, "user_id")
+	if !ok {
+		return ctx, false, nil
+	}
+	companyID, ok := uuidClaim(claims, "company_id")
+	if !ok {
+		return ctx, false, nil
+	}
+	role, _ := claims["role"].(string)
+	if !metadata.Role(role).Valid() {
+		return ctx, false, nil
+	}
+	ctx = context.WithValue(ctx, companyCtxKey{}, companyID)
+	return context.WithValue(ctx, callerCtxKey{}, caller{userID: userID, role: metadata.Role(role)}), true, nil
+}
+
+func uuidClaim(claims jwt.MapClaims, name string) (uuid.UUID, bool) {
+	s, ok := claims[name].(string)
+	if !ok {
+		return uuid.Nil, false
+	}
+	id, err := uuid.Parse(s)
+	return id, err == nil && id != uuid.Nil
+}
+
+// withActor makes the caller of ctx the actor of the changes made with it, see metadata.WithActor
+func withActor(ctx context.Context) context.Context {
+	c, ok := ctx.Value(callerCtxKey{}).(caller)
+	if !ok {
+		return ctx
+	}
+	actor := metadata.ActorFromContext(ctx)
+	actor.UserID, actor.APIKeyID = c.userID, uuid.Nil
+	if c.apiKey != nil {
+		actor.UserID, actor.APIKeyID = uuid.Nil, c.apiKey.ID
+	}
+	return metadata.WithActor(ctx, actor)
+}
+
+// UserIDFromContext returns the user behind the request, false for API keys
+func UserIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	c, ok := ctx.Value(callerCtxKey{}).(caller)
+	return c.userID, ok && c.apiKey == nil
+}
+
+// RoleFromContext returns the role the caller's token was issued with, or the role of its API key
+func RoleFromContext(ctx context.Context) (metadata.Role, bool) {
+	c, ok := ctx.Value(callerCtxKey{}).(caller)
+	return c.role, ok
+}
+
+// APIKeyFromContext returns the API key the request was authorized with
+func APIKeyFromContext(ctx context.Context) (*metadata.APIKey, bool) {
+	c, _ := ctx.Value(callerCtxKey{}).(caller)
+	return c.apiKey, c.apiKey != nil
+}
+
+// RequireUser wraps h so it answers 403 to API keys, for routes about the calling user
+func RequireUser(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := UserIDFromContext(r.Context()); !ok {
+			WriteJSONError(w, http.StatusForbidden, "Forbidden, needs a user")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// RequireCompanyScope wraps h so it answers 403 to API keys scoped to a group,
+// for routes that reach beyond a single group
+func RequireCompanyScope(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := APIKeyFromContext(r.Context()); ok && key.GrpID != uuid.Nil {
+			WriteJSONError(w, http.StatusForbidden, "Forbidden, needs a company wide key")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// RequireRole wraps h so it answers 403 unless the caller has at least role min
+func RequireRole(min metadata.Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := RoleFromContext(r.Context())
+		if !ok {
+			WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+			return
+		}
+		if !role.Allows(min) {
+			WriteJSONError(w, http.StatusForbidden, "Forbidden, needs role "+string(min))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// CompanyIDFromContext returns the company of the authenticated caller
+func CompanyIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(companyCtxKey{}).(uuid.UUID)
+	return id, ok
+}
+
+// AuthorizeCompany answers 403 unless the caller is the company owning the resource.
+// A Nil companyID means the client left it out and is always the caller's own.
+func AuthorizeCompany(w http.ResponseWriter, r *http.Request, companyID uuid.UUID) bool {
+	callerID, ok := CompanyIDFromContext(r.Context())
+	if !ok {
+		WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return false
+	}
+	if companyID != uuid.Nil && companyID != callerID {
+		WriteJSONError(w, http.StatusForbidden, "Forbidden")
+		return false
+	}
+	return true
+}
+
+// AuthorizeGroup is AuthorizeCompany for resources of a group, it also answers
+// 403 to API keys scoped to another group
+func AuthorizeGroup(w http.ResponseWriter, r *http.Request, companyID, groupID uuid.UUID) bool {
+	if !AuthorizeCompany(w, r, companyID) {
+		return false
+	}
+	if key, ok := APIKeyFromContext(r.Context()); ok && key.GrpID != uuid.Nil && key.GrpID != groupID {
+		WriteJSONError(w, http.StatusForbidden, "Forbidden")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package metadatarouter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	metadatamemstore "github.com/mukundvijay123/KCloud/metadata/metadataMemStore"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+	telemetryrouter "github.com/mukundvijay123/KCloud/telemetry/telemetryApiRouter"
+)
+
+// emptyDataStore answers every telemetry query with no readings
+type emptyDataStore struct{}
+
+func (emptyDataStore) Write(ctx context.Context, r *storageengine.Reading) error { return nil }
+func (emptyDataStore) WriteBatch(ctx context.Context, readings []*storageengine.Reading) error {
+	return nil
+}
+func (emptyDataStore) ReadRange(ctx context.Context, companyID, deviceID uuid.UUID, from, to time.Time) ([]*storageengine.Reading, error) {
+	return nil, nil
+}
+func (emptyDataStore) Latest(ctx context.Context, companyID, deviceID uuid.UUID) (*storageengine.Reading, error) {
+	return nil, storageengine.ErrNoReadings
+}
+func (emptyDataStore) Query(ctx context.Context, q *storageengine.Query) (*storageengine.QueryResult, error) {
+	return &storageengine.QueryResult{}, nil
+}
+
+// newTestServer runs the metadata and telemetry routes on a mem store, like main does on postgres
+func newTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	store := metadatamemstore.NewMemStore(logger)
+
+	m := metadatarouter.NewMetadataRouterWithStore(store, logger)
+	j := &metadatarouter.JWTMiddleWare{}
+	j.SetSecretKey([]byte("tenant-test-secret"))
+	if err := m.AddJWTMiddleWare(j); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreateRouter(); err != nil {
+		t.Fatal(err)
+	}
+
+	telemetry := telemetryrouter.NewTelemetryRouter(store, emptyDataStore{}, logger)
+	deviceAuth := metadatarouter.NewDeviceAuthMiddleWare(store, logger)
+	if err := telemetry.AddRoutes(m.Router, deviceAuth.DeviceMiddleware, j.JWTMiddleware); err != nil {
+		t.Fatal(err)
+	}
+	return m.Router
+}
+
+func do(t *testing.T, h http.Handler, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+// signupAndLogin creates a company and returns the access token of its owner
+func signupAndLogin(t *testing.T, h http.Handler, name string) string {
+	t.Helper()
+	rec := do(t, h, "POST", "/api/user/signup", "", map[string]string{
+		"company_name": name, "username": name, "company_password": "password-" + name,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signup %s: %d %s", name, rec.Code, rec.Body)
+	}
+	rec = do(t, h, "POST", "/api/user/login", "", map[string]string{
+		"username": name, "password": "password-" + name,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("login %s: %d %s", name, rec.Code, rec.Body)
+	}
+	var tokens struct {
+		Token string `json:"token"`
+	}
+	decode(t, rec, &tokens)
+	return tokens.Token
+}
+
+func TestCompanyIsolation(t *testing.T) {
+	h := newTestServer(t)
+	tokenA := signupAndLogin(t, h, "companya")
+	tokenB := signupAndLogin(t, h, "companyb")
+
+	// Company A owns a group with a device
+	if rec := do(t, h, "POST", "/api/user/createGroup", tokenA, map[string]string{"group_name": "plant"}); rec.Code != http.StatusCreated {
+		t.Fatalf("createGroup: %d %s", rec.Code, rec.Body)
+	}
+	rec := do(t, h, "GET", "/api/user/getGroups", tokenA, nil)
+	var groups struct {
+		Groups []*metadata.Grp `json:"groups"`
+	}
+	decode(t, rec, &groups)
+	if len(groups.Groups) != 1 {
+		t.Fatalf("getGroups: got %d groups, want 1", len(groups.Groups))
+	}
+	grp := groups.Groups[0]
+
+	rec = do(t, h, "POST", "/api/user/createDevice", tokenA, map[string]any{
+		"grp_id":                grp.ID,
+		"device_name":           "boiler",
+		"device_type":           "sensor",
+		"telemetry_data_schema": map[string]string{"temp": "float"},
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("createDevice: %d %s", rec.Code, rec.Body)
+	}
+	var device metadata.Device
+	decode(t, rec, &device)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+	}{
+		{"getGroup", "GET", "/api/user/getGroup?id=" + grp.ID.String(), nil},
+		{"deleteGroup", "POST", "/api/user/deleteGroup", map[string]any{"id": grp.ID, "group_name": grp.GroupName}},
+		{"deleteGroup claiming A", "POST", "/api/user/deleteGroup", map[string]any{"id": grp.ID, "group_name": grp.GroupName, "company_id": grp.CompanyID}},
+		{"getDevice", "GET", "/api/user/getDevice?id=" + device.ID.String(), nil},
+		{"deleteDevice", "POST", "/api/user/deleteDevice", map[string]any{"id": device.ID}},
+		{"updateDeviceLocation", "POST", "/api/user/updateDeviceLocation", map[string]any{
+			"id": device.ID, "device_location": map[string]float64{"latitude": 1, "longitude": 1},
+		}},
+		{"updateDeviceSchema", "POST", "/api/user/updateDeviceSchema", map[string]any{
+			"id": device.ID, "telemetry_data_schema": map[string]string{"temp": "float", "rpm": "int"},
+		}},
+		{"query device telemetry", "GET", "/api/telemetry/" + device.ID.String(), nil},
+		{"query group telemetry", "GET", "/api/telemetry/group/" + grp.ID.String(), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, h, tt.method, tt.path, tokenB, tt.body)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("company B got %d %s, want 403", rec.Code, rec.Body)
+			}
+		})
+	}
+
+	// Nothing of A changed
+	rec = do(t, h, "GET", "/api/user/getDevice?id="+device.ID.String(), tokenA, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("getDevice as A: %d %s", rec.Code, rec.Body)
+	}
+	var after metadata.Device
+	decode(t, rec, &after)
+	if after.DeviceLocation != device.DeviceLocation || after.SchemaVersion != device.SchemaVersion {
+		t.Errorf("device of A changed: %+v", after)
+	}
+	if rec := do(t, h, "GET", "/api/user/getGroup?id="+grp.ID.String(), tokenA, nil); rec.Code != http.StatusOK {
+		t.Errorf("getGroup as A: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, "GET", "/api/telemetry/"+device.ID.String(), tokenA, nil); rec.Code != http.StatusOK {
+		t.Errorf("query telemetry as A: %d %s", rec.Code, rec.Body)
+	}
+	// A deletes its group by id alone
+	if rec := do(t, h, "POST", "/api/user/deleteGroup", tokenA, map[string]any{"id": grp.ID}); rec.Code != http.StatusAccepted {
+		t.Errorf("deleteGroup as A: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDeleteCompany(t *testing.T) {
+	h := newTestServer(t)
+	tokenA := signupAndLogin(t, h, "companya")
+	tokenB := signupAndLogin(t, h, "companyb")
+
+	// Existing and unknown usernames get the same answer, neither is looked up
+	for _, username := range []string{"companya", "nosuchcompany"} {
+		rec := do(t, h, "POST", "/api/user/deleteCompany", tokenB, map[string]string{
+			"username": username, "company_password": "password-companyb",
+		})
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("company B deleting %s: got %d %s, want 403", username, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(t, h, "GET", "/api/user/getGroups", tokenA, nil); rec.Code != http.StatusOK {
+		t.Fatalf("company A is gone: %d %s", rec.Code, rec.Body)
+	}
+
+	rec := do(t, h, "POST", "/api/user/deleteCompany", tokenB, map[string]string{
+		"username": "companyb", "company_password": "password-companyb",
+	})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("company B deleting itself: got %d %s, want 202", rec.Code, rec.Body)
+	}
+}
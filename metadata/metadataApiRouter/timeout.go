@@ -0,0 +1,19 @@
+package metadatarouter
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RequestTimeout bounds the context of every request, store calls made with
+// r.Context() are cancelled once it expires or the client goes away
+func RequestTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
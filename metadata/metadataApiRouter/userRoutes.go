@@ -0,0 +1,276 @@
+package metadatarouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+type userRoleRequest struct {
+	ID   uuid.UUID     `json:"id"`
+	Role metadata.Role `json:"role"`
+}
+
+type userIDRequest struct {
+	ID uuid.UUID `json:"id"`
+}
+
+type inviteRequest struct {
+	Role             metadata.Role `json:"role"`
+	ExpiresInSeconds int           `json:"expires_in"` //0 for the default of 7 days
+}
+
+type acceptInviteRequest struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// addUserRoutes adds the routes managing the users of the caller's company to the post login router
+func (m *MetadataRouter) addUserRoutes(postLoginRouter *mux.Router) {
+	postLoginRouter.HandleFunc("/getMe", RequireUser(m.getMeHandler)).Methods("GET")
+	postLoginRouter.HandleFunc("/getUsers", RequireUser(m.getUsersHandler)).Methods("GET")
+	postLoginRouter.HandleFunc("/updateUserRole", RequireRole(metadata.RoleAdmin, m.updateUserRoleHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/removeUser", RequireRole(metadata.RoleAdmin, m.removeUserHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/createInvite", RequireRole(metadata.RoleAdmin, m.createInviteHandler)).Methods("POST")
+	postLoginRouter.HandleFunc("/getInvites", RequireRole(metadata.RoleAdmin, m.getInvitesHandler)).Methods("GET")
+	postLoginRouter.HandleFunc("/deleteInvite", RequireRole(metadata.RoleAdmin, m.deleteInviteHandler)).Methods("POST")
+}
+
+// getMeHandler returns the calling user
+func (m *MetadataRouter) getMeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := UserIDFromContext(r.Context())
+	user, err := m.MdataStore.GetUserByID(r.Context(), userID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch user")
+		m.logger.Println("[getMeHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+func (m *MetadataRouter) getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, _ := CompanyIDFromContext(r.Context())
+	users, err := m.MdataStore.ListUsersByCompany(r.Context(), companyID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch users")
+		m.logger.Println("[getUsersHandler] error:", err)
+		return
+	}
+	if users == nil {
+		users = []*metadata.User{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*metadata.User{"users": users})
+}
+
+// updateUserRoleHandler changes the role of a user, the user's sessions are
+// revoked so the new role applies from its next login. Only owners may make or
+// unmake owners.
+func (m *MetadataRouter) updateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req userRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !req.Role.Valid() {
+		StoreError(w, metadata.ErrInvalidRole, "Invalid role")
+		return
+	}
+
+	user, ok := m.fetchUser(w, r, req.ID)
+	if !ok {
+		return
+	}
+	if (user.Role == metadata.RoleOwner || req.Role == metadata.RoleOwner) && !callerIsOwner(w, r) {
+		return
+	}
+
+	if err := m.MdataStore.UpdateUserRole(r.Context(), user, req.Role); err != nil {
+		StoreError(w, err, "Error updating user role")
+		m.logger.Println("[updateUserRoleHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// removeUserHandler removes a user of the caller's company, only owners may remove owners
+func (m *MetadataRouter) removeUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req userIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	user, ok := m.fetchUser(w, r, req.ID)
+	if !ok {
+		return
+	}
+	if user.Role == metadata.RoleOwner && !callerIsOwner(w, r) {
+		return
+	}
+
+	if err := m.MdataStore.DeleteUser(r.Context(), user); err != nil {
+		StoreError(w, err, "Error removing user")
+		m.logger.Println("[removeUserHandler] error:", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// createInviteHandler invites a new user to the caller's company. The response
+// carries the invite token, it is never shown again.
+func (m *MetadataRouter) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req inviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ExpiresInSeconds < 0 {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !req.Role.Valid() {
+		StoreError(w, metadata.ErrInvalidRole, "Invalid role")
+		return
+	}
+	if req.Role == metadata.RoleOwner && !callerIsOwner(w, r) {
+		return
+	}
+
+	ttl := metadata.DefaultInviteTTL
+	if req.ExpiresInSeconds > 0 {
+		ttl = time.Duration(req.ExpiresInSeconds) * time.Second
+	}
+	token, err := metadata.NewToken()
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError, "Error creating invite")
+		m.logger.Println("[createInviteHandler] error:", err)
+		return
+	}
+
+	invite := metadata.Invite{Role: req.Role, ExpiresAt: time.Now().Add(ttl)}
+	invite.CompanyID, _ = CompanyIDFromContext(r.Context())
+	invite.InvitedBy, _ = UserIDFromContext(r.Context())
+	if err := m.MdataStore.CreateInvite(r.Context(), &invite, metadata.HashToken(token)); err != nil {
+		StoreError(w, err, "Error creating invite")
+		m.logger.Println("[createInviteHandler] error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invite": invite,
+		"token":  token,
+	})
+}
+
+// getInvitesHandler lists the caller's company invites that did not expire
+func (m *MetadataRouter) getInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, _ := CompanyIDFromContext(r.Context())
+	invites, err := m.MdataStore.ListInvitesByCompany(r.Context(), companyID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch invites")
+		m.logger.Println("[getInvitesHandler] error:", err)
+		return
+	}
+	if invites == nil {
+		invites = []*metadata.Invite{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*metadata.Invite{"invites": invites})
+}
+
+func (m *MetadataRouter) deleteInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req userIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == uuid.Nil {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// DeleteInvite matches on id and company_id, another company's invite is never touched
+	invite := metadata.Invite{ID: req.ID}
+	invite.CompanyID, _ = CompanyIDFromContext(r.Context())
+	if err := m.MdataStore.DeleteInvite(r.Context(), &invite); err != nil {
+		StoreError(w, err, "Error deleting invite")
+		m.logger.Println("[deleteInviteHandler] error:", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// acceptInviteHandler creates a user from an invite token, no access token needed.
+// The new user logs in like any other.
+func (m *MetadataRouter) acceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req acceptInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		WriteJSONError(w, http.StatusBadRequest, "Username and password required")
+		return
+	}
+
+	user := metadata.User{Username: req.Username}
+	if err := m.MdataStore.AcceptInvite(r.Context(), metadata.HashToken(req.Token), &user, req.Password); err != nil {
+		StoreError(w, err, "Error accepting invite")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// fetchUser loads a user of the caller's company. On failure it has already written the response.
+func (m *MetadataRouter) fetchUser(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (*metadata.User, bool) {
+	user, err := m.MdataStore.GetUserByID(r.Context(), userID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch user")
+		m.logger.Println("[fetchUser] error:", err)
+		return nil, false
+	}
+	if !AuthorizeCompany(w, r, user.CompanyID) {
+		return nil, false
+	}
+	return user, true
+}
+
+// verifyCaller answers 401 unless password is the calling user's, routes that
+// cant be undone ask for it again
+func (m *MetadataRouter) verifyCaller(w http.ResponseWriter, r *http.Request, password string) bool {
+	userID, _ := UserIDFromContext(r.Context())
+	user, err := m.MdataStore.GetUserByID(r.Context(), userID.String())
+	if err != nil {
+		StoreError(w, err, "Failed to fetch user")
+		return false
+	}
+	verified, err := m.MdataStore.VerifyUser(r.Context(), user.Username, password)
+	if err != nil {
+		StoreError(w, err, "Error verifying credentials")
+		return false
+	}
+	if verified == nil {
+		WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return false
+	}
+	return true
+}
+
+// callerIsOwner answers 403 unless the caller is an owner
+func callerIsOwner(w http.ResponseWriter, r *http.Request) bool {
+	if role, _ := RoleFromContext(r.Context()); role != metadata.RoleOwner {
+		WriteJSONError(w, http.StatusForbidden, "Forbidden, needs role "+string(metadata.RoleOwner))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package metadatamemstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+// apiKeyUseInterval matches MetadataDb, last use is recorded at most once a minute
+const apiKeyUseInterval = time.Minute
+
+func copyAPIKey(k *memAPIKey) *types.APIKey {
+	cp := k.key
+	return &cp
+}
+
+func (s *MemStore) CreateAPIKey(ctx context.Context, k *types.APIKey, keyHash string) error {
+	if !types.IsValidName(k.Name) {
+		s.logger.Println("[CreateAPIKey] invalid key name:", k.Name)
+		return metadatastore.ErrInvalidName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.companies[k.CompanyID]; !ok {
+		return metadatastore.ErrCompanyNoExist
+	}
+	if k.GrpID != uuid.Nil {
+		if g, ok := s.groups[k.GrpID]; !ok || g.CompanyID != k.CompanyID {
+			s.logger.Println("[CreateAPIKey] group not found for company:", k.GrpID, k.CompanyID)
+			return metadatastore.ErrGroupNotExist
+		}
+	}
+	if k.ExpiresAt != nil {
+		expiresAt := k.ExpiresAt.UTC()
+		k.ExpiresAt = &expiresAt
+	}
+	k.ID = uuid.New()
+	k.CreatedAt = time.Now().UTC()
+	k.LastUsedAt, k.RevokedAt = nil, nil
+	s.apiKeys[k.ID] = &memAPIKey{key: *k, keyHash: keyHash}
+	s.audit(ctx, k.CompanyID, types.AuditAPIKeyCreate, k.ID, nil, k)
+	return nil
+}
+
+func (s *MemStore) VerifyAPIKey(ctx context.Context, keyHash string, now time.Time) (*types.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.apiKeys {
+		if stored.keyHash != keyHash {
+			continue
+		}
+		k := &stored.key
+		if k.RevokedAt != nil || (k.ExpiresAt != nil && !k.ExpiresAt.After(now)) {
+			break
+		}
+		if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyUseInterval {
+			used := now.UTC()
+			k.LastUsedAt = &used
+		}
+		return copyAPIKey(stored), nil
+	}
+	return nil, types.ErrInvalidAPIKey
+}
+
+func (s *MemStore) ListAPIKeysByCompany(ctx context.Context, companyID string) ([]*types.APIKey, error) {
+	id, err := parseID(companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []*types.APIKey
+	for _, stored := range s.apiKeys {
+		if stored.key.CompanyID == id {
+			keys = append(keys, copyAPIKey(stored))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *MemStore) RevokeAPIKey(ctx context.Context, k *types.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.apiKeys[k.ID]
+	if !ok || stored.key.CompanyID != k.CompanyID {
+		return fmt.Errorf("%w: %s", types.ErrAPIKeyNotFound, k.ID)
+	}
+	before := copyAPIKey(stored)
+	if stored.key.RevokedAt == nil {
+		revokedAt := time.Now().UTC()
+		stored.key.RevokedAt = &revokedAt
+	}
+	s.audit(ctx, k.CompanyID, types.AuditAPIKeyRevoke, k.ID, before, copyAPIKey(stored))
+	*k = *copyAPIKey(stored)
+	return nil
+}
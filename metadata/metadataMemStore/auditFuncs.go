@@ -0,0 +1,80 @@
+package metadatamemstore
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+// audit appends the event of a change made with ctx, s.mu held. Times are cut
+// to microseconds like postgres and kept increasing, so events of one company
+// list in the order they were made.
+func (s *MemStore) audit(ctx context.Context, companyID uuid.UUID, action string, resourceID uuid.UUID, before, after any) {
+	e, err := types.NewAuditEvent(ctx, companyID, action, resourceID, before, after)
+	if err != nil {
+		s.logger.Println("[audit] error building event:", err)
+		return
+	}
+
+	e.ID = uuid.New()
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	if n := len(s.auditLog); n > 0 && !e.CreatedAt.After(s.auditLog[n-1].CreatedAt) {
+		e.CreatedAt = s.auditLog[n-1].CreatedAt.Add(time.Microsecond)
+	}
+	s.auditLog = append(s.auditLog, e)
+}
+
+func (s *MemStore) ListAuditEvents(ctx context.Context, companyID string, f *types.AuditFilter) ([]*types.AuditEvent, string, error) {
+	id, err := parseID(companyID)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err = f.Normalize()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Newest first, ties on the id like ORDER BY created_at DESC, id DESC
+	newer := func(a *types.AuditEvent, at time.Time, id uuid.UUID) bool {
+		if !a.CreatedAt.Equal(at) {
+			return a.CreatedAt.After(at)
+		}
+		return a.ID.String() > id.String()
+	}
+	var cursorAt time.Time
+	var cursorID uuid.UUID
+	if f.Cursor != "" {
+		cursorAt, cursorID, _ = types.DecodeAuditCursor(f.Cursor) //checked by Normalize
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []*types.AuditEvent
+	for _, e := range s.auditLog {
+		switch {
+		case e.CompanyID != id,
+			f.Action != "" && e.Action != f.Action,
+			f.ResourceID != uuid.Nil && e.ResourceID != f.ResourceID,
+			f.ActorID != uuid.Nil && e.ActorUserID != f.ActorID && e.ActorAPIKeyID != f.ActorID,
+			!f.Since.IsZero() && e.CreatedAt.Before(f.Since),
+			!f.Until.IsZero() && !e.CreatedAt.Before(f.Until),
+			f.Cursor != "" && !newer(&types.AuditEvent{CreatedAt: cursorAt, ID: cursorID}, e.CreatedAt, e.ID):
+			continue
+		}
+		cp := *e
+		events = append(events, &cp)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return newer(events[i], events[j].CreatedAt, events[j].ID)
+	})
+
+	if len(events) <= f.Limit {
+		return events, "", nil
+	}
+	events = events[:f.Limit]
+	return events, types.EncodeCursor(types.AuditCursor(events[len(events)-1])), nil
+}
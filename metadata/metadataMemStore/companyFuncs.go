@@ -0,0 +1,172 @@
+package metadatamemstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+func (s *MemStore) CreateCompany(ctx context.Context, c *types.Company) error {
+	if !types.IsValidName(c.CompanyName) || !types.IsValidName(c.Username) {
+		s.logger.Println("invalid company or username: ", c.CompanyName)
+		return metadatastore.ErrInvalidName
+	}
+	if !types.IsValidPassword(c.CompanyPassword) {
+		s.logger.Println("invalid password")
+		return metadatastore.ErrInvalidPasswd
+	}
+
+	passwordHash, err := types.HashPassword(c.CompanyPassword)
+	if err != nil {
+		s.logger.Println("Error hashing password: ", err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.companies {
+		if existing.company.Username == c.Username || existing.company.CompanyName == c.CompanyName {
+			s.logger.Println("Company or username already taken: ", c.CompanyName, c.Username)
+			return metadatastore.ErrCompanyExists
+		}
+	}
+
+	if s.userByUsername(c.Username) != nil {
+		s.logger.Println("Username already taken by a user: ", c.Username)
+		return metadatastore.ErrCompanyExists
+	}
+
+	c.ID = uuid.New()
+	stored := &memCompany{company: *c}
+	stored.company.CompanyPassword = ""
+	s.companies[c.ID] = stored
+
+	// The company login is its first owner
+	owner := &memUser{
+		user: types.User{
+			ID:        uuid.New(),
+			CompanyID: c.ID,
+			Username:  c.Username,
+			Role:      types.RoleOwner,
+			CreatedAt: time.Now().UTC(),
+		},
+		passwordHash: passwordHash,
+	}
+	s.users[owner.user.ID] = owner
+
+	// Signups have no actor yet, the new owner is it
+	s.audit(types.WithDefaultActor(ctx, owner.user.ID), c.ID, types.AuditCompanyCreate, c.ID, nil, types.CompanyState(c))
+
+	c.CompanyPassword = ""
+	s.logger.Println("Company provisioned successfully")
+	return nil
+}
+
+// DeleteCompany deletes a company with all its users, groups and devices
+func (s *MemStore) DeleteCompany(ctx context.Context, c *types.Company) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	companyID := c.ID
+	stored, ok := s.companies[companyID]
+	if !ok {
+		s.logger.Println(metadatastore.ErrCompanyNoExist, companyID)
+		return metadatastore.ErrCompanyNoExist
+	}
+
+	for id, d := range s.devices {
+		if d.device.CompanyID == companyID {
+			delete(s.devices, id)
+		}
+	}
+	for id, g := range s.groups {
+		if g.CompanyID == companyID {
+			delete(s.groups, id)
+		}
+	}
+	for id, k := range s.apiKeys {
+		if k.key.CompanyID == companyID {
+			delete(s.apiKeys, id)
+		}
+	}
+	for id, inv := range s.invites {
+		if inv.invite.CompanyID == companyID {
+			delete(s.invites, id)
+		}
+	}
+	for id, u := range s.users {
+		if u.user.CompanyID == companyID {
+			s.deleteUser(id)
+		}
+	}
+	delete(s.companies, companyID)
+
+	// The event outlives the company like in postgres
+	s.audit(ctx, companyID, types.AuditCompanyDelete, companyID, copyCompany(stored), nil)
+
+	s.logger.Println("Company deleted successfully:", companyID)
+	return nil
+}
+
+// GetCompanyByID returns ErrCompanyNoExist when the company doesnt exist, like MetadataDBReader
+func (s *MemStore) GetCompanyByID(ctx context.Context, id string) (*types.Company, error) {
+	companyID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.companies[companyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", metadatastore.ErrCompanyNoExist, id)
+	}
+	return copyCompany(stored), nil
+}
+
+func (s *MemStore) GetCompanyByUsername(ctx context.Context, username string) (*types.Company, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored := s.companyByUsername(username)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s", metadatastore.ErrCompanyNoExist, username)
+	}
+	return copyCompany(stored), nil
+}
+
+func (s *MemStore) ListCompanies(ctx context.Context, opts *types.ListOptions) ([]*types.Company, string, error) {
+	opts, err := opts.Normalize(false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var companies []*types.Company
+	for _, stored := range s.companies {
+		if strings.HasPrefix(stored.company.Username, opts.NamePrefix) {
+			companies = append(companies, copyCompany(stored))
+		}
+	}
+	companies, next := page(companies, opts, types.CompanyCursor)
+	return companies, next, nil
+}
+
+// companyByUsername needs s.mu held
+func (s *MemStore) companyByUsername(username string) *memCompany {
+	for _, stored := range s.companies {
+		if stored.company.Username == username {
+			return stored
+		}
+	}
+	return nil
+}
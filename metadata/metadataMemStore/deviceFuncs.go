@@ -0,0 +1,286 @@
+package metadatamemstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+func (s *MemStore) CreateDevice(ctx context.Context, d *types.Device) error {
+	if !types.IsValidName(d.DeviceName) {
+		s.logger.Println("[CreateDevice] invalid device name:", d.DeviceName)
+		return metadatastore.ErrInvalidName
+	}
+	if d.TelemetryDataSchema == nil {
+		d.TelemetryDataSchema = types.TelemetrySchema{}
+	}
+	if err := types.ValidateSchema(d.TelemetryDataSchema); err != nil {
+		s.logger.Println("[CreateDevice] invalid schema:", err)
+		return err
+	}
+
+	secret, err := types.NewDeviceSecret()
+	if err != nil {
+		s.logger.Println("[CreateDevice] failed to generate device secret:", err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grp, ok := s.groups[d.GrpID]
+	if !ok || grp.CompanyID != d.CompanyID {
+		s.logger.Println("[CreateDevice] group not found for company:", d.GrpID, d.CompanyID)
+		return metadatastore.ErrGroupNotExist
+	}
+	for _, existing := range s.devices {
+		if existing.device.GrpID == d.GrpID && existing.device.DeviceName == d.DeviceName {
+			s.logger.Println("[CreateDevice] device name taken in group:", d.DeviceName)
+			return metadatastore.ErrDeviceExists
+		}
+	}
+
+	d.ID = uuid.New()
+	d.SchemaVersion = 1
+	d.Shadow = types.Shadow{Desired: types.ShadowState{}, Reported: types.ShadowState{}}
+	stored := &memDevice{device: *d, secretHash: types.HashDeviceSecret(secret)}
+	stored.schemas = []*types.SchemaRevision{{Version: 1, Schema: copySchema(d.TelemetryDataSchema), CreatedAt: time.Now().UTC()}}
+	stored.device = *s.copyDevice(stored)
+	s.devices[d.ID] = stored
+
+	grp.NoOfDevices++
+	s.companies[d.CompanyID].company.NoOfDevices++
+	s.audit(ctx, d.CompanyID, types.AuditDeviceCreate, d.ID, nil, s.deviceState(stored))
+
+	d.LastSeenAt, d.Status = nil, types.DeviceNeverSeen
+	d.DeviceSecret = secret
+	s.logger.Println("[CreateDevice] device created successfully:", d.DeviceName)
+	return nil
+}
+
+func (s *MemStore) DeleteDevice(ctx context.Context, d *types.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.ownedDevice(d)
+	if err != nil {
+		s.logger.Println("[DeleteDevice] device not found with ID:", d.ID)
+		return err
+	}
+
+	delete(s.devices, d.ID)
+	if grp, ok := s.groups[stored.device.GrpID]; ok {
+		grp.NoOfDevices--
+	}
+	if company, ok := s.companies[stored.device.CompanyID]; ok {
+		company.company.NoOfDevices--
+	}
+	s.audit(ctx, stored.device.CompanyID, types.AuditDeviceDelete, d.ID, s.deviceState(stored), nil)
+
+	s.logger.Println("[DeleteDevice] device deleted successfully:", d.DeviceName)
+	return nil
+}
+
+func (s *MemStore) UpdateDeviceLocation(ctx context.Context, d *types.Device, l *types.Location) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.ownedDevice(d)
+	if err != nil {
+		s.logger.Println("[UpdateDeviceLocation] device not found with ID:", d.ID)
+		return err
+	}
+
+	before := s.deviceState(stored)
+	stored.device.DeviceLocation = *l
+	s.audit(ctx, stored.device.CompanyID, types.AuditDeviceLocation, d.ID, before, s.deviceState(stored))
+	return nil
+}
+
+func (s *MemStore) UpdateDeviceSchema(ctx context.Context, d *types.Device, schema *types.TelemetrySchema, force bool) error {
+	if err := types.ValidateSchema(*schema); err != nil {
+		s.logger.Println("[UpdateDeviceSchema] invalid schema:", err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.ownedDevice(d)
+	if err != nil {
+		s.logger.Println("[UpdateDeviceSchema] device not found with ID:", d.ID)
+		return err
+	}
+
+	current := stored.device.TelemetryDataSchema
+	if !types.SchemaEqual(current, *schema) {
+		incompatible := types.CheckSchemaChange(current, *schema)
+		if incompatible != nil && !force {
+			return incompatible
+		}
+		before := s.deviceState(stored)
+		stored.device.TelemetryDataSchema = copySchema(*schema)
+		stored.device.SchemaVersion++
+		stored.schemas = append(stored.schemas, &types.SchemaRevision{
+			Version:   stored.device.SchemaVersion,
+			Schema:    copySchema(*schema),
+			Forced:    incompatible != nil,
+			CreatedAt: time.Now().UTC(),
+		})
+		s.audit(ctx, stored.device.CompanyID, types.AuditDeviceSchema, d.ID, before, s.deviceState(stored))
+	}
+	d.TelemetryDataSchema = copySchema(stored.device.TelemetryDataSchema)
+	d.SchemaVersion = stored.device.SchemaVersion
+	return nil
+}
+
+func (s *MemStore) RotateDeviceSecret(ctx context.Context, d *types.Device) (string, error) {
+	secret, err := types.NewDeviceSecret()
+	if err != nil {
+		s.logger.Println("[RotateDeviceSecret] failed to generate device secret:", err)
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.ownedDevice(d)
+	if err != nil {
+		s.logger.Println("[RotateDeviceSecret] device not found with ID:", d.ID)
+		return "", err
+	}
+
+	stored.secretHash = types.HashDeviceSecret(secret)
+	s.audit(ctx, stored.device.CompanyID, types.AuditDeviceSecretRotate, d.ID, nil, nil)
+	d.DeviceSecret = secret
+	return secret, nil
+}
+
+func (s *MemStore) RevokeDeviceSecret(ctx context.Context, d *types.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.ownedDevice(d)
+	if err != nil {
+		s.logger.Println("[RevokeDeviceSecret] device not found with ID:", d.ID)
+		return err
+	}
+
+	stored.secretHash = ""
+	s.audit(ctx, stored.device.CompanyID, types.AuditDeviceSecretRevoke, d.ID, nil, nil)
+	d.DeviceSecret = ""
+	return nil
+}
+
+func (s *MemStore) GetDeviceByID(ctx context.Context, id string) (*types.Device, error) {
+	deviceID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.devices[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", metadatastore.ErrDeviceNotExist, id)
+	}
+	return s.copyDevice(stored), nil
+}
+
+func (s *MemStore) ListDeviceSchemas(ctx context.Context, deviceID string) ([]*types.SchemaRevision, error) {
+	id, err := parseID(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.devices[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", metadatastore.ErrDeviceNotExist, deviceID)
+	}
+	revisions := make([]*types.SchemaRevision, 0, len(stored.schemas))
+	for i := len(stored.schemas) - 1; i >= 0; i-- {
+		rev := *stored.schemas[i]
+		rev.Schema = copySchema(rev.Schema)
+		revisions = append(revisions, &rev)
+	}
+	return revisions, nil
+}
+
+func (s *MemStore) ListDevicesByGroup(ctx context.Context, groupID string, opts *types.ListOptions) ([]*types.Device, string, error) {
+	id, err := parseID(groupID)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.listDevices(func(d *types.Device) bool { return d.GrpID == id }, opts)
+}
+
+func (s *MemStore) ListDevicesByCompany(ctx context.Context, companyID string, opts *types.ListOptions) ([]*types.Device, string, error) {
+	id, err := parseID(companyID)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.listDevices(func(d *types.Device) bool { return d.CompanyID == id }, opts)
+}
+
+func (s *MemStore) GetDeviceBySecret(ctx context.Context, secret string) (*types.Device, error) {
+	hash := types.HashDeviceSecret(secret)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, stored := range s.devices {
+		if stored.secretHash != "" && stored.secretHash == hash {
+			return s.copyDevice(stored), nil
+		}
+	}
+	return nil, metadatastore.ErrDeviceNotExist
+}
+
+func (s *MemStore) listDevices(match func(d *types.Device) bool, opts *types.ListOptions) ([]*types.Device, string, error) {
+	opts, err := opts.Normalize(true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var devices []*types.Device
+	for _, stored := range s.devices {
+		d := s.copyDevice(stored)
+		if !match(d) || !strings.HasPrefix(d.DeviceName, opts.NamePrefix) {
+			continue
+		}
+		if opts.DeviceType != "" && d.DeviceType != opts.DeviceType {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	devices, next := page(devices, opts, func(d *types.Device) types.Cursor {
+		return types.DeviceCursor(d, opts.Sort)
+	})
+	return devices, next, nil
+}
+
+// ownedDevice returns the stored device matching d's id and company, needs s.mu held
+func (s *MemStore) ownedDevice(d *types.Device) (*memDevice, error) {
+	stored, ok := s.devices[d.ID]
+	if !ok || stored.device.CompanyID != d.CompanyID {
+		return nil, fmt.Errorf("%w: %s", metadatastore.ErrDeviceNotExist, d.ID)
+	}
+	return stored, nil
+}
+
+// deviceState needs s.mu held, it is what audit events keep of a device
+func (s *MemStore) deviceState(d *memDevice) types.Device {
+	return types.DeviceState(s.copyDevice(d))
+}
@@ -0,0 +1,139 @@
+package metadatamemstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+func (s *MemStore) CreateGroup(ctx context.Context, g *types.Grp) error {
+	if !types.IsValidName(g.GroupName) {
+		s.logger.Println("invalid group name:", g.GroupName)
+		return metadatastore.ErrInvalidName
+	}
+	heartbeat, err := types.NormalizeHeartbeat(g.HeartbeatSeconds)
+	if err != nil {
+		return err
+	}
+	g.HeartbeatSeconds = heartbeat
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	company, ok := s.companies[g.CompanyID]
+	if !ok {
+		s.logger.Println("Company not found for group:", g.CompanyID)
+		return metadatastore.ErrCompanyNoExist
+	}
+	for _, existing := range s.groups {
+		if existing.CompanyID == g.CompanyID && existing.GroupName == g.GroupName {
+			s.logger.Println("Group name already taken:", g.GroupName)
+			return metadatastore.ErrGroupExists
+		}
+	}
+
+	g.ID = uuid.New()
+	s.groups[g.ID] = copyGroup(g)
+	company.company.NoOfGrps++
+	s.audit(ctx, g.CompanyID, types.AuditGroupCreate, g.ID, nil, g)
+
+	s.logger.Println("Group created successfully:", g.GroupName)
+	return nil
+}
+
+// DeleteGroup deletes a group of the company with its devices
+func (s *MemStore) DeleteGroup(ctx context.Context, g *types.Grp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.groups[g.ID]
+	if !ok || stored.CompanyID != g.CompanyID {
+		s.logger.Println("No group deleted, not found:", g.ID)
+		return metadatastore.ErrGroupNotExist
+	}
+
+	for id, d := range s.devices {
+		if d.device.GrpID == g.ID {
+			delete(s.devices, id)
+		}
+	}
+	for id, k := range s.apiKeys {
+		if k.key.GrpID == g.ID {
+			delete(s.apiKeys, id)
+		}
+	}
+	delete(s.groups, g.ID)
+
+	if company, ok := s.companies[g.CompanyID]; ok {
+		company.company.NoOfGrps--
+		company.company.NoOfDevices -= stored.NoOfDevices
+	}
+	s.audit(ctx, g.CompanyID, types.AuditGroupDelete, g.ID, stored, nil)
+
+	s.logger.Println("Group deleted successfully:", g.GroupName)
+	return nil
+}
+
+func (s *MemStore) UpdateGroupHeartbeat(ctx context.Context, g *types.Grp, seconds int) error {
+	seconds, err := types.NormalizeHeartbeat(seconds)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.groups[g.ID]
+	if !ok || stored.CompanyID != g.CompanyID {
+		s.logger.Println("No group updated, not found:", g.ID)
+		return metadatastore.ErrGroupNotExist
+	}
+	before := copyGroup(stored)
+	stored.HeartbeatSeconds = seconds
+	g.HeartbeatSeconds = seconds
+	s.audit(ctx, g.CompanyID, types.AuditGroupHeartbeat, g.ID, before, stored)
+	return nil
+}
+
+func (s *MemStore) GetGroupByID(ctx context.Context, id string) (*types.Grp, error) {
+	groupID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	g, ok := s.groups[groupID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", metadatastore.ErrGroupNotExist, id)
+	}
+	return copyGroup(g), nil
+}
+
+func (s *MemStore) ListGroupsByCompany(ctx context.Context, companyID string, opts *types.ListOptions) ([]*types.Grp, string, error) {
+	id, err := parseID(companyID)
+	if err != nil {
+		return nil, "", err
+	}
+	opts, err = opts.Normalize(false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var groups []*types.Grp
+	for _, g := range s.groups {
+		if g.CompanyID == id && strings.HasPrefix(g.GroupName, opts.NamePrefix) {
+			groups = append(groups, copyGroup(g))
+		}
+	}
+	groups, next := page(groups, opts, types.GroupCursor)
+	return groups, next, nil
+}
@@ -0,0 +1,158 @@
+package metadatamemstore
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+// MemStore is an in-memory metadata.MetadataStore with the same semantics as
+// metadatastore.MetadataDb, for tests and embedded use. It is safe for
+// concurrent use and returns copies, callers never share its state.
+type MemStore struct {
+	mu        sync.RWMutex
+	logger    *log.Logger
+	companies map[uuid.UUID]*memCompany
+	users     map[uuid.UUID]*memUser
+	invites   map[uuid.UUID]*memInvite
+	apiKeys   map[uuid.UUID]*memAPIKey
+	groups    map[uuid.UUID]*types.Grp
+	devices   map[uuid.UUID]*memDevice
+	sessions  map[uuid.UUID]*types.Session
+	refresh   map[string]*memRefreshToken //by token hash
+	denied    map[string]time.Time        //jti to access token expiry
+	auditLog  []*types.AuditEvent         //oldest first, only appended to
+}
+
+type memCompany struct {
+	company types.Company
+}
+
+type memUser struct {
+	user         types.User
+	passwordHash string
+}
+
+type memInvite struct {
+	invite    types.Invite
+	tokenHash string
+}
+
+type memAPIKey struct {
+	key     types.APIKey
+	keyHash string
+}
+
+type memRefreshToken struct {
+	sessionID uuid.UUID
+	used      bool
+}
+
+type memDevice struct {
+	device     types.Device
+	secretHash string                  //empty when revoked
+	lastSeen   *time.Time              //nil until seen, like a missing device_presence row
+	online     bool                    //flipped by RecordDevicesSeen and MarkDevicesOffline
+	schemas    []*types.SchemaRevision //oldest first
+}
+
+func NewMemStore(logger *log.Logger) *MemStore {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &MemStore{
+		logger:    logger,
+		companies: make(map[uuid.UUID]*memCompany),
+		users:     make(map[uuid.UUID]*memUser),
+		invites:   make(map[uuid.UUID]*memInvite),
+		apiKeys:   make(map[uuid.UUID]*memAPIKey),
+		groups:    make(map[uuid.UUID]*types.Grp),
+		devices:   make(map[uuid.UUID]*memDevice),
+		sessions:  make(map[uuid.UUID]*types.Session),
+		refresh:   make(map[string]*memRefreshToken),
+		denied:    make(map[string]time.Time),
+	}
+}
+
+func parseID(id string) (uuid.UUID, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %q", metadatastore.ErrInvalidID, id)
+	}
+	return parsed, nil
+}
+
+func copyCompany(c *memCompany) *types.Company {
+	cp := c.company
+	cp.CompanyPassword = ""
+	return &cp
+}
+
+func copySchema(schema types.TelemetrySchema) types.TelemetrySchema {
+	cp := make(types.TelemetrySchema, len(schema))
+	for field, typ := range schema {
+		cp[field] = typ
+	}
+	return cp
+}
+
+func copyGroup(g *types.Grp) *types.Grp {
+	cp := *g
+	return &cp
+}
+
+// copyDevice needs s.mu held, the status depends on the group heartbeat timeout
+func (s *MemStore) copyDevice(d *memDevice) *types.Device {
+	cp := d.device
+	cp.DeviceSecret = ""
+	cp.TelemetryDataSchema = copySchema(d.device.TelemetryDataSchema)
+	cp.Shadow = types.CopyShadow(d.device.Shadow)
+	timeout := types.DefaultHeartbeatTimeout
+	if g, ok := s.groups[d.device.GrpID]; ok {
+		timeout = g.HeartbeatTimeout()
+	}
+	cp.SetPresence(d.lastSeen, timeout, time.Now())
+	return &cp
+}
+
+// page sorts rows by (key, id) like the keyset queries of MetadataDBReader,
+// skips up to the cursor and cuts one page
+func page[T any](rows []T, opts *types.ListOptions, key func(T) types.Cursor) ([]T, string) {
+	less := func(a, b types.Cursor) bool {
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.ID.String() < b.ID.String()
+	}
+	desc := opts.Descending()
+	sort.Slice(rows, func(i, j int) bool {
+		if desc {
+			return less(key(rows[j]), key(rows[i]))
+		}
+		return less(key(rows[i]), key(rows[j]))
+	})
+
+	if opts.Cursor != "" {
+		after, _ := types.DecodeCursor(opts.Cursor) //checked by Normalize
+		start := sort.Search(len(rows), func(i int) bool {
+			if desc {
+				return less(key(rows[i]), *after)
+			}
+			return less(*after, key(rows[i]))
+		})
+		rows = rows[start:]
+	}
+
+	if len(rows) <= opts.Limit {
+		return rows, ""
+	}
+	rows = rows[:opts.Limit]
+	return rows, types.EncodeCursor(key(rows[len(rows)-1]))
+}
@@ -0,0 +1,16 @@
+package metadatamemstore
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatatest "github.com/mukundvijay123/KCloud/metadata/metadataTest"
+)
+
+func TestConformance(t *testing.T) {
+	metadatatest.RunConformance(t, func(t *testing.T) types.MetadataStore {
+		return NewMemStore(log.New(io.Discard, "", 0))
+	})
+}
@@ -0,0 +1,62 @@
+package metadatamemstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+func (s *MemStore) RecordDevicesSeen(ctx context.Context, seen map[uuid.UUID]time.Time) ([]uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var online []uuid.UUID
+	for id, at := range seen {
+		stored, ok := s.devices[id]
+		if !ok {
+			continue
+		}
+		if stored.lastSeen == nil || at.After(*stored.lastSeen) {
+			t := at.UTC()
+			stored.lastSeen = &t
+		}
+		if !stored.online {
+			stored.online = true
+			online = append(online, id)
+		}
+	}
+	return online, nil
+}
+
+func (s *MemStore) MarkDevicesOffline(ctx context.Context, now time.Time) ([]*types.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var offline []*types.Device
+	for _, stored := range s.devices {
+		if !stored.online || stored.lastSeen == nil {
+			continue
+		}
+		timeout := types.DefaultHeartbeatTimeout
+		if g, ok := s.groups[stored.device.GrpID]; ok {
+			timeout = g.HeartbeatTimeout()
+		}
+		if now.Sub(*stored.lastSeen) >= timeout {
+			stored.online = false
+			offline = append(offline, s.copyDevice(stored))
+		}
+	}
+	return offline, nil
+}
+
+func (s *MemStore) ListStaleDevices(ctx context.Context, companyID string, opts *types.ListOptions) ([]*types.Device, string, error) {
+	id, err := parseID(companyID)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.listDevices(func(d *types.Device) bool {
+		return d.CompanyID == id && d.Status != types.DeviceOnline
+	}, opts)
+}
@@ -0,0 +1,142 @@
+package metadatamemstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+func copySession(session *types.Session) *types.Session {
+	cp := *session
+	return &cp
+}
+
+func (s *MemStore) CreateSession(ctx context.Context, userID uuid.UUID, refreshHash string, expiresAt time.Time) (*types.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		s.logger.Println("[CreateSession] user not found:", userID)
+		return nil, types.ErrUserNotFound
+	}
+
+	session := &types.Session{
+		ID:        uuid.New(),
+		UserID:    userID,
+		CompanyID: user.user.CompanyID,
+		Role:      user.user.Role,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+	s.sessions[session.ID] = session
+	s.refresh[refreshHash] = &memRefreshToken{sessionID: session.ID}
+	return copySession(session), nil
+}
+
+func (s *MemStore) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*types.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[oldHash]
+	if !ok {
+		s.logger.Println("[RotateRefreshToken] unknown refresh token")
+		return nil, types.ErrInvalidRefreshToken
+	}
+	session, ok := s.sessions[token.sessionID]
+	if !ok {
+		return nil, types.ErrInvalidRefreshToken
+	}
+
+	now := time.Now().UTC()
+	if token.used {
+		if session.RevokedAt == nil {
+			session.RevokedAt = &now
+		}
+		s.logger.Println("[RotateRefreshToken] refresh token reused, session revoked:", session.ID)
+		return nil, types.ErrInvalidRefreshToken
+	}
+	if session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+		s.logger.Println("[RotateRefreshToken] session revoked or expired:", session.ID)
+		return nil, types.ErrInvalidRefreshToken
+	}
+
+	token.used = true
+	s.refresh[newHash] = &memRefreshToken{sessionID: session.ID}
+	session.ExpiresAt = expiresAt.UTC()
+	session.Role = s.users[session.UserID].user.Role
+	return copySession(session), nil
+}
+
+func (s *MemStore) RevokeSession(ctx context.Context, sessionID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[sessionID]; ok && session.RevokedAt == nil {
+		now := time.Now().UTC()
+		session.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *MemStore) DenyToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.denied[jti]; !ok {
+		s.denied[jti] = expiresAt.UTC()
+	}
+	return nil
+}
+
+func (s *MemStore) TokenRevoked(ctx context.Context, jti string, sessionID uuid.UUID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.denied[jti]; ok {
+		return true, nil
+	}
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return true, nil
+	}
+	return session.RevokedAt != nil || !session.ExpiresAt.After(time.Now()), nil
+}
+
+func (s *MemStore) PurgeSessions(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for jti, expiresAt := range s.denied {
+		if !expiresAt.After(now) {
+			delete(s.denied, jti)
+		}
+	}
+	for id, session := range s.sessions {
+		if !session.ExpiresAt.After(now) {
+			s.deleteSession(id)
+		}
+	}
+	return nil
+}
+
+// revokeSessions needs s.mu held
+func (s *MemStore) revokeSessions(userID uuid.UUID, now time.Time) {
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			session.RevokedAt = &now
+		}
+	}
+}
+
+// deleteSession needs s.mu held, refresh tokens go with their session like the cascade in MetadataDb
+func (s *MemStore) deleteSession(id uuid.UUID) {
+	delete(s.sessions, id)
+	for hash, token := range s.refresh {
+		if token.sessionID == id {
+			delete(s.refresh, hash)
+		}
+	}
+}
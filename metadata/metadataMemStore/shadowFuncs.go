@@ -0,0 +1,30 @@
+package metadatamemstore
+
+import (
+	"context"
+
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+func (s *MemStore) UpdateDeviceShadow(ctx context.Context, d *types.Device, section types.ShadowSection, patch types.ShadowState, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.ownedDevice(d)
+	if err != nil {
+		s.logger.Println("[UpdateDeviceShadow] device not found with ID:", d.ID)
+		return err
+	}
+
+	shadow := types.CopyShadow(stored.device.Shadow)
+	if err := shadow.ApplyShadowPatch(section, patch, version); err != nil {
+		return err
+	}
+	if section == types.ShadowDesired {
+		s.audit(ctx, stored.device.CompanyID, types.AuditDeviceShadowDesired, d.ID,
+			types.DesiredShadowState(stored.device.Shadow), types.DesiredShadowState(shadow))
+	}
+	stored.device.Shadow = shadow
+	d.Shadow = types.CopyShadow(shadow)
+	return nil
+}
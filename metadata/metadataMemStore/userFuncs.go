@@ -0,0 +1,276 @@
+package metadatamemstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+func copyUser(u *memUser) *types.User {
+	cp := u.user
+	return &cp
+}
+
+func (s *MemStore) VerifyUser(ctx context.Context, username string, password string) (*types.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored := s.userByUsername(username)
+	if stored == nil {
+		types.CheckPassword(types.DummyPasswordHash, password)
+		return nil, nil
+	}
+	if ok, _ := types.CheckPassword(stored.passwordHash, password); !ok {
+		return nil, nil
+	}
+	return copyUser(stored), nil
+}
+
+func (s *MemStore) GetUserByID(ctx context.Context, id string) (*types.User, error) {
+	userID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.users[userID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", types.ErrUserNotFound, id)
+	}
+	return copyUser(stored), nil
+}
+
+func (s *MemStore) ListUsersByCompany(ctx context.Context, companyID string) ([]*types.User, error) {
+	id, err := parseID(companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []*types.User
+	for _, stored := range s.users {
+		if stored.user.CompanyID == id {
+			users = append(users, copyUser(stored))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *MemStore) UpdateUserPassword(ctx context.Context, u *types.User, oldPassword string, newPassword string) error {
+	if !types.IsValidPassword(newPassword) {
+		s.logger.Println("[UpdateUserPassword] invalid new password")
+		return metadatastore.ErrInvalidPasswd
+	}
+	newHash, err := types.HashPassword(newPassword)
+	if err != nil {
+		s.logger.Println("[UpdateUserPassword] error hashing new password:", err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[u.ID]
+	if !ok {
+		return types.ErrUserNotFound
+	}
+	if ok, _ := types.CheckPassword(stored.passwordHash, oldPassword); !ok {
+		s.logger.Println("[UpdateUserPassword] incorrect current password for user:", u.ID)
+		return metadatastore.ErrWrongPasswd
+	}
+
+	stored.passwordHash = newHash
+	s.revokeSessions(u.ID, time.Now().UTC())
+	s.audit(ctx, stored.user.CompanyID, types.AuditUserPassword, u.ID, nil, nil)
+	return nil
+}
+
+func (s *MemStore) UpdateUserRole(ctx context.Context, u *types.User, role types.Role) error {
+	if !role.Valid() {
+		s.logger.Println("[UpdateUserRole] invalid role:", role)
+		return types.ErrInvalidRole
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOwnerRemains(u, role); err != nil {
+		return err
+	}
+	stored := s.users[u.ID]
+	before := copyUser(stored)
+	stored.user.Role = role
+	s.revokeSessions(u.ID, time.Now().UTC())
+	s.audit(ctx, stored.user.CompanyID, types.AuditUserRole, u.ID, before, copyUser(stored))
+	*u = *copyUser(stored)
+	return nil
+}
+
+func (s *MemStore) DeleteUser(ctx context.Context, u *types.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOwnerRemains(u, ""); err != nil {
+		return err
+	}
+	before := copyUser(s.users[u.ID])
+	s.deleteUser(u.ID)
+	s.audit(ctx, before.CompanyID, types.AuditUserDelete, u.ID, before, nil)
+	return nil
+}
+
+func (s *MemStore) CreateInvite(ctx context.Context, inv *types.Invite, tokenHash string) error {
+	if !inv.Role.Valid() {
+		s.logger.Println("[CreateInvite] invalid role:", inv.Role)
+		return types.ErrInvalidRole
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.companies[inv.CompanyID]; !ok {
+		return metadatastore.ErrCompanyNoExist
+	}
+	inv.ID = uuid.New()
+	inv.CreatedAt = time.Now().UTC()
+	inv.ExpiresAt = inv.ExpiresAt.UTC()
+	s.invites[inv.ID] = &memInvite{invite: *inv, tokenHash: tokenHash}
+	s.audit(ctx, inv.CompanyID, types.AuditInviteCreate, inv.ID, nil, inv)
+	return nil
+}
+
+func (s *MemStore) ListInvitesByCompany(ctx context.Context, companyID string) ([]*types.Invite, error) {
+	id, err := parseID(companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var invites []*types.Invite
+	for _, stored := range s.invites {
+		if stored.invite.CompanyID == id && stored.invite.ExpiresAt.After(now) {
+			cp := stored.invite
+			invites = append(invites, &cp)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.Before(invites[j].CreatedAt) })
+	return invites, nil
+}
+
+func (s *MemStore) DeleteInvite(ctx context.Context, inv *types.Invite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.invites[inv.ID]
+	if !ok || stored.invite.CompanyID != inv.CompanyID {
+		return types.ErrInvalidInvite
+	}
+	delete(s.invites, inv.ID)
+	s.audit(ctx, inv.CompanyID, types.AuditInviteDelete, inv.ID, stored.invite, nil)
+	return nil
+}
+
+func (s *MemStore) AcceptInvite(ctx context.Context, tokenHash string, u *types.User, password string) error {
+	if !types.IsValidName(u.Username) {
+		s.logger.Println("[AcceptInvite] invalid username:", u.Username)
+		return metadatastore.ErrInvalidName
+	}
+	if !types.IsValidPassword(password) {
+		s.logger.Println("[AcceptInvite] invalid password")
+		return metadatastore.ErrInvalidPasswd
+	}
+	passwordHash, err := types.HashPassword(password)
+	if err != nil {
+		s.logger.Println("[AcceptInvite] error hashing password:", err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inv *memInvite
+	for _, stored := range s.invites {
+		if stored.tokenHash == tokenHash && stored.invite.ExpiresAt.After(time.Now()) {
+			inv = stored
+		}
+	}
+	if inv == nil {
+		return types.ErrInvalidInvite
+	}
+	if s.userByUsername(u.Username) != nil {
+		return types.ErrUsernameTaken
+	}
+
+	delete(s.invites, inv.invite.ID)
+	u.ID = uuid.New()
+	u.CompanyID = inv.invite.CompanyID
+	u.Role = inv.invite.Role
+	u.CreatedAt = time.Now().UTC()
+	s.users[u.ID] = &memUser{user: *u, passwordHash: passwordHash}
+
+	// Nobody is logged in to accept an invite, the new user is the actor
+	s.audit(types.WithDefaultActor(ctx, u.ID), u.CompanyID, types.AuditUserCreate, u.ID, nil, u)
+	return nil
+}
+
+// userByUsername needs s.mu held
+func (s *MemStore) userByUsername(username string) *memUser {
+	for _, stored := range s.users {
+		if stored.user.Username == username {
+			return stored
+		}
+	}
+	return nil
+}
+
+// checkOwnerRemains needs s.mu held, it fails unless u exists in u.CompanyID
+// and the company keeps an owner once u has role next
+func (s *MemStore) checkOwnerRemains(u *types.User, next types.Role) error {
+	stored, ok := s.users[u.ID]
+	if !ok || stored.user.CompanyID != u.CompanyID {
+		return fmt.Errorf("%w: %s", types.ErrUserNotFound, u.ID)
+	}
+	if stored.user.Role != types.RoleOwner || next == types.RoleOwner {
+		return nil
+	}
+	for id, other := range s.users {
+		if id != u.ID && other.user.CompanyID == u.CompanyID && other.user.Role == types.RoleOwner {
+			return nil
+		}
+	}
+	return types.ErrLastOwner
+}
+
+// deleteUser needs s.mu held, sessions go with their user like the cascade in MetadataDb
+// and invites and api keys forget who made them
+func (s *MemStore) deleteUser(id uuid.UUID) {
+	for sessionID, session := range s.sessions {
+		if session.UserID == id {
+			s.deleteSession(sessionID)
+		}
+	}
+	for _, inv := range s.invites {
+		if inv.invite.InvitedBy == id {
+			inv.invite.InvitedBy = uuid.Nil
+		}
+	}
+	for _, k := range s.apiKeys {
+		if k.key.CreatedBy == id {
+			k.key.CreatedBy = uuid.Nil
+		}
+	}
+	delete(s.users, id)
+}
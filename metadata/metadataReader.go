@@ -1,21 +1,26 @@
 package metadata
 
+import "context"
+
 //Readonly interface to get matadata
 
 // MetadataReader defines read-only operations for metadata
+// Get methods return an error wrapping ErrNotFound when nothing matches, never nil, nil.
+// List methods return one page and the cursor of the next, empty on the last page.
 type MetadataReader interface {
 	// Companies
-	GetCompanyByID(id string) (*Company, error)
-	GetCompanyByUsername(username string) (*Company, error)
-	ListCompanies() ([]*Company, error)
-	VerifyCompany(username string, hashedPassword string) (bool, error)
+	GetCompanyByID(ctx context.Context, id string) (*Company, error)
+	GetCompanyByUsername(ctx context.Context, username string) (*Company, error)
+	ListCompanies(ctx context.Context, opts *ListOptions) ([]*Company, string, error)
 
 	// Groups
-	GetGroupByID(id string) (*Grp, error)
-	ListGroupsByCompany(companyID string) ([]*Grp, error)
+	GetGroupByID(ctx context.Context, id string) (*Grp, error)
+	ListGroupsByCompany(ctx context.Context, companyID string, opts *ListOptions) ([]*Grp, string, error)
 
 	// Devices
-	GetDeviceByID(id string) (*Device, error)
-	ListDevicesByGroup(groupID string) ([]*Device, error)
-	ListDevicesByCompany(companyID string) ([]*Device, error)
+	GetDeviceByID(ctx context.Context, id string) (*Device, error)
+	ListDevicesByGroup(ctx context.Context, groupID string, opts *ListOptions) ([]*Device, string, error)
+	ListDevicesByCompany(ctx context.Context, companyID string, opts *ListOptions) ([]*Device, string, error)
+	GetDeviceBySecret(ctx context.Context, secret string) (*Device, error)
+	ListDeviceSchemas(ctx context.Context, deviceID string) ([]*SchemaRevision, error) //Schema history of a device, newest first
 }
@@ -1,6 +1,7 @@
 package metadatareader
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -8,8 +9,12 @@ import (
 )
 
 // GetCompanyByID fetches a company by ID and nulls out the password
-func (r *MetadataDBReader) GetCompanyByID(id string) (*types.Company, error) {
-	row := r.dbConn.QueryRow(`
+func (r *MetadataDBReader) GetCompanyByID(ctx context.Context, id string) (*types.Company, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+
+	row := r.dbConn.QueryRowContext(ctx, `
 		SELECT id, company_name, username, no_of_grps, no_of_devices
 		FROM company
 		WHERE id=$1
@@ -20,10 +25,10 @@ func (r *MetadataDBReader) GetCompanyByID(id string) (*types.Company, error) {
 	if err != nil {
 		if err == sql.ErrNoRows {
 			r.logger.Println("[GetCompanyByID] company not found:", id)
-			return nil, nil
+			return nil, fmt.Errorf("%w: %s", ErrComanyNotFound, id)
 		}
 		r.logger.Println("[GetCompanyByID] error querying company:", err)
-		return nil, fmt.Errorf(ErrComanyNotFound.Error(), err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 
 	}
 
@@ -34,8 +39,8 @@ func (r *MetadataDBReader) GetCompanyByID(id string) (*types.Company, error) {
 }
 
 // GetCompanyByUsername fetches a company by username and nulls out the password
-func (r *MetadataDBReader) GetCompanyByUsername(username string) (*types.Company, error) {
-	row := r.dbConn.QueryRow(`
+func (r *MetadataDBReader) GetCompanyByUsername(ctx context.Context, username string) (*types.Company, error) {
+	row := r.dbConn.QueryRowContext(ctx, `
 		SELECT id, company_name, username, no_of_grps, no_of_devices
 		FROM company
 		WHERE username=$1
@@ -46,10 +51,10 @@ func (r *MetadataDBReader) GetCompanyByUsername(username string) (*types.Company
 	if err != nil {
 		if err == sql.ErrNoRows {
 			r.logger.Println("[GetCompanyByUsername] company not found:", username)
-			return nil, nil
+			return nil, fmt.Errorf("%w: %s", ErrComanyNotFound, username)
 		}
 		r.logger.Println("[GetCompanyByUsername] error querying company:", err)
-		return nil, fmt.Errorf(ErrComanyNotFound.Error(), err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
 	// Null out password
@@ -58,14 +63,21 @@ func (r *MetadataDBReader) GetCompanyByUsername(username string) (*types.Company
 	return c, nil
 }
 
-func (r *MetadataDBReader) ListCompanies() ([]*types.Company, error) {
-	rows, err := r.dbConn.Query(`
+// ListCompanies lists one page of companies ordered by username
+func (r *MetadataDBReader) ListCompanies(ctx context.Context, opts *types.ListOptions) ([]*types.Company, string, error) {
+	opts, err := opts.Normalize(false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	query, args := pageQuery(`
 		SELECT id, company_name, username, no_of_grps, no_of_devices
 		FROM company
-	`)
+		WHERE TRUE`, nil, "username", "", opts)
+	rows, err := r.dbConn.QueryContext(ctx, query, args...)
 	if err != nil {
 		r.logger.Println("[ListCompanies] error querying companies:", err)
-		return nil, err
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer rows.Close()
 
@@ -75,7 +87,7 @@ func (r *MetadataDBReader) ListCompanies() ([]*types.Company, error) {
 		err := rows.Scan(&c.ID, &c.CompanyName, &c.Username, &c.NoOfGrps, &c.NoOfDevices)
 		if err != nil {
 			r.logger.Println("[ListCompanies] error scanning row:", err)
-			continue
+			return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 		}
 		c.CompanyPassword = "" // null out password
 		companies = append(companies, c)
@@ -83,36 +95,9 @@ func (r *MetadataDBReader) ListCompanies() ([]*types.Company, error) {
 
 	if err = rows.Err(); err != nil {
 		r.logger.Println("[ListCompanies] rows iteration error:", err)
-		return nil, ErrComanyNotFound
-	}
-
-	return companies, nil
-}
-
-func (r *MetadataDBReader) VerifyCompany(username string, hashedPassword string) (bool, error) {
-	var storedPassword string
-	row := r.dbConn.QueryRow(`
-		SELECT company_password
-		FROM company
-		WHERE username = $1
-	`, username)
-
-	err := row.Scan(&storedPassword)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			r.logger.Println("[VerifyCompany] username not found:", username)
-			return false, nil
-		}
-		r.logger.Println("[VerifyCompany] error querying password:", err)
-		return false, ErrDbErrorGeneric
-	}
-
-	// Compare the hashed password
-	if storedPassword != hashedPassword {
-		r.logger.Println("[VerifyCompany] password mismatch for username:", username)
-		return false, nil
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	r.logger.Println("[VerifyCompany] credentials verified for username:", username)
-	return true, nil
+	companies, next := nextCursor(companies, opts, types.CompanyCursor)
+	return companies, next, nil
 }
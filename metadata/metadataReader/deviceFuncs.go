@@ -1,122 +1,246 @@
 package metadatareader
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 	types "github.com/mukundvijay123/KCloud/metadata"
 )
 
+// deviceColumns are the columns scanDevice reads. Last seen times live in
+// device_presence so that device traffic never writes the device row.
+const deviceColumns = `id, grp_id, company_id, device_name, device_type, device_description, longitude, latitude, telemetry_data_schema,
+			schema_version, shadow_desired, shadow_reported, shadow_version,
+			(SELECT last_seen_at FROM device_presence p WHERE p.device_id = device.id),
+			(SELECT heartbeat_timeout FROM grp g WHERE g.id = device.grp_id)`
+
+// staleCondition matches devices not seen within the heartbeat timeout of their group
+const staleCondition = ` AND NOT EXISTS (
+			SELECT 1 FROM device_presence p JOIN grp g ON g.id = device.grp_id
+			WHERE p.device_id = device.id AND p.last_seen_at > now() - g.heartbeat_timeout * interval '1 second')`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanDevice reads a row of deviceColumns
+func scanDevice(row scanner) (*types.Device, error) {
+	d := &types.Device{}
+	var (
+		schemaJSON, desiredJSON, reportedJSON []byte
+		lastSeen                              sql.NullTime
+		heartbeat                             int
+	)
+	err := row.Scan(&d.ID, &d.GrpID, &d.CompanyID, &d.DeviceName, &d.DeviceType, &d.DeviceDescription,
+		&d.DeviceLocation.Longitude, &d.DeviceLocation.Latitude, &schemaJSON,
+		&d.SchemaVersion, &desiredJSON, &reportedJSON, &d.Shadow.Version, &lastSeen, &heartbeat)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(schemaJSON, &d.TelemetryDataSchema); err != nil {
+		return nil, fmt.Errorf("%w: failed to unmarshal schema: %w", ErrDbErrorGeneric, err)
+	}
+	if d.Shadow, err = types.UnmarshalShadow(desiredJSON, reportedJSON, d.Shadow.Version); err != nil {
+		return nil, fmt.Errorf("%w: failed to unmarshal shadow: %w", ErrDbErrorGeneric, err)
+	}
+
+	g := types.Grp{HeartbeatSeconds: heartbeat}
+	if lastSeen.Valid {
+		d.SetPresence(&lastSeen.Time, g.HeartbeatTimeout(), time.Now())
+	} else {
+		d.SetPresence(nil, g.HeartbeatTimeout(), time.Now())
+	}
+	return d, nil
+}
+
 // GetDeviceByID fetches a device by ID
-func (r *MetadataDBReader) GetDeviceByID(id string) (*types.Device, error) {
-	row := r.dbConn.QueryRow(`
-		SELECT id, grp_id, company_id, device_name, device_type, device_description, longitude, latitude, telemetry_data_schema
+func (r *MetadataDBReader) GetDeviceByID(ctx context.Context, id string) (*types.Device, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+
+	row := r.dbConn.QueryRowContext(ctx, `
+		SELECT `+deviceColumns+`
 		FROM device
 		WHERE id=$1
 	`, id)
 
-	d := &types.Device{}
-	var schemaJSON []byte
-	err := row.Scan(&d.ID, &d.GrpID, &d.CompanyID, &d.DeviceName, &d.DeviceType, &d.DeviceDescription,
-		&d.DeviceLocation.Longitude, &d.DeviceLocation.Latitude, &schemaJSON)
+	d, err := scanDevice(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			r.logger.Println("[GetDeviceByID] device not found:", id)
-			return nil, nil
+			return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, id)
 		}
 		r.logger.Println("[GetDeviceByID] query error:", err)
-		return nil, err
-	}
-
-	// Unmarshal JSON schema
-	var schema types.TelemetrySchema
-	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
-		r.logger.Println("[GetDeviceByID] failed to unmarshal schema:", err)
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
-	d.TelemetryDataSchema = schema
-
 	return d, nil
 }
 
-// ListDevicesByGroup lists all devices for a given group
-func (r *MetadataDBReader) ListDevicesByGroup(groupID string) ([]*types.Device, error) {
-	rows, err := r.dbConn.Query(`
-		SELECT id, grp_id, company_id, device_name, device_type, device_description, longitude, latitude, telemetry_data_schema
+// GetDevicesByIDs fetches the devices with the given ids, skipping those that dont exist
+func (r *MetadataDBReader) GetDevicesByIDs(ctx context.Context, ids []uuid.UUID) ([]*types.Device, error) {
+	strIDs := make([]string, len(ids))
+	for i, id := range ids {
+		strIDs[i] = id.String()
+	}
+
+	rows, err := r.dbConn.QueryContext(ctx, `
+		SELECT `+deviceColumns+`
 		FROM device
-		WHERE grp_id=$1
-	`, groupID)
+		WHERE id = ANY($1)
+	`, pq.Array(strIDs))
 	if err != nil {
-		r.logger.Println("[ListDevicesByGroup] query error:", err)
-		return nil, err
+		r.logger.Println("[GetDevicesByIDs] query error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer rows.Close()
 
 	var devices []*types.Device
 	for rows.Next() {
-		d := &types.Device{}
-		var schemaJSON []byte
-		if err := rows.Scan(&d.ID, &d.GrpID, &d.CompanyID, &d.DeviceName, &d.DeviceType,
-			&d.DeviceDescription, &d.DeviceLocation.Longitude, &d.DeviceLocation.Latitude, &schemaJSON); err != nil {
-			r.logger.Println("[ListDevicesByGroup] row scan error:", err)
-			continue
+		d, err := scanDevice(rows)
+		if err != nil {
+			r.logger.Println("[GetDevicesByIDs] row scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		r.logger.Println("[GetDevicesByIDs] rows iteration error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return devices, nil
+}
 
-		var schema types.TelemetrySchema
-		if err := json.Unmarshal(schemaJSON, &schema); err != nil {
-			r.logger.Println("[ListDevicesByGroup] failed to unmarshal schema for device:", d.DeviceName, err)
-			continue
-		}
-		d.TelemetryDataSchema = schema
+// ListDevicesByGroup lists one page of the devices of a group
+func (r *MetadataDBReader) ListDevicesByGroup(ctx context.Context, groupID string, opts *types.ListOptions) ([]*types.Device, string, error) {
+	if err := validateID(groupID); err != nil {
+		return nil, "", err
+	}
+	return r.listDevices(ctx, "ListDevicesByGroup", "grp_id", groupID, "", opts)
+}
+
+// ListDevicesByCompany lists one page of the devices of a company
+func (r *MetadataDBReader) ListDevicesByCompany(ctx context.Context, companyID string, opts *types.ListOptions) ([]*types.Device, string, error) {
+	if err := validateID(companyID); err != nil {
+		return nil, "", err
+	}
+	return r.listDevices(ctx, "ListDevicesByCompany", "company_id", companyID, "", opts)
+}
+
+// ListStaleDevices lists one page of the devices of a company that are offline or were never seen
+func (r *MetadataDBReader) ListStaleDevices(ctx context.Context, companyID string, opts *types.ListOptions) ([]*types.Device, string, error) {
+	if err := validateID(companyID); err != nil {
+		return nil, "", err
+	}
+	return r.listDevices(ctx, "ListStaleDevices", "company_id", companyID, staleCondition, opts)
+}
+
+// listDevices lists the devices with ownerCol = ownerID matching the extra
+// condition, if any. fn names the caller in logs.
+func (r *MetadataDBReader) listDevices(ctx context.Context, fn, ownerCol, ownerID, condition string, opts *types.ListOptions) ([]*types.Device, string, error) {
+	opts, err := opts.Normalize(true)
+	if err != nil {
+		return nil, "", err
+	}
 
+	query, args := pageQuery(`
+		SELECT `+deviceColumns+`
+		FROM device
+		WHERE `+ownerCol+`=$1`+condition, []interface{}{ownerID}, "device_name", "device_type", opts)
+	rows, err := r.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		r.logger.Printf("[%s] query error: %v", fn, err)
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var devices []*types.Device
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			r.logger.Printf("[%s] row scan error: %v", fn, err)
+			return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
 		devices = append(devices, d)
 	}
 
 	if err := rows.Err(); err != nil {
-		r.logger.Println("[ListDevicesByGroup] rows iteration error:", err)
-		return nil, err
+		r.logger.Printf("[%s] rows iteration error: %v", fn, err)
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	return devices, nil
+	devices, next := nextCursor(devices, opts, func(d *types.Device) types.Cursor {
+		return types.DeviceCursor(d, opts.Sort)
+	})
+	return devices, next, nil
 }
 
-// ListDevicesByCompany lists all devices for a given company
-func (r *MetadataDBReader) ListDevicesByCompany(companyID string) ([]*types.Device, error) {
-	rows, err := r.dbConn.Query(`
-		SELECT id, grp_id, company_id, device_name, device_type, device_description, longitude, latitude, telemetry_data_schema
+// GetDeviceBySecret fetches the device a secret was issued to
+func (r *MetadataDBReader) GetDeviceBySecret(ctx context.Context, secret string) (*types.Device, error) {
+	row := r.dbConn.QueryRowContext(ctx, `
+		SELECT `+deviceColumns+`
 		FROM device
-		WHERE company_id=$1
-	`, companyID)
+		WHERE device_secret_hash=$1
+	`, types.HashDeviceSecret(secret))
+
+	d, err := scanDevice(row)
 	if err != nil {
-		r.logger.Println("[ListDevicesByCompany] query error:", err)
+		if err == sql.ErrNoRows {
+			r.logger.Println("[GetDeviceBySecret] no device for secret")
+			return nil, ErrDeviceNotFound
+		}
+		r.logger.Println("[GetDeviceBySecret] query error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return d, nil
+}
+
+// ListDeviceSchemas returns every schema version of a device, newest first
+func (r *MetadataDBReader) ListDeviceSchemas(ctx context.Context, deviceID string) ([]*types.SchemaRevision, error) {
+	if err := validateID(deviceID); err != nil {
 		return nil, err
 	}
+
+	rows, err := r.dbConn.QueryContext(ctx, `
+		SELECT version, telemetry_data_schema, forced, created_at
+		FROM device_schema
+		WHERE device_id=$1
+		ORDER BY version DESC
+	`, deviceID)
+	if err != nil {
+		r.logger.Println("[ListDeviceSchemas] query error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
 	defer rows.Close()
 
-	var devices []*types.Device
+	var revisions []*types.SchemaRevision
 	for rows.Next() {
-		d := &types.Device{}
+		rev := &types.SchemaRevision{}
 		var schemaJSON []byte
-		if err := rows.Scan(&d.ID, &d.GrpID, &d.CompanyID, &d.DeviceName, &d.DeviceType,
-			&d.DeviceDescription, &d.DeviceLocation.Longitude, &d.DeviceLocation.Latitude, &schemaJSON); err != nil {
-			r.logger.Println("[ListDevicesByCompany] row scan error:", err)
-			continue
+		if err := rows.Scan(&rev.Version, &schemaJSON, &rev.Forced, &rev.CreatedAt); err != nil {
+			r.logger.Println("[ListDeviceSchemas] row scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 		}
-
-		var schema types.TelemetrySchema
-		if err := json.Unmarshal(schemaJSON, &schema); err != nil {
-			r.logger.Println("[ListDevicesByCompany] failed to unmarshal schema for device:", d.DeviceName, err)
-			continue
+		if err := json.Unmarshal(schemaJSON, &rev.Schema); err != nil {
+			r.logger.Println("[ListDeviceSchemas] failed to unmarshal schema:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 		}
-		d.TelemetryDataSchema = schema
-
-		devices = append(devices, d)
+		revisions = append(revisions, rev)
 	}
-
 	if err := rows.Err(); err != nil {
-		r.logger.Println("[ListDevicesByCompany] rows iteration error:", err)
-		return nil, err
+		r.logger.Println("[ListDeviceSchemas] rows iteration error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	return devices, nil
+	// Every device has its first version from creation on
+	if len(revisions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID)
+	}
+	return revisions, nil
 }
@@ -1,8 +1,27 @@
 package metadatareader
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
 
 var (
-	ErrComanyNotFound = errors.New("company not found")
-	ErrDbErrorGeneric = errors.New("database error: ")
+	ErrComanyNotFound = types.NewError(types.ErrNotFound, "company not found")
+	ErrGroupNotFound  = types.NewError(types.ErrNotFound, "group not found")
+	ErrDeviceNotFound = types.NewError(types.ErrNotFound, "device not found")
+	ErrDbErrorGeneric = errors.New("database error")
 )
+
+// ErrInvalidID is returned for ids that are not UUIDs, postgres would reject them anyway
+var ErrInvalidID = types.NewError(types.ErrValidation, "invalid id")
+
+func validateID(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return nil
+}
@@ -1,58 +1,73 @@
 package metadatareader
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 
 	types "github.com/mukundvijay123/KCloud/metadata"
 )
 
-func (r *MetadataDBReader) GetGroupByID(id string) (*types.Grp, error) {
-	row := r.dbConn.QueryRow(`
-		SELECT id, company_id, grp_name, no_of_devices
+func (r *MetadataDBReader) GetGroupByID(ctx context.Context, id string) (*types.Grp, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+
+	row := r.dbConn.QueryRowContext(ctx, `
+		SELECT id, company_id, grp_name, no_of_devices, heartbeat_timeout
 		FROM grp
 		WHERE id=$1
 	`, id)
 
 	g := &types.Grp{}
-	err := row.Scan(&g.ID, &g.CompanyID, &g.GroupName, &g.NoOfDevices)
+	err := row.Scan(&g.ID, &g.CompanyID, &g.GroupName, &g.NoOfDevices, &g.HeartbeatSeconds)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			r.logger.Println("[GetGroupByID] group not found:", id)
-			return nil, nil
+			return nil, fmt.Errorf("%w: %s", ErrGroupNotFound, id)
 		}
 		r.logger.Println("[GetGroupByID] query error:", err)
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	return g, nil
 }
 
-// ListGroupsByCompany lists all groups for a given company
-func (r *MetadataDBReader) ListGroupsByCompany(companyID string) ([]*types.Grp, error) {
-	rows, err := r.dbConn.Query(`
-		SELECT id, company_id, grp_name, no_of_devices
+// ListGroupsByCompany lists one page of the groups of a company
+func (r *MetadataDBReader) ListGroupsByCompany(ctx context.Context, companyID string, opts *types.ListOptions) ([]*types.Grp, string, error) {
+	if err := validateID(companyID); err != nil {
+		return nil, "", err
+	}
+	opts, err := opts.Normalize(false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	query, args := pageQuery(`
+		SELECT id, company_id, grp_name, no_of_devices, heartbeat_timeout
 		FROM grp
-		WHERE company_id=$1
-	`, companyID)
+		WHERE company_id=$1`, []interface{}{companyID}, "grp_name", "", opts)
+	rows, err := r.dbConn.QueryContext(ctx, query, args...)
 	if err != nil {
 		r.logger.Println("[ListGroupsByCompany] query error:", err)
-		return nil, err
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer rows.Close()
 
 	var groups []*types.Grp
 	for rows.Next() {
 		g := &types.Grp{}
-		if err := rows.Scan(&g.ID, &g.CompanyID, &g.GroupName, &g.NoOfDevices); err != nil {
+		if err := rows.Scan(&g.ID, &g.CompanyID, &g.GroupName, &g.NoOfDevices, &g.HeartbeatSeconds); err != nil {
 			r.logger.Println("[ListGroupsByCompany] row scan error:", err)
-			continue
+			return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 		}
 		groups = append(groups, g)
 	}
 
 	if err := rows.Err(); err != nil {
 		r.logger.Println("[ListGroupsByCompany] rows iteration error:", err)
-		return nil, err
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	return groups, nil
+	groups, next := nextCursor(groups, opts, types.GroupCursor)
+	return groups, next, nil
 }
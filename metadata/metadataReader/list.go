@@ -0,0 +1,52 @@
+package metadatareader
+
+import (
+	"fmt"
+
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+// pageQuery appends the filters, keyset condition, order and limit of opts to
+// query, which has to end in an open WHERE clause. typeCol is empty for lists
+// without a device type. One row more than the limit is asked for, nextCursor
+// uses it to tell if there is another page.
+func pageQuery(query string, args []interface{}, nameCol, typeCol string, opts *types.ListOptions) (string, []interface{}) {
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if opts.NamePrefix != "" {
+		query += fmt.Sprintf(" AND %s LIKE %s", nameCol, arg(opts.NamePrefix+"%"))
+	}
+	if opts.DeviceType != "" && typeCol != "" {
+		query += fmt.Sprintf(" AND %s = %s", typeCol, arg(opts.DeviceType))
+	}
+
+	// Byte order so pages match the in-memory store whatever the db collation
+	keyCol := nameCol + ` COLLATE "C"`
+	if opts.Sort == types.SortType || opts.Sort == types.SortTypeDesc {
+		keyCol = fmt.Sprintf(`COALESCE(%s, '') COLLATE "C"`, typeCol)
+	}
+	dir, cmp := "ASC", ">"
+	if opts.Descending() {
+		dir, cmp = "DESC", "<"
+	}
+
+	if opts.Cursor != "" {
+		c, _ := types.DecodeCursor(opts.Cursor) //checked by Normalize
+		query += fmt.Sprintf(" AND (%s, id) %s (%s, %s)", keyCol, cmp, arg(c.Key), arg(c.ID))
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", keyCol, dir, dir, arg(opts.Limit+1))
+	return query, args
+}
+
+// nextCursor trims a page fetched with pageQuery to the limit and returns the
+// cursor after its last row, empty on the last page
+func nextCursor[T any](page []T, opts *types.ListOptions, key func(T) types.Cursor) ([]T, string) {
+	if len(page) <= opts.Limit {
+		return page, ""
+	}
+	page = page[:opts.Limit]
+	return page, types.EncodeCursor(key(page[len(page)-1]))
+}
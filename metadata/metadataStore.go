@@ -1,22 +1,37 @@
 package metadata
 
+import "context"
+
 type MetadataStore interface {
 	//MetadataReader
 	MetadataReader
 
 	//Company
-	CreateCompany(c *Company) error //Creates a company
-	DeleteCompany(c *Company) error //Deletes a company
-	UpdatePassword(c *Company, newPassword string) error
+	CreateCompany(ctx context.Context, c *Company) error //Creates a company and its first owner from c.Username and c.CompanyPassword
+	DeleteCompany(ctx context.Context, c *Company) error //Deletes the company with id c.ID, its users, groups and devices
 
 	//Group
-	CreateGroup(g *Grp) error //Creates a group of sensors in a company
-	DeleteGroup(g *Grp) error //Deletes a group of sensors within a company
+	CreateGroup(ctx context.Context, g *Grp) error                       //Creates a group of sensors in a company
+	DeleteGroup(ctx context.Context, g *Grp) error                       //Deletes a group of sensors within a company
+	UpdateGroupHeartbeat(ctx context.Context, g *Grp, seconds int) error //Sets the heartbeat timeout of a group, 0 for the default
 
 	//Devices
-	CreateDevice(d *Device) error                                //Create a device entry
-	DeleteDevice(d *Device) error                                //Deletes a device entry
-	UpdateDeviceLocation(d *Device, l *Location) error           //Update Device Location
-	UpdateDeviceSchema(d *Device, schema *TelemetrySchema) error //Updates Device Schema
+	CreateDevice(ctx context.Context, d *Device) error                                            //Create a device entry
+	DeleteDevice(ctx context.Context, d *Device) error                                            //Deletes a device entry
+	UpdateDeviceLocation(ctx context.Context, d *Device, l *Location) error                       //Update Device Location
+	UpdateDeviceSchema(ctx context.Context, d *Device, schema *TelemetrySchema, force bool) error //Saves a new schema version, force allows incompatible changes
+	RotateDeviceSecret(ctx context.Context, d *Device) (string, error)                            //Issues a new device secret, the old one stops working
+	RevokeDeviceSecret(ctx context.Context, d *Device) error                                      //Removes the device secret, device cant authenticate
+	ShadowStore
+	PresenceStore
+	SessionStore
+	UserStore
+	APIKeyStore
+	AuditStore
+}
 
+// ShadowStore updates device shadows, the broker only needs this much of a MetadataStore
+type ShadowStore interface {
+	//Merges patch into a section of the device shadow and sets d.Shadow to the result
+	UpdateDeviceShadow(ctx context.Context, d *Device, section ShadowSection, patch ShadowState, version int64) error
 }
@@ -1,22 +1,43 @@
 package metadatastore
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 
+	"github.com/google/uuid"
 	types "github.com/mukundvijay123/KCloud/metadata"
 )
 
-func (mdb *MetadataDb) CreateDevice(d *types.Device) error {
-	if !isValidName(d.DeviceName) {
+func (mdb *MetadataDb) CreateDevice(ctx context.Context, d *types.Device) error {
+	if !types.IsValidName(d.DeviceName) {
 		mdb.logger.Println("[CreateDevice] invalid device name:", d.DeviceName)
 		return ErrInvalidName
 	}
+	if d.TelemetryDataSchema == nil {
+		d.TelemetryDataSchema = types.TelemetrySchema{}
+	}
+	if err := types.ValidateSchema(d.TelemetryDataSchema); err != nil {
+		mdb.logger.Println("[CreateDevice] invalid schema:", err)
+		return err
+	}
+	schemaJSON, err := json.Marshal(d.TelemetryDataSchema)
+	if err != nil {
+		mdb.logger.Println("[CreateDevice] failed to marshal schema:", err)
+		return fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+
+	secret, err := types.NewDeviceSecret()
+	if err != nil {
+		mdb.logger.Println("[CreateDevice] failed to generate device secret:", err)
+		return err
+	}
 
-	tx, err := mdb.dbConn.Begin()
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
 	if err != nil {
 		mdb.logger.Println("[CreateDevice] failed to begin transaction:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer func() {
 		if err != nil {
@@ -25,12 +46,25 @@ func (mdb *MetadataDb) CreateDevice(d *types.Device) error {
 		}
 	}()
 
+	// The group has to belong to the device's company
+	var grpCompanyID uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT company_id FROM grp WHERE id=$1`, d.GrpID).Scan(&grpCompanyID)
+	if err == sql.ErrNoRows || (err == nil && grpCompanyID != d.CompanyID) {
+		mdb.logger.Println("[CreateDevice] group not found for company:", d.GrpID, d.CompanyID)
+		err = ErrGroupNotExist
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[CreateDevice] failed to look up group:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
 	insertDeviceQuery := `
-		INSERT INTO device (grp_id, company_id, device_name, device_type, device_description, longitude, latitude)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO device (grp_id, company_id, device_name, device_type, device_description, longitude, latitude, telemetry_data_schema, device_secret_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id
 	`
-	err = tx.QueryRow(
+	err = tx.QueryRowContext(ctx,
 		insertDeviceQuery,
 		d.GrpID,
 		d.CompanyID,
@@ -39,39 +73,64 @@ func (mdb *MetadataDb) CreateDevice(d *types.Device) error {
 		d.DeviceDescription,
 		d.DeviceLocation.Longitude,
 		d.DeviceLocation.Latitude,
+		schemaJSON,
+		types.HashDeviceSecret(secret),
 	).Scan(&d.ID)
 	if err != nil {
+		if isUniqueViolation(err) {
+			mdb.logger.Println("[CreateDevice] device name taken in group:", d.DeviceName)
+			err = ErrDeviceExists
+			return err
+		}
 		mdb.logger.Println("[CreateDevice] failed to insert device:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	mdb.logger.Println("[CreateDevice] device inserted with ID:", d.ID)
 
-	_, err = tx.Exec(`UPDATE grp SET no_of_devices = no_of_devices + 1 WHERE id=$1`, d.GrpID)
+	_, err = tx.ExecContext(ctx, `INSERT INTO device_schema (device_id, version, telemetry_data_schema) VALUES ($1, 1, $2)`, d.ID, schemaJSON)
+	if err != nil {
+		mdb.logger.Println("[CreateDevice] failed to insert schema version:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE grp SET no_of_devices = no_of_devices + 1 WHERE id=$1`, d.GrpID)
 	if err != nil {
 		mdb.logger.Println("[CreateDevice] failed to update grp count:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	_, err = tx.Exec(`UPDATE company SET no_of_devices = no_of_devices + 1 WHERE id=$1`, d.CompanyID)
+	_, err = tx.ExecContext(ctx, `UPDATE company SET no_of_devices = no_of_devices + 1 WHERE id=$1`, d.CompanyID)
 	if err != nil {
 		mdb.logger.Println("[CreateDevice] failed to update company count:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	after := types.DeviceState(d)
+	after.SchemaVersion = 1
+	if err = mdb.audit(ctx, tx, d.CompanyID, types.AuditDeviceCreate, d.ID, nil, after); err != nil {
+		return err
 	}
 
 	if err = tx.Commit(); err != nil {
 		mdb.logger.Println("[CreateDevice] failed to commit transaction:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
+	d.SchemaVersion = 1
+	d.LastSeenAt, d.Status = nil, types.DeviceNeverSeen
+	// Handed out once, only the hash is kept
+	d.DeviceSecret = secret
+	d.Shadow = types.Shadow{Desired: types.ShadowState{}, Reported: types.ShadowState{}}
+
 	mdb.logger.Println("[CreateDevice] device created successfully:", d.DeviceName)
 	return nil
 }
 
-func (mdb *MetadataDb) DeleteDevice(d *types.Device) error {
-	tx, err := mdb.dbConn.Begin()
+func (mdb *MetadataDb) DeleteDevice(ctx context.Context, d *types.Device) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
 	if err != nil {
 		mdb.logger.Println("[DeleteDevice] failed to begin transaction:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer func() {
 		if err != nil {
@@ -80,104 +139,246 @@ func (mdb *MetadataDb) DeleteDevice(d *types.Device) error {
 		}
 	}()
 
-	deleteDeviceQuery := `DELETE FROM device WHERE id=$1`
-	res, err := tx.Exec(deleteDeviceQuery, d.ID)
+	before, err := mdb.lockDevice(ctx, tx, d)
 	if err != nil {
-		mdb.logger.Println("[DeleteDevice] failed to delete device:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		mdb.logger.Println("[DeleteDevice] failed to read device:", err)
+		return err
 	}
 
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		mdb.logger.Println("[DeleteDevice] device not found with ID:", d.ID)
-		return fmt.Errorf(ErrDeviceNotExist.Error(), d.ID)
+	_, err = tx.ExecContext(ctx, `DELETE FROM device WHERE id=$1`, d.ID)
+	if err != nil {
+		mdb.logger.Println("[DeleteDevice] failed to delete device:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	mdb.logger.Println("[DeleteDevice] device deleted with ID:", d.ID)
 
-	_, err = tx.Exec(`UPDATE grp SET no_of_devices = no_of_devices - 1 WHERE id=$1`, d.GrpID)
+	// Telemetry has no foreign key on the device
+	_, err = tx.ExecContext(ctx, `DELETE FROM data WHERE company_id=$1 AND device_id=$2`, d.CompanyID, d.ID)
+	if err != nil {
+		mdb.logger.Println("[DeleteDevice] failed to delete telemetry:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE grp SET no_of_devices = no_of_devices - 1 WHERE id=$1`, before.GrpID)
 	if err != nil {
 		mdb.logger.Println("[DeleteDevice] failed to decrement grp count:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	_, err = tx.Exec(`UPDATE company SET no_of_devices = no_of_devices - 1 WHERE id=$1`, d.CompanyID)
+	_, err = tx.ExecContext(ctx, `UPDATE company SET no_of_devices = no_of_devices - 1 WHERE id=$1`, d.CompanyID)
 	if err != nil {
 		mdb.logger.Println("[DeleteDevice] failed to decrement company count:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = mdb.audit(ctx, tx, d.CompanyID, types.AuditDeviceDelete, d.ID, before, nil); err != nil {
+		return err
 	}
 
 	if err = tx.Commit(); err != nil {
 		mdb.logger.Println("[DeleteDevice] failed to commit transaction:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
 	mdb.logger.Println("[DeleteDevice] device deleted successfully:", d.DeviceName)
 	return nil
 }
 
-func (mdb *MetadataDb) UpdateDeviceLocation(d *types.Device, l *types.Location) error {
-	query := `UPDATE device SET longitude=$1, latitude=$2 WHERE id=$3`
-	res, err := mdb.dbConn.Exec(query, l.Longitude, l.Latitude, d.ID)
+func (mdb *MetadataDb) UpdateDeviceLocation(ctx context.Context, d *types.Device, l *types.Location) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceLocation] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before, err := mdb.lockDevice(ctx, tx, d)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceLocation] failed to read device:", err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE device SET longitude=$1, latitude=$2 WHERE id=$3`, l.Longitude, l.Latitude, d.ID)
 	if err != nil {
 		mdb.logger.Println("[UpdateDeviceLocation] failed to update location:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		mdb.logger.Println("[UpdateDeviceLocation] device not found with ID:", d.ID)
-		return fmt.Errorf(ErrDeviceNotExist.Error(), d.ID)
+	after := *before
+	after.DeviceLocation = *l
+	if err = mdb.audit(ctx, tx, d.CompanyID, types.AuditDeviceLocation, d.ID, before, after); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[UpdateDeviceLocation] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
 	mdb.logger.Println("[UpdateDeviceLocation] device location updated for:", d.DeviceName)
 	return nil
 }
 
-// UpdateDeviceSchema updates the telemetry schema JSON field of a device
-func (mdb *MetadataDb) UpdateDeviceSchema(d *types.Device, schema *types.TelemetrySchema) (err error) {
-	// Validate schema
-	validTypes := map[string]bool{
-		"int":    true,
-		"float":  true,
-		"bool":   true,
-		"string": true,
+// UpdateDeviceSchema saves schema as the next schema version of a device. Only
+// added fields are allowed unless force is set, an unchanged schema is a no-op.
+func (mdb *MetadataDb) UpdateDeviceSchema(ctx context.Context, d *types.Device, schema *types.TelemetrySchema, force bool) (err error) {
+	if err := types.ValidateSchema(*schema); err != nil {
+		mdb.logger.Println("[UpdateDeviceSchema] invalid schema:", err)
+		return err
+	}
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceSchema] failed to marshal schema:", err)
+		return fmt.Errorf("%w: %v", ErrInvalidSchema, err)
 	}
 
-	for field, typ := range *schema {
-		if len(field) > 32 {
-			mdb.logger.Println("[UpdateDeviceSchema] invalid field name length:", field)
-			return fmt.Errorf("field name '%s' exceeds 32 characters", field)
-		}
-		if !validTypes[typ] {
-			mdb.logger.Println("[UpdateDeviceSchema] invalid type for field:", field, "type:", typ)
-			return fmt.Errorf("invalid type '%s' for field '%s'", typ, field)
-		}
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceSchema] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
 
-	// Marshal schema into JSON
-	schemaJSON, err := json.Marshal(schema)
+	// Lock the row so concurrent updates get consecutive versions
+	before, err := mdb.lockDevice(ctx, tx, d)
 	if err != nil {
-		mdb.logger.Println("[UpdateDeviceSchema] failed to marshal schema:", err)
-		return fmt.Errorf("failed to marshal schema: %w", err)
+		mdb.logger.Println("[UpdateDeviceSchema] failed to read device:", err)
+		return err
+	}
+	current, version := before.TelemetryDataSchema, before.SchemaVersion
+
+	if types.SchemaEqual(current, *schema) {
+		_ = tx.Rollback()
+		d.TelemetryDataSchema = current
+		d.SchemaVersion = version
+		return nil
+	}
+	incompatible := types.CheckSchemaChange(current, *schema)
+	if incompatible != nil && !force {
+		err = incompatible
+		return err
 	}
 
-	// Update DB
-	query := `UPDATE device SET telemetry_data_schema = $1 WHERE id = $2`
-	res, err := mdb.dbConn.Exec(query, schemaJSON, d.ID)
+	version++
+	_, err = tx.ExecContext(ctx, `UPDATE device SET telemetry_data_schema = $1, schema_version = $2 WHERE id = $3`, schemaJSON, version, d.ID)
 	if err != nil {
 		mdb.logger.Println("[UpdateDeviceSchema] failed to update schema in DB:", err)
-		return fmt.Errorf("db error: %w", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO device_schema (device_id, version, telemetry_data_schema, forced) VALUES ($1, $2, $3, $4)
+	`, d.ID, version, schemaJSON, incompatible != nil)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceSchema] failed to insert schema version:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	after := *before
+	after.TelemetryDataSchema, after.SchemaVersion = *schema, version
+	if err = mdb.audit(ctx, tx, d.CompanyID, types.AuditDeviceSchema, d.ID, before, after); err != nil {
+		return err
 	}
 
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		mdb.logger.Println("[UpdateDeviceSchema] device not found with ID:", d.ID)
-		return fmt.Errorf("device with id %s does not exist", d.ID)
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[UpdateDeviceSchema] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
 	// Update local struct copy
 	d.TelemetryDataSchema = *schema
+	d.SchemaVersion = version
 
-	mdb.logger.Println("[UpdateDeviceSchema] schema updated successfully for device:", d.DeviceName)
+	mdb.logger.Println("[UpdateDeviceSchema] schema updated to version", version, "for device:", d.DeviceName)
 	return nil
 }
+
+// RotateDeviceSecret replaces the device secret and returns the new one
+func (mdb *MetadataDb) RotateDeviceSecret(ctx context.Context, d *types.Device) (string, error) {
+	secret, err := types.NewDeviceSecret()
+	if err != nil {
+		mdb.logger.Println("[RotateDeviceSecret] failed to generate device secret:", err)
+		return "", err
+	}
+
+	if err := mdb.setDeviceSecretHash(ctx, d, types.HashDeviceSecret(secret), types.AuditDeviceSecretRotate); err != nil {
+		mdb.logger.Println("[RotateDeviceSecret] failed to update secret:", err)
+		return "", err
+	}
+
+	d.DeviceSecret = secret
+	mdb.logger.Println("[RotateDeviceSecret] secret rotated for device:", d.ID)
+	return secret, nil
+}
+
+// RevokeDeviceSecret clears the device secret so the device can no longer authenticate
+func (mdb *MetadataDb) RevokeDeviceSecret(ctx context.Context, d *types.Device) error {
+	if err := mdb.setDeviceSecretHash(ctx, d, nil, types.AuditDeviceSecretRevoke); err != nil {
+		mdb.logger.Println("[RevokeDeviceSecret] failed to revoke secret:", err)
+		return err
+	}
+
+	d.DeviceSecret = ""
+	mdb.logger.Println("[RevokeDeviceSecret] secret revoked for device:", d.ID)
+	return nil
+}
+
+// setDeviceSecretHash stores hash, nil for none, as the secret of a device of
+// d's company. The event leaves the secret out, only that it changed is kept.
+func (mdb *MetadataDb) setDeviceSecretHash(ctx context.Context, d *types.Device, hash any, action string) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, `UPDATE device SET device_secret_hash=$1 WHERE id=$2 AND company_id=$3`, hash, d.ID, d.CompanyID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		err = ErrDeviceNotExist
+		return err
+	}
+
+	if err = mdb.audit(ctx, tx, d.CompanyID, action, d.ID, nil, nil); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+// lockDevice reads the audited state of a device of d's company and locks its row until tx ends
+func (mdb *MetadataDb) lockDevice(ctx context.Context, tx *sql.Tx, d *types.Device) (*types.Device, error) {
+	s := &types.Device{ID: d.ID, CompanyID: d.CompanyID}
+	var schemaJSON []byte
+	err := tx.QueryRowContext(ctx, `
+		SELECT grp_id, device_name, device_type, device_description, longitude, latitude, telemetry_data_schema, schema_version
+		FROM device WHERE id = $1 AND company_id = $2 FOR UPDATE
+	`, d.ID, d.CompanyID).Scan(&s.GrpID, &s.DeviceName, &s.DeviceType, &s.DeviceDescription,
+		&s.DeviceLocation.Longitude, &s.DeviceLocation.Latitude, &schemaJSON, &s.SchemaVersion)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotExist, d.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err := json.Unmarshal(schemaJSON, &s.TelemetryDataSchema); err != nil {
+		return nil, fmt.Errorf("%w: failed to unmarshal schema: %w", ErrDbErrorGeneric, err)
+	}
+	return s, nil
+}
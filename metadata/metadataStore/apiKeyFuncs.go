@@ -0,0 +1,206 @@
+package metadatastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+// apiKeyUseInterval is how precise last_used_at is, a busy key is not written on every request
+const apiKeyUseInterval = time.Minute
+
+const apiKeyColumns = `id, company_id, grp_id, name, read_only, created_by, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row rowScanner) (*types.APIKey, error) {
+	k := &types.APIKey{}
+	var grpID, createdBy uuid.NullUUID
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&k.ID, &k.CompanyID, &grpID, &k.Name, &k.ReadOnly, &createdBy, &k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	k.GrpID = grpID.UUID
+	k.CreatedBy = createdBy.UUID
+	k.ExpiresAt = timeOrNil(expiresAt)
+	k.LastUsedAt = timeOrNil(lastUsedAt)
+	k.RevokedAt = timeOrNil(revokedAt)
+	return k, nil
+}
+
+func timeOrNil(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// CreateAPIKey checks that a group scoped key names a group of its company
+func (mdb *MetadataDb) CreateAPIKey(ctx context.Context, k *types.APIKey, keyHash string) error {
+	if !types.IsValidName(k.Name) {
+		mdb.logger.Println("[CreateAPIKey] invalid key name:", k.Name)
+		return ErrInvalidName
+	}
+
+	grpID := uuid.NullUUID{UUID: k.GrpID, Valid: k.GrpID != uuid.Nil}
+	createdBy := uuid.NullUUID{UUID: k.CreatedBy, Valid: k.CreatedBy != uuid.Nil}
+	var expiresAt sql.NullTime
+	if k.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: k.ExpiresAt.UTC(), Valid: true}
+	}
+
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[CreateAPIKey] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO api_key (company_id, grp_id, name, key_hash, read_only, created_by, expires_at)
+		SELECT $1, $2, $3, $4, $5, $6, $7
+		WHERE $2::uuid IS NULL OR EXISTS (SELECT 1 FROM grp WHERE id = $2 AND company_id = $1)
+		RETURNING id, created_at
+	`, k.CompanyID, grpID, k.Name, keyHash, k.ReadOnly, createdBy, expiresAt).Scan(&k.ID, &k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[CreateAPIKey] group not found for company:", k.GrpID, k.CompanyID)
+		err = ErrGroupNotExist
+		return err
+	}
+	if isForeignKeyViolation(err) {
+		mdb.logger.Println("[CreateAPIKey] company or creating user not found:", k.CompanyID)
+		err = ErrCompanyNoExist
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[CreateAPIKey] error creating api key:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if k.ExpiresAt != nil {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	k.LastUsedAt, k.RevokedAt = nil, nil
+
+	if err = mdb.audit(ctx, tx, k.CompanyID, types.AuditAPIKeyCreate, k.ID, nil, k); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[CreateAPIKey] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (mdb *MetadataDb) VerifyAPIKey(ctx context.Context, keyHash string, now time.Time) (*types.APIKey, error) {
+	k, err := scanAPIKey(mdb.dbConn.QueryRowContext(ctx, `
+		SELECT `+apiKeyColumns+` FROM api_key
+		WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > $2)
+	`, keyHash, now))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, types.ErrInvalidAPIKey
+	}
+	if err != nil {
+		mdb.logger.Println("[VerifyAPIKey] error querying api key:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyUseInterval {
+		// Failing to record the use must not fail the request
+		_, err = mdb.dbConn.ExecContext(ctx, `UPDATE api_key SET last_used_at = $2 WHERE id = $1`, k.ID, now.UTC())
+		if err != nil {
+			mdb.logger.Println("[VerifyAPIKey] error recording last use:", err)
+		} else {
+			used := now.UTC()
+			k.LastUsedAt = &used
+		}
+	}
+	return k, nil
+}
+
+func (mdb *MetadataDb) ListAPIKeysByCompany(ctx context.Context, companyID string) ([]*types.APIKey, error) {
+	if _, err := uuid.Parse(companyID); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidID, companyID)
+	}
+
+	rows, err := mdb.dbConn.QueryContext(ctx, `
+		SELECT `+apiKeyColumns+` FROM api_key
+		WHERE company_id = $1
+		ORDER BY created_at
+	`, companyID)
+	if err != nil {
+		mdb.logger.Println("[ListAPIKeysByCompany] error querying api keys:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var keys []*types.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			mdb.logger.Println("[ListAPIKeysByCompany] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		mdb.logger.Println("[ListAPIKeysByCompany] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey keeps the first revocation time when a key is revoked twice
+func (mdb *MetadataDb) RevokeAPIKey(ctx context.Context, k *types.APIKey) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[RevokeAPIKey] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before, err := scanAPIKey(tx.QueryRowContext(ctx, `
+		SELECT `+apiKeyColumns+` FROM api_key WHERE id = $1 AND company_id = $2 FOR UPDATE
+	`, k.ID, k.CompanyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("%w: %s", types.ErrAPIKeyNotFound, k.ID)
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[RevokeAPIKey] error reading api key:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	revoked, err := scanAPIKey(tx.QueryRowContext(ctx, `
+		UPDATE api_key SET revoked_at = COALESCE(revoked_at, now())
+		WHERE id = $1
+		RETURNING `+apiKeyColumns,
+		k.ID))
+	if err != nil {
+		mdb.logger.Println("[RevokeAPIKey] error revoking api key:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = mdb.audit(ctx, tx, k.CompanyID, types.AuditAPIKeyRevoke, k.ID, before, revoked); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[RevokeAPIKey] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	*k = *revoked
+	return nil
+}
@@ -0,0 +1,108 @@
+package metadatastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	auditlog "github.com/mukundvijay123/KCloud/metadata/auditLog"
+)
+
+// audit writes the event of a change made with ctx into tx, so it commits or
+// rolls back with the change. before and after are the resource around it.
+func (mdb *MetadataDb) audit(ctx context.Context, tx *sql.Tx, companyID uuid.UUID, action string, resourceID uuid.UUID, before, after any) error {
+	if err := auditlog.Write(ctx, tx, companyID, action, resourceID, before, after); err != nil {
+		mdb.logger.Println("[audit] error writing event:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func nullUUID(id uuid.UUID) uuid.NullUUID {
+	return uuid.NullUUID{UUID: id, Valid: id != uuid.Nil}
+}
+
+const auditColumns = `id, company_id, actor_user_id, actor_api_key_id, action, resource_id, before, after, request_id, created_at`
+
+func scanAuditEvent(row rowScanner) (*types.AuditEvent, error) {
+	e := &types.AuditEvent{}
+	var userID, apiKeyID uuid.NullUUID
+	var before, after []byte
+	var requestID sql.NullString
+	err := row.Scan(&e.ID, &e.CompanyID, &userID, &apiKeyID, &e.Action, &e.ResourceID, &before, &after, &requestID, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	e.ActorUserID = userID.UUID
+	e.ActorAPIKeyID = apiKeyID.UUID
+	e.Before, e.After = before, after
+	e.RequestID = requestID.String
+	return e, nil
+}
+
+func (mdb *MetadataDb) ListAuditEvents(ctx context.Context, companyID string, f *types.AuditFilter) ([]*types.AuditEvent, string, error) {
+	if _, err := uuid.Parse(companyID); err != nil {
+		return nil, "", fmt.Errorf("%w: %q", ErrInvalidID, companyID)
+	}
+	f, err := f.Normalize()
+	if err != nil {
+		return nil, "", err
+	}
+
+	args := []interface{}{companyID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	query := `SELECT ` + auditColumns + ` FROM audit_event WHERE company_id = $1`
+	if f.Action != "" {
+		query += ` AND action = ` + arg(f.Action)
+	}
+	if f.ResourceID != uuid.Nil {
+		query += ` AND resource_id = ` + arg(f.ResourceID)
+	}
+	if f.ActorID != uuid.Nil {
+		n := arg(f.ActorID)
+		query += fmt.Sprintf(` AND (actor_user_id = %s OR actor_api_key_id = %s)`, n, n)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND created_at >= ` + arg(f.Since)
+	}
+	if !f.Until.IsZero() {
+		query += ` AND created_at < ` + arg(f.Until)
+	}
+	if f.Cursor != "" {
+		at, id, _ := types.DecodeAuditCursor(f.Cursor) //checked by Normalize
+		query += fmt.Sprintf(` AND (created_at, id) < (%s, %s)`, arg(at), arg(id))
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ` + arg(f.Limit+1)
+
+	rows, err := mdb.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		mdb.logger.Println("[ListAuditEvents] query error:", err)
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var events []*types.AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			mdb.logger.Println("[ListAuditEvents] scan error:", err)
+			return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		mdb.logger.Println("[ListAuditEvents] rows error:", err)
+		return nil, "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if len(events) <= f.Limit {
+		return events, "", nil
+	}
+	events = events[:f.Limit]
+	return events, types.EncodeCursor(types.AuditCursor(events[len(events)-1])), nil
+}
@@ -1,132 +1,100 @@
 package metadatastore
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 	types "github.com/mukundvijay123/KCloud/metadata"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
 )
 
 // adding a  company to metadata store
-func (mdb *MetadataDb) CreateCompany(c *types.Company) error {
+func (mdb *MetadataDb) CreateCompany(ctx context.Context, c *types.Company) error {
 
-	if !isValidName(c.CompanyName) || !isValidName(c.Username) {
+	if !types.IsValidName(c.CompanyName) || !types.IsValidName(c.Username) {
 		mdb.logger.Println("invalid company or username: ", c.CompanyName)
 		return ErrInvalidName
 	}
 
-	if !isValidPasswd(c.CompanyPassword) {
+	if !types.IsValidPassword(c.CompanyPassword) {
 		mdb.logger.Println("invalid password")
 		return ErrInvalidPasswd
 	}
 
-	tx, err := mdb.dbConn.Begin()
+	passwordHash, err := types.HashPassword(c.CompanyPassword)
 	if err != nil {
-		mdb.logger.Println("Error creating a transaction: ", err)
-	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-		}
-	}()
-
-	insertCompanyQuery := `INSERT INTO company (company_name, username, company_password, no_of_grps, no_of_devices) 
-                    VALUES ($1, $2, $3, $4, $5) RETURNING id`
-
-	err = tx.QueryRow(insertCompanyQuery, c.CompanyName, c.Username, c.CompanyPassword, c.NoOfGrps, c.NoOfDevices).Scan(&c.ID)
-	if err != nil {
-		mdb.logger.Println("Error creating company: ", ErrDbErrorGeneric.Error(), err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
-	}
-
-	//If required communicate to storage engine here
-	//Functionality to be added later
-	if err = tx.Commit(); err != nil {
-		mdb.logger.Println(ErrDbErrorGeneric)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
-	}
-	mdb.logger.Println("Company provisioned successfully")
-
-	return nil
-}
-
-// Delete a  company entry from metadata store
-func (mdb *MetadataDb) DeleteCompany(c *types.Company) error {
-	if !isValidName(c.Username) {
-		mdb.logger.Println("invalid company or username: ", c.CompanyName)
-		return ErrInvalidName
+		mdb.logger.Println("Error hashing password: ", err)
+		return err
 	}
 
-	if !isValidPasswd(c.CompanyPassword) {
-		mdb.logger.Println("invalid password")
-		return ErrInvalidPasswd
-	}
-	tx, err := mdb.dbConn.Begin()
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
 	if err != nil {
 		mdb.logger.Println("Error creating a transaction: ", err)
-		return fmt.Errorf("%w", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
-
 	defer func() {
 		if err != nil {
 			_ = tx.Rollback()
 		}
 	}()
 
-	var dbPassword string
-	queryCheck := `SELECT company_password FROM company WHERE username = $1`
-	err = tx.QueryRow(queryCheck, c.Username).Scan(&dbPassword)
+	insertCompanyQuery := `INSERT INTO company (company_name, username, no_of_grps, no_of_devices) 
+                    VALUES ($1, $2, $3, $4) RETURNING id`
 
-	if err == sql.ErrNoRows {
-		mdb.logger.Println(ErrCompanyNoExist, c.Username)
-		return ErrCompanyNoExist
+	err = tx.QueryRowContext(ctx, insertCompanyQuery, c.CompanyName, c.Username, c.NoOfGrps, c.NoOfDevices).Scan(&c.ID)
+	if isUniqueViolation(err) {
+		mdb.logger.Println("Company or username already taken: ", c.CompanyName, c.Username)
+		err = ErrCompanyExists
+		return err
 	}
 	if err != nil {
-		mdb.logger.Println(ErrDbErrorGeneric, err)
-		return ErrDbErrorGeneric
+		mdb.logger.Println("Error creating company: ", ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	// simple password match (better: hash+compare, not plain text)
-	if dbPassword != c.CompanyPassword {
-		mdb.logger.Println("Invalid password for company:", c.Username)
-		return ErrInvalidPasswd
+	// The company login is its first owner, the username may already belong to a user
+	var ownerID uuid.UUID
+	insertOwnerQuery := `INSERT INTO app_user (company_id, username, password_hash, role) VALUES ($1, $2, $3, $4) RETURNING id`
+	err = tx.QueryRowContext(ctx, insertOwnerQuery, c.ID, c.Username, passwordHash, types.RoleOwner).Scan(&ownerID)
+	if isUniqueViolation(err) {
+		mdb.logger.Println("Username already taken by a user: ", c.Username)
+		err = ErrCompanyExists
+		return err
 	}
-
-	deleteQuery := `DELETE FROM company WHERE username = $1`
-	_, err = tx.Exec(deleteQuery, c.Username)
 	if err != nil {
-		mdb.logger.Println(ErrDbErrorGeneric, err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		mdb.logger.Println("Error creating owner: ", ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	if commitErr := tx.Commit(); commitErr != nil {
-		mdb.logger.Println("Error committing delete transaction:", commitErr)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), commitErr)
+	// Signups have no actor yet, the new owner is it
+	ctx = types.WithDefaultActor(ctx, ownerID)
+	if err = mdb.audit(ctx, tx, c.ID, types.AuditCompanyCreate, c.ID, nil, types.CompanyState(c)); err != nil {
+		return err
 	}
 
-	mdb.logger.Println("Company deleted successfully:", c.Username)
+	//If required communicate to storage engine here
+	//Functionality to be added later
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println(ErrDbErrorGeneric)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	// Dont keep the plaintext around once it is stored
+	c.CompanyPassword = ""
+	mdb.logger.Println("Company provisioned successfully")
+
 	return nil
 }
 
-func (mdb *MetadataDb) UpdatePassword(c *types.Company, newPassword string) error {
-	// Validate inputs
-	if !isValidName(c.Username) {
-		mdb.logger.Println("invalid username:", c.Username)
-		return ErrInvalidName
-	}
-	if !isValidPasswd(c.CompanyPassword) {
-		mdb.logger.Println("invalid current password")
-		return ErrInvalidPasswd
-	}
-	if !isValidPasswd(newPassword) {
-		mdb.logger.Println("invalid new password")
-		return ErrInvalidPasswd
-	}
-
-	tx, err := mdb.dbConn.Begin()
+// DeleteCompany deletes a company, its users, groups and devices go with it.
+// Callers check that an owner asked for it.
+func (mdb *MetadataDb) DeleteCompany(ctx context.Context, c *types.Company) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
 	if err != nil {
-		mdb.logger.Println("Error creating transaction:", err)
-		return fmt.Errorf("%w", err)
+		mdb.logger.Println("Error creating a transaction: ", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer func() {
 		if err != nil {
@@ -134,41 +102,38 @@ func (mdb *MetadataDb) UpdatePassword(c *types.Company, newPassword string) erro
 		}
 	}()
 
-	// Verify old password
-	var dbPassword string
-	queryCheck := `SELECT company_password FROM company WHERE username = $1`
-	err = tx.QueryRow(queryCheck, c.Username).Scan(&dbPassword)
+	before := types.Company{ID: c.ID}
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM company WHERE id = $1 RETURNING company_name, username, no_of_grps, no_of_devices
+	`, c.ID).Scan(&before.CompanyName, &before.Username, &before.NoOfGrps, &before.NoOfDevices)
 	if err == sql.ErrNoRows {
-		mdb.logger.Println("Company not found for username:", c.Username)
-		return fmt.Errorf("company not found")
+		mdb.logger.Println(ErrCompanyNoExist, c.ID)
+		err = ErrCompanyNoExist
+		return err
 	}
 	if err != nil {
-		mdb.logger.Println("Error checking company:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		mdb.logger.Println(ErrDbErrorGeneric, err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	if dbPassword != c.CompanyPassword {
-		mdb.logger.Println("Incorrect current password for username:", c.Username)
-		return ErrInvalidPasswd
+	// Telemetry has no foreign key on the company, its partition goes with it.
+	// Dropping it locks "data" until the commit, deletes are rare enough
+	partition := pq.QuoteIdentifier(storageengine.PartitionName(c.ID))
+	if _, err = tx.ExecContext(ctx, `DROP TABLE IF EXISTS `+partition); err != nil {
+		mdb.logger.Println("Error dropping the telemetry partition:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	// Update password
-	updateQuery := `UPDATE company SET company_password = $1 WHERE username = $2`
-	_, err = tx.Exec(updateQuery, newPassword, c.Username)
-	if err != nil {
-		mdb.logger.Println("Error updating password:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+	// The event outlives the company, audit_event has no foreign key on it
+	if err = mdb.audit(ctx, tx, c.ID, types.AuditCompanyDelete, c.ID, before, nil); err != nil {
+		return err
 	}
 
-	// Commit
 	if err = tx.Commit(); err != nil {
-		mdb.logger.Println("Error committing password update:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		mdb.logger.Println(ErrDbErrorGeneric, err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	// Update in-memory struct
-	c.CompanyPassword = newPassword
-	mdb.logger.Println("Password updated successfully for username:", c.Username)
-
+	mdb.logger.Println("Company deleted successfully:", c.ID)
 	return nil
 }
@@ -1,11 +1,21 @@
 package metadatastore
 
-import "errors"
+import (
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatareader "github.com/mukundvijay123/KCloud/metadata/metadataReader"
+)
 
 var (
-	ErrInvalidName    = errors.New("invalid company  or username")
-	ErrInvalidPasswd  = errors.New("invalid password")
-	ErrDbErrorGeneric = errors.New("database error: ")
-	ErrCompanyNoExist = errors.New("comapny doesnt exist")
-	ErrDeviceNotExist = errors.New("device doesnt exist")
+	ErrInvalidName    = types.NewError(types.ErrValidation, "invalid company  or username")
+	ErrInvalidPasswd  = types.NewError(types.ErrValidation, "invalid password")
+	ErrWrongPasswd    = types.NewError(types.ErrUnauthorized, "incorrect password")
+	ErrDbErrorGeneric = metadatareader.ErrDbErrorGeneric
+	ErrCompanyNoExist = metadatareader.ErrComanyNotFound
+	ErrDeviceNotExist = metadatareader.ErrDeviceNotFound
+	ErrGroupNotExist  = metadatareader.ErrGroupNotFound
+	ErrInvalidID      = metadatareader.ErrInvalidID
+	ErrDeviceExists   = types.NewError(types.ErrConflict, "device with this name already exists in the group")
+	ErrInvalidSchema  = types.ErrInvalidSchema
+	ErrCompanyExists  = types.NewError(types.ErrConflict, "company or username already taken")
+	ErrGroupExists    = types.NewError(types.ErrConflict, "group with this name already exists in the company")
 )
@@ -1,21 +1,28 @@
 package metadatastore
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 
 	types "github.com/mukundvijay123/KCloud/metadata"
 )
 
-func (mdb *MetadataDb) CreateGroup(g *types.Grp) error {
-	if !isValidName(g.GroupName) {
+func (mdb *MetadataDb) CreateGroup(ctx context.Context, g *types.Grp) error {
+	if !types.IsValidName(g.GroupName) {
 		mdb.logger.Println("invalid group name:", g.GroupName)
 		return ErrInvalidName
 	}
+	heartbeat, err := types.NormalizeHeartbeat(g.HeartbeatSeconds)
+	if err != nil {
+		return err
+	}
+	g.HeartbeatSeconds = heartbeat
 
-	tx, err := mdb.dbConn.Begin()
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
 	if err != nil {
 		mdb.logger.Println("Error creating transaction:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer func() {
 		if err != nil {
@@ -25,44 +32,53 @@ func (mdb *MetadataDb) CreateGroup(g *types.Grp) error {
 
 	// Insert the group
 	insertGroupQuery := `
-		INSERT INTO grp (company_id, group_name, no_of_devices)
-		VALUES ($1, $2, $3) RETURNING id
+		INSERT INTO grp (company_id, grp_name, no_of_devices, heartbeat_timeout)
+		VALUES ($1, $2, $3, $4) RETURNING id
 	`
-	err = tx.QueryRow(insertGroupQuery, g.CompanyID, g.GroupName, g.NoOfDevices).Scan(&g.ID)
+	err = tx.QueryRowContext(ctx, insertGroupQuery, g.CompanyID, g.GroupName, g.NoOfDevices, g.HeartbeatSeconds).Scan(&g.ID)
+	if isUniqueViolation(err) {
+		mdb.logger.Println("Group name already taken:", g.GroupName)
+		err = ErrGroupExists
+		return err
+	}
+	if isForeignKeyViolation(err) {
+		mdb.logger.Println("Company not found for group:", g.CompanyID)
+		err = ErrCompanyNoExist
+		return err
+	}
 	if err != nil {
 		mdb.logger.Println("Error inserting group:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
 	// Increment company's group count
 	updateCompanyQuery := `
 		UPDATE company SET no_of_grps = no_of_grps + 1 WHERE id = $1
 	`
-	_, err = tx.Exec(updateCompanyQuery, g.CompanyID)
+	_, err = tx.ExecContext(ctx, updateCompanyQuery, g.CompanyID)
 	if err != nil {
 		mdb.logger.Println("Error updating company group count:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = mdb.audit(ctx, tx, g.CompanyID, types.AuditGroupCreate, g.ID, nil, g); err != nil {
+		return err
 	}
 
 	if err = tx.Commit(); err != nil {
 		mdb.logger.Println("Error committing group creation:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
 	mdb.logger.Println("Group created successfully:", g.GroupName)
 	return nil
 }
 
-func (mdb *MetadataDb) DeleteGroup(g *types.Grp) error {
-	if !isValidName(g.GroupName) {
-		mdb.logger.Println("invalid group name:", g.GroupName)
-		return ErrInvalidName
-	}
-
-	tx, err := mdb.dbConn.Begin()
+func (mdb *MetadataDb) DeleteGroup(ctx context.Context, g *types.Grp) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
 	if err != nil {
 		mdb.logger.Println("Error creating transaction:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 	defer func() {
 		if err != nil {
@@ -70,35 +86,101 @@ func (mdb *MetadataDb) DeleteGroup(g *types.Grp) error {
 		}
 	}()
 
-	// Delete group by ID + CompanyID
-	deleteQuery := `DELETE FROM grp WHERE id = $1 AND company_id = $2`
-	res, err := tx.Exec(deleteQuery, g.ID, g.CompanyID)
+	// Telemetry has no foreign key on the devices, remove it before they cascade away
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM data WHERE company_id = $1 AND device_id IN (SELECT id FROM device WHERE grp_id = $2 AND company_id = $1)
+	`, g.CompanyID, g.ID)
 	if err != nil {
-		mdb.logger.Println("Error deleting group:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		mdb.logger.Println("Error deleting group telemetry:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
+	// Delete group by ID + CompanyID, its devices go with it (ON DELETE CASCADE)
+	before := types.Grp{ID: g.ID, CompanyID: g.CompanyID}
+	deleteQuery := `DELETE FROM grp WHERE id = $1 AND company_id = $2 RETURNING grp_name, no_of_devices, heartbeat_timeout`
+	err = tx.QueryRowContext(ctx, deleteQuery, g.ID, g.CompanyID).Scan(&before.GroupName, &before.NoOfDevices, &before.HeartbeatSeconds)
+	if err == sql.ErrNoRows {
 		mdb.logger.Println("No group deleted, not found:", g.ID)
-		return fmt.Errorf("group not found")
+		err = ErrGroupNotExist
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("Error deleting group:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
-	// Decrement company's group count
+	// Decrement company's group count and drop the cascaded devices from its device count
 	updateCompanyQuery := `
-		UPDATE company SET no_of_grps = no_of_grps - 1 WHERE id = $1
+		UPDATE company SET no_of_grps = no_of_grps - 1, no_of_devices = no_of_devices - $2 WHERE id = $1
 	`
-	_, err = tx.Exec(updateCompanyQuery, g.CompanyID)
+	_, err = tx.ExecContext(ctx, updateCompanyQuery, g.CompanyID, before.NoOfDevices)
 	if err != nil {
 		mdb.logger.Println("Error updating company group count:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = mdb.audit(ctx, tx, g.CompanyID, types.AuditGroupDelete, g.ID, before, nil); err != nil {
+		return err
 	}
 
 	if err = tx.Commit(); err != nil {
 		mdb.logger.Println("Error committing group deletion:", err)
-		return fmt.Errorf(ErrDbErrorGeneric.Error(), err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
 	}
 
 	mdb.logger.Println("Group deleted successfully:", g.GroupName)
 	return nil
 }
+
+// UpdateGroupHeartbeat sets how long devices of the group may go unseen before they are offline
+func (mdb *MetadataDb) UpdateGroupHeartbeat(ctx context.Context, g *types.Grp, seconds int) error {
+	seconds, err := types.NormalizeHeartbeat(seconds)
+	if err != nil {
+		return err
+	}
+
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("Error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before := types.Grp{ID: g.ID, CompanyID: g.CompanyID}
+	err = tx.QueryRowContext(ctx, `
+		SELECT grp_name, no_of_devices, heartbeat_timeout FROM grp WHERE id = $1 AND company_id = $2 FOR UPDATE
+	`, g.ID, g.CompanyID).Scan(&before.GroupName, &before.NoOfDevices, &before.HeartbeatSeconds)
+	if err == sql.ErrNoRows {
+		mdb.logger.Println("No group updated, not found:", g.ID)
+		err = ErrGroupNotExist
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("Error reading group:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE grp SET heartbeat_timeout = $1 WHERE id = $2`, seconds, g.ID)
+	if err != nil {
+		mdb.logger.Println("Error updating group heartbeat:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	after := before
+	after.HeartbeatSeconds = seconds
+	if err = mdb.audit(ctx, tx, g.CompanyID, types.AuditGroupHeartbeat, g.ID, before, after); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("Error committing group heartbeat:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	g.HeartbeatSeconds = seconds
+	return nil
+}
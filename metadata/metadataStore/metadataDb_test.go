@@ -0,0 +1,87 @@
+package metadatastore_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+	metadatatest "github.com/mukundvijay123/KCloud/metadata/metadataTest"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+// TestConformance runs the suite against the database of KCLOUD_TEST_DSN,
+// migrated to the latest version
+func TestConformance(t *testing.T) {
+	db := metadatatest.OpenTestDb(t)
+	logger := log.New(io.Discard, "", 0)
+
+	metadatatest.RunConformance(t, func(t *testing.T) types.MetadataStore {
+		return metadatastore.NewMetadataDb(db, logger)
+	})
+}
+
+// TestDeleteRemovesTelemetry checks that deleting a device, a group or a
+// company takes their readings along, "data" has no foreign keys to do it
+func TestDeleteRemovesTelemetry(t *testing.T) {
+	db := metadatatest.OpenTestDb(t)
+	logger := log.New(io.Discard, "", 0)
+	s := metadatastore.NewMetadataDb(db, logger)
+	data := storageengine.NewPgDataStore(db, logger)
+	ctx := context.Background()
+
+	devices := metadatatest.MustDevices(t, s, 2)
+	deleted, kept := devices[0], devices[1]
+	for _, d := range devices {
+		r := &storageengine.Reading{CompanyID: d.CompanyID, DeviceID: d.ID, Timestamp: time.Now(), Data: map[string]interface{}{"temp": 1.0}}
+		if err := data.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := s.DeleteDevice(ctx, deleted); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	if _, err := data.Latest(ctx, deleted.CompanyID, deleted.ID); !errors.Is(err, storageengine.ErrNoReadings) {
+		t.Errorf("Latest of the deleted device = %v, want ErrNoReadings", err)
+	}
+	if _, err := data.Latest(ctx, kept.CompanyID, kept.ID); err != nil {
+		t.Errorf("Latest of the other device = %v, want its reading", err)
+	}
+
+	g, err := s.GetGroupByID(ctx, kept.GrpID.String())
+	if err != nil {
+		t.Fatalf("GetGroupByID: %v", err)
+	}
+	if err := s.DeleteGroup(ctx, g); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if _, err := data.Latest(ctx, kept.CompanyID, kept.ID); !errors.Is(err, storageengine.ErrNoReadings) {
+		t.Errorf("Latest of a device of the deleted group = %v, want ErrNoReadings", err)
+	}
+
+	partition := storageengine.PartitionName(kept.CompanyID)
+	if !tableExists(t, ctx, db, partition) {
+		t.Fatalf("partition %s was never created", partition)
+	}
+	if err := s.DeleteCompany(ctx, &types.Company{ID: kept.CompanyID}); err != nil {
+		t.Fatalf("DeleteCompany: %v", err)
+	}
+	if tableExists(t, ctx, db, partition) {
+		t.Errorf("partition %s outlived its company", partition)
+	}
+}
+
+func tableExists(t *testing.T, ctx context.Context, db *sql.DB, name string) bool {
+	t.Helper()
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+		t.Fatalf("looking up %s: %v", name, err)
+	}
+	return exists
+}
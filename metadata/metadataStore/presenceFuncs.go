@@ -0,0 +1,97 @@
+package metadatastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+// RecordDevicesSeen upserts the last seen times in device_presence, never
+// moving one back, and returns the devices that were offline or never seen
+func (mdb *MetadataDb) RecordDevicesSeen(ctx context.Context, seen map[uuid.UUID]time.Time) ([]uuid.UUID, error) {
+	if len(seen) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, 0, len(seen))
+	times := make([]time.Time, 0, len(seen))
+	for id, at := range seen {
+		ids = append(ids, id.String())
+		times = append(times, at.UTC())
+	}
+
+	// prev is read from the snapshot before the upsert, so it holds the old online flags.
+	// Devices deleted since they were seen are dropped by the join.
+	rows, err := mdb.dbConn.QueryContext(ctx, `
+		WITH seen AS (
+			SELECT unnest($1::uuid[]) AS device_id, unnest($2::timestamptz[]) AS at
+		), prev AS (
+			SELECT device_id, online FROM device_presence WHERE device_id = ANY($1::uuid[])
+		), up AS (
+			INSERT INTO device_presence (device_id, last_seen_at, online)
+			SELECT s.device_id, s.at, true FROM seen s JOIN device d ON d.id = s.device_id
+			ON CONFLICT (device_id) DO UPDATE
+			SET last_seen_at = GREATEST(device_presence.last_seen_at, EXCLUDED.last_seen_at), online = true
+			RETURNING device_id
+		)
+		SELECT up.device_id FROM up LEFT JOIN prev ON prev.device_id = up.device_id
+		WHERE prev.online IS NOT TRUE
+	`, pq.Array(ids), pq.Array(times))
+	if err != nil {
+		mdb.logger.Println("[RecordDevicesSeen] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var online []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			mdb.logger.Println("[RecordDevicesSeen] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		online = append(online, id)
+	}
+	if err := rows.Err(); err != nil {
+		mdb.logger.Println("[RecordDevicesSeen] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return online, nil
+}
+
+// MarkDevicesOffline flips the online flag of devices whose group heartbeat
+// timeout passed. Only one instance gets each device, the update locks the rows.
+func (mdb *MetadataDb) MarkDevicesOffline(ctx context.Context, now time.Time) ([]*types.Device, error) {
+	rows, err := mdb.dbConn.QueryContext(ctx, `
+		UPDATE device_presence p SET online = false
+		FROM device d JOIN grp g ON g.id = d.grp_id
+		WHERE p.device_id = d.id AND p.online AND p.last_seen_at <= $1 - g.heartbeat_timeout * interval '1 second'
+		RETURNING p.device_id
+	`, now.UTC())
+	if err != nil {
+		mdb.logger.Println("[MarkDevicesOffline] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			mdb.logger.Println("[MarkDevicesOffline] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		mdb.logger.Println("[MarkDevicesOffline] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return mdb.MetadataDbReader.GetDevicesByIDs(ctx, ids)
+}
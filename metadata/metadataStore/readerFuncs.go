@@ -1,41 +1,53 @@
 package metadatastore
 
-import "github.com/mukundvijay123/KCloud/metadata"
+import (
+	"context"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
 
 // Forwarding methods so *MetadataDb satisfies metadata.MetadataStore
 
-func (mdb *MetadataDb) GetCompanyByID(id string) (*metadata.Company, error) {
-	return mdb.MetadataDbReader.GetCompanyByID(id)
+func (mdb *MetadataDb) GetCompanyByID(ctx context.Context, id string) (*metadata.Company, error) {
+	return mdb.MetadataDbReader.GetCompanyByID(ctx, id)
+}
+
+func (mdb *MetadataDb) GetCompanyByUsername(ctx context.Context, username string) (*metadata.Company, error) {
+	return mdb.MetadataDbReader.GetCompanyByUsername(ctx, username)
+}
+
+func (mdb *MetadataDb) ListCompanies(ctx context.Context, opts *metadata.ListOptions) ([]*metadata.Company, string, error) {
+	return mdb.MetadataDbReader.ListCompanies(ctx, opts)
 }
 
-func (mdb *MetadataDb) GetCompanyByUsername(username string) (*metadata.Company, error) {
-	return mdb.MetadataDbReader.GetCompanyByUsername(username)
+func (mdb *MetadataDb) GetGroupByID(ctx context.Context, id string) (*metadata.Grp, error) {
+	return mdb.MetadataDbReader.GetGroupByID(ctx, id)
 }
 
-func (mdb *MetadataDb) ListCompanies() ([]*metadata.Company, error) {
-	return mdb.MetadataDbReader.ListCompanies()
+func (mdb *MetadataDb) ListGroupsByCompany(ctx context.Context, companyID string, opts *metadata.ListOptions) ([]*metadata.Grp, string, error) {
+	return mdb.MetadataDbReader.ListGroupsByCompany(ctx, companyID, opts)
 }
 
-func (mdb *MetadataDb) VerifyCompany(username string, hashedPassword string) (bool, error) {
-	return mdb.MetadataDbReader.VerifyCompany(username, hashedPassword)
+func (mdb *MetadataDb) GetDeviceByID(ctx context.Context, id string) (*metadata.Device, error) {
+	return mdb.MetadataDbReader.GetDeviceByID(ctx, id)
 }
 
-func (mdb *MetadataDb) GetGroupByID(id string) (*metadata.Grp, error) {
-	return mdb.MetadataDbReader.GetGroupByID(id)
+func (mdb *MetadataDb) ListDevicesByGroup(ctx context.Context, groupID string, opts *metadata.ListOptions) ([]*metadata.Device, string, error) {
+	return mdb.MetadataDbReader.ListDevicesByGroup(ctx, groupID, opts)
 }
 
-func (mdb *MetadataDb) ListGroupsByCompany(companyID string) ([]*metadata.Grp, error) {
-	return mdb.MetadataDbReader.ListGroupsByCompany(companyID)
+func (mdb *MetadataDb) ListDevicesByCompany(ctx context.Context, companyID string, opts *metadata.ListOptions) ([]*metadata.Device, string, error) {
+	return mdb.MetadataDbReader.ListDevicesByCompany(ctx, companyID, opts)
 }
 
-func (mdb *MetadataDb) GetDeviceByID(id string) (*metadata.Device, error) {
-	return mdb.MetadataDbReader.GetDeviceByID(id)
+func (mdb *MetadataDb) GetDeviceBySecret(ctx context.Context, secret string) (*metadata.Device, error) {
+	return mdb.MetadataDbReader.GetDeviceBySecret(ctx, secret)
 }
 
-func (mdb *MetadataDb) ListDevicesByGroup(groupID string) ([]*metadata.Device, error) {
-	return mdb.MetadataDbReader.ListDevicesByGroup(groupID)
+func (mdb *MetadataDb) ListStaleDevices(ctx context.Context, companyID string, opts *metadata.ListOptions) ([]*metadata.Device, string, error) {
+	return mdb.MetadataDbReader.ListStaleDevices(ctx, companyID, opts)
 }
 
-func (mdb *MetadataDb) ListDevicesByCompany(companyID string) ([]*metadata.Device, error) {
-	return mdb.MetadataDbReader.ListDevicesByCompany(companyID)
+func (mdb *MetadataDb) ListDeviceSchemas(ctx context.Context, deviceID string) ([]*metadata.SchemaRevision, error) {
+	return mdb.MetadataDbReader.ListDeviceSchemas(ctx, deviceID)
 }
@@ -0,0 +1,180 @@
+package metadatastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+func (mdb *MetadataDb) CreateSession(ctx context.Context, userID uuid.UUID, refreshHash string, expiresAt time.Time) (*types.Session, error) {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[CreateSession] error creating a transaction:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	s := &types.Session{UserID: userID, ExpiresAt: expiresAt.UTC()}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO company_session (user_id, company_id, expires_at)
+		SELECT id, company_id, $2 FROM app_user WHERE id = $1
+		RETURNING id, company_id, created_at, (SELECT role FROM app_user WHERE id = $1)
+	`, userID, s.ExpiresAt).Scan(&s.ID, &s.CompanyID, &s.CreatedAt, &s.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[CreateSession] user not found:", userID)
+		err = types.ErrUserNotFound
+		return nil, err
+	}
+	if err != nil {
+		mdb.logger.Println("[CreateSession] error creating session:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO refresh_token (token_hash, session_id) VALUES ($1, $2)`, refreshHash, s.ID)
+	if err != nil {
+		mdb.logger.Println("[CreateSession] error storing refresh token:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[CreateSession] error committing:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return s, nil
+}
+
+// RotateRefreshToken locks the token and its session, so of two concurrent
+// refreshes with the same token one wins and the other revokes the session
+func (mdb *MetadataDb) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*types.Session, error) {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[RotateRefreshToken] error creating a transaction:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var s types.Session
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT s.id, s.user_id, s.company_id, u.role, s.created_at, s.expires_at, s.revoked_at, t.used_at
+		FROM refresh_token t
+		JOIN company_session s ON s.id = t.session_id
+		JOIN app_user u ON u.id = s.user_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t, s
+	`, oldHash).Scan(&s.ID, &s.UserID, &s.CompanyID, &s.Role, &s.CreatedAt, &s.ExpiresAt, &revokedAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[RotateRefreshToken] unknown refresh token")
+		err = types.ErrInvalidRefreshToken
+		return nil, err
+	}
+	if err != nil {
+		mdb.logger.Println("[RotateRefreshToken] error reading refresh token:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if usedAt.Valid {
+		// The revocation has to be committed, so the error is returned after it
+		if _, err = tx.ExecContext(ctx, `UPDATE company_session SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, s.ID); err != nil {
+			mdb.logger.Println("[RotateRefreshToken] error revoking session:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		if err = tx.Commit(); err != nil {
+			mdb.logger.Println("[RotateRefreshToken] error committing:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		mdb.logger.Println("[RotateRefreshToken] refresh token reused, session revoked:", s.ID)
+		return nil, types.ErrInvalidRefreshToken
+	}
+	if revokedAt.Valid || !s.ExpiresAt.After(time.Now()) {
+		mdb.logger.Println("[RotateRefreshToken] session revoked or expired:", s.ID)
+		err = types.ErrInvalidRefreshToken
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE refresh_token SET used_at = now() WHERE token_hash = $1`, oldHash); err != nil {
+		mdb.logger.Println("[RotateRefreshToken] error marking refresh token used:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO refresh_token (token_hash, session_id) VALUES ($1, $2)`, newHash, s.ID); err != nil {
+		mdb.logger.Println("[RotateRefreshToken] error storing refresh token:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	s.ExpiresAt = expiresAt.UTC()
+	if _, err = tx.ExecContext(ctx, `UPDATE company_session SET expires_at = $1 WHERE id = $2`, s.ExpiresAt, s.ID); err != nil {
+		mdb.logger.Println("[RotateRefreshToken] error extending session:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[RotateRefreshToken] error committing:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return &s, nil
+}
+
+// RevokeSession is idempotent, revoking a revoked session is not an error
+func (mdb *MetadataDb) RevokeSession(ctx context.Context, sessionID uuid.UUID) error {
+	_, err := mdb.dbConn.ExecContext(ctx, `UPDATE company_session SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, sessionID)
+	if err != nil {
+		mdb.logger.Println("[RevokeSession] error:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (mdb *MetadataDb) DenyToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := mdb.dbConn.ExecContext(ctx, `
+		INSERT INTO token_denylist (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, expiresAt.UTC())
+	if err != nil {
+		mdb.logger.Println("[DenyToken] error:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (mdb *MetadataDb) TokenRevoked(ctx context.Context, jti string, sessionID uuid.UUID) (bool, error) {
+	var active bool
+	err := mdb.dbConn.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM company_session
+			WHERE id = $2 AND revoked_at IS NULL AND expires_at > now()
+		) AND NOT EXISTS (
+			SELECT 1 FROM token_denylist WHERE jti = $1
+		)
+	`, jti, sessionID).Scan(&active)
+	if err != nil {
+		mdb.logger.Println("[TokenRevoked] error:", err)
+		return false, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return !active, nil
+}
+
+func (mdb *MetadataDb) PurgeSessions(ctx context.Context, now time.Time) error {
+	now = now.UTC()
+	if _, err := mdb.dbConn.ExecContext(ctx, `DELETE FROM token_denylist WHERE expires_at <= $1`, now); err != nil {
+		mdb.logger.Println("[PurgeSessions] error purging denylist:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	// TokenRevoked treats a missing session as revoked, so expired ones can go
+	if _, err := mdb.dbConn.ExecContext(ctx, `DELETE FROM company_session WHERE expires_at <= $1`, now); err != nil {
+		mdb.logger.Println("[PurgeSessions] error purging sessions:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
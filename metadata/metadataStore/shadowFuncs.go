@@ -0,0 +1,85 @@
+package metadatastore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+// UpdateDeviceShadow merges patch into a section of the device shadow. The row
+// is locked while merging so concurrent patches to either section all apply.
+func (mdb *MetadataDb) UpdateDeviceShadow(ctx context.Context, d *types.Device, section types.ShadowSection, patch types.ShadowState, version int64) (err error) {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceShadow] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var desiredJSON, reportedJSON []byte
+	var current int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT shadow_desired, shadow_reported, shadow_version
+		FROM device
+		WHERE id=$1 AND company_id=$2
+		FOR UPDATE
+	`, d.ID, d.CompanyID).Scan(&desiredJSON, &reportedJSON, &current)
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[UpdateDeviceShadow] device not found with ID:", d.ID)
+		err = fmt.Errorf("%w: %s", ErrDeviceNotExist, d.ID)
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceShadow] failed to read shadow:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	shadow, err := types.UnmarshalShadow(desiredJSON, reportedJSON, current)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceShadow] failed to unmarshal shadow:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	before := types.DesiredShadowState(types.CopyShadow(shadow))
+	if err = shadow.ApplyShadowPatch(section, patch, version); err != nil {
+		return err
+	}
+
+	if desiredJSON, err = json.Marshal(shadow.Desired); err != nil {
+		return err
+	}
+	if reportedJSON, err = json.Marshal(shadow.Reported); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE device SET shadow_desired=$1, shadow_reported=$2, shadow_version=$3
+		WHERE id=$4
+	`, desiredJSON, reportedJSON, shadow.Version, d.ID)
+	if err != nil {
+		mdb.logger.Println("[UpdateDeviceShadow] failed to update shadow:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if section == types.ShadowDesired {
+		err = mdb.audit(ctx, tx, d.CompanyID, types.AuditDeviceShadowDesired, d.ID, before, types.DesiredShadowState(shadow))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[UpdateDeviceShadow] failed to commit transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	d.Shadow = shadow
+	mdb.logger.Printf("[UpdateDeviceShadow] %s of device %s updated to version %d", section, d.ID, shadow.Version)
+	return nil
+}
@@ -0,0 +1,508 @@
+package metadatastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+)
+
+const userColumns = `id, company_id, username, role, created_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner, extra ...any) (*types.User, error) {
+	u := &types.User{}
+	dest := append([]any{&u.ID, &u.CompanyID, &u.Username, &u.Role, &u.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// VerifyUser checks a login and upgrades a legacy plaintext or weaker hash
+// to a fresh bcrypt hash once the password is known to be correct
+func (mdb *MetadataDb) VerifyUser(ctx context.Context, username string, password string) (*types.User, error) {
+	var storedPassword string
+	row := mdb.dbConn.QueryRowContext(ctx, `SELECT `+userColumns+`, password_hash FROM app_user WHERE username = $1`, username)
+	u, err := scanUser(row, &storedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[VerifyUser] username not found:", username)
+		types.CheckPassword(types.DummyPasswordHash, password)
+		return nil, nil
+	}
+	if err != nil {
+		mdb.logger.Println("[VerifyUser] error querying password:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	ok, needsRehash := types.CheckPassword(storedPassword, password)
+	if !ok {
+		mdb.logger.Println("[VerifyUser] password mismatch for username:", username)
+		return nil, nil
+	}
+
+	if needsRehash {
+		mdb.rehashPassword(ctx, u.ID, storedPassword, password)
+	}
+
+	mdb.logger.Println("[VerifyUser] credentials verified for username:", username)
+	return u, nil
+}
+
+// rehashPassword replaces the stored password unless it changed meanwhile.
+// Failing here must not fail the login, the next login retries.
+func (mdb *MetadataDb) rehashPassword(ctx context.Context, userID uuid.UUID, storedPassword, password string) {
+	newHash, err := types.HashPassword(password)
+	if err != nil {
+		mdb.logger.Println("[rehashPassword] error hashing password:", err)
+		return
+	}
+
+	query := `UPDATE app_user SET password_hash = $1 WHERE id = $2 AND password_hash = $3`
+	if _, err := mdb.dbConn.ExecContext(ctx, query, newHash, userID, storedPassword); err != nil {
+		mdb.logger.Println("[rehashPassword] error storing rehashed password:", err)
+		return
+	}
+	mdb.logger.Println("[rehashPassword] password hash upgraded for user:", userID)
+}
+
+func (mdb *MetadataDb) GetUserByID(ctx context.Context, id string) (*types.User, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+
+	u, err := scanUser(mdb.dbConn.QueryRowContext(ctx, `SELECT `+userColumns+` FROM app_user WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[GetUserByID] user not found:", id)
+		return nil, fmt.Errorf("%w: %s", types.ErrUserNotFound, id)
+	}
+	if err != nil {
+		mdb.logger.Println("[GetUserByID] error querying user:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return u, nil
+}
+
+func (mdb *MetadataDb) ListUsersByCompany(ctx context.Context, companyID string) ([]*types.User, error) {
+	if _, err := uuid.Parse(companyID); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidID, companyID)
+	}
+
+	rows, err := mdb.dbConn.QueryContext(ctx, `SELECT `+userColumns+` FROM app_user WHERE company_id = $1 ORDER BY username`, companyID)
+	if err != nil {
+		mdb.logger.Println("[ListUsersByCompany] error querying users:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var users []*types.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			mdb.logger.Println("[ListUsersByCompany] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		mdb.logger.Println("[ListUsersByCompany] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return users, nil
+}
+
+// UpdateUserPassword changes a password after checking the current one and
+// logs the user out everywhere, whoever knew the old password may hold a session
+func (mdb *MetadataDb) UpdateUserPassword(ctx context.Context, u *types.User, oldPassword string, newPassword string) error {
+	if !types.IsValidPassword(newPassword) {
+		mdb.logger.Println("[UpdateUserPassword] invalid new password")
+		return ErrInvalidPasswd
+	}
+
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[UpdateUserPassword] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var storedPassword string
+	var companyID uuid.UUID
+	err = tx.QueryRowContext(ctx, `SELECT password_hash, company_id FROM app_user WHERE id = $1 FOR UPDATE`, u.ID).Scan(&storedPassword, &companyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[UpdateUserPassword] user not found:", u.ID)
+		err = types.ErrUserNotFound
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[UpdateUserPassword] error checking user:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if ok, _ := types.CheckPassword(storedPassword, oldPassword); !ok {
+		mdb.logger.Println("[UpdateUserPassword] incorrect current password for user:", u.ID)
+		err = ErrWrongPasswd
+		return err
+	}
+
+	newHash, err := types.HashPassword(newPassword)
+	if err != nil {
+		mdb.logger.Println("[UpdateUserPassword] error hashing new password:", err)
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE app_user SET password_hash = $1 WHERE id = $2`, newHash, u.ID); err != nil {
+		mdb.logger.Println("[UpdateUserPassword] error updating password:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err = revokeUserSessions(ctx, tx, u.ID); err != nil {
+		mdb.logger.Println("[UpdateUserPassword] error revoking sessions:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	// Neither password makes it into the event
+	if err = mdb.audit(ctx, tx, companyID, types.AuditUserPassword, u.ID, nil, nil); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[UpdateUserPassword] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	mdb.logger.Println("[UpdateUserPassword] password updated for user:", u.ID)
+	return nil
+}
+
+// UpdateUserRole changes a role and revokes the user's sessions, so that no
+// token with the old role outlives the change
+func (mdb *MetadataDb) UpdateUserRole(ctx context.Context, u *types.User, role types.Role) error {
+	if !role.Valid() {
+		mdb.logger.Println("[UpdateUserRole] invalid role:", role)
+		return types.ErrInvalidRole
+	}
+
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[UpdateUserRole] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err = checkOwnerRemains(ctx, tx, u, role); err != nil {
+		mdb.logger.Println("[UpdateUserRole] error:", err)
+		return err
+	}
+
+	before, err := scanUser(tx.QueryRowContext(ctx, `SELECT `+userColumns+` FROM app_user WHERE id = $1`, u.ID))
+	if err != nil {
+		mdb.logger.Println("[UpdateUserRole] error reading user:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	row := tx.QueryRowContext(ctx, `UPDATE app_user SET role = $1 WHERE id = $2 RETURNING `+userColumns, role, u.ID)
+	updated, err := scanUser(row)
+	if err != nil {
+		mdb.logger.Println("[UpdateUserRole] error updating role:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err = revokeUserSessions(ctx, tx, u.ID); err != nil {
+		mdb.logger.Println("[UpdateUserRole] error revoking sessions:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err = mdb.audit(ctx, tx, updated.CompanyID, types.AuditUserRole, u.ID, before, updated); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[UpdateUserRole] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	*u = *updated
+	mdb.logger.Println("[UpdateUserRole] user", u.ID, "is now", role)
+	return nil
+}
+
+// DeleteUser removes a user, its sessions cascade away
+func (mdb *MetadataDb) DeleteUser(ctx context.Context, u *types.User) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[DeleteUser] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// An empty role means no role at all, the user goes
+	if err = checkOwnerRemains(ctx, tx, u, ""); err != nil {
+		mdb.logger.Println("[DeleteUser] error:", err)
+		return err
+	}
+	before, err := scanUser(tx.QueryRowContext(ctx, `DELETE FROM app_user WHERE id = $1 RETURNING `+userColumns, u.ID))
+	if err != nil {
+		mdb.logger.Println("[DeleteUser] error deleting user:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err = mdb.audit(ctx, tx, before.CompanyID, types.AuditUserDelete, u.ID, before, nil); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[DeleteUser] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	mdb.logger.Println("[DeleteUser] user deleted:", u.ID)
+	return nil
+}
+
+// checkOwnerRemains locks the users of u.CompanyID, so concurrent changes
+// see each other, and fails unless u exists and the company keeps an owner
+// once u has role next
+func checkOwnerRemains(ctx context.Context, tx *sql.Tx, u *types.User, next types.Role) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, role FROM app_user WHERE company_id = $1 FOR UPDATE`, u.CompanyID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	found := false
+	owners, remaining := 0, 0
+	for rows.Next() {
+		var id uuid.UUID
+		var role types.Role
+		if err := rows.Scan(&id, &role); err != nil {
+			return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		if role == types.RoleOwner {
+			owners++
+		}
+		if id == u.ID {
+			found = true
+			role = next
+		}
+		if role == types.RoleOwner {
+			remaining++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", types.ErrUserNotFound, u.ID)
+	}
+	if owners > 0 && remaining == 0 {
+		return types.ErrLastOwner
+	}
+	return nil
+}
+
+func revokeUserSessions(ctx context.Context, tx *sql.Tx, userID uuid.UUID) error {
+	_, err := tx.ExecContext(ctx, `UPDATE company_session SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	return err
+}
+
+const inviteColumns = `id, company_id, role, invited_by, created_at, expires_at`
+
+func scanInvite(row rowScanner) (*types.Invite, error) {
+	inv := &types.Invite{}
+	var invitedBy uuid.NullUUID
+	if err := row.Scan(&inv.ID, &inv.CompanyID, &inv.Role, &invitedBy, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+		return nil, err
+	}
+	inv.InvitedBy = invitedBy.UUID
+	return inv, nil
+}
+
+func (mdb *MetadataDb) CreateInvite(ctx context.Context, inv *types.Invite, tokenHash string) error {
+	if !inv.Role.Valid() {
+		mdb.logger.Println("[CreateInvite] invalid role:", inv.Role)
+		return types.ErrInvalidRole
+	}
+
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[CreateInvite] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO company_invite (company_id, token_hash, role, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, inv.CompanyID, tokenHash, inv.Role, nullUUID(inv.InvitedBy), inv.ExpiresAt.UTC()).Scan(&inv.ID, &inv.CreatedAt)
+	if isForeignKeyViolation(err) {
+		mdb.logger.Println("[CreateInvite] company or inviting user not found:", inv.CompanyID)
+		err = ErrCompanyNoExist
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[CreateInvite] error creating invite:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = mdb.audit(ctx, tx, inv.CompanyID, types.AuditInviteCreate, inv.ID, nil, inv); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[CreateInvite] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (mdb *MetadataDb) ListInvitesByCompany(ctx context.Context, companyID string) ([]*types.Invite, error) {
+	if _, err := uuid.Parse(companyID); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidID, companyID)
+	}
+
+	rows, err := mdb.dbConn.QueryContext(ctx, `
+		SELECT `+inviteColumns+` FROM company_invite
+		WHERE company_id = $1 AND expires_at > now()
+		ORDER BY created_at
+	`, companyID)
+	if err != nil {
+		mdb.logger.Println("[ListInvitesByCompany] error querying invites:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var invites []*types.Invite
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			mdb.logger.Println("[ListInvitesByCompany] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		invites = append(invites, inv)
+	}
+	if err := rows.Err(); err != nil {
+		mdb.logger.Println("[ListInvitesByCompany] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return invites, nil
+}
+
+func (mdb *MetadataDb) DeleteInvite(ctx context.Context, inv *types.Invite) error {
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[DeleteInvite] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	row := tx.QueryRowContext(ctx, `DELETE FROM company_invite WHERE id = $1 AND company_id = $2 RETURNING `+inviteColumns, inv.ID, inv.CompanyID)
+	before, err := scanInvite(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = types.ErrInvalidInvite
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[DeleteInvite] error deleting invite:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = mdb.audit(ctx, tx, inv.CompanyID, types.AuditInviteDelete, inv.ID, before, nil); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[DeleteInvite] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+// AcceptInvite deletes the invite and creates the user in one transaction,
+// an invite is good for one user
+func (mdb *MetadataDb) AcceptInvite(ctx context.Context, tokenHash string, u *types.User, password string) error {
+	if !types.IsValidName(u.Username) {
+		mdb.logger.Println("[AcceptInvite] invalid username:", u.Username)
+		return ErrInvalidName
+	}
+	if !types.IsValidPassword(password) {
+		mdb.logger.Println("[AcceptInvite] invalid password")
+		return ErrInvalidPasswd
+	}
+	passwordHash, err := types.HashPassword(password)
+	if err != nil {
+		mdb.logger.Println("[AcceptInvite] error hashing password:", err)
+		return err
+	}
+
+	tx, err := mdb.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		mdb.logger.Println("[AcceptInvite] error creating transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM company_invite WHERE token_hash = $1 AND expires_at > now()
+		RETURNING company_id, role
+	`, tokenHash).Scan(&u.CompanyID, &u.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		mdb.logger.Println("[AcceptInvite] invite not found or expired")
+		err = types.ErrInvalidInvite
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[AcceptInvite] error reading invite:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO app_user (company_id, username, password_hash, role) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, u.CompanyID, u.Username, passwordHash, u.Role).Scan(&u.ID, &u.CreatedAt)
+	if isUniqueViolation(err) {
+		mdb.logger.Println("[AcceptInvite] username already taken:", u.Username)
+		err = types.ErrUsernameTaken
+		return err
+	}
+	if err != nil {
+		mdb.logger.Println("[AcceptInvite] error creating user:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	// Nobody is logged in to accept an invite, the new user is the actor
+	ctx = types.WithDefaultActor(ctx, u.ID)
+	if err = mdb.audit(ctx, tx, u.CompanyID, types.AuditUserCreate, u.ID, nil, u); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mdb.logger.Println("[AcceptInvite] error committing:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	mdb.logger.Println("[AcceptInvite] user joined company:", u.Username, u.CompanyID)
+	return nil
+}
@@ -1,22 +1,19 @@
 package metadatastore
 
 import (
-	"regexp"
-	"strings"
-)
-
-func isValidName(test string) bool {
+	"errors"
 
-	s := strings.TrimSpace(test)
-	if s == "" {
-		return false
-	}
-	re := regexp.MustCompile(`^[a-zA-Z0-9]+$`)
-	return re.MatchString(s)
+	"github.com/lib/pq"
+)
 
+// isUniqueViolation reports whether err is a postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
 }
 
-func isValidPasswd(test string) bool {
-	s := strings.TrimSpace(test)
-	return s != ""
+// isForeignKeyViolation reports whether err is a postgres foreign key violation
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
 }
@@ -0,0 +1,1266 @@
+// Package metadatatest holds the conformance suite every metadata.MetadataStore
+// implementation has to pass, so the in-memory store and MetadataDb stay in step.
+package metadatatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+)
+
+const testPassword = "correcthorse"
+
+var nameSeq atomic.Uint64
+
+// uniqueName returns an alphanumeric name that does not collide across runs
+// against a shared database
+func uniqueName(prefix string) string {
+	return fmt.Sprintf("%s%d%d", prefix, time.Now().UnixNano(), nameSeq.Add(1))
+}
+
+// RunConformance runs the suite against stores returned by newStore. Each
+// subtest gets its own store, stores may share state as all names are unique.
+func RunConformance(t *testing.T, newStore func(t *testing.T) types.MetadataStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s types.MetadataStore)
+	}{
+		{"CompanyLifecycle", testCompanyLifecycle},
+		{"UniqueUsername", testUniqueUsername},
+		{"InvalidInput", testInvalidInput},
+		{"UpdatePassword", testUpdatePassword},
+		{"Users", testUsers},
+		{"GroupLifecycle", testGroupLifecycle},
+		{"DeviceLifecycle", testDeviceLifecycle},
+		{"DeviceCrossCompany", testDeviceCrossCompany},
+		{"DeviceSecret", testDeviceSecret},
+		{"DeviceShadow", testDeviceShadow},
+		{"DevicePresence", testDevicePresence},
+		{"SchemaVersions", testSchemaVersions},
+		{"Sessions", testSessions},
+		{"APIKeys", testAPIKeys},
+		{"Audit", testAudit},
+		{"CascadingDeletes", testCascadingDeletes},
+		{"ConcurrentDeviceCreates", testConcurrentDeviceCreates},
+		{"ListPagination", testListPagination},
+		{"ListFilters", testListFilters},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func mustCompany(t *testing.T, s types.MetadataStore) *types.Company {
+	t.Helper()
+	ctx := context.Background()
+	c := &types.Company{
+		CompanyName:     uniqueName("co"),
+		Username:        uniqueName("user"),
+		CompanyPassword: testPassword,
+	}
+	if err := s.CreateCompany(ctx, c); err != nil {
+		t.Fatalf("CreateCompany: %v", err)
+	}
+	if c.ID == uuid.Nil {
+		t.Fatal("CreateCompany did not set the company id")
+	}
+	return c
+}
+
+// mustOwner logs in as the first owner, created along with the company
+func mustOwner(t *testing.T, s types.MetadataStore, c *types.Company) *types.User {
+	t.Helper()
+	u, err := s.VerifyUser(context.Background(), c.Username, testPassword)
+	if err != nil || u == nil {
+		t.Fatalf("VerifyUser(company login) = %v, %v", u, err)
+	}
+	return u
+}
+
+func mustGroup(t *testing.T, s types.MetadataStore, c *types.Company) *types.Grp {
+	t.Helper()
+	ctx := context.Background()
+	g := &types.Grp{CompanyID: c.ID, GroupName: uniqueName("grp")}
+	if err := s.CreateGroup(ctx, g); err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if g.ID == uuid.Nil {
+		t.Fatal("CreateGroup did not set the group id")
+	}
+	return g
+}
+
+func mustDevice(t *testing.T, s types.MetadataStore, g *types.Grp) *types.Device {
+	t.Helper()
+	ctx := context.Background()
+	d := &types.Device{
+		GrpID:               g.ID,
+		CompanyID:           g.CompanyID,
+		DeviceName:          uniqueName("dev"),
+		DeviceType:          "sensor",
+		TelemetryDataSchema: types.TelemetrySchema{"temp": "float", "on": "bool"},
+	}
+	if err := s.CreateDevice(ctx, d); err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	if d.ID == uuid.Nil {
+		t.Fatal("CreateDevice did not set the device id")
+	}
+	return d
+}
+
+func mustGetCompany(t *testing.T, s types.MetadataStore, id uuid.UUID) *types.Company {
+	t.Helper()
+	ctx := context.Background()
+	c, err := s.GetCompanyByID(ctx, id.String())
+	if err != nil {
+		t.Fatalf("GetCompanyByID: %v", err)
+	}
+	return c
+}
+
+func mustGetGroup(t *testing.T, s types.MetadataStore, id uuid.UUID) *types.Grp {
+	t.Helper()
+	ctx := context.Background()
+	g, err := s.GetGroupByID(ctx, id.String())
+	if err != nil {
+		t.Fatalf("GetGroupByID: %v", err)
+	}
+	return g
+}
+
+func testCompanyLifecycle(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	if c.CompanyPassword != "" {
+		t.Error("CreateCompany left the plaintext password on the company")
+	}
+
+	got, err := s.GetCompanyByUsername(ctx, c.Username)
+	if err != nil || got == nil {
+		t.Fatalf("GetCompanyByUsername = %v, %v", got, err)
+	}
+	if got.ID != c.ID || got.CompanyName != c.CompanyName {
+		t.Errorf("GetCompanyByUsername = %+v, want %+v", got, c)
+	}
+	if got.CompanyPassword != "" {
+		t.Error("reader exposed the stored password")
+	}
+
+	owner := mustOwner(t, s, c)
+	if owner.CompanyID != c.ID || owner.Role != types.RoleOwner {
+		t.Errorf("company login = %+v, want an owner of %v", owner, c.ID)
+	}
+	if u, err := s.VerifyUser(ctx, c.Username, "wrong"); err != nil || u != nil {
+		t.Errorf("VerifyUser(wrong) = %v, %v", u, err)
+	}
+
+	del := &types.Company{ID: c.ID}
+	if err := s.DeleteCompany(ctx, del); err != nil {
+		t.Fatalf("DeleteCompany: %v", err)
+	}
+	if _, err := s.GetCompanyByID(ctx, c.ID.String()); !errors.Is(err, metadatastore.ErrCompanyNoExist) {
+		t.Errorf("GetCompanyByID after delete = %v, want ErrCompanyNoExist", err)
+	}
+	if _, err := s.GetCompanyByUsername(ctx, c.Username); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("GetCompanyByUsername after delete = %v, want a NotFound error", err)
+	}
+	if _, err := s.GetUserByID(ctx, owner.ID.String()); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("GetUserByID after company delete = %v, want a NotFound error", err)
+	}
+	if _, err := s.GetCompanyByID(ctx, "not-a-uuid"); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("GetCompanyByID(invalid id) = %v, want a Validation error", err)
+	}
+	if err := s.DeleteCompany(ctx, del); !errors.Is(err, metadatastore.ErrCompanyNoExist) {
+		t.Errorf("DeleteCompany twice = %v, want ErrCompanyNoExist", err)
+	}
+}
+
+func testUniqueUsername(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+
+	dup := &types.Company{CompanyName: uniqueName("co"), Username: c.Username, CompanyPassword: testPassword}
+	if err := s.CreateCompany(ctx, dup); !errors.Is(err, metadatastore.ErrCompanyExists) {
+		t.Errorf("CreateCompany(duplicate username) = %v, want ErrCompanyExists", err)
+	}
+	dup = &types.Company{CompanyName: c.CompanyName, Username: uniqueName("user"), CompanyPassword: testPassword}
+	if err := s.CreateCompany(ctx, dup); !errors.Is(err, metadatastore.ErrCompanyExists) {
+		t.Errorf("CreateCompany(duplicate company name) = %v, want ErrCompanyExists", err)
+	}
+}
+
+func testInvalidInput(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	bad := &types.Company{CompanyName: "has space", Username: uniqueName("user"), CompanyPassword: testPassword}
+	if err := s.CreateCompany(ctx, bad); !errors.Is(err, metadatastore.ErrInvalidName) {
+		t.Errorf("CreateCompany(invalid name) = %v, want ErrInvalidName", err)
+	}
+	bad = &types.Company{CompanyName: uniqueName("co"), Username: uniqueName("user"), CompanyPassword: " "}
+	if err := s.CreateCompany(ctx, bad); !errors.Is(err, metadatastore.ErrInvalidPasswd) {
+		t.Errorf("CreateCompany(blank password) = %v, want ErrInvalidPasswd", err)
+	}
+
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+	if err := s.CreateGroup(ctx, &types.Grp{CompanyID: c.ID, GroupName: "no-dashes"}); !errors.Is(err, metadatastore.ErrInvalidName) {
+		t.Errorf("CreateGroup(invalid name) = %v, want ErrInvalidName", err)
+	}
+
+	d := &types.Device{
+		GrpID:               g.ID,
+		CompanyID:           c.ID,
+		DeviceName:          uniqueName("dev"),
+		TelemetryDataSchema: types.TelemetrySchema{"temp": "decimal"},
+	}
+	if err := s.CreateDevice(ctx, d); !errors.Is(err, metadatastore.ErrInvalidSchema) {
+		t.Errorf("CreateDevice(invalid schema) = %v, want ErrInvalidSchema", err)
+	}
+	if got := mustGetGroup(t, s, g.ID).NoOfDevices; got != 0 {
+		t.Errorf("group counts %d devices after a rejected create, want 0", got)
+	}
+}
+
+func testUpdatePassword(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	owner := mustOwner(t, s, c)
+	const newPassword = "batterystaple"
+
+	if err := s.UpdateUserPassword(ctx, owner, "wrong", newPassword); !errors.Is(err, metadatastore.ErrWrongPasswd) {
+		t.Errorf("UpdateUserPassword(wrong current) = %v, want ErrWrongPasswd", err)
+	}
+	if err := s.UpdateUserPassword(ctx, owner, testPassword, " "); !errors.Is(err, metadatastore.ErrInvalidPasswd) {
+		t.Errorf("UpdateUserPassword(blank) = %v, want ErrInvalidPasswd", err)
+	}
+	if err := s.UpdateUserPassword(ctx, owner, testPassword, newPassword); err != nil {
+		t.Fatalf("UpdateUserPassword: %v", err)
+	}
+	if u, _ := s.VerifyUser(ctx, c.Username, testPassword); u != nil {
+		t.Error("old password still verifies")
+	}
+	if u, _ := s.VerifyUser(ctx, c.Username, newPassword); u == nil || u.ID != owner.ID {
+		t.Error("new password does not verify")
+	}
+}
+
+func testUsers(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	owner := mustOwner(t, s, c)
+
+	dup := &types.Company{CompanyName: uniqueName("co"), Username: uniqueName("user"), CompanyPassword: testPassword}
+	join := func(role types.Role) *types.User {
+		t.Helper()
+		token := uniqueName("invite")
+		inv := &types.Invite{CompanyID: c.ID, Role: role, InvitedBy: owner.ID, ExpiresAt: time.Now().Add(time.Hour)}
+		if err := s.CreateInvite(ctx, inv, types.HashToken(token)); err != nil {
+			t.Fatalf("CreateInvite: %v", err)
+		}
+		u := &types.User{Username: uniqueName("member")}
+		if err := s.AcceptInvite(ctx, types.HashToken(token), u, testPassword); err != nil {
+			t.Fatalf("AcceptInvite: %v", err)
+		}
+		if u.ID == uuid.Nil || u.CompanyID != c.ID || u.Role != role {
+			t.Errorf("AcceptInvite = %+v, want a %s of %v", u, role, c.ID)
+		}
+		return u
+	}
+
+	if err := s.CreateInvite(ctx, &types.Invite{CompanyID: c.ID, Role: "root", ExpiresAt: time.Now().Add(time.Hour)}, "x"); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("CreateInvite(invalid role) = %v, want a validation error", err)
+	}
+
+	token := uniqueName("invite")
+	inv := &types.Invite{CompanyID: c.ID, Role: types.RoleViewer, InvitedBy: owner.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.CreateInvite(ctx, inv, types.HashToken(token)); err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	expired := uniqueName("invite")
+	if err := s.CreateInvite(ctx, &types.Invite{CompanyID: c.ID, Role: types.RoleAdmin, ExpiresAt: time.Now().Add(-time.Minute)}, types.HashToken(expired)); err != nil {
+		t.Fatalf("CreateInvite(expired): %v", err)
+	}
+	invites, err := s.ListInvitesByCompany(ctx, c.ID.String())
+	if err != nil {
+		t.Fatalf("ListInvitesByCompany: %v", err)
+	}
+	if len(invites) != 1 || invites[0].ID != inv.ID || invites[0].InvitedBy != owner.ID {
+		t.Errorf("ListInvitesByCompany = %+v, want only the pending invite", invites)
+	}
+	if err := s.AcceptInvite(ctx, types.HashToken(expired), &types.User{Username: uniqueName("member")}, testPassword); !errors.Is(err, types.ErrInvalidInvite) {
+		t.Errorf("AcceptInvite(expired) = %v, want ErrInvalidInvite", err)
+	}
+	if err := s.AcceptInvite(ctx, types.HashToken(token), &types.User{Username: dup.Username}, " "); !errors.Is(err, metadatastore.ErrInvalidPasswd) {
+		t.Errorf("AcceptInvite(blank password) = %v, want ErrInvalidPasswd", err)
+	}
+	if err := s.AcceptInvite(ctx, types.HashToken(token), &types.User{Username: c.Username}, testPassword); !errors.Is(err, types.ErrUsernameTaken) {
+		t.Errorf("AcceptInvite(taken username) = %v, want ErrUsernameTaken", err)
+	}
+	viewer := &types.User{Username: dup.Username}
+	if err := s.AcceptInvite(ctx, types.HashToken(token), viewer, testPassword); err != nil {
+		t.Fatalf("AcceptInvite: %v", err)
+	}
+	if err := s.AcceptInvite(ctx, types.HashToken(token), &types.User{Username: uniqueName("member")}, testPassword); !errors.Is(err, types.ErrInvalidInvite) {
+		t.Errorf("AcceptInvite twice = %v, want ErrInvalidInvite", err)
+	}
+	if u, _ := s.VerifyUser(ctx, viewer.Username, testPassword); u == nil || u.Role != types.RoleViewer || u.CompanyID != c.ID {
+		t.Errorf("VerifyUser(invited) = %+v, want a viewer of %v", u, c.ID)
+	}
+	// User names are unique over companies too
+	if err := s.CreateCompany(ctx, dup); !errors.Is(err, metadatastore.ErrCompanyExists) {
+		t.Errorf("CreateCompany(username of a user) = %v, want ErrCompanyExists", err)
+	}
+
+	gone := &types.Invite{CompanyID: c.ID, Role: types.RoleViewer, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.CreateInvite(ctx, gone, types.HashToken(uniqueName("invite"))); err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	if err := s.DeleteInvite(ctx, &types.Invite{ID: gone.ID, CompanyID: uuid.New()}); !errors.Is(err, types.ErrInvalidInvite) {
+		t.Errorf("DeleteInvite(other company) = %v, want ErrInvalidInvite", err)
+	}
+	if err := s.DeleteInvite(ctx, gone); err != nil {
+		t.Errorf("DeleteInvite: %v", err)
+	}
+
+	admin := join(types.RoleAdmin)
+	users, err := s.ListUsersByCompany(ctx, c.ID.String())
+	if err != nil {
+		t.Fatalf("ListUsersByCompany: %v", err)
+	}
+	if len(users) != 3 {
+		t.Errorf("ListUsersByCompany lists %d users, want 3", len(users))
+	}
+
+	if err := s.UpdateUserRole(ctx, admin, "root"); !errors.Is(err, types.ErrInvalidRole) {
+		t.Errorf("UpdateUserRole(invalid) = %v, want ErrInvalidRole", err)
+	}
+	if err := s.UpdateUserRole(ctx, owner, types.RoleAdmin); !errors.Is(err, types.ErrLastOwner) {
+		t.Errorf("UpdateUserRole(last owner) = %v, want ErrLastOwner", err)
+	}
+	if err := s.DeleteUser(ctx, owner); !errors.Is(err, types.ErrLastOwner) {
+		t.Errorf("DeleteUser(last owner) = %v, want ErrLastOwner", err)
+	}
+	other := mustCompany(t, s)
+	if err := s.UpdateUserRole(ctx, &types.User{ID: admin.ID, CompanyID: other.ID}, types.RoleViewer); !errors.Is(err, types.ErrUserNotFound) {
+		t.Errorf("UpdateUserRole(other company) = %v, want ErrUserNotFound", err)
+	}
+
+	session, err := s.CreateSession(ctx, admin.ID, types.HashToken(uniqueName("refresh")), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if session.Role != types.RoleAdmin || session.CompanyID != c.ID {
+		t.Errorf("session = %+v, want an admin session of %v", session, c.ID)
+	}
+	if err := s.UpdateUserRole(ctx, admin, types.RoleOwner); err != nil {
+		t.Fatalf("UpdateUserRole: %v", err)
+	}
+	if admin.Role != types.RoleOwner {
+		t.Errorf("UpdateUserRole left role %q", admin.Role)
+	}
+	if revoked, _ := s.TokenRevoked(ctx, uniqueName("jti"), session.ID); !revoked {
+		t.Error("session survived a role change")
+	}
+	// With a second owner the first may step down
+	if err := s.UpdateUserRole(ctx, owner, types.RoleViewer); err != nil {
+		t.Errorf("UpdateUserRole(one of two owners) = %v", err)
+	}
+
+	session, err = s.CreateSession(ctx, viewer.ID, types.HashToken(uniqueName("refresh")), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := s.DeleteUser(ctx, viewer); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := s.GetUserByID(ctx, viewer.ID.String()); !errors.Is(err, types.ErrUserNotFound) {
+		t.Errorf("GetUserByID after delete = %v, want ErrUserNotFound", err)
+	}
+	if revoked, _ := s.TokenRevoked(ctx, uniqueName("jti"), session.ID); !revoked {
+		t.Error("session survived its user")
+	}
+	if err := s.DeleteUser(ctx, viewer); !errors.Is(err, types.ErrUserNotFound) {
+		t.Errorf("DeleteUser twice = %v, want ErrUserNotFound", err)
+	}
+}
+
+func testGroupLifecycle(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+
+	if err := s.CreateGroup(ctx, &types.Grp{CompanyID: c.ID, GroupName: g.GroupName}); !errors.Is(err, metadatastore.ErrGroupExists) {
+		t.Errorf("CreateGroup(duplicate) = %v, want ErrGroupExists", err)
+	}
+	if err := s.CreateGroup(ctx, &types.Grp{CompanyID: uuid.New(), GroupName: uniqueName("grp")}); !errors.Is(err, metadatastore.ErrCompanyNoExist) {
+		t.Errorf("CreateGroup(unknown company) = %v, want ErrCompanyNoExist", err)
+	}
+
+	// Group names are only unique within a company
+	other := mustCompany(t, s)
+	if err := s.CreateGroup(ctx, &types.Grp{CompanyID: other.ID, GroupName: g.GroupName}); err != nil {
+		t.Errorf("CreateGroup(same name, other company) = %v", err)
+	}
+
+	if got := mustGetCompany(t, s, c.ID).NoOfGrps; got != 1 {
+		t.Errorf("company counts %d groups, want 1", got)
+	}
+	groups, _, err := s.ListGroupsByCompany(ctx, c.ID.String(), nil)
+	if err != nil || len(groups) != 1 || groups[0].ID != g.ID {
+		t.Errorf("ListGroupsByCompany = %v, %v", groups, err)
+	}
+
+	// Deleting through another company must not work
+	if err := s.DeleteGroup(ctx, &types.Grp{ID: g.ID, CompanyID: other.ID, GroupName: g.GroupName}); !errors.Is(err, metadatastore.ErrGroupNotExist) {
+		t.Errorf("DeleteGroup(other company) = %v, want ErrGroupNotExist", err)
+	}
+	// The id is enough, the name isn't needed
+	if err := s.DeleteGroup(ctx, &types.Grp{ID: g.ID, CompanyID: g.CompanyID}); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if _, err := s.GetGroupByID(ctx, g.ID.String()); !errors.Is(err, metadatastore.ErrGroupNotExist) {
+		t.Errorf("GetGroupByID after delete = %v, want ErrGroupNotExist", err)
+	}
+	if got := mustGetCompany(t, s, c.ID).NoOfGrps; got != 0 {
+		t.Errorf("company counts %d groups after delete, want 0", got)
+	}
+}
+
+func testDeviceLifecycle(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+	d := mustDevice(t, s, g)
+
+	dup := &types.Device{GrpID: g.ID, CompanyID: c.ID, DeviceName: d.DeviceName}
+	if err := s.CreateDevice(ctx, dup); !errors.Is(err, metadatastore.ErrDeviceExists) {
+		t.Errorf("CreateDevice(duplicate) = %v, want ErrDeviceExists", err)
+	}
+
+	got, err := s.GetDeviceByID(ctx, d.ID.String())
+	if err != nil || got == nil {
+		t.Fatalf("GetDeviceByID = %v, %v", got, err)
+	}
+	if got.DeviceName != d.DeviceName || got.GrpID != g.ID || got.CompanyID != c.ID {
+		t.Errorf("GetDeviceByID = %+v, want %+v", got, d)
+	}
+	if got.DeviceSecret != "" {
+		t.Error("reader exposed the device secret")
+	}
+	if got.TelemetryDataSchema["temp"] != "float" {
+		t.Errorf("schema = %v", got.TelemetryDataSchema)
+	}
+
+	if got := mustGetGroup(t, s, g.ID).NoOfDevices; got != 1 {
+		t.Errorf("group counts %d devices, want 1", got)
+	}
+	if got := mustGetCompany(t, s, c.ID).NoOfDevices; got != 1 {
+		t.Errorf("company counts %d devices, want 1", got)
+	}
+
+	loc := &types.Location{Longitude: 77.59, Latitude: 12.97}
+	if err := s.UpdateDeviceLocation(ctx, d, loc); err != nil {
+		t.Fatalf("UpdateDeviceLocation: %v", err)
+	}
+	// Dropping temp is incompatible, forced here; see testSchemaVersions
+	schema := types.TelemetrySchema{"humidity": "int"}
+	if err := s.UpdateDeviceSchema(ctx, d, &schema, true); err != nil {
+		t.Fatalf("UpdateDeviceSchema: %v", err)
+	}
+	bad := types.TelemetrySchema{"humidity": "percent"}
+	if err := s.UpdateDeviceSchema(ctx, d, &bad, true); !errors.Is(err, metadatastore.ErrInvalidSchema) {
+		t.Errorf("UpdateDeviceSchema(invalid) = %v, want ErrInvalidSchema", err)
+	}
+	got, _ = s.GetDeviceByID(ctx, d.ID.String())
+	if got.DeviceLocation != *loc {
+		t.Errorf("location = %+v, want %+v", got.DeviceLocation, *loc)
+	}
+	if len(got.TelemetryDataSchema) != 1 || got.TelemetryDataSchema["humidity"] != "int" {
+		t.Errorf("schema = %v, want %v", got.TelemetryDataSchema, schema)
+	}
+
+	byGroup, _, err := s.ListDevicesByGroup(ctx, g.ID.String(), nil)
+	if err != nil || len(byGroup) != 1 {
+		t.Errorf("ListDevicesByGroup = %v, %v", byGroup, err)
+	}
+	byCompany, _, err := s.ListDevicesByCompany(ctx, c.ID.String(), nil)
+	if err != nil || len(byCompany) != 1 {
+		t.Errorf("ListDevicesByCompany = %v, %v", byCompany, err)
+	}
+
+	if err := s.DeleteDevice(ctx, d); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	if err := s.DeleteDevice(ctx, d); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Errorf("DeleteDevice twice = %v, want ErrDeviceNotExist", err)
+	}
+	if got := mustGetGroup(t, s, g.ID).NoOfDevices; got != 0 {
+		t.Errorf("group counts %d devices after delete, want 0", got)
+	}
+	if got := mustGetCompany(t, s, c.ID).NoOfDevices; got != 0 {
+		t.Errorf("company counts %d devices after delete, want 0", got)
+	}
+}
+
+func testDeviceCrossCompany(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	owner := mustCompany(t, s)
+	g := mustGroup(t, s, owner)
+	d := mustDevice(t, s, g)
+	other := mustCompany(t, s)
+
+	// A device cant be created in a group of another company
+	foreign := &types.Device{GrpID: g.ID, CompanyID: other.ID, DeviceName: uniqueName("dev")}
+	if err := s.CreateDevice(ctx, foreign); !errors.Is(err, metadatastore.ErrGroupNotExist) {
+		t.Errorf("CreateDevice(foreign group) = %v, want ErrGroupNotExist", err)
+	}
+
+	stolen := *d
+	stolen.CompanyID = other.ID
+	if err := s.DeleteDevice(ctx, &stolen); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Errorf("DeleteDevice(other company) = %v, want ErrDeviceNotExist", err)
+	}
+	if err := s.UpdateDeviceLocation(ctx, &stolen, &types.Location{}); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Errorf("UpdateDeviceLocation(other company) = %v, want ErrDeviceNotExist", err)
+	}
+	if _, err := s.RotateDeviceSecret(ctx, &stolen); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Errorf("RotateDeviceSecret(other company) = %v, want ErrDeviceNotExist", err)
+	}
+	if _, err := s.GetDeviceByID(ctx, d.ID.String()); err != nil {
+		t.Error("device was deleted through another company")
+	}
+}
+
+func testDeviceSecret(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+	d := mustDevice(t, s, g)
+
+	first := d.DeviceSecret
+	if first == "" {
+		t.Fatal("CreateDevice did not hand out a secret")
+	}
+	if got, err := s.GetDeviceBySecret(ctx, first); err != nil || got == nil || got.ID != d.ID {
+		t.Fatalf("GetDeviceBySecret = %v, %v", got, err)
+	}
+
+	second, err := s.RotateDeviceSecret(ctx, d)
+	if err != nil {
+		t.Fatalf("RotateDeviceSecret: %v", err)
+	}
+	if second == first {
+		t.Error("RotateDeviceSecret returned the old secret")
+	}
+	if _, err := s.GetDeviceBySecret(ctx, first); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Error("old secret still authenticates after rotation")
+	}
+	if got, _ := s.GetDeviceBySecret(ctx, second); got == nil || got.ID != d.ID {
+		t.Error("new secret does not authenticate")
+	}
+
+	if err := s.RevokeDeviceSecret(ctx, d); err != nil {
+		t.Fatalf("RevokeDeviceSecret: %v", err)
+	}
+	if _, err := s.GetDeviceBySecret(ctx, second); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Error("secret still authenticates after revocation")
+	}
+}
+
+func testDeviceShadow(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+	d := mustDevice(t, s, g)
+
+	if d.Shadow.Version != 0 || len(d.Shadow.Desired) != 0 || len(d.Shadow.Reported) != 0 {
+		t.Fatalf("new device shadow = %+v, want empty", d.Shadow)
+	}
+
+	desired := types.ShadowState{"interval": float64(30), "led": map[string]interface{}{"color": "red", "on": true}}
+	if err := s.UpdateDeviceShadow(ctx, d, types.ShadowDesired, desired, 0); err != nil {
+		t.Fatalf("UpdateDeviceShadow(desired): %v", err)
+	}
+	if d.Shadow.Version != 1 || len(d.Shadow.Delta) != 2 {
+		t.Errorf("shadow after desired = %+v, want version 1 and a delta of 2 keys", d.Shadow)
+	}
+
+	reported := types.ShadowState{"interval": float64(30), "led": map[string]interface{}{"on": true}}
+	if err := s.UpdateDeviceShadow(ctx, d, types.ShadowReported, reported, 1); err != nil {
+		t.Fatalf("UpdateDeviceShadow(reported): %v", err)
+	}
+	got, err := s.GetDeviceByID(ctx, d.ID.String())
+	if err != nil {
+		t.Fatalf("GetDeviceByID: %v", err)
+	}
+	if got.Shadow.Version != 2 {
+		t.Errorf("version = %d, want 2", got.Shadow.Version)
+	}
+	led, _ := got.Shadow.Delta["led"].(map[string]interface{})
+	if len(got.Shadow.Delta) != 1 || len(led) != 1 || led["color"] != "red" {
+		t.Errorf("delta = %v, want only led.color", got.Shadow.Delta)
+	}
+
+	// A stale version is refused, null removes a key
+	if err := s.UpdateDeviceShadow(ctx, d, types.ShadowDesired, types.ShadowState{"led": nil}, 1); !errors.Is(err, types.ErrShadowVersionConflict) {
+		t.Errorf("UpdateDeviceShadow(stale version) = %v, want ErrShadowVersionConflict", err)
+	}
+	if err := s.UpdateDeviceShadow(ctx, d, types.ShadowDesired, types.ShadowState{"led": nil}, 2); err != nil {
+		t.Fatalf("UpdateDeviceShadow(remove): %v", err)
+	}
+	if _, ok := d.Shadow.Desired["led"]; ok || d.Shadow.Delta != nil {
+		t.Errorf("shadow after remove = %+v, want no led and no delta", d.Shadow)
+	}
+
+	if err := s.UpdateDeviceShadow(ctx, d, types.ShadowSection("other"), types.ShadowState{}, 0); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("UpdateDeviceShadow(unknown section) = %v, want a validation error", err)
+	}
+	stolen := *d
+	stolen.CompanyID = mustCompany(t, s).ID
+	if err := s.UpdateDeviceShadow(ctx, &stolen, types.ShadowDesired, types.ShadowState{"x": "y"}, 0); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Errorf("UpdateDeviceShadow(other company) = %v, want ErrDeviceNotExist", err)
+	}
+}
+
+func testDevicePresence(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+	d := mustDevice(t, s, g)
+
+	if d.Status != types.DeviceNeverSeen || d.LastSeenAt != nil {
+		t.Errorf("new device status = %q, last seen %v, want never seen", d.Status, d.LastSeenAt)
+	}
+	if !isStale(t, s, c, d.ID) {
+		t.Error("ListStaleDevices misses a device never seen")
+	}
+
+	if err := s.UpdateGroupHeartbeat(ctx, g, 10); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("UpdateGroupHeartbeat(10s) = %v, want a validation error", err)
+	}
+	if err := s.UpdateGroupHeartbeat(ctx, g, 60); err != nil {
+		t.Fatalf("UpdateGroupHeartbeat: %v", err)
+	}
+	if got, _ := s.GetGroupByID(ctx, g.ID.String()); got == nil || got.HeartbeatSeconds != 60 {
+		t.Errorf("group heartbeat = %+v, want 60", got)
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	online, err := s.RecordDevicesSeen(ctx, map[uuid.UUID]time.Time{d.ID: now, uuid.New(): now})
+	if err != nil {
+		t.Fatalf("RecordDevicesSeen: %v", err)
+	}
+	if len(online) != 1 || online[0] != d.ID {
+		t.Errorf("RecordDevicesSeen came online = %v, want only %v", online, d.ID)
+	}
+	if online, _ = s.RecordDevicesSeen(ctx, map[uuid.UUID]time.Time{d.ID: now.Add(-time.Hour)}); len(online) != 0 {
+		t.Errorf("RecordDevicesSeen(already online) = %v, want none", online)
+	}
+	got, err := s.GetDeviceByID(ctx, d.ID.String())
+	if err != nil {
+		t.Fatalf("GetDeviceByID: %v", err)
+	}
+	if got.Status != types.DeviceOnline || got.LastSeenAt == nil || !got.LastSeenAt.Equal(now) {
+		t.Errorf("seen device status = %q, last seen %v, want online at %v", got.Status, got.LastSeenAt, now)
+	}
+	if isStale(t, s, c, d.ID) {
+		t.Error("ListStaleDevices lists an online device")
+	}
+
+	offline := func(at time.Time) bool {
+		devices, err := s.MarkDevicesOffline(ctx, at)
+		if err != nil {
+			t.Fatalf("MarkDevicesOffline: %v", err)
+		}
+		for _, o := range devices {
+			if o.ID == d.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if offline(now.Add(30 * time.Second)) {
+		t.Error("device marked offline within its heartbeat timeout")
+	}
+	if !offline(now.Add(2 * time.Minute)) {
+		t.Error("device not marked offline after its heartbeat timeout")
+	}
+	if offline(now.Add(3 * time.Minute)) {
+		t.Error("device marked offline twice")
+	}
+	if online, _ = s.RecordDevicesSeen(ctx, map[uuid.UUID]time.Time{d.ID: now.Add(time.Second)}); len(online) != 1 {
+		t.Errorf("RecordDevicesSeen(offline device) = %v, want it back online", online)
+	}
+}
+
+// isStale reports whether ListStaleDevices of c lists the device
+func isStale(t *testing.T, s types.MetadataStore, c *types.Company, id uuid.UUID) bool {
+	t.Helper()
+	devices, _, err := s.ListStaleDevices(context.Background(), c.ID.String(), &types.ListOptions{Limit: types.MaxListLimit})
+	if err != nil {
+		t.Fatalf("ListStaleDevices: %v", err)
+	}
+	for _, d := range devices {
+		if d.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func testSchemaVersions(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+	d := mustDevice(t, s, g)
+	if d.SchemaVersion != 1 {
+		t.Errorf("new device schema version = %d, want 1", d.SchemaVersion)
+	}
+	first := d.TelemetryDataSchema
+
+	added := types.TelemetrySchema{"humidity": "int"}
+	for field, typ := range first {
+		added[field] = typ
+	}
+	if err := s.UpdateDeviceSchema(ctx, d, &added, false); err != nil {
+		t.Fatalf("UpdateDeviceSchema(added field): %v", err)
+	}
+	if d.SchemaVersion != 2 {
+		t.Errorf("schema version after adding a field = %d, want 2", d.SchemaVersion)
+	}
+	if err := s.UpdateDeviceSchema(ctx, d, &added, false); err != nil || d.SchemaVersion != 2 {
+		t.Errorf("UpdateDeviceSchema(unchanged) = %v, version %d, want no new version", err, d.SchemaVersion)
+	}
+
+	changed := types.TelemetrySchema{"humidity": "float"}
+	if err := s.UpdateDeviceSchema(ctx, d, &changed, false); !errors.Is(err, types.ErrSchemaIncompatible) {
+		t.Errorf("UpdateDeviceSchema(changed type) = %v, want ErrSchemaIncompatible", err)
+	}
+	if got, _ := s.GetDeviceByID(ctx, d.ID.String()); got == nil || got.SchemaVersion != 2 || got.TelemetryDataSchema["humidity"] != "int" {
+		t.Errorf("device after a refused change = %+v, want version 2 unchanged", got)
+	}
+	if err := s.UpdateDeviceSchema(ctx, d, &changed, true); err != nil {
+		t.Fatalf("UpdateDeviceSchema(forced): %v", err)
+	}
+
+	history, err := s.ListDeviceSchemas(ctx, d.ID.String())
+	if err != nil {
+		t.Fatalf("ListDeviceSchemas: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("ListDeviceSchemas returned %d versions, want 3", len(history))
+	}
+	for i, want := range []int{3, 2, 1} {
+		if history[i].Version != want {
+			t.Errorf("history[%d].Version = %d, want %d", i, history[i].Version, want)
+		}
+	}
+	if !history[0].Forced || history[1].Forced || !types.SchemaEqual(history[2].Schema, first) {
+		t.Errorf("history = %+v %+v %+v", history[0], history[1], history[2])
+	}
+	if _, err := s.ListDeviceSchemas(ctx, uuid.NewString()); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("ListDeviceSchemas(unknown) = %v, want a not found error", err)
+	}
+}
+
+func testSessions(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	owner := mustOwner(t, s, c)
+	expires := time.Now().Add(time.Hour)
+	hash := func() string { return types.HashToken(uniqueName("refresh")) }
+	revoked := func(session *types.Session, jti string) bool {
+		t.Helper()
+		r, err := s.TokenRevoked(ctx, jti, session.ID)
+		if err != nil {
+			t.Fatalf("TokenRevoked: %v", err)
+		}
+		return r
+	}
+
+	// Jtis are unique too, the denylist outlives the companies
+	denied, fresh := uniqueName("jti"), uniqueName("jti")
+	first := hash()
+	session, err := s.CreateSession(ctx, owner.ID, first, expires)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if session.ID == uuid.Nil || session.UserID != owner.ID || session.CompanyID != c.ID || session.Role != types.RoleOwner {
+		t.Errorf("CreateSession = %+v, want an owner session of %v", session, c.ID)
+	}
+	if _, err := s.CreateSession(ctx, uuid.New(), hash(), expires); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("CreateSession(unknown user) = %v, want not found", err)
+	}
+	if revoked(session, denied) {
+		t.Error("new session reported revoked")
+	}
+
+	second := hash()
+	rotated, err := s.RotateRefreshToken(ctx, first, second, expires.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+	if rotated.ID != session.ID || !rotated.ExpiresAt.After(expires) {
+		t.Errorf("rotated session = %+v, want %v extended", rotated, session.ID)
+	}
+	if _, err := s.RotateRefreshToken(ctx, hash(), hash(), expires); !errors.Is(err, types.ErrUnauthorized) {
+		t.Errorf("RotateRefreshToken(unknown) = %v, want unauthorized", err)
+	}
+
+	if err := s.DenyToken(ctx, denied, expires); err != nil {
+		t.Fatalf("DenyToken: %v", err)
+	}
+	if err := s.DenyToken(ctx, denied, expires); err != nil {
+		t.Errorf("DenyToken twice: %v", err)
+	}
+	if !revoked(session, denied) || revoked(session, fresh) {
+		t.Error("denylist does not match the denied token only")
+	}
+
+	// Replaying the first token means it leaked, the whole session goes
+	if _, err := s.RotateRefreshToken(ctx, first, hash(), expires); !errors.Is(err, types.ErrUnauthorized) {
+		t.Errorf("RotateRefreshToken(reused) = %v, want unauthorized", err)
+	}
+	if !revoked(session, fresh) {
+		t.Error("session survived a reused refresh token")
+	}
+	if _, err := s.RotateRefreshToken(ctx, second, hash(), expires); !errors.Is(err, types.ErrUnauthorized) {
+		t.Errorf("RotateRefreshToken(revoked session) = %v, want unauthorized", err)
+	}
+
+	other, err := s.CreateSession(ctx, owner.ID, hash(), expires)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := s.RevokeSession(ctx, other.ID); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if err := s.RevokeSession(ctx, other.ID); err != nil {
+		t.Errorf("RevokeSession twice: %v", err)
+	}
+	if !revoked(other, fresh) {
+		t.Error("revoked session still active")
+	}
+
+	live, err := s.CreateSession(ctx, owner.ID, hash(), expires)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := s.UpdateUserPassword(ctx, owner, testPassword, "batterystaple"); err != nil {
+		t.Fatalf("UpdateUserPassword: %v", err)
+	}
+	if !revoked(live, fresh) {
+		t.Error("session survived a password change")
+	}
+
+	expired, err := s.CreateSession(ctx, owner.ID, hash(), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if !revoked(expired, fresh) {
+		t.Error("expired session still active")
+	}
+	if err := s.PurgeSessions(ctx, time.Now()); err != nil {
+		t.Fatalf("PurgeSessions: %v", err)
+	}
+	if !revoked(expired, fresh) {
+		t.Error("purged session still active")
+	}
+
+	d := mustCompany(t, s)
+	gone, err := s.CreateSession(ctx, mustOwner(t, s, d).ID, hash(), expires)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := s.DeleteCompany(ctx, &types.Company{ID: d.ID}); err != nil {
+		t.Fatalf("DeleteCompany: %v", err)
+	}
+	if !revoked(gone, fresh) {
+		t.Error("session survived its company")
+	}
+}
+
+func testAPIKeys(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	owner := mustOwner(t, s, c)
+	g := mustGroup(t, s, c)
+	now := time.Now()
+	hash := func() string { return types.HashToken(uniqueName(types.APIKeyPrefix)) }
+
+	wideHash, scopedHash, expiredHash := hash(), hash(), hash()
+	wide := &types.APIKey{CompanyID: c.ID, Name: uniqueName("ci"), CreatedBy: owner.ID}
+	if err := s.CreateAPIKey(ctx, wide, wideHash); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	if wide.ID == uuid.Nil || wide.CreatedAt.IsZero() {
+		t.Errorf("CreateAPIKey did not set id and created_at: %+v", wide)
+	}
+	expiresAt := now.Add(time.Hour)
+	scoped := &types.APIKey{CompanyID: c.ID, GrpID: g.ID, Name: uniqueName("job"), ReadOnly: true, ExpiresAt: &expiresAt}
+	if err := s.CreateAPIKey(ctx, scoped, scopedHash); err != nil {
+		t.Fatalf("CreateAPIKey(group): %v", err)
+	}
+	expiredAt := now.Add(-time.Minute)
+	expired := &types.APIKey{CompanyID: c.ID, Name: uniqueName("old"), ExpiresAt: &expiredAt}
+	if err := s.CreateAPIKey(ctx, expired, expiredHash); err != nil {
+		t.Fatalf("CreateAPIKey(expired): %v", err)
+	}
+
+	other := mustGroup(t, s, mustCompany(t, s))
+	if err := s.CreateAPIKey(ctx, &types.APIKey{CompanyID: c.ID, GrpID: other.ID, Name: uniqueName("x")}, hash()); !errors.Is(err, metadatastore.ErrGroupNotExist) {
+		t.Errorf("CreateAPIKey(other company's group) = %v, want group not found", err)
+	}
+	if err := s.CreateAPIKey(ctx, &types.APIKey{CompanyID: c.ID, Name: "has space"}, hash()); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("CreateAPIKey(bad name) = %v, want validation error", err)
+	}
+
+	got, err := s.VerifyAPIKey(ctx, scopedHash, now)
+	if err != nil {
+		t.Fatalf("VerifyAPIKey: %v", err)
+	}
+	if got.ID != scoped.ID || got.GrpID != g.ID || !got.ReadOnly || got.Role() != types.RoleViewer {
+		t.Errorf("VerifyAPIKey = %+v, want the read-only key of group %v", got, g.ID)
+	}
+	if got.LastUsedAt == nil {
+		t.Error("VerifyAPIKey did not record the use")
+	}
+	if _, err := s.VerifyAPIKey(ctx, expiredHash, now); !errors.Is(err, types.ErrInvalidAPIKey) {
+		t.Errorf("VerifyAPIKey(expired) = %v, want invalid api key", err)
+	}
+	if _, err := s.VerifyAPIKey(ctx, hash(), now); !errors.Is(err, types.ErrUnauthorized) {
+		t.Errorf("VerifyAPIKey(unknown) = %v, want unauthorized", err)
+	}
+
+	revoke := &types.APIKey{ID: wide.ID, CompanyID: other.CompanyID}
+	if err := s.RevokeAPIKey(ctx, revoke); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("RevokeAPIKey(other company) = %v, want not found", err)
+	}
+	revoke.CompanyID = c.ID
+	if err := s.RevokeAPIKey(ctx, revoke); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	if revoke.RevokedAt == nil || revoke.Name != wide.Name {
+		t.Errorf("RevokeAPIKey set %+v, want the revoked key", revoke)
+	}
+	if err := s.RevokeAPIKey(ctx, &types.APIKey{ID: wide.ID, CompanyID: c.ID}); err != nil {
+		t.Errorf("RevokeAPIKey twice: %v", err)
+	}
+	if _, err := s.VerifyAPIKey(ctx, wideHash, now); !errors.Is(err, types.ErrInvalidAPIKey) {
+		t.Errorf("VerifyAPIKey(revoked) = %v, want invalid api key", err)
+	}
+
+	keys, err := s.ListAPIKeysByCompany(ctx, c.ID.String())
+	if err != nil {
+		t.Fatalf("ListAPIKeysByCompany: %v", err)
+	}
+	if len(keys) != 3 || keys[0].ID != wide.ID || keys[0].RevokedAt == nil || keys[1].LastUsedAt == nil {
+		t.Errorf("ListAPIKeysByCompany = %d keys, want 3 oldest first with revocation and last use", len(keys))
+	}
+
+	// Keys go with their group
+	if err := s.DeleteGroup(ctx, g); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if _, err := s.VerifyAPIKey(ctx, scopedHash, now); !errors.Is(err, types.ErrInvalidAPIKey) {
+		t.Errorf("VerifyAPIKey after DeleteGroup = %v, want invalid api key", err)
+	}
+}
+
+// auditActions lists the actions of a company's audit log matching f, newest first
+func auditActions(t *testing.T, s types.MetadataStore, c *types.Company, f *types.AuditFilter) ([]*types.AuditEvent, []string) {
+	t.Helper()
+	events, _, err := s.ListAuditEvents(context.Background(), c.ID.String(), f)
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	actions := make([]string, len(events))
+	for i, e := range events {
+		actions[i] = e.Action
+	}
+	return events, actions
+}
+
+func testAudit(t *testing.T, s types.MetadataStore) {
+	c := mustCompany(t, s)
+	owner := mustOwner(t, s, c)
+	ctx := types.WithActor(context.Background(), types.Actor{UserID: owner.ID, RequestID: "req-audit"})
+
+	g := &types.Grp{CompanyID: c.ID, GroupName: uniqueName("grp")}
+	if err := s.CreateGroup(ctx, g); err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	d := &types.Device{GrpID: g.ID, CompanyID: c.ID, DeviceName: uniqueName("dev"), TelemetryDataSchema: types.TelemetrySchema{"temp": "float"}}
+	if err := s.CreateDevice(ctx, d); err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	if err := s.UpdateDeviceSchema(ctx, d, &types.TelemetrySchema{"temp": "float", "rh": "int"}, false); err != nil {
+		t.Fatalf("UpdateDeviceSchema: %v", err)
+	}
+	if err := s.UpdateDeviceShadow(ctx, d, types.ShadowDesired, types.ShadowState{"led": true}, 0); err != nil {
+		t.Fatalf("UpdateDeviceShadow(desired): %v", err)
+	}
+	// Reports come from the device and are not audited
+	if err := s.UpdateDeviceShadow(ctx, d, types.ShadowReported, types.ShadowState{"led": true}, 0); err != nil {
+		t.Fatalf("UpdateDeviceShadow(reported): %v", err)
+	}
+	if _, err := s.RotateDeviceSecret(ctx, d); err != nil {
+		t.Fatalf("RotateDeviceSecret: %v", err)
+	}
+	// Failed changes leave no event
+	if err := s.UpdateDeviceSchema(ctx, d, &types.TelemetrySchema{"temp": "int"}, false); err == nil {
+		t.Fatal("UpdateDeviceSchema accepted an incompatible schema")
+	}
+
+	keyCtx := types.WithActor(context.Background(), types.Actor{APIKeyID: uuid.New()})
+	if err := s.UpdateGroupHeartbeat(keyCtx, g, 90); err != nil {
+		t.Fatalf("UpdateGroupHeartbeat: %v", err)
+	}
+
+	events, actions := auditActions(t, s, c, nil)
+	want := []string{types.AuditGroupHeartbeat, types.AuditDeviceSecretRotate, types.AuditDeviceShadowDesired,
+		types.AuditDeviceSchema, types.AuditDeviceCreate, types.AuditGroupCreate, types.AuditCompanyCreate}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Fatalf("audit log = %v, want %v", actions, want)
+	}
+
+	// Signups are made by the new owner
+	if signup := events[6]; signup.ActorUserID != owner.ID || signup.ResourceID != c.ID || strings.Contains(string(signup.After), testPassword) {
+		t.Errorf("company.create event = %+v, want owner %v as actor and no password", signup, owner.ID)
+	}
+	created := events[4]
+	if created.ActorUserID != owner.ID || created.RequestID != "req-audit" || created.ResourceID != d.ID || created.CompanyID != c.ID {
+		t.Errorf("device.create event = %+v, want actor, request id and device", created)
+	}
+	if created.Before != nil || created.After == nil || created.CreatedAt.IsZero() {
+		t.Errorf("device.create event has before %s, after %s, want only after", created.Before, created.After)
+	}
+	for _, e := range events {
+		if d.DeviceSecret != "" && (strings.Contains(string(e.Before), d.DeviceSecret) || strings.Contains(string(e.After), d.DeviceSecret)) {
+			t.Errorf("%s event leaks the device secret", e.Action)
+		}
+	}
+	if heartbeat := events[0]; heartbeat.ActorAPIKeyID == uuid.Nil || heartbeat.ActorUserID != uuid.Nil || heartbeat.Before == nil || heartbeat.After == nil {
+		t.Errorf("group.update_heartbeat event = %+v, want the api key as actor and both states", heartbeat)
+	}
+
+	if _, actions := auditActions(t, s, c, &types.AuditFilter{Action: types.AuditDeviceSchema}); len(actions) != 1 {
+		t.Errorf("filter by action = %v, want 1 event", actions)
+	}
+	if _, actions := auditActions(t, s, c, &types.AuditFilter{ResourceID: d.ID}); len(actions) != 4 {
+		t.Errorf("filter by resource = %v, want 4 events", actions)
+	}
+	if _, actions := auditActions(t, s, c, &types.AuditFilter{ActorID: events[0].ActorAPIKeyID}); len(actions) != 1 {
+		t.Errorf("filter by api key = %v, want 1 event", actions)
+	}
+	if _, actions := auditActions(t, s, c, &types.AuditFilter{ActorID: owner.ID}); len(actions) != 6 {
+		t.Errorf("filter by user = %v, want 6 events", actions)
+	}
+	if _, actions := auditActions(t, s, c, &types.AuditFilter{Since: events[3].CreatedAt, Until: events[1].CreatedAt}); len(actions) != 2 {
+		t.Errorf("filter by time = %v, want 2 events", actions)
+	}
+
+	var paged []string
+	f := &types.AuditFilter{Limit: 3}
+	for page := 0; ; page++ {
+		if page > len(events) {
+			t.Fatal("audit pagination does not end")
+		}
+		got, next, err := s.ListAuditEvents(context.Background(), c.ID.String(), f)
+		if err != nil {
+			t.Fatalf("ListAuditEvents page %d: %v", page, err)
+		}
+		for _, e := range got {
+			paged = append(paged, e.Action)
+		}
+		if next == "" {
+			break
+		}
+		f.Cursor = next
+	}
+	if strings.Join(paged, " ") != strings.Join(want, " ") {
+		t.Errorf("paged audit log = %v, want %v", paged, want)
+	}
+	if _, _, err := s.ListAuditEvents(context.Background(), c.ID.String(), &types.AuditFilter{Cursor: "nope"}); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("ListAuditEvents(bad cursor) = %v, want validation error", err)
+	}
+
+	other := mustCompany(t, s)
+	if _, actions := auditActions(t, s, other, nil); len(actions) != 1 || actions[0] != types.AuditCompanyCreate {
+		t.Errorf("other company's audit log = %v, want only its signup", actions)
+	}
+
+	// The log outlives the company
+	if err := s.DeleteCompany(ctx, &types.Company{ID: c.ID}); err != nil {
+		t.Fatalf("DeleteCompany: %v", err)
+	}
+	if _, actions := auditActions(t, s, c, nil); len(actions) != len(want)+1 || actions[0] != types.AuditCompanyDelete {
+		t.Errorf("audit log after DeleteCompany = %v, want %s first", actions, types.AuditCompanyDelete)
+	}
+}
+
+func testCascadingDeletes(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	keep := mustGroup(t, s, c)
+	drop := mustGroup(t, s, c)
+	kept := mustDevice(t, s, keep)
+	dropped := []*types.Device{mustDevice(t, s, drop), mustDevice(t, s, drop)}
+
+	if err := s.DeleteGroup(ctx, drop); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	for _, d := range dropped {
+		if _, err := s.GetDeviceByID(ctx, d.ID.String()); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+			t.Errorf("device %s survived its group", d.ID)
+		}
+	}
+	company := mustGetCompany(t, s, c.ID)
+	if company.NoOfGrps != 1 || company.NoOfDevices != 1 {
+		t.Errorf("company counts %d groups, %d devices, want 1, 1", company.NoOfGrps, company.NoOfDevices)
+	}
+
+	if err := s.DeleteCompany(ctx, &types.Company{ID: c.ID}); err != nil {
+		t.Fatalf("DeleteCompany: %v", err)
+	}
+	if _, err := s.GetGroupByID(ctx, keep.ID.String()); !errors.Is(err, metadatastore.ErrGroupNotExist) {
+		t.Error("group survived its company")
+	}
+	if _, err := s.GetDeviceByID(ctx, kept.ID.String()); !errors.Is(err, metadatastore.ErrDeviceNotExist) {
+		t.Error("device survived its company")
+	}
+}
+
+func testConcurrentDeviceCreates(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := &types.Device{GrpID: g.ID, CompanyID: c.ID, DeviceName: uniqueName("dev")}
+			errs <- s.CreateDevice(ctx, d)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("CreateDevice: %v", err)
+		}
+	}
+
+	if got := mustGetGroup(t, s, g.ID).NoOfDevices; got != n {
+		t.Errorf("group counts %d devices, want %d", got, n)
+	}
+	if got := mustGetCompany(t, s, c.ID).NoOfDevices; got != n {
+		t.Errorf("company counts %d devices, want %d", got, n)
+	}
+}
+
+func testListPagination(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	g := mustGroup(t, s, c)
+	const n = 7
+	for i := 0; i < n; i++ {
+		mustDevice(t, s, g)
+	}
+
+	for _, sort := range []string{types.SortName, types.SortNameDesc} {
+		var names []string
+		opts := &types.ListOptions{Limit: 3, Sort: sort}
+		for pages := 0; ; pages++ {
+			if pages > n {
+				t.Fatalf("sort %s: pagination does not terminate", sort)
+			}
+			devices, next, err := s.ListDevicesByGroup(ctx, g.ID.String(), opts)
+			if err != nil {
+				t.Fatalf("ListDevicesByGroup: %v", err)
+			}
+			if len(devices) > opts.Limit {
+				t.Fatalf("page of %d devices, limit %d", len(devices), opts.Limit)
+			}
+			for _, d := range devices {
+				names = append(names, d.DeviceName)
+			}
+			if next == "" {
+				break
+			}
+			opts.Cursor = next
+		}
+
+		if len(names) != n {
+			t.Fatalf("sort %s: paged through %d devices, want %d", sort, len(names), n)
+		}
+		for i := 1; i < len(names); i++ {
+			inOrder := names[i-1] < names[i]
+			if sort == types.SortNameDesc {
+				inOrder = names[i-1] > names[i]
+			}
+			if !inOrder {
+				t.Errorf("sort %s: %q listed before %q", sort, names[i-1], names[i])
+			}
+		}
+	}
+
+	if _, _, err := s.ListDevicesByGroup(ctx, g.ID.String(), &types.ListOptions{Cursor: "%%%"}); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("ListDevicesByGroup(bad cursor) = %v, want a Validation error", err)
+	}
+	if _, _, err := s.ListGroupsByCompany(ctx, c.ID.String(), &types.ListOptions{Sort: types.SortType}); !errors.Is(err, types.ErrValidation) {
+		t.Errorf("ListGroupsByCompany(sort by type) = %v, want a Validation error", err)
+	}
+}
+
+func testListFilters(t *testing.T, s types.MetadataStore) {
+	ctx := context.Background()
+	c := mustCompany(t, s)
+	alpha := &types.Grp{CompanyID: c.ID, GroupName: uniqueName("alpha")}
+	beta := &types.Grp{CompanyID: c.ID, GroupName: uniqueName("beta")}
+	for _, g := range []*types.Grp{alpha, beta} {
+		if err := s.CreateGroup(ctx, g); err != nil {
+			t.Fatalf("CreateGroup: %v", err)
+		}
+	}
+
+	groups, _, err := s.ListGroupsByCompany(ctx, c.ID.String(), &types.ListOptions{NamePrefix: "alpha"})
+	if err != nil || len(groups) != 1 || groups[0].ID != alpha.ID {
+		t.Errorf("ListGroupsByCompany(prefix alpha) = %v, %v", groups, err)
+	}
+
+	for _, typ := range []string{"camera", "meter", "meter"} {
+		d := &types.Device{GrpID: alpha.ID, CompanyID: c.ID, DeviceName: uniqueName("dev"), DeviceType: typ}
+		if err := s.CreateDevice(ctx, d); err != nil {
+			t.Fatalf("CreateDevice: %v", err)
+		}
+	}
+
+	meters, _, err := s.ListDevicesByCompany(ctx, c.ID.String(), &types.ListOptions{DeviceType: "meter"})
+	if err != nil || len(meters) != 2 {
+		t.Errorf("ListDevicesByCompany(type meter) = %d devices, %v, want 2", len(meters), err)
+	}
+
+	byType, _, err := s.ListDevicesByCompany(ctx, c.ID.String(), &types.ListOptions{Sort: types.SortTypeDesc})
+	if err != nil || len(byType) != 3 {
+		t.Fatalf("ListDevicesByCompany(sort -type) = %d devices, %v, want 3", len(byType), err)
+	}
+	if byType[0].DeviceType != "meter" || byType[2].DeviceType != "camera" {
+		t.Errorf("sort -type listed %s first and %s last", byType[0].DeviceType, byType[2].DeviceType)
+	}
+}
@@ -0,0 +1,72 @@
+package metadatatest
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+	types "github.com/mukundvijay123/KCloud/metadata"
+	"github.com/mukundvijay123/KCloud/migrations"
+)
+
+// OpenTestDb opens the database of KCLOUD_TEST_DSN migrated to the latest
+// version and skips t when it is not set. Names are unique, any database will do.
+func OpenTestDb(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("KCLOUD_TEST_DSN")
+	if dsn == "" {
+		t.Skip("KCLOUD_TEST_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.NewMigrator(db, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("migrating the test database: %v", err)
+	}
+	return db
+}
+
+// MustDevice creates a company with a group and a device in s, for the tests
+// of the stores that keep their own rows of them
+func MustDevice(t *testing.T, s types.MetadataStore) *types.Device {
+	t.Helper()
+	return MustDevices(t, s, 1)[0]
+}
+
+// MustDevices is MustDevice for n devices of one company and group
+func MustDevices(t *testing.T, s types.MetadataStore, n int) []*types.Device {
+	t.Helper()
+	g := mustGroup(t, s, mustCompany(t, s))
+	devices := make([]*types.Device, n)
+	for i := range devices {
+		devices[i] = mustDevice(t, s, g)
+	}
+	return devices
+}
+
+// AuditActions lists the actions of a company's audit log, newest first
+func AuditActions(t *testing.T, s types.AuditStore, companyID string) ([]*types.AuditEvent, string) {
+	t.Helper()
+	events, _, err := s.ListAuditEvents(context.Background(), companyID, nil)
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	actions := make([]string, len(events))
+	for i, e := range events {
+		actions[i] = e.Action
+	}
+	return events, strings.Join(actions, " ")
+}
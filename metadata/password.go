@@ -0,0 +1,47 @@
+package metadata
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordHashCost  = 12 //bcrypt work factor for company passwords
+	MaxPasswordLength = 72 //bcrypt ignores anything past 72 bytes, longer passwords are rejected
+)
+
+// DummyPasswordHash is checked against when a login names an unknown user, so
+// it takes as long as a wrong password and the timing doesn't tell usernames apart
+const DummyPasswordHash = "$2a$12$xC2DO3CFlVkEmPBhh.kPBeJyzWYYqZX1GK351xlvnFwq/H0jxgG3a"
+
+// HashPassword returns the bcrypt hash stored in place of a password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword compares a password with the stored value in constant time.
+// Rows written before hashing was introduced hold the plaintext, those still
+// verify but report needsRehash, as do hashes made with a lower cost.
+func CheckPassword(stored, password string) (ok bool, needsRehash bool) {
+	if !IsPasswordHash(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost < PasswordHashCost
+}
+
+// IsPasswordHash reports whether a stored password is a bcrypt hash rather than legacy plaintext
+func IsPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
@@ -0,0 +1,22 @@
+package metadata
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A dummy hash that doesn't parse, or is cheaper than real ones, fails fast
+// and gives unknown usernames away again
+func TestDummyPasswordHash(t *testing.T) {
+	cost, err := bcrypt.Cost([]byte(DummyPasswordHash))
+	if err != nil {
+		t.Fatalf("DummyPasswordHash is not a bcrypt hash: %v", err)
+	}
+	if cost != PasswordHashCost {
+		t.Errorf("DummyPasswordHash has cost %d, want PasswordHashCost %d", cost, PasswordHashCost)
+	}
+	if ok, _ := CheckPassword(DummyPasswordHash, ""); ok {
+		t.Error("the empty password matches DummyPasswordHash")
+	}
+}
@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultHeartbeatTimeout = 5 * time.Minute
+	MinHeartbeatTimeout     = 30 * time.Second //last seen times are written in batches, shorter would flap
+	MaxHeartbeatTimeout     = 7 * 24 * time.Hour
+)
+
+// DeviceStatus is derived from when a device was last seen and the heartbeat timeout of its group
+type DeviceStatus string
+
+const (
+	DeviceOnline    DeviceStatus = "online"
+	DeviceOffline   DeviceStatus = "offline"
+	DeviceNeverSeen DeviceStatus = "never_seen"
+)
+
+var ErrInvalidHeartbeat = NewError(ErrValidation, "invalid heartbeat timeout")
+
+// PresenceRecorder is told about every message of a device, from any transport.
+// It must not block, it is called on the ingest path.
+type PresenceRecorder interface {
+	DeviceSeen(d *Device, at time.Time)
+}
+
+// PresenceStore keeps when devices were last seen, apart from the device rows
+// so that traffic doesnt write them
+type PresenceStore interface {
+	//Moves the last seen times of devices forward, returns the ids of those that were offline or never seen
+	RecordDevicesSeen(ctx context.Context, seen map[uuid.UUID]time.Time) ([]uuid.UUID, error)
+	//Flips online devices not seen within their group heartbeat timeout to offline and returns them
+	MarkDevicesOffline(ctx context.Context, now time.Time) ([]*Device, error)
+	//Lists one page of the devices of a company not seen within their group heartbeat timeout
+	ListStaleDevices(ctx context.Context, companyID string, opts *ListOptions) ([]*Device, string, error)
+}
+
+// HeartbeatTimeout is the timeout of a group, the default when it has none
+func (g *Grp) HeartbeatTimeout() time.Duration {
+	if g.HeartbeatSeconds <= 0 {
+		return DefaultHeartbeatTimeout
+	}
+	return time.Duration(g.HeartbeatSeconds) * time.Second
+}
+
+// NormalizeHeartbeat checks a heartbeat timeout in seconds, 0 is replaced by the default
+func NormalizeHeartbeat(seconds int) (int, error) {
+	if seconds == 0 {
+		return int(DefaultHeartbeatTimeout / time.Second), nil
+	}
+	if d := time.Duration(seconds) * time.Second; seconds < 0 || d < MinHeartbeatTimeout || d > MaxHeartbeatTimeout {
+		return 0, fmt.Errorf("%w: must be between %v and %v", ErrInvalidHeartbeat, MinHeartbeatTimeout, MaxHeartbeatTimeout)
+	}
+	return seconds, nil
+}
+
+// SetPresence sets LastSeenAt and the Status derived from it at now
+func (d *Device) SetPresence(lastSeen *time.Time, timeout time.Duration, now time.Time) {
+	d.LastSeenAt = nil
+	d.Status = DeviceNeverSeen
+	if lastSeen == nil {
+		return
+	}
+	t := lastSeen.UTC()
+	d.LastSeenAt = &t
+	d.Status = DeviceOffline
+	if now.Sub(t) < timeout {
+		d.Status = DeviceOnline
+	}
+}
@@ -0,0 +1,51 @@
+package metadata
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrSchemaIncompatible = NewError(ErrConflict, "incompatible schema change")
+
+// SchemaRevision is one version of a device telemetry schema. Readings are
+// tagged with the version they were validated against.
+type SchemaRevision struct {
+	Version   int             `json:"version"`
+	Schema    TelemetrySchema `json:"telemetry_data_schema"`
+	Forced    bool            `json:"forced"` //saved despite changing or removing fields
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// CheckSchemaChange checks that next only adds fields to prev. Changing the
+// type of a field or removing one would break readings stored under prev.
+func CheckSchemaChange(prev, next TelemetrySchema) error {
+	var problems []string
+	for field, typ := range prev {
+		newTyp, ok := next[field]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("field '%s' removed", field))
+		} else if newTyp != typ {
+			problems = append(problems, fmt.Sprintf("field '%s' changed from %s to %s", field, typ, newTyp))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%w: %s, pass force to save it anyway", ErrSchemaIncompatible, strings.Join(problems, ", "))
+}
+
+// SchemaEqual reports whether two schemas have the same fields and types
+func SchemaEqual(a, b TelemetrySchema) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for field, typ := range a {
+		if b[field] != typ {
+			return false
+		}
+	}
+	return true
+}
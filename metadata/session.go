@@ -0,0 +1,44 @@
+package metadata
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var ErrInvalidRefreshToken = NewError(ErrUnauthorized, "invalid refresh token")
+
+// Session is one login of a user. Its access tokens stop working once it is
+// revoked, by logout, a password or role change or a reused refresh token.
+type Session struct {
+	ID        uuid.UUID  `json:"id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	CompanyID uuid.UUID  `json:"company_id"` //of the user
+	Role      Role       `json:"role"`       //of the user, current as of the last refresh
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"` //moved forward by every refresh
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// SessionStore keeps sessions, their refresh tokens (only hashes, see
+// HashToken) and the denylist of access token ids. Sessions go with
+// their user, see UserStore.
+type SessionStore interface {
+	//Starts a session whose first refresh token hashes to refreshHash
+	CreateSession(ctx context.Context, userID uuid.UUID, refreshHash string, expiresAt time.Time) (*Session, error)
+	//Swaps a refresh token for a new one. A token used twice was stolen, the session is revoked.
+	RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*Session, error)
+	RevokeSession(ctx context.Context, sessionID uuid.UUID) error
+	//Denies an access token until it expires
+	DenyToken(ctx context.Context, jti string, expiresAt time.Time) error
+	//Reports whether an access token was denied or its session is gone, revoked or expired
+	TokenRevoked(ctx context.Context, jti string, sessionID uuid.UUID) (bool, error)
+	//Drops sessions and denylist entries that expired before now
+	PurgeSessions(ctx context.Context, now time.Time) error
+}
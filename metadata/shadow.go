@@ -0,0 +1,204 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+const (
+	MaxShadowBytes = 8 << 10 //per section, JSON encoded
+	MaxShadowDepth = 6
+)
+
+// ShadowSection names a half of the shadow
+type ShadowSection string
+
+const (
+	ShadowDesired  ShadowSection = "desired"  //written by apps
+	ShadowReported ShadowSection = "reported" //written by the device
+)
+
+var (
+	ErrInvalidShadow         = NewError(ErrValidation, "invalid shadow")
+	ErrShadowVersionConflict = NewError(ErrConflict, "shadow version mismatch")
+)
+
+// ShadowNotifier tells a device about desired state it hasnt reported yet, e.g. over MQTT
+type ShadowNotifier interface {
+	NotifyShadow(d *Device)
+}
+
+// ShadowState is a JSON object of device state
+type ShadowState map[string]interface{}
+
+// Shadow is the desired and reported state of a device. Version is bumped on
+// every update, pass it back to update only if nobody else did in between.
+type Shadow struct {
+	Desired  ShadowState `json:"desired"`
+	Reported ShadowState `json:"reported"`
+	Delta    ShadowState `json:"delta,omitempty"` //desired state the device hasnt reported yet, computed
+	Version  int64       `json:"version"`
+}
+
+// ApplyShadowPatch merges patch into section of s and bumps the version. A
+// version other than 0 must match s.Version. Patches merge like RFC 7386: nested
+// objects merge, null removes a key, anything else replaces.
+func (s *Shadow) ApplyShadowPatch(section ShadowSection, patch ShadowState, version int64) error {
+	if version != 0 && version != s.Version {
+		return fmt.Errorf("%w: have %d, got %d", ErrShadowVersionConflict, s.Version, version)
+	}
+
+	var target *ShadowState
+	switch section {
+	case ShadowDesired:
+		target = &s.Desired
+	case ShadowReported:
+		target = &s.Reported
+	default:
+		return fmt.Errorf("%w: unknown section %q", ErrInvalidShadow, section)
+	}
+
+	merged := mergeState(*target, patch)
+	if err := validateShadowState(merged); err != nil {
+		return err
+	}
+	*target = merged
+	s.Version++
+	s.Delta = ShadowDelta(s.Desired, s.Reported)
+	return nil
+}
+
+// ShadowDelta returns the parts of desired that differ from reported
+func ShadowDelta(desired, reported ShadowState) ShadowState {
+	delta := ShadowState{}
+	for k, want := range desired {
+		have, ok := reported[k]
+		if !ok {
+			delta[k] = want
+			continue
+		}
+		wantObj, wantIsObj := asState(want)
+		haveObj, haveIsObj := asState(have)
+		if wantIsObj && haveIsObj {
+			if sub := ShadowDelta(wantObj, haveObj); len(sub) > 0 {
+				delta[k] = sub
+			}
+			continue
+		}
+		if !reflect.DeepEqual(want, have) {
+			delta[k] = want
+		}
+	}
+	if len(delta) == 0 {
+		return nil
+	}
+	return delta
+}
+
+// UnmarshalShadow fills in a device shadow from its stored columns
+func UnmarshalShadow(desired, reported []byte, version int64) (Shadow, error) {
+	s := Shadow{Desired: ShadowState{}, Reported: ShadowState{}, Version: version}
+	if len(desired) > 0 {
+		if err := json.Unmarshal(desired, &s.Desired); err != nil {
+			return s, err
+		}
+	}
+	if len(reported) > 0 {
+		if err := json.Unmarshal(reported, &s.Reported); err != nil {
+			return s, err
+		}
+	}
+	s.Delta = ShadowDelta(s.Desired, s.Reported)
+	return s, nil
+}
+
+// mergeState returns base with patch merged in, base is not modified
+func mergeState(base, patch ShadowState) ShadowState {
+	merged := make(ShadowState, len(base)+len(patch))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(merged, k)
+			continue
+		}
+		patchObj, patchIsObj := asState(v)
+		baseObj, baseIsObj := asState(merged[k])
+		if patchIsObj {
+			if !baseIsObj {
+				baseObj = nil
+			}
+			merged[k] = map[string]interface{}(mergeState(baseObj, patchObj))
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+func validateShadowState(s ShadowState) error {
+	if depth(s) > MaxShadowDepth {
+		return fmt.Errorf("%w: nested deeper than %d levels", ErrInvalidShadow, MaxShadowDepth)
+	}
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidShadow, err)
+	}
+	if len(raw) > MaxShadowBytes {
+		return fmt.Errorf("%w: state exceeds %d bytes", ErrInvalidShadow, MaxShadowBytes)
+	}
+	return nil
+}
+
+func depth(v interface{}) int {
+	switch t := v.(type) {
+	case ShadowState:
+		return depth(map[string]interface{}(t))
+	case map[string]interface{}:
+		max := 0
+		for _, child := range t {
+			if d := depth(child); d > max {
+				max = d
+			}
+		}
+		return max + 1
+	case []interface{}:
+		max := 0
+		for _, child := range t {
+			if d := depth(child); d > max {
+				max = d
+			}
+		}
+		return max + 1
+	}
+	return 0
+}
+
+func asState(v interface{}) (ShadowState, bool) {
+	switch t := v.(type) {
+	case ShadowState:
+		return t, true
+	case map[string]interface{}:
+		return t, true
+	}
+	return nil, false
+}
+
+// CopyShadow deep copies s so the copy can be changed independently
+func CopyShadow(s Shadow) Shadow {
+	return Shadow{
+		Desired:  copyState(s.Desired),
+		Reported: copyState(s.Reported),
+		Delta:    copyState(s.Delta),
+		Version:  s.Version,
+	}
+}
+
+func copyState(s ShadowState) ShadowState {
+	if s == nil {
+		return nil
+	}
+	return mergeState(nil, s)
+}
@@ -0,0 +1,27 @@
+package metadata
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// TokenBytes is the amount of randomness in a token
+const TokenBytes = 32
+
+// NewToken generates a random bearer token, hex encoded, for device secrets,
+// refresh tokens, API keys, invites and webhook secrets
+func NewToken() (string, error) {
+	b := make([]byte, TokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the hex sha256 of a token, the only form that is stored.
+// Tokens are random so a fast hash is enough, no salt or KDF needed.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
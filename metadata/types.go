@@ -1,21 +1,26 @@
 package metadata
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type Company struct {
 	ID              uuid.UUID `json:"id"` //UUID for company
 	CompanyName     string    `json:"company_name"`
-	Username        string    `json:"username"` //has to be unique
-	CompanyPassword string    `json:"company_password"`
+	Username        string    `json:"username"`         //has to be unique
+	CompanyPassword string    `json:"company_password"` //only read on signup, the password of the first owner
 	NoOfGrps        int       `json:"no_of_grps"`
 	NoOfDevices     int       `json:"no_of_devices"`
 }
 
 type Grp struct {
-	ID          uuid.UUID ` json:"id"`
-	CompanyID   uuid.UUID ` json:"company_id"`
-	GroupName   string    ` json:"group_name"`
-	NoOfDevices int       ` json:"no_of_devices"`
+	ID               uuid.UUID ` json:"id"`
+	CompanyID        uuid.UUID ` json:"company_id"`
+	GroupName        string    ` json:"group_name"`
+	NoOfDevices      int       ` json:"no_of_devices"`
+	HeartbeatSeconds int       ` json:"heartbeat_timeout"` //devices not seen for this long are offline, 0 is the default
 }
 
 type Device struct {
@@ -25,8 +30,13 @@ type Device struct {
 	DeviceName          string          `json:"device_name"`
 	DeviceType          string          `json:"device_type"`
 	DeviceDescription   string          `json:"device_description"`
-	DeviceLocation      Location        `json:"device_location"`       //Can be null
-	TelemetryDataSchema TelemetrySchema `json:"telemetry_data_schema"` //Non nested json schema with colname:type mapping
+	DeviceLocation      Location        `json:"device_location"`         //Can be null
+	TelemetryDataSchema TelemetrySchema `json:"telemetry_data_schema"`   //Non nested json schema with colname:type mapping
+	SchemaVersion       int             `json:"schema_version"`          //Version of TelemetryDataSchema, see schemaVersion.go
+	Shadow              Shadow          `json:"shadow"`                  //Desired and reported state, see shadow.go
+	LastSeenAt          *time.Time      `json:"last_seen_at"`            //Last message from any transport, nil if never seen
+	Status              DeviceStatus    `json:"status"`                  //Derived from LastSeenAt, see presence.go
+	DeviceSecret        string          `json:"device_secret,omitempty"` //Only set right after creation or rotation, never stored
 }
 
 type TelemetrySchema map[string]string
@@ -0,0 +1,83 @@
+package metadata
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Role of a user within its company, each role may do everything the ones below it may
+type Role string
+
+const (
+	RoleOwner    Role = "owner"    //deletes the company, manages owners
+	RoleAdmin    Role = "admin"    //manages groups, users, rules and webhooks
+	RoleOperator Role = "operator" //manages devices and sends commands
+	RoleViewer   Role = "viewer"   //reads only
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3, RoleOwner: 4}
+
+func (r Role) Valid() bool {
+	_, ok := roleRank[r]
+	return ok
+}
+
+// Allows reports whether r may do what min may
+func (r Role) Allows(min Role) bool {
+	return r.Valid() && roleRank[r] >= roleRank[min]
+}
+
+const DefaultInviteTTL = 7 * 24 * time.Hour
+
+var (
+	ErrInvalidRole   = NewError(ErrValidation, "invalid role")
+	ErrUserNotFound  = NewError(ErrNotFound, "user not found")
+	ErrUsernameTaken = NewError(ErrConflict, "username already taken")
+	ErrLastOwner     = NewError(ErrConflict, "a company needs at least one owner")
+	ErrInvalidInvite = NewError(ErrNotFound, "invite not found or expired")
+)
+
+// User is a login of a company. The company's own username and password, given
+// on signup, become its first owner.
+type User struct {
+	ID        uuid.UUID `json:"id"`
+	CompanyID uuid.UUID `json:"company_id"`
+	Username  string    `json:"username"` //unique over all companies
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Invite lets whoever holds its token join the company with Role. Only the token hash is stored.
+type Invite struct {
+	ID        uuid.UUID `json:"id"`
+	CompanyID uuid.UUID `json:"company_id"`
+	Role      Role      `json:"role"`
+	InvitedBy uuid.UUID `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UserStore keeps the users of companies and their pending invites. Changing a
+// user's password or role revokes its sessions, removing it drops them.
+type UserStore interface {
+	//Returns the user if the password matches, nil otherwise
+	VerifyUser(ctx context.Context, username string, password string) (*User, error)
+	GetUserByID(ctx context.Context, id string) (*User, error)
+	//Lists all users of a company by username, teams are small so there are no pages
+	ListUsersByCompany(ctx context.Context, companyID string) ([]*User, error)
+	UpdateUserPassword(ctx context.Context, u *User, oldPassword string, newPassword string) error
+	//Sets u.Role, u.ID and u.CompanyID pick the user. The last owner cant be demoted.
+	UpdateUserRole(ctx context.Context, u *User, role Role) error
+	//Removes a user, u.ID and u.CompanyID pick it. The last owner cant be removed.
+	DeleteUser(ctx context.Context, u *User) error
+
+	//Stores an invite, sets its ID and CreatedAt
+	CreateInvite(ctx context.Context, inv *Invite, tokenHash string) error
+	//Lists the invites of a company that did not expire
+	ListInvitesByCompany(ctx context.Context, companyID string) ([]*Invite, error)
+	DeleteInvite(ctx context.Context, inv *Invite) error
+	//Creates u from the invite with the token hash and deletes the invite
+	AcceptInvite(ctx context.Context, tokenHash string, u *User, password string) error
+}
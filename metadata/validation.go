@@ -0,0 +1,48 @@
+package metadata
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const MaxFieldNameLength = 32
+
+var ErrInvalidSchema = NewError(ErrValidation, "invalid telemetry schema")
+
+// SchemaTypes are the types a telemetry field can have
+var SchemaTypes = map[string]bool{
+	"int":    true,
+	"float":  true,
+	"bool":   true,
+	"string": true,
+}
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// IsValidName reports whether s can be used as a company, user, group or device name
+func IsValidName(s string) bool {
+	s = strings.TrimSpace(s)
+	return s != "" && nameRe.MatchString(s)
+}
+
+// IsValidPassword reports whether s can be used as a password
+func IsValidPassword(s string) bool {
+	return strings.TrimSpace(s) != "" && len(s) <= MaxPasswordLength
+}
+
+// ValidateSchema checks a telemetry schema is flat with known types and short field names
+func ValidateSchema(schema TelemetrySchema) error {
+	for field, typ := range schema {
+		if strings.TrimSpace(field) == "" {
+			return fmt.Errorf("%w: empty field name", ErrInvalidSchema)
+		}
+		if len(field) > MaxFieldNameLength {
+			return fmt.Errorf("%w: field name '%s' exceeds %d characters", ErrInvalidSchema, field, MaxFieldNameLength)
+		}
+		if !SchemaTypes[typ] {
+			return fmt.Errorf("%w: invalid type '%s' for field '%s'", ErrInvalidSchema, typ, field)
+		}
+	}
+	return nil
+}
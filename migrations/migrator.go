@@ -0,0 +1,237 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrLegacySchema is returned by Up for databases made by the installer that
+// predates migrations. Their integer ids cannot be adopted by the baseline.
+var ErrLegacySchema = errors.New("database has the schema of the old installer")
+
+// advisoryLockKey serialises migrators running against the same database
+const advisoryLockKey = 4242_0001
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+// Migrator applies and reverts the embedded migrations, recording applied
+// versions in the schema_migrations table
+type Migrator struct {
+	dbConn     *sql.DB
+	logger     *log.Logger
+	migrations []*Migration
+}
+
+func NewMigrator(db *sql.DB, logger *log.Logger) (*Migrator, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		dbConn:     db,
+		logger:     logger,
+		migrations: migrations,
+	}, nil
+}
+
+// Up applies every pending migration in order, each in its own transaction
+func (m *Migrator) Up() error {
+	return m.withLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			if err := checkLegacySchema(conn); err != nil {
+				return err
+			}
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			if err := m.apply(conn, mig.Version, mig.Name, mig.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mig.Version, mig.Name); err != nil {
+				return err
+			}
+			m.logger.Printf("[Up] applied migration %04d_%s", mig.Version, mig.Name)
+		}
+		return nil
+	})
+}
+
+// Down reverts the last steps applied migrations, newest first
+func (m *Migrator) Down(steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("steps must be positive")
+	}
+
+	return m.withLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if err := m.apply(conn, mig.Version, mig.Name, mig.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`, mig.Version); err != nil {
+				return err
+			}
+			m.logger.Printf("[Down] reverted migration %04d_%s", mig.Version, mig.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status lists every known migration and whether it is applied
+func (m *Migrator) Status() ([]*MigrationStatus, error) {
+	var statuses []*MigrationStatus
+	err := m.withLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			s := &MigrationStatus{Version: mig.Version, Name: mig.Name}
+			if at, ok := applied[mig.Version]; ok {
+				s.Applied = true
+				s.AppliedAt = &at
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// apply runs a migration script and its bookkeeping statement atomically
+func (m *Migrator) apply(conn *sql.Conn, version int, name, script, bookkeeping string, args ...interface{}) (err error) {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning migration %04d_%s: %w", version, name, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("error running migration %04d_%s: %w", version, name, err)
+	}
+	if _, err = tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return fmt.Errorf("error recording migration %04d_%s: %w", version, name, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migration %04d_%s: %w", version, name, err)
+	}
+	return nil
+}
+
+// withLock runs f on a single connection holding the migration advisory lock
+func (m *Migrator) withLock(f func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.dbConn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting a connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, advisoryLockKey); err != nil {
+		return fmt.Errorf("error taking migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, advisoryLockKey)
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	return f(conn)
+}
+
+// checkLegacySchema refuses a database the old installer created, before the
+// baseline migration would half adopt it: SERIAL company ids that the uuid
+// foreign keys cannot reference, a devices table instead of device and groups
+// keyed by group_name.
+func checkLegacySchema(conn *sql.Conn) error {
+	var serialIDs, devicesTable, groupName bool
+	err := conn.QueryRowContext(context.Background(), `
+		SELECT
+			EXISTS (SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'company'
+				AND column_name = 'id' AND data_type <> 'uuid'),
+			EXISTS (SELECT 1 FROM information_schema.tables
+				WHERE table_schema = current_schema() AND table_name = 'devices'),
+			EXISTS (SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'grp'
+				AND column_name = 'group_name')
+	`).Scan(&serialIDs, &devicesTable, &groupName)
+	if err != nil {
+		return fmt.Errorf("error inspecting the existing schema: %w", err)
+	}
+
+	var found []string
+	if serialIDs {
+		found = append(found, "company.id is not a uuid")
+	}
+	if devicesTable {
+		found = append(found, "a devices table exists")
+	}
+	if groupName {
+		found = append(found, "grp has a group_name column")
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w (%s): no migration was applied, export the data, "+
+		"drop the company, grp, devices and data tables and migrate an empty database",
+		ErrLegacySchema, strings.Join(found, ", "))
+}
+
+func appliedVersions(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("error reading schema_migrations: %w", err)
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// The tables the installer made before migrations existed
+const legacySchema = `
+	CREATE TABLE company (
+		id SERIAL PRIMARY KEY,
+		company_name VARCHAR(32) UNIQUE,
+		username VARCHAR(32) UNIQUE,
+		company_password VARCHAR(64),
+		no_of_grps INT NOT NULL,
+		no_of_devices INT NOT NULL
+	);
+	CREATE TABLE grp (
+		id SERIAL PRIMARY KEY,
+		group_name VARCHAR(32),
+		no_of_devices INT NOT NULL,
+		company_id INT REFERENCES company(id)
+	);
+	CREATE TABLE devices (
+		id SERIAL PRIMARY KEY,
+		grp_id INT REFERENCES grp(id),
+		device_name VARCHAR(32)
+	);
+`
+
+// TestUpRefusesLegacySchema builds the old installer's tables in a scratch
+// schema of the KCLOUD_TEST_DSN database and checks Up leaves them alone
+func TestUpRefusesLegacySchema(t *testing.T) {
+	dsn := os.Getenv("KCLOUD_TEST_DSN")
+	if dsn == "" {
+		t.Skip("KCLOUD_TEST_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1) //one session, so the migrator sees the search_path set below
+
+	schema := fmt.Sprintf("kcloud_legacy_%d", time.Now().UnixNano())
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+	if _, err := db.Exec(`SET search_path TO ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(legacySchema); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMigrator(db, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); !errors.Is(err, ErrLegacySchema) {
+		t.Fatalf("Up = %v, want ErrLegacySchema", err)
+	}
+
+	var applied int
+	var device sql.NullString
+	err = db.QueryRow(`SELECT (SELECT count(*) FROM schema_migrations), to_regclass('device')`).Scan(&applied, &device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 0 || device.Valid {
+		t.Errorf("Up changed the legacy database: %d migrations applied, device table %q", applied, device.String)
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS data;
+DROP TABLE IF EXISTS device;
+DROP TABLE IF EXISTS grp;
+DROP TABLE IF EXISTS company;
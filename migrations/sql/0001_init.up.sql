@@ -1,5 +1,10 @@
+-- Baseline KCloud schema. Uses IF NOT EXISTS so databases created from the
+-- old metadataStore/schema.sql are adopted without changes. Databases of the
+-- older installer, with SERIAL ids and a devices table, are refused by the
+-- migrator before this runs.
+
 -- COMPANY TABLE
-CREATE TABLE company (
+CREATE TABLE IF NOT EXISTS company (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     company_name VARCHAR(255) NOT NULL,
     username VARCHAR(255) NOT NULL,
@@ -11,7 +16,7 @@ CREATE TABLE company (
 );
 
 -- GROUP TABLE
-CREATE TABLE grp (
+CREATE TABLE IF NOT EXISTS grp (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
     grp_name VARCHAR(255) NOT NULL,
@@ -20,7 +25,7 @@ CREATE TABLE grp (
 );
 
 -- DEVICE TABLE
-CREATE TABLE device (
+CREATE TABLE IF NOT EXISTS device (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     grp_id UUID NOT NULL REFERENCES grp(id) ON DELETE CASCADE,
     company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
@@ -32,3 +37,12 @@ CREATE TABLE device (
     telemetry_data_schema JSONB DEFAULT '{}'::jsonb NOT NULL,
     CONSTRAINT unique_device_per_grp UNIQUE (grp_id, device_name)
 );
+
+-- TELEMETRY TABLE, one partition per company is created by the storage engine
+CREATE TABLE IF NOT EXISTS data (
+    company_id UUID NOT NULL,
+    device_id UUID NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    telemetry_data JSONB NOT NULL,
+    PRIMARY KEY (company_id, device_id, timestamp)
+) PARTITION BY LIST (company_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS device_secret_hash_idx;
+ALTER TABLE device DROP COLUMN IF EXISTS device_secret_hash;
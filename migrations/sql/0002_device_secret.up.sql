@@ -0,0 +1,3 @@
+-- sha256 of the device secret, NULL when revoked
+ALTER TABLE device ADD COLUMN IF NOT EXISTS device_secret_hash CHAR(64);
+CREATE UNIQUE INDEX IF NOT EXISTS device_secret_hash_idx ON device (device_secret_hash);
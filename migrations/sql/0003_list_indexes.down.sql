@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS device_grp_name_page_idx;
+DROP INDEX IF EXISTS device_company_name_page_idx;
+DROP INDEX IF EXISTS grp_name_page_idx;
+DROP INDEX IF EXISTS company_username_page_idx;
@@ -0,0 +1,5 @@
+-- Keyset pagination of the list calls orders by (name COLLATE "C", id)
+CREATE INDEX IF NOT EXISTS company_username_page_idx ON company ((username COLLATE "C"), id);
+CREATE INDEX IF NOT EXISTS grp_name_page_idx ON grp (company_id, (grp_name COLLATE "C"), id);
+CREATE INDEX IF NOT EXISTS device_company_name_page_idx ON device (company_id, (device_name COLLATE "C"), id);
+CREATE INDEX IF NOT EXISTS device_grp_name_page_idx ON device (grp_id, (device_name COLLATE "C"), id);
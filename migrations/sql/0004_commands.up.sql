@@ -0,0 +1,19 @@
+-- Cloud to device commands and the results devices report
+CREATE TABLE IF NOT EXISTS command (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES device(id) ON DELETE CASCADE,
+    grp_id UUID REFERENCES grp(id) ON DELETE SET NULL, -- set when sent to a whole group
+    name VARCHAR(64) NOT NULL,
+    payload JSONB,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    result JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    delivered_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    CONSTRAINT command_status_check CHECK (status IN ('pending', 'delivered', 'succeeded', 'failed', 'expired'))
+);
+
+CREATE INDEX IF NOT EXISTS command_device_idx ON command (device_id, created_at);
+CREATE INDEX IF NOT EXISTS command_unfinished_idx ON command (expires_at) WHERE status IN ('pending', 'delivered');
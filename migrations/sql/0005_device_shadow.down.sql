@@ -0,0 +1,4 @@
+ALTER TABLE device
+    DROP COLUMN IF EXISTS shadow_version,
+    DROP COLUMN IF EXISTS shadow_reported,
+    DROP COLUMN IF EXISTS shadow_desired;
@@ -0,0 +1,5 @@
+-- Device shadow: the state apps want a device in and the state it last reported
+ALTER TABLE device
+    ADD COLUMN IF NOT EXISTS shadow_desired JSONB NOT NULL DEFAULT '{}'::jsonb,
+    ADD COLUMN IF NOT EXISTS shadow_reported JSONB NOT NULL DEFAULT '{}'::jsonb,
+    ADD COLUMN IF NOT EXISTS shadow_version BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS rule_event;
+DROP TABLE IF EXISTS rule_state;
+DROP TABLE IF EXISTS rule;
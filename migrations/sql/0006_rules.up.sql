@@ -0,0 +1,36 @@
+-- Telemetry rules, the devices they are firing for and their state changes
+CREATE TABLE IF NOT EXISTS rule (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    name VARCHAR(128) NOT NULL,
+    scope VARCHAR(16) NOT NULL,
+    target_id UUID NOT NULL, -- device or group id, the company id for company rules
+    expr TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT rule_scope_check CHECK (scope IN ('device', 'group', 'company'))
+);
+
+CREATE INDEX IF NOT EXISTS rule_company_idx ON rule (company_id);
+
+CREATE TABLE IF NOT EXISTS rule_state (
+    rule_id UUID NOT NULL REFERENCES rule(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES device(id) ON DELETE CASCADE,
+    since TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (rule_id, device_id)
+);
+
+CREATE TABLE IF NOT EXISTS rule_event (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    rule_id UUID NOT NULL REFERENCES rule(id) ON DELETE CASCADE,
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES device(id) ON DELETE CASCADE,
+    state VARCHAR(16) NOT NULL,
+    value JSONB,
+    at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT rule_event_state_check CHECK (state IN ('firing', 'resolved'))
+);
+
+CREATE INDEX IF NOT EXISTS rule_event_company_idx ON rule_event (company_id, created_at DESC);
@@ -0,0 +1,37 @@
+-- Company webhooks and the outbox of payloads sent to them
+CREATE TABLE IF NOT EXISTS webhook (
+    company_id UUID PRIMARY KEY REFERENCES company(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    secret VARCHAR(64) NOT NULL, -- hmac key, kept in clear to sign payloads
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id UUID PRIMARY KEY,
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    event_type VARCHAR(64) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ DEFAULT now(), -- NULL once delivered or failed
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ,
+    CONSTRAINT webhook_delivery_status_check CHECK (status IN ('pending', 'delivered', 'failed'))
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON webhook_delivery (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_delivery_company_idx ON webhook_delivery (company_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS webhook_attempt (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    delivery_id UUID NOT NULL REFERENCES webhook_delivery(id) ON DELETE CASCADE,
+    attempted_at TIMESTAMPTZ NOT NULL,
+    status_code INT, -- NULL when no response came back
+    error TEXT,
+    duration_ms BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_attempt_delivery_idx ON webhook_attempt (delivery_id, attempted_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS device_presence;
+ALTER TABLE grp DROP COLUMN IF EXISTS heartbeat_timeout;
@@ -0,0 +1,11 @@
+-- Devices not seen for heartbeat_timeout seconds are offline
+ALTER TABLE grp ADD COLUMN IF NOT EXISTS heartbeat_timeout INT NOT NULL DEFAULT 300;
+
+-- Last seen times, kept apart from device so that traffic never writes the device row
+CREATE TABLE IF NOT EXISTS device_presence (
+    device_id UUID PRIMARY KEY REFERENCES device(id) ON DELETE CASCADE,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    online BOOLEAN NOT NULL DEFAULT true -- cleared once the heartbeat timeout passes and the offline event is sent
+);
+
+CREATE INDEX IF NOT EXISTS device_presence_online_idx ON device_presence (last_seen_at) WHERE online;
@@ -0,0 +1,3 @@
+ALTER TABLE data DROP COLUMN IF EXISTS schema_version;
+DROP TABLE IF EXISTS device_schema;
+ALTER TABLE device DROP COLUMN IF EXISTS schema_version;
@@ -0,0 +1,19 @@
+-- Every version of a device telemetry schema, readings point at the one they were validated against
+ALTER TABLE device ADD COLUMN IF NOT EXISTS schema_version INT NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS device_schema (
+    device_id UUID NOT NULL REFERENCES device(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    telemetry_data_schema JSONB NOT NULL,
+    forced BOOLEAN NOT NULL DEFAULT false, -- saved despite changing or removing fields
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (device_id, version)
+);
+
+-- The current schemas of existing devices become their first version
+INSERT INTO device_schema (device_id, version, telemetry_data_schema)
+SELECT id, schema_version, telemetry_data_schema FROM device
+ON CONFLICT DO NOTHING;
+
+-- NULL for readings stored before schemas were versioned
+ALTER TABLE data ADD COLUMN IF NOT EXISTS schema_version INT;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS token_denylist;
+DROP TABLE IF EXISTS refresh_token;
+DROP TABLE IF EXISTS company_session;
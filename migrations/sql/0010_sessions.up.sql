@@ -0,0 +1,24 @@
+-- Login sessions, their refresh tokens and the denylist of revoked access tokens
+CREATE TABLE IF NOT EXISTS company_session (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL, -- moved forward on every refresh
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS company_session_company_idx ON company_session (company_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS refresh_token (
+    token_hash VARCHAR(64) PRIMARY KEY, -- sha256 of the token, the token itself is never stored
+    session_id UUID NOT NULL REFERENCES company_session(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    used_at TIMESTAMPTZ -- set once rotated, a second use revokes the session
+);
+
+CREATE INDEX IF NOT EXISTS refresh_token_session_idx ON refresh_token (session_id);
+
+CREATE TABLE IF NOT EXISTS token_denylist (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL -- the access token expiry, the entry is useless after it
+);
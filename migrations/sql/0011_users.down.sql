@@ -0,0 +1,17 @@
+DROP TABLE IF EXISTS company_invite;
+
+DROP INDEX IF EXISTS company_session_user_idx;
+ALTER TABLE company_session DROP COLUMN IF EXISTS user_id;
+
+-- The login goes back to the company, from the owner with its username or the oldest owner
+ALTER TABLE company ADD COLUMN IF NOT EXISTS company_password VARCHAR(255);
+UPDATE company c SET company_password = (
+    SELECT u.password_hash FROM app_user u
+    WHERE u.company_id = c.id AND u.role = 'owner'
+    ORDER BY u.username = c.username DESC, u.created_at
+    LIMIT 1
+);
+UPDATE company SET company_password = '' WHERE company_password IS NULL;
+ALTER TABLE company ALTER COLUMN company_password SET NOT NULL;
+
+DROP TABLE IF EXISTS app_user;
@@ -0,0 +1,38 @@
+-- Users of a company with roles. The company login becomes the first owner.
+CREATE TABLE IF NOT EXISTS app_user (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    username VARCHAR(255) NOT NULL,
+    password_hash VARCHAR(255) NOT NULL, -- legacy plaintext copied from company is rehashed on login
+    role VARCHAR(16) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (username),
+    CONSTRAINT app_user_role_check CHECK (role IN ('owner', 'admin', 'operator', 'viewer'))
+);
+
+CREATE INDEX IF NOT EXISTS app_user_company_idx ON app_user (company_id);
+
+INSERT INTO app_user (company_id, username, password_hash, role)
+SELECT id, username, company_password, 'owner' FROM company
+ON CONFLICT (username) DO NOTHING;
+
+ALTER TABLE company DROP COLUMN IF EXISTS company_password;
+
+-- Sessions belong to a user now, open ones have to log in again
+DELETE FROM company_session;
+ALTER TABLE company_session ADD COLUMN IF NOT EXISTS user_id UUID NOT NULL REFERENCES app_user(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS company_session_user_idx ON company_session (user_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS company_invite (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL, -- sha256 of the invite token
+    role VARCHAR(16) NOT NULL,
+    invited_by UUID REFERENCES app_user(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    UNIQUE (token_hash),
+    CONSTRAINT company_invite_role_check CHECK (role IN ('owner', 'admin', 'operator', 'viewer'))
+);
+
+CREATE INDEX IF NOT EXISTS company_invite_company_idx ON company_invite (company_id, created_at);
@@ -0,0 +1,17 @@
+-- API keys for machines, scoped to a company or one of its groups
+CREATE TABLE IF NOT EXISTS api_key (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id UUID NOT NULL REFERENCES company(id) ON DELETE CASCADE,
+    grp_id UUID REFERENCES grp(id) ON DELETE CASCADE, -- null for a company wide key
+    name VARCHAR(255) NOT NULL,
+    key_hash VARCHAR(64) NOT NULL, -- sha256 of the key, the key itself is never stored
+    read_only BOOLEAN NOT NULL DEFAULT true,
+    created_by UUID REFERENCES app_user(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ, -- null never expires
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    UNIQUE (key_hash)
+);
+
+CREATE INDEX IF NOT EXISTS api_key_company_idx ON api_key (company_id, created_at);
@@ -0,0 +1,28 @@
+-- Append-only log of metadata changes, written in the transaction of each change.
+-- company_id has no foreign key, the events of a deleted company stay.
+CREATE TABLE IF NOT EXISTS audit_event (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id UUID NOT NULL,
+    actor_user_id UUID, -- null unless a user made the change
+    actor_api_key_id UUID, -- null unless an api key made the change
+    action VARCHAR(64) NOT NULL,
+    resource_id UUID NOT NULL,
+    before JSONB,
+    after JSONB,
+    request_id VARCHAR(64),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp()
+);
+
+CREATE INDEX IF NOT EXISTS audit_event_company_idx ON audit_event (company_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS audit_event_resource_idx ON audit_event (resource_id);
+
+CREATE OR REPLACE FUNCTION audit_event_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_event_append_only ON audit_event;
+CREATE TRIGGER audit_event_append_only
+    BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_event
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_event_append_only();
@@ -0,0 +1,80 @@
+package mqttbroker
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mukundvijay123/KCloud/commands"
+	"github.com/mukundvijay123/KCloud/metadata"
+	"github.com/mukundvijay123/KCloud/rules"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+// Broker is an embedded MQTT 3.1.1/5 broker that accepts telemetry from devices.
+// Devices connect with their id as username and their device secret as password
+// and publish to kcloud/{company}/{group}/{device}/telemetry. With Commands set
+// they also receive commands on .../commands and answer on .../commands/result,
+// with Shadows set they get shadow deltas on .../shadow/delta and report their
+// state on .../shadow/reported.
+type Broker struct {
+	logger     *log.Logger
+	MdataStore metadata.MetadataReader
+	DataStore  storageengine.DataStore
+	Commands   commands.CommandStore     //optional, nil disables the command topics
+	Shadows    metadata.ShadowStore      //optional, nil disables the shadow topics
+	Rules      rules.Evaluator           //optional, checks ingested readings against the rules
+	Presence   metadata.PresenceRecorder //optional, told about every packet of a device
+	Server     *mqtt.Server
+
+	hook *deviceHook
+}
+
+func NewBroker(mdataStore metadata.MetadataReader, dataStore storageengine.DataStore, logger *log.Logger) (*Broker, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	b := &Broker{
+		logger:     logger,
+		MdataStore: mdataStore,
+		DataStore:  dataStore,
+	}
+
+	b.Server = mqtt.New(&mqtt.Options{
+		InlineClient: true, //lets KCloud publish to devices and tests use an in-process client
+		Logger:       slog.New(slog.NewTextHandler(logger.Writer(), &slog.HandlerOptions{Level: slog.LevelWarn})),
+	})
+	b.hook = &deviceHook{broker: b}
+	if err := b.Server.AddHook(b.hook, nil); err != nil {
+		return nil, fmt.Errorf("error adding device hook: %w", err)
+	}
+
+	return b, nil
+}
+
+// ListenTCP adds a plain TCP listener, call before Serve
+func (b *Broker) ListenTCP(addr string) error {
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})
+	if err := b.Server.AddListener(tcp); err != nil {
+		return fmt.Errorf("error adding mqtt listener on %s: %w", addr, err)
+	}
+	return nil
+}
+
+// Serve starts the listeners, it does not block
+func (b *Broker) Serve() error {
+	return b.Server.Serve()
+}
+
+// Close disconnects every client and stops the listeners
+func (b *Broker) Close() error {
+	return b.Server.Close()
+}
+
+// Publish sends a message to devices from inside KCloud, bypassing ACLs
+func (b *Broker) Publish(topic string, payload []byte, qos byte) error {
+	return b.Server.Publish(topic, payload, false, qos)
+}
@@ -0,0 +1,432 @@
+package mqttbroker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatamemstore "github.com/mukundvijay123/KCloud/metadata/metadataMemStore"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+// memDataStore keeps the written readings
+type memDataStore struct {
+	mu       sync.Mutex
+	readings []*storageengine.Reading
+}
+
+func (s *memDataStore) Write(ctx context.Context, r *storageengine.Reading) error {
+	return s.WriteBatch(ctx, []*storageengine.Reading{r})
+}
+
+func (s *memDataStore) WriteBatch(ctx context.Context, readings []*storageengine.Reading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readings = append(s.readings, readings...)
+	return nil
+}
+
+func (s *memDataStore) ReadRange(ctx context.Context, companyID, deviceID uuid.UUID, from, to time.Time) ([]*storageengine.Reading, error) {
+	return nil, nil
+}
+
+func (s *memDataStore) Latest(ctx context.Context, companyID, deviceID uuid.UUID) (*storageengine.Reading, error) {
+	return nil, storageengine.ErrNoReadings
+}
+
+func (s *memDataStore) Query(ctx context.Context, q *storageengine.Query) (*storageengine.QueryResult, error) {
+	return &storageengine.QueryResult{}, nil
+}
+
+func (s *memDataStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.readings)
+}
+
+// testClient is a minimal MQTT 5 client talking to the broker over a pipe
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestBroker(t *testing.T) (*Broker, *metadatamemstore.MemStore, *memDataStore) {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	store := metadatamemstore.NewMemStore(logger)
+	data := &memDataStore{}
+	b, err := NewBroker(store, data, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, store, data
+}
+
+func newTestDevice(t *testing.T, store metadata.MetadataStore) *metadata.Device {
+	t.Helper()
+	ctx := context.Background()
+	c := &metadata.Company{CompanyName: "acme", Username: "acme", CompanyPassword: "correcthorse"}
+	if err := store.CreateCompany(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	g := &metadata.Grp{CompanyID: c.ID, GroupName: "plant"}
+	if err := store.CreateGroup(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	d := &metadata.Device{
+		GrpID:               g.ID,
+		CompanyID:           c.ID,
+		DeviceName:          "boiler",
+		DeviceType:          "sensor",
+		TelemetryDataSchema: metadata.TelemetrySchema{"temp": "float"},
+	}
+	if err := store.CreateDevice(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// connect sends CONNECT and returns the client and the CONNACK reason code
+func connect(t *testing.T, b *Broker, username, password string) (*testClient, byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	go b.Server.EstablishConnection("test", server)
+	c := &testClient{t: t, conn: client, r: bufio.NewReader(client)}
+	t.Cleanup(func() { client.Close() })
+
+	c.send(packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 5,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: username,
+			UsernameFlag:     true,
+			Username:         []byte(username),
+			PasswordFlag:     password != "",
+			Password:         []byte(password),
+		},
+	})
+	pk, ok := c.read()
+	if !ok || pk.FixedHeader.Type != packets.Connack {
+		t.Fatalf("no CONNACK, got %+v", pk.FixedHeader)
+	}
+	return c, pk.ReasonCode
+}
+
+func (c *testClient) send(pk packets.Packet) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(&buf)
+	case packets.Publish:
+		err = pk.PublishEncode(&buf)
+	case packets.Disconnect:
+		err = pk.DisconnectEncode(&buf)
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// read returns the next packet, false once the broker closed the connection
+func (c *testClient) read() (packets.Packet, bool) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	hb, err := c.r.ReadByte()
+	if err != nil {
+		return packets.Packet{}, false
+	}
+	pk := packets.Packet{ProtocolVersion: 5}
+	if err := pk.FixedHeader.Decode(hb); err != nil {
+		c.t.Fatal(err)
+	}
+	for mult := 1; ; mult *= 128 {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return packets.Packet{}, false
+		}
+		pk.FixedHeader.Remaining += int(b&127) * mult
+		if b&128 == 0 {
+			break
+		}
+	}
+	body := make([]byte, pk.FixedHeader.Remaining)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return packets.Packet{}, false
+	}
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(body)
+	case packets.Puback:
+		err = pk.PubackDecode(body)
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return pk, true
+}
+
+var nextPacketID uint16
+
+// publish sends a qos 1 publish and returns the PUBACK reason code, false when
+// the broker closed the connection instead
+func (c *testClient) publish(topic, payload string) (byte, bool) {
+	c.t.Helper()
+	nextPacketID++
+	c.send(packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		ProtocolVersion: 5,
+		TopicName:       topic,
+		Payload:         []byte(payload),
+		PacketID:        nextPacketID,
+	})
+	pk, ok := c.read()
+	if !ok {
+		return 0, false
+	}
+	if pk.FixedHeader.Type != packets.Puback || pk.PacketID != nextPacketID {
+		c.t.Fatalf("got %+v, want the PUBACK of %d", pk.FixedHeader, nextPacketID)
+	}
+	return pk.ReasonCode, true
+}
+
+func sessionCount(b *Broker) int {
+	n := 0
+	b.hook.sessions.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func waitForSessions(t *testing.T, b *Broker, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for sessionCount(b) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions, want %d", sessionCount(b), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnectRejectsBadCredentials(t *testing.T) {
+	b, store, _ := newTestBroker(t)
+	d := newTestDevice(t, store)
+
+	tests := []struct {
+		name, username, password string
+	}{
+		{"wrong secret", d.ID.String(), "not-the-secret"},
+		{"secret of another id", uuid.NewString(), d.DeviceSecret},
+		{"no password", d.ID.String(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, code := connect(t, b, tt.username, tt.password)
+			if code != packets.ErrBadUsernameOrPassword.Code {
+				t.Errorf("CONNACK %#x, want bad username or password", code)
+			}
+		})
+	}
+	if n := sessionCount(b); n != 0 {
+		t.Errorf("%d sessions after rejected connects", n)
+	}
+}
+
+func TestPublishTelemetry(t *testing.T) {
+	b, store, data := newTestBroker(t)
+	d := newTestDevice(t, store)
+
+	c, code := connect(t, b, d.ID.String(), d.DeviceSecret)
+	if code != packets.CodeSuccess.Code {
+		t.Fatalf("CONNACK %#x, want success", code)
+	}
+
+	if code, _ := c.publish(TelemetryTopic(d), `{"data": {"temp": 21.5}}`); code != packets.CodeSuccess.Code {
+		t.Fatalf("PUBACK %#x for valid telemetry", code)
+	}
+	if code, _ := c.publish(TelemetryTopic(d), `{"data": {"temp": "hot"}}`); code != packets.ErrPayloadFormatInvalid.Code {
+		t.Errorf("PUBACK %#x for telemetry breaking the schema, want payload format invalid", code)
+	}
+	other := *d
+	other.ID = uuid.New()
+	if code, _ := c.publish(TelemetryTopic(&other), `{"data": {"temp": 1}}`); code != packets.ErrNotAuthorized.Code {
+		t.Errorf("PUBACK %#x for another device's topic, want not authorized", code)
+	}
+	if n := data.count(); n != 1 {
+		t.Errorf("%d readings stored, want 1", n)
+	}
+
+	c.send(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}, ProtocolVersion: 5})
+	waitForSessions(t, b, 0)
+}
+
+// ageSessions makes every session due for its next lookup, as if
+// reverifyInterval had passed
+func ageSessions(b *Broker) {
+	b.hook.sessions.Range(func(k, v any) bool {
+		sess := *v.(*deviceSession)
+		sess.verifiedAt = time.Now().Add(-reverifyInterval)
+		b.hook.sessions.Store(k, &sess)
+		return true
+	})
+}
+
+func TestChangedCredentialsDisconnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(b *Broker, store *metadatamemstore.MemStore, d *metadata.Device) error
+	}{
+		{"secret rotated", func(b *Broker, store *metadatamemstore.MemStore, d *metadata.Device) error {
+			_, err := store.RotateDeviceSecret(context.Background(), d)
+			b.DisconnectDevice(d.ID)
+			return err
+		}},
+		{"secret revoked", func(b *Broker, store *metadatamemstore.MemStore, d *metadata.Device) error {
+			err := store.RevokeDeviceSecret(context.Background(), d)
+			b.DisconnectDevice(d.ID)
+			return err
+		}},
+		{"group deleted", func(b *Broker, store *metadatamemstore.MemStore, d *metadata.Device) error {
+			err := store.DeleteGroup(context.Background(), &metadata.Grp{ID: d.GrpID, CompanyID: d.CompanyID})
+			b.DisconnectGroup(d.GrpID)
+			return err
+		}},
+		{"company deleted", func(b *Broker, store *metadatamemstore.MemStore, d *metadata.Device) error {
+			err := store.DeleteCompany(context.Background(), &metadata.Company{ID: d.CompanyID})
+			b.DisconnectCompany(d.CompanyID)
+			return err
+		}},
+		// Another instance rotated it, nobody tells this broker
+		{"secret rotated elsewhere", func(b *Broker, store *metadatamemstore.MemStore, d *metadata.Device) error {
+			_, err := store.RotateDeviceSecret(context.Background(), d)
+			ageSessions(b)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, store, data := newTestBroker(t)
+			d := newTestDevice(t, store)
+
+			c, code := connect(t, b, d.ID.String(), d.DeviceSecret)
+			if code != packets.CodeSuccess.Code {
+				t.Fatalf("CONNACK %#x, want success", code)
+			}
+			if code, _ := c.publish(TelemetryTopic(d), `{"data": {"temp": 1}}`); code != packets.CodeSuccess.Code {
+				t.Fatalf("PUBACK %#x before the change", code)
+			}
+
+			if err := tt.change(b, store, d); err != nil {
+				t.Fatal(err)
+			}
+
+			// Devices the API disconnected are gone already, others go on their next publish
+			if sessionCount(b) > 0 {
+				if code, ok := c.publish(TelemetryTopic(d), `{"data": {"temp": 2}}`); ok && code == packets.CodeSuccess.Code {
+					t.Error("publish with the old secret accepted")
+				}
+			}
+			if n := data.count(); n != 1 {
+				t.Errorf("%d readings stored, want 1", n)
+			}
+			for i := 0; ; i++ {
+				if _, ok := c.read(); !ok {
+					break
+				}
+				if i == 1 {
+					t.Fatal("connection still open")
+				}
+			}
+			waitForSessions(t, b, 0)
+		})
+	}
+}
+
+// countingReader counts the lookups of devices by secret
+type countingReader struct {
+	metadata.MetadataReader
+	mu      sync.Mutex
+	lookups int
+}
+
+func (r *countingReader) GetDeviceBySecret(ctx context.Context, secret string) (*metadata.Device, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.mu.Unlock()
+	return r.MetadataReader.GetDeviceBySecret(ctx, secret)
+}
+
+func (r *countingReader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func TestPublishUsesTheVerifiedDevice(t *testing.T) {
+	b, store, data := newTestBroker(t)
+	d := newTestDevice(t, store)
+	reader := &countingReader{MetadataReader: store}
+	b.MdataStore = reader
+
+	c, code := connect(t, b, d.ID.String(), d.DeviceSecret)
+	if code != packets.CodeSuccess.Code {
+		t.Fatalf("CONNACK %#x, want success", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code, _ := c.publish(TelemetryTopic(d), `{"data": {"temp": 1}}`); code != packets.CodeSuccess.Code {
+			t.Fatalf("PUBACK %#x for valid telemetry", code)
+		}
+	}
+	if n := reader.count(); n != 1 {
+		t.Errorf("%d device lookups for a connect and 3 publishes, want 1", n)
+	}
+
+	// A new schema applies once the API tells the broker, without reconnecting
+	schema := metadata.TelemetrySchema{"temp": "float", "rpm": "int"}
+	if err := store.UpdateDeviceSchema(context.Background(), d, &schema, false); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := c.publish(TelemetryTopic(d), `{"data": {"rpm": 3000}}`); code != packets.ErrPayloadFormatInvalid.Code {
+		t.Errorf("PUBACK %#x for a field of the unannounced schema, want payload format invalid", code)
+	}
+	b.DeviceChanged(d)
+	if code, _ := c.publish(TelemetryTopic(d), `{"data": {"rpm": 3000}}`); code != packets.CodeSuccess.Code {
+		t.Errorf("PUBACK %#x for a field of the new schema, want success", code)
+	}
+	if n := data.count(); n != 4 {
+		t.Errorf("%d readings stored, want 4", n)
+	}
+
+	// The device is looked up again once reverifyInterval passed
+	ageSessions(b)
+	if code, _ := c.publish(TelemetryTopic(d), `{"data": {"temp": 1}}`); code != packets.CodeSuccess.Code {
+		t.Fatalf("PUBACK %#x after the interval", code)
+	}
+	if n := reader.count(); n != 2 {
+		t.Errorf("%d device lookups after the interval, want 2", n)
+	}
+}
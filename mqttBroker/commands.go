@@ -0,0 +1,83 @@
+package mqttbroker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mukundvijay123/KCloud/commands"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// commandQos delivers commands at least once, devices dedupe by command id
+const commandQos = 1
+
+// commandResult is what a device publishes to CommandResultTopic. Status
+// "delivered" acks the command, "succeeded" or "failed" finishes it.
+type commandResult struct {
+	ID     uuid.UUID       `json:"id"`
+	Status commands.Status `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Notify publishes cmd to the device's command topic. A device that isnt
+// subscribed gets it when it next subscribes, or by polling over HTTP.
+func (b *Broker) Notify(d *metadata.Device, cmd *commands.Command) {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		b.logger.Println("[Notify] failed to encode command:", err)
+		return
+	}
+	if err := b.Publish(CommandTopic(d), payload, commandQos); err != nil {
+		b.logger.Println("[Notify] failed to publish command:", err)
+	}
+}
+
+// pushPending publishes every pending command of d, used when d subscribes to its command topic
+func (b *Broker) pushPending(d *metadata.Device) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	cmds, err := b.Commands.ListPending(ctx, d.ID, metadata.MaxListLimit)
+	if err != nil {
+		b.logger.Println("[pushPending] failed to list commands:", err)
+		return
+	}
+	for _, cmd := range cmds {
+		b.Notify(d, cmd)
+	}
+}
+
+// commandResult applies an ack or result a device published
+func (h *deviceHook) commandResult(cl *mqtt.Client, pk packets.Packet, device *metadata.Device) error {
+	var res commandResult
+	if err := json.Unmarshal(pk.Payload, &res); err != nil || res.ID == uuid.Nil {
+		h.broker.logger.Printf("[WARN] MQTT malformed command result from device %v", device.ID)
+		return reject(cl, pk, packets.ErrPayloadFormatInvalid)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	var err error
+	if res.Status == commands.StatusDelivered {
+		_, err = h.broker.Commands.Ack(ctx, device.ID, res.ID)
+	} else {
+		_, err = h.broker.Commands.Complete(ctx, device.ID, res.ID, res.Status, res.Result)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, metadata.ErrValidation):
+		h.broker.logger.Printf("[WARN] MQTT invalid command result from device %v: %v", device.ID, err)
+		return reject(cl, pk, packets.ErrPayloadFormatInvalid)
+	case errors.Is(err, metadata.ErrNotFound), errors.Is(err, metadata.ErrConflict):
+		h.broker.logger.Printf("[WARN] MQTT command result from device %v refused: %v", device.ID, err)
+		return reject(cl, pk, packets.ErrNotAuthorized)
+	}
+	h.broker.logger.Println("[commandResult] failed to store result:", err)
+	return reject(cl, pk, packets.ErrImplementationSpecificError)
+}
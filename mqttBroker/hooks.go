@@ -0,0 +1,284 @@
+package mqttbroker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mukundvijay123/KCloud/metadata"
+	"github.com/mukundvijay123/KCloud/telemetry"
+)
+
+const (
+	lookupTimeout    = 5 * time.Second //bounds the metadata lookups done while handling a packet
+	reverifyInterval = time.Minute     //how often a connected device is looked up again, catches changes made on other instances
+)
+
+// deviceHook authenticates devices, enforces topic ownership, stores telemetry
+// and exchanges commands and shadow updates
+type deviceHook struct {
+	mqtt.HookBase
+	broker   *Broker
+	sessions sync.Map //*mqtt.Client -> *deviceSession, removed on disconnect
+}
+
+// deviceSession is a connected device and the secret it authenticated with.
+// Sessions are replaced, never changed, so readers need no lock.
+type deviceSession struct {
+	device     *metadata.Device
+	secret     string
+	verifiedAt time.Time //when device was last looked up by secret
+}
+
+func (h *deviceHook) ID() string {
+	return "kcloud-device"
+}
+
+func (h *deviceHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+		mqtt.OnACLCheck,
+		mqtt.OnPublish,
+		mqtt.OnSubscribed,
+		mqtt.OnPacketRead,
+	}, []byte{b})
+}
+
+// OnConnectAuthenticate accepts username=device id, password=device secret
+func (h *deviceHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	username := string(pk.Connect.Username)
+	if username == "" || len(pk.Connect.Password) == 0 {
+		h.broker.logger.Printf("[WARN] MQTT connect without credentials from %s", cl.Net.Remote)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	device, err := h.broker.MdataStore.GetDeviceBySecret(ctx, string(pk.Connect.Password))
+	if err != nil && !errors.Is(err, metadata.ErrNotFound) {
+		h.broker.logger.Printf("[ERROR] MQTT device lookup failed: %v", err)
+		return false
+	}
+	if err != nil || device.ID.String() != username {
+		h.broker.logger.Printf("[WARN] MQTT invalid device credentials from %s", cl.Net.Remote)
+		return false
+	}
+
+	h.sessions.Store(cl, &deviceSession{device: device, secret: string(pk.Connect.Password), verifiedAt: time.Now()})
+	if h.broker.Presence != nil {
+		h.broker.Presence.DeviceSeen(device, time.Now())
+	}
+	h.broker.logger.Printf("[INFO] MQTT device connected from %s (device_id=%v)", cl.Net.Remote, device.ID)
+	return true
+}
+
+// OnDisconnect forgets the device of cl
+func (h *deviceHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
+
+// OnPacketRead counts every packet of a connected device, keepalive pings
+// included, as a sign of life
+func (h *deviceHook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if h.broker.Presence == nil || pk.FixedHeader.Type == packets.Connect {
+		return pk, nil
+	}
+	if device, ok := h.connectedDevice(cl); ok {
+		h.broker.Presence.DeviceSeen(device, time.Now())
+	}
+	return pk, nil
+}
+
+// OnACLCheck limits a device to topics under its own prefix. It runs for every
+// publish of a device and every message sent to it, so it uses the device
+// verified on connect. The API disconnects a device whose secret is rotated or
+// revoked, see Broker.DisconnectDevice; it is looked up again every
+// reverifyInterval for changes made through other instances.
+func (h *deviceHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	v, ok := h.sessions.Load(cl)
+	if !ok {
+		return false
+	}
+	sess := v.(*deviceSession)
+	device := sess.device
+	if time.Since(sess.verifiedAt) >= reverifyInterval {
+		if device, ok = h.verifyDevice(cl, sess); !ok {
+			return false
+		}
+	}
+	if write {
+		return topic == TelemetryTopic(device) ||
+			(h.broker.Commands != nil && topic == CommandResultTopic(device)) ||
+			(h.broker.Shadows != nil && topic == ShadowReportedTopic(device))
+	}
+	return isDeviceTopic(device, topic)
+}
+
+// OnPublish routes device publishes to the telemetry or command result handling
+func (h *deviceHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	device, ok := h.connectedDevice(cl)
+	if !ok {
+		return pk, reject(cl, pk, packets.ErrNotAuthorized)
+	}
+	switch {
+	case pk.TopicName == TelemetryTopic(device):
+		return pk, h.storeTelemetry(cl, pk, device)
+	case h.broker.Commands != nil && pk.TopicName == CommandResultTopic(device):
+		return pk, h.commandResult(cl, pk, device)
+	case h.broker.Shadows != nil && pk.TopicName == ShadowReportedTopic(device):
+		return pk, h.shadowReported(cl, pk, device)
+	}
+	return pk, reject(cl, pk, packets.ErrNotAuthorized)
+}
+
+// storeTelemetry validates telemetry against the device schema and writes it to the storage engine.
+// Schema changes reach device through Broker.DeviceChanged, without reconnecting.
+func (h *deviceHook) storeTelemetry(cl *mqtt.Client, pk packets.Packet, device *metadata.Device) error {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	rows, err := telemetry.DecodeRows(pk.Payload)
+	if err != nil || len(rows) == 0 || len(rows) > telemetry.MaxBatchRows {
+		h.broker.logger.Printf("[WARN] MQTT malformed telemetry from device %v", device.ID)
+		return reject(cl, pk, packets.ErrPayloadFormatInvalid)
+	}
+
+	readings, rowErrs := telemetry.BuildReadings(device, rows, time.Now())
+	if len(rowErrs) > 0 {
+		h.broker.logger.Printf("[WARN] MQTT telemetry from device %v rejected: %+v", device.ID, rowErrs)
+		return reject(cl, pk, packets.ErrPayloadFormatInvalid)
+	}
+
+	if err := h.broker.DataStore.WriteBatch(ctx, readings); err != nil {
+		h.broker.logger.Println("[storeTelemetry] failed to store readings:", err)
+		return reject(cl, pk, packets.ErrImplementationSpecificError)
+	}
+	if h.broker.Rules != nil {
+		h.broker.Rules.Evaluate(ctx, device, readings)
+	}
+
+	return nil
+}
+
+// OnSubscribed pushes what a device missed while offline once it subscribes
+// to its command or shadow delta topic
+func (h *deviceHook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	if cl.Net.Inline {
+		return
+	}
+	device, ok := h.connectedDevice(cl)
+	if !ok {
+		return
+	}
+
+	var pushCommands, pushShadow bool
+	for i, sub := range pk.Filters {
+		if i >= len(reasonCodes) || reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			continue
+		}
+		pushCommands = pushCommands || subscribes(device, sub.Filter, CommandTopic(device))
+		pushShadow = pushShadow || subscribes(device, sub.Filter, ShadowDeltaTopic(device))
+	}
+
+	// Publish after the SUBACK has gone out
+	if pushCommands && h.broker.Commands != nil {
+		go h.broker.pushPending(device)
+	}
+	if pushShadow && h.broker.Shadows != nil {
+		go h.broker.pushShadowDelta(device)
+	}
+}
+
+// connectedDevice returns the device cl authenticated as, as of its last check
+func (h *deviceHook) connectedDevice(cl *mqtt.Client) (*metadata.Device, bool) {
+	v, ok := h.sessions.Load(cl)
+	if !ok {
+		return nil, false
+	}
+	return v.(*deviceSession).device, true
+}
+
+// verifyDevice fetches the device of cl again by the secret it connected with.
+// A device whose secret was rotated or revoked, or that was deleted, is
+// disconnected. When the lookup fails the last known device is used.
+func (h *deviceHook) verifyDevice(cl *mqtt.Client, sess *deviceSession) (*metadata.Device, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	device, err := h.broker.MdataStore.GetDeviceBySecret(ctx, sess.secret)
+	if err != nil && !errors.Is(err, metadata.ErrNotFound) {
+		h.broker.logger.Println("[verifyDevice] device lookup failed:", err)
+		return sess.device, true
+	}
+	if err != nil || device.ID != sess.device.ID {
+		h.broker.logger.Printf("[WARN] MQTT device %v credentials no longer valid, disconnecting", sess.device.ID)
+		h.sessions.Delete(cl)
+		cl.Stop(packets.ErrNotAuthorized)
+		return nil, false
+	}
+
+	// Unless cl disconnected meanwhile, the session must not come back then
+	h.sessions.CompareAndSwap(cl, sess, &deviceSession{device: device, secret: sess.secret, verifiedAt: time.Now()})
+	return device, true
+}
+
+// disconnect closes the connections of the devices matching match
+func (h *deviceHook) disconnect(match func(d *metadata.Device) bool) {
+	h.sessions.Range(func(k, v any) bool {
+		sess := v.(*deviceSession)
+		if match(sess.device) {
+			h.broker.logger.Printf("[INFO] MQTT device %v disconnected, it has to authenticate again", sess.device.ID)
+			h.sessions.Delete(k)
+			k.(*mqtt.Client).Stop(packets.ErrNotAuthorized)
+		}
+		return true
+	})
+}
+
+// DeviceChanged makes the connections of d use it from now on, e.g. its new schema
+func (b *Broker) DeviceChanged(d *metadata.Device) {
+	b.hook.sessions.Range(func(k, v any) bool {
+		sess := v.(*deviceSession)
+		if sess.device.ID == d.ID {
+			b.hook.sessions.CompareAndSwap(k, sess, &deviceSession{device: d, secret: sess.secret, verifiedAt: sess.verifiedAt})
+		}
+		return true
+	})
+}
+
+// DisconnectDevice closes the connections of a device whose secret was rotated
+// or revoked, or that was deleted. It has to connect and authenticate again.
+func (b *Broker) DisconnectDevice(deviceID uuid.UUID) {
+	b.hook.disconnect(func(d *metadata.Device) bool { return d.ID == deviceID })
+}
+
+// DisconnectGroup closes the connections of the devices of a deleted group
+func (b *Broker) DisconnectGroup(grpID uuid.UUID) {
+	b.hook.disconnect(func(d *metadata.Device) bool { return d.GrpID == grpID })
+}
+
+// DisconnectCompany closes the connections of the devices of a deleted company
+func (b *Broker) DisconnectCompany(companyID uuid.UUID) {
+	b.hook.disconnect(func(d *metadata.Device) bool { return d.CompanyID == companyID })
+}
+
+// reject drops a publish. MQTT 5 clients publishing with qos > 0 get the reason
+// code in their PUBACK. Older clients cant be told, the message is acked so they
+// dont resend it forever, but it is neither stored nor forwarded.
+func reject(cl *mqtt.Client, pk packets.Packet, code packets.Code) error {
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return code
+	}
+	return packets.CodeSuccessIgnore
+}
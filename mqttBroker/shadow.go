@@ -0,0 +1,80 @@
+package mqttbroker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// shadowQos delivers deltas at least once, applying one twice is harmless
+const shadowQos = 1
+
+// shadowDelta is what KCloud publishes to ShadowDeltaTopic
+type shadowDelta struct {
+	Version int64                `json:"version"`
+	Delta   metadata.ShadowState `json:"delta"`
+}
+
+// shadowReport is what a device publishes to ShadowReportedTopic, version 0 skips the check
+type shadowReport struct {
+	Reported metadata.ShadowState `json:"reported"`
+	Version  int64                `json:"version"`
+}
+
+// NotifyShadow publishes the shadow delta of d to its delta topic
+func (b *Broker) NotifyShadow(d *metadata.Device) {
+	payload, err := json.Marshal(shadowDelta{Version: d.Shadow.Version, Delta: d.Shadow.Delta})
+	if err != nil {
+		b.logger.Println("[NotifyShadow] failed to encode delta:", err)
+		return
+	}
+	if err := b.Publish(ShadowDeltaTopic(d), payload, shadowQos); err != nil {
+		b.logger.Println("[NotifyShadow] failed to publish delta:", err)
+	}
+}
+
+// pushShadowDelta publishes the current delta of d if there is one
+func (b *Broker) pushShadowDelta(d *metadata.Device) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	d, err := b.MdataStore.GetDeviceByID(ctx, d.ID.String())
+	if err != nil {
+		b.logger.Println("[pushShadowDelta] device lookup failed:", err)
+		return
+	}
+	if len(d.Shadow.Delta) > 0 {
+		b.NotifyShadow(d)
+	}
+}
+
+// shadowReported merges state a device reported into its shadow
+func (h *deviceHook) shadowReported(cl *mqtt.Client, pk packets.Packet, device *metadata.Device) error {
+	var report shadowReport
+	if err := json.Unmarshal(pk.Payload, &report); err != nil || report.Reported == nil {
+		h.broker.logger.Printf("[WARN] MQTT malformed shadow report from device %v", device.ID)
+		return reject(cl, pk, packets.ErrPayloadFormatInvalid)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	// Work on a copy, the connected device is shared by every packet of the client
+	d := *device
+	err := h.broker.Shadows.UpdateDeviceShadow(ctx, &d, metadata.ShadowReported, report.Reported, report.Version)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, metadata.ErrValidation), errors.Is(err, metadata.ErrConflict):
+		h.broker.logger.Printf("[WARN] MQTT shadow report from device %v refused: %v", device.ID, err)
+		return reject(cl, pk, packets.ErrPayloadFormatInvalid)
+	case errors.Is(err, metadata.ErrNotFound):
+		return reject(cl, pk, packets.ErrNotAuthorized)
+	}
+	h.broker.logger.Println("[shadowReported] failed to update shadow:", err)
+	return reject(cl, pk, packets.ErrImplementationSpecificError)
+}
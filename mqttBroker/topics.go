@@ -0,0 +1,55 @@
+package mqttbroker
+
+import (
+	"strings"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+const (
+	topicRoot          = "kcloud"
+	telemetryTopicName = "telemetry"
+	commandTopicName   = "commands"
+	resultTopicName    = "result"
+	shadowTopicName    = "shadow"
+)
+
+// DeviceTopic returns the topic prefix owned by a device: kcloud/{company}/{group}/{device}
+func DeviceTopic(d *metadata.Device) string {
+	return strings.Join([]string{topicRoot, d.CompanyID.String(), d.GrpID.String(), d.ID.String()}, "/")
+}
+
+// TelemetryTopic is where a device publishes its readings
+func TelemetryTopic(d *metadata.Device) string {
+	return DeviceTopic(d) + "/" + telemetryTopicName
+}
+
+// CommandTopic is where KCloud pushes commands to a device
+func CommandTopic(d *metadata.Device) string {
+	return DeviceTopic(d) + "/" + commandTopicName
+}
+
+// CommandResultTopic is where a device acks commands and reports their results
+func CommandResultTopic(d *metadata.Device) string {
+	return CommandTopic(d) + "/" + resultTopicName
+}
+
+// ShadowDeltaTopic is where KCloud pushes desired state a device hasnt reported yet
+func ShadowDeltaTopic(d *metadata.Device) string {
+	return DeviceTopic(d) + "/" + shadowTopicName + "/delta"
+}
+
+// ShadowReportedTopic is where a device reports its state
+func ShadowReportedTopic(d *metadata.Device) string {
+	return DeviceTopic(d) + "/" + shadowTopicName + "/reported"
+}
+
+// subscribes reports whether filter, as subscribed by d, receives topic
+func subscribes(d *metadata.Device, filter, topic string) bool {
+	return filter == topic || filter == DeviceTopic(d)+"/#"
+}
+
+// isDeviceTopic reports whether topic (or a filter) lies under the device prefix
+func isDeviceTopic(d *metadata.Device, topic string) bool {
+	return strings.HasPrefix(topic, DeviceTopic(d)+"/")
+}
@@ -0,0 +1,163 @@
+package presence
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// flushTimeout bounds the last flush after the run ctx is done
+const flushTimeout = 5 * time.Second
+
+// Event is an online or offline transition of a device
+type Event struct {
+	DeviceID   uuid.UUID             `json:"device_id"`
+	DeviceName string                `json:"device_name"`
+	GroupID    uuid.UUID             `json:"grp_id"`
+	CompanyID  uuid.UUID             `json:"company_id"`
+	Status     metadata.DeviceStatus `json:"status"` //online or offline
+	LastSeenAt *time.Time            `json:"last_seen_at"`
+	At         time.Time             `json:"at"`
+}
+
+// EventHandler is told about every transition, e.g. to send it to a webhook
+type EventHandler interface {
+	HandlePresence(ctx context.Context, e *Event)
+}
+
+// Tracker notes when devices are seen in memory and writes the latest times
+// in batches, so ingest never waits on the database and the device rows are
+// not touched per message. It also turns devices that went quiet offline.
+type Tracker struct {
+	logger  *log.Logger
+	Store   metadata.PresenceStore
+	Handler EventHandler //optional
+
+	mu   sync.Mutex
+	seen map[uuid.UUID]*metadata.Device //devices seen since the last flush, LastSeenAt set to the latest time
+}
+
+func NewTracker(store metadata.PresenceStore, logger *log.Logger) *Tracker {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &Tracker{
+		logger: logger,
+		Store:  store,
+		seen:   make(map[uuid.UUID]*metadata.Device),
+	}
+}
+
+// DeviceSeen records a message of d at, it makes a Tracker a metadata.PresenceRecorder
+func (t *Tracker) DeviceSeen(d *metadata.Device, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prev, ok := t.seen[d.ID]; ok && !at.After(*prev.LastSeenAt) {
+		return
+	}
+	t.seen[d.ID] = &metadata.Device{
+		ID:         d.ID,
+		GrpID:      d.GrpID,
+		CompanyID:  d.CompanyID,
+		DeviceName: d.DeviceName,
+		LastSeenAt: &at,
+	}
+}
+
+// Flush writes the times noted since the last flush and reports the devices that came online
+func (t *Tracker) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	pending := t.seen
+	t.seen = make(map[uuid.UUID]*metadata.Device)
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	times := make(map[uuid.UUID]time.Time, len(pending))
+	for id, d := range pending {
+		times[id] = *d.LastSeenAt
+	}
+	online, err := t.Store.RecordDevicesSeen(ctx, times)
+	if err != nil {
+		t.requeue(pending)
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, id := range online {
+		t.handle(ctx, pending[id], metadata.DeviceOnline, now)
+	}
+	return nil
+}
+
+// Sweep marks the devices whose group heartbeat timeout passed offline and reports them
+func (t *Tracker) Sweep(ctx context.Context, now time.Time) error {
+	devices, err := t.Store.MarkDevicesOffline(ctx, now)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		t.handle(ctx, d, metadata.DeviceOffline, now.UTC())
+	}
+	return nil
+}
+
+// Run flushes and sweeps every interval until ctx is done, then flushes once more.
+// Wait for it to return before closing the store.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+			if err := t.Flush(flushCtx); err != nil {
+				t.logger.Println("[Run] final flush failed:", err)
+			}
+			cancel()
+			return
+		case now := <-ticker.C:
+			// Flush first so a device that just spoke is not swept
+			if err := t.Flush(ctx); err != nil {
+				t.logger.Println("[Run] flush failed:", err)
+			}
+			if err := t.Sweep(ctx, now); err != nil {
+				t.logger.Println("[Run] sweep failed:", err)
+			}
+		}
+	}
+}
+
+// requeue puts back times that failed to be written, unless newer ones came in meanwhile
+func (t *Tracker) requeue(pending map[uuid.UUID]*metadata.Device) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, d := range pending {
+		if newer, ok := t.seen[id]; !ok || d.LastSeenAt.After(*newer.LastSeenAt) {
+			t.seen[id] = d
+		}
+	}
+}
+
+func (t *Tracker) handle(ctx context.Context, d *metadata.Device, status metadata.DeviceStatus, at time.Time) {
+	t.logger.Printf("[presence] device %v is %s", d.ID, status)
+	if t.Handler == nil {
+		return
+	}
+	t.Handler.HandlePresence(ctx, &Event{
+		DeviceID:   d.ID,
+		DeviceName: d.DeviceName,
+		GroupID:    d.GrpID,
+		CompanyID:  d.CompanyID,
+		Status:     status,
+		LastSeenAt: d.LastSeenAt,
+		At:         at,
+	})
+}
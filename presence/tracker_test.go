@@ -0,0 +1,199 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+var t0 = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// fakeStore records the calls of a Tracker
+type fakeStore struct {
+	metadata.PresenceStore
+
+	mu        sync.Mutex
+	calls     []string
+	recorded  []map[uuid.UUID]time.Time
+	recordErr error              //returned by RecordDevicesSeen
+	online    []uuid.UUID        //returned by RecordDevicesSeen
+	offline   []*metadata.Device //returned by MarkDevicesOffline
+}
+
+func (s *fakeStore) RecordDevicesSeen(ctx context.Context, seen map[uuid.UUID]time.Time) ([]uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, "record")
+	if s.recordErr != nil {
+		return nil, s.recordErr
+	}
+	s.recorded = append(s.recorded, seen)
+	return s.online, nil
+}
+
+func (s *fakeStore) MarkDevicesOffline(ctx context.Context, now time.Time) ([]*metadata.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, "mark")
+	return s.offline, nil
+}
+
+func (s *fakeStore) callList() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// fakeHandler keeps the events it is told about
+type fakeHandler struct {
+	events []*Event
+}
+
+func (h *fakeHandler) HandlePresence(ctx context.Context, e *Event) {
+	h.events = append(h.events, e)
+}
+
+func newTestTracker() (*Tracker, *fakeStore, *fakeHandler) {
+	store := &fakeStore{}
+	handler := &fakeHandler{}
+	t := NewTracker(store, log.New(io.Discard, "", 0))
+	t.Handler = handler
+	return t, store, handler
+}
+
+func newDevice() *metadata.Device {
+	return &metadata.Device{ID: uuid.New(), GrpID: uuid.New(), CompanyID: uuid.New(), DeviceName: "boiler"}
+}
+
+func TestDeviceSeenKeepsTheNewestTime(t *testing.T) {
+	tr, store, _ := newTestTracker()
+	d := newDevice()
+
+	tr.DeviceSeen(d, t0.Add(2*time.Second))
+	tr.DeviceSeen(d, t0) //arrived late
+	tr.DeviceSeen(d, t0.Add(time.Second))
+	if err := tr.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.recorded) != 1 || len(store.recorded[0]) != 1 || !store.recorded[0][d.ID].Equal(t0.Add(2*time.Second)) {
+		t.Errorf("recorded %v, want only t0+2s for the device", store.recorded)
+	}
+}
+
+func TestFlushRequeuesOnFailure(t *testing.T) {
+	tr, store, _ := newTestTracker()
+	older, newer, untouched := newDevice(), newDevice(), newDevice()
+	tr.DeviceSeen(older, t0.Add(time.Minute))
+	tr.DeviceSeen(newer, t0)
+	tr.DeviceSeen(untouched, t0)
+
+	store.recordErr = errors.New("database down")
+	if err := tr.Flush(context.Background()); err == nil {
+		t.Fatal("Flush succeeded with the store failing")
+	}
+
+	// Seen while the flush failed: the requeued time of older is newer, newer has a newer one
+	tr.DeviceSeen(older, t0)
+	tr.DeviceSeen(newer, t0.Add(time.Minute))
+
+	store.recordErr = nil
+	if err := tr.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[uuid.UUID]time.Time{
+		older.ID:     t0.Add(time.Minute),
+		newer.ID:     t0.Add(time.Minute),
+		untouched.ID: t0,
+	}
+	if len(store.recorded) != 1 || len(store.recorded[0]) != len(want) {
+		t.Fatalf("recorded %v, want %v", store.recorded, want)
+	}
+	for id, at := range want {
+		if !store.recorded[0][id].Equal(at) {
+			t.Errorf("recorded %v for %v, want %v", store.recorded[0][id], id, at)
+		}
+	}
+
+	// Nothing is left to write
+	if err := tr.Flush(context.Background()); err != nil || len(store.recorded) != 1 {
+		t.Errorf("a second flush wrote %v (%v)", store.recorded[1:], err)
+	}
+}
+
+func TestEventsSentToHandler(t *testing.T) {
+	tr, store, handler := newTestTracker()
+	came, known := newDevice(), newDevice()
+	went := newDevice()
+	went.LastSeenAt = &t0
+	store.online = []uuid.UUID{came.ID}
+	store.offline = []*metadata.Device{went}
+
+	tr.DeviceSeen(came, t0)
+	tr.DeviceSeen(known, t0)
+	if err := tr.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	now := t0.Add(10 * time.Minute)
+	if err := tr.Sweep(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handler.events) != 2 {
+		t.Fatalf("got %d events, want an online and an offline one", len(handler.events))
+	}
+	on, off := handler.events[0], handler.events[1]
+	if on.Status != metadata.DeviceOnline || on.DeviceID != came.ID || on.DeviceName != came.DeviceName ||
+		on.GroupID != came.GrpID || on.CompanyID != came.CompanyID || !on.LastSeenAt.Equal(t0) {
+		t.Errorf("online event %+v, want one for %v seen at t0", on, came.ID)
+	}
+	if off.Status != metadata.DeviceOffline || off.DeviceID != went.ID || !off.At.Equal(now) || !off.LastSeenAt.Equal(t0) {
+		t.Errorf("offline event %+v, want one for %v at t0+10m", off, went.ID)
+	}
+}
+
+func TestRunFlushesBeforeSweeping(t *testing.T) {
+	tr, store, _ := newTestTracker()
+	tr.DeviceSeen(newDevice(), t0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tr.Run(ctx, 10*time.Millisecond)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(store.callList()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("calls %v after 2s, want a tick", store.callList())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if calls := store.callList(); calls[0] != "record" || calls[1] != "mark" {
+		t.Errorf("calls %v, want the flush before the sweep", calls)
+	}
+}
+
+func TestRunFlushesWhenStopped(t *testing.T) {
+	tr, store, _ := newTestTracker()
+	tr.DeviceSeen(newDevice(), t0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr.Run(ctx, time.Hour)
+
+	if calls := store.callList(); len(calls) != 1 || calls[0] != "record" {
+		t.Errorf("calls %v, want only the final flush", calls)
+	}
+}
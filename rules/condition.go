@@ -0,0 +1,153 @@
+package rules
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+// MaxFor caps how long a condition can be required to hold
+const MaxFor = 24 * time.Hour
+
+// Op compares a field to the rule value
+type Op string
+
+const (
+	OpGT Op = ">"
+	OpGE Op = ">="
+	OpLT Op = "<"
+	OpLE Op = "<="
+	OpEQ Op = "=="
+	OpNE Op = "!="
+)
+
+// Condition is a parsed rule expression: Field Op Value [for For]
+type Condition struct {
+	Field string
+	Op    Op
+	Value interface{} //float64, bool or string
+	For   time.Duration
+}
+
+// field op value [for duration], a string value is double quoted
+var exprRe = regexp.MustCompile(`^\s*([A-Za-z0-9_]+)\s*(>=|<=|==|!=|>|<)\s*("(?:[^"\\]|\\.)*"|[^\s"]+)(?:\s+for\s+(\S+))?\s*$`)
+
+// ParseCondition parses an expression like `temperature > 80 for 5m` or `door == "open"`
+func ParseCondition(expr string) (*Condition, error) {
+	m := exprRe.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, fmt.Errorf(`%w: expected "<field> <op> <value> [for <duration>]"`, ErrInvalidRule)
+	}
+
+	c := &Condition{Field: m[1], Op: Op(m[2])}
+	if len(c.Field) > metadata.MaxFieldNameLength {
+		return nil, fmt.Errorf("%w: field name exceeds %d characters", ErrInvalidRule, metadata.MaxFieldNameLength)
+	}
+
+	switch raw := m[3]; {
+	case strings.HasPrefix(raw, `"`):
+		s, err := strconv.Unquote(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid string %s", ErrInvalidRule, raw)
+		}
+		c.Value = s
+	case raw == "true" || raw == "false":
+		c.Value = raw == "true"
+	default:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid value %q, quote strings", ErrInvalidRule, raw)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%w: value must be a finite number", ErrInvalidRule)
+		}
+		c.Value = f
+	}
+	if _, numeric := c.Value.(float64); !numeric && c.Op != OpEQ && c.Op != OpNE {
+		return nil, fmt.Errorf("%w: %s needs a number", ErrInvalidRule, c.Op)
+	}
+
+	if m[4] != "" {
+		d, err := time.ParseDuration(m[4])
+		if err != nil || d < 0 || d > MaxFor {
+			return nil, fmt.Errorf("%w: for must be a duration up to %s", ErrInvalidRule, MaxFor)
+		}
+		c.For = d
+	}
+	return c, nil
+}
+
+// Check type checks c against a telemetry schema
+func (c *Condition) Check(schema metadata.TelemetrySchema) error {
+	typ, ok := schema[c.Field]
+	if !ok {
+		return fmt.Errorf("%w: no field %q in the schema", ErrInvalidRule, c.Field)
+	}
+
+	var want string
+	switch c.Value.(type) {
+	case float64:
+		if typ == "int" || typ == "float" {
+			return nil
+		}
+		want = "a number"
+	case bool:
+		if typ == "bool" {
+			return nil
+		}
+		want = "a bool"
+	case string:
+		if typ == "string" {
+			return nil
+		}
+		want = "a string"
+	}
+	return fmt.Errorf("%w: field %q is %s, the rule compares it to %s", ErrInvalidRule, c.Field, typ, want)
+}
+
+// Match reports whether the field value v meets the condition. Values of the
+// wrong type never match.
+func (c *Condition) Match(v interface{}) bool {
+	switch want := c.Value.(type) {
+	case float64:
+		var got float64
+		switch n := v.(type) {
+		case float64:
+			got = n
+		case int64:
+			got = float64(n)
+		case int:
+			got = float64(n)
+		default:
+			return false
+		}
+		switch c.Op {
+		case OpGT:
+			return got > want
+		case OpGE:
+			return got >= want
+		case OpLT:
+			return got < want
+		case OpLE:
+			return got <= want
+		case OpEQ:
+			return got == want
+		case OpNE:
+			return got != want
+		}
+	case bool, string:
+		if fmt.Sprintf("%T", v) != fmt.Sprintf("%T", want) {
+			return false
+		}
+		if c.Op == OpEQ {
+			return v == want
+		}
+		return v != want
+	}
+	return false
+}
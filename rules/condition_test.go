@@ -0,0 +1,56 @@
+package rules
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		expr string
+		want *Condition //nil when expr is invalid
+	}{
+		{"temperature > 80", &Condition{Field: "temperature", Op: OpGT, Value: 80.0}},
+		{"temperature>=80.5 for 5m", &Condition{Field: "temperature", Op: OpGE, Value: 80.5, For: 5 * time.Minute}},
+		{"  rpm <= -3  ", &Condition{Field: "rpm", Op: OpLE, Value: -3.0}},
+		{"rpm < 1e3", &Condition{Field: "rpm", Op: OpLT, Value: 1000.0}},
+		{"on == true", &Condition{Field: "on", Op: OpEQ, Value: true}},
+		{`door != "open"`, &Condition{Field: "door", Op: OpNE, Value: "open"}},
+		{`label == "say \"hi\""`, &Condition{Field: "label", Op: OpEQ, Value: `say "hi"`}},
+		{"temperature > 80 for 24h", &Condition{Field: "temperature", Op: OpGT, Value: 80.0, For: 24 * time.Hour}},
+
+		{"", nil},
+		{"temperature", nil},
+		{"temperature => 80", nil},
+		{"temperature > open", nil},
+		{`door > "open"`, nil},
+		{"on < true", nil},
+		{"temperature > 80 for ever", nil},
+		{"temperature > 80 for -1m", nil},
+		{"temperature > 80 for 25h", nil},
+		{"temperature > NaN", nil},
+		{"temperature > nan", nil},
+		{"temperature < Inf", nil},
+		{"temperature < +Inf", nil},
+		{"temperature > -inf", nil},
+		{"temperature > 1e999", nil},
+		{"bad-field > 1", nil},
+	}
+	for _, tt := range tests {
+		c, err := ParseCondition(tt.expr)
+		if tt.want == nil {
+			if !errors.Is(err, ErrInvalidRule) {
+				t.Errorf("ParseCondition(%q) = %+v, %v, want ErrInvalidRule", tt.expr, c, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCondition(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if *c != *tt.want {
+			t.Errorf("ParseCondition(%q) = %+v, want %+v", tt.expr, c, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package rules
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+// Engine evaluates readings against the rules of their company. Rules are
+// cached per company and reloaded after Invalidate; firing rules are kept in
+// the store so a restart does not alert again.
+type Engine struct {
+	logger  *log.Logger
+	Rules   RuleStore
+	Handler EventHandler //optional, told about every event
+
+	mu        sync.Mutex
+	companies map[uuid.UUID]*companyRules
+}
+
+// companyRules is the cached rules of a company and their state per device
+type companyRules struct {
+	mu     sync.Mutex
+	rules  []*Rule //nil until loaded
+	states map[stateKey]*ruleState
+	loaded bool   //states were read from the store
+	gen    uint64 //bumped by Invalidate, a load started before is not cached
+}
+
+type stateKey struct {
+	ruleID   uuid.UUID
+	deviceID uuid.UUID
+}
+
+type ruleState struct {
+	since   time.Time //when the condition started to hold, zero while it doesnt
+	firing  bool
+	lastAt  time.Time //newest sample seen, older ones are skipped
+	version time.Time //UpdatedAt of the rule this state is for
+}
+
+func NewEngine(store RuleStore, logger *log.Logger) *Engine {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &Engine{
+		logger:    logger,
+		Rules:     store,
+		companies: make(map[uuid.UUID]*companyRules),
+	}
+}
+
+// Evaluate runs the readings of d through every enabled rule covering it,
+// oldest first, and records the resulting firing and resolved events
+func (e *Engine) Evaluate(ctx context.Context, d *metadata.Device, readings []*storageengine.Reading) {
+	cr := e.company(d.CompanyID)
+	rules, err := e.load(ctx, cr, d.CompanyID)
+	if err != nil {
+		e.logger.Println("[Evaluate] failed to load rules:", err)
+		return
+	}
+
+	cr.mu.Lock()
+	sorted := make([]*storageengine.Reading, len(readings))
+	copy(sorted, readings)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	var events []*Event
+	for _, r := range rules {
+		if !r.Enabled || r.Condition == nil || !r.Applies(d) || r.Condition.Check(d.TelemetryDataSchema) != nil {
+			continue
+		}
+		key := stateKey{ruleID: r.ID, deviceID: d.ID}
+		st, ok := cr.states[key]
+		if !ok {
+			st = &ruleState{version: r.UpdatedAt}
+			cr.states[key] = st
+		}
+		if !st.version.Equal(r.UpdatedAt) {
+			// The condition changed, start over but remember if it was firing
+			st.since, st.version = time.Time{}, r.UpdatedAt
+		}
+
+		for _, reading := range sorted {
+			v, ok := reading.Data[r.Condition.Field]
+			if !ok || reading.Timestamp.Before(st.lastAt) {
+				continue
+			}
+			st.lastAt = reading.Timestamp
+			if ev := st.observe(r, d, v, reading.Timestamp); ev != nil {
+				events = append(events, ev)
+			}
+		}
+	}
+	cr.mu.Unlock()
+
+	for _, ev := range events {
+		if err := e.Rules.RecordEvent(ctx, ev); err != nil {
+			e.logger.Println("[Evaluate] failed to record event:", err)
+			continue
+		}
+		e.logger.Printf("[Evaluate] rule %q %s for device %s", ev.RuleName, ev.State, ev.DeviceID)
+		if e.Handler != nil {
+			e.Handler.HandleEvent(ctx, ev)
+		}
+	}
+}
+
+// observe moves the state on by one sample and returns the event it caused, if any
+func (st *ruleState) observe(r *Rule, d *metadata.Device, v interface{}, at time.Time) *Event {
+	if !r.Condition.Match(v) {
+		st.since = time.Time{}
+		if !st.firing {
+			return nil
+		}
+		st.firing = false
+		return newEvent(r, d, StateResolved, v, at)
+	}
+
+	if st.since.IsZero() {
+		st.since = at
+	}
+	if st.firing || at.Sub(st.since) < r.Condition.For {
+		return nil
+	}
+	st.firing = true
+	return newEvent(r, d, StateFiring, v, at)
+}
+
+func newEvent(r *Rule, d *metadata.Device, state State, v interface{}, at time.Time) *Event {
+	return &Event{
+		RuleID:    r.ID,
+		RuleName:  r.Name,
+		CompanyID: d.CompanyID,
+		DeviceID:  d.ID,
+		State:     state,
+		Value:     v,
+		At:        at,
+	}
+}
+
+// Invalidate drops the cached rules of a company, the next reading reloads them
+func (e *Engine) Invalidate(companyID uuid.UUID) {
+	cr := e.company(companyID)
+	cr.mu.Lock()
+	cr.rules = nil
+	cr.gen++
+	cr.mu.Unlock()
+}
+
+// RunReload invalidates every company every interval until ctx is done, so
+// rule changes made through other KCloud instances are picked up
+func (e *Engine) RunReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.mu.Lock()
+			ids := make([]uuid.UUID, 0, len(e.companies))
+			for id := range e.companies {
+				ids = append(ids, id)
+			}
+			e.mu.Unlock()
+			for _, id := range ids {
+				e.Invalidate(id)
+			}
+		}
+	}
+}
+
+func (e *Engine) company(companyID uuid.UUID) *companyRules {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cr, ok := e.companies[companyID]
+	if !ok {
+		cr = &companyRules{states: make(map[stateKey]*ruleState)}
+		e.companies[companyID] = cr
+	}
+	return cr
+}
+
+// load returns the rules of cr, reading them from the store if they were
+// invalidated. The store is read without cr.mu held, so a slow query does not
+// hold up the other readings of the company, then the result is swapped in.
+func (e *Engine) load(ctx context.Context, cr *companyRules, companyID uuid.UUID) ([]*Rule, error) {
+	cr.mu.Lock()
+	cached, gen, loaded := cr.rules, cr.gen, cr.loaded
+	cr.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	rules, err := e.Rules.ListRules(ctx, companyID)
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = []*Rule{}
+	}
+	var firing []*Firing
+	if !loaded {
+		if firing, err = e.Rules.ListFiring(ctx, companyID); err != nil {
+			return nil, err
+		}
+	}
+	live := make(map[uuid.UUID]*Rule, len(rules))
+	for _, r := range rules {
+		live[r.ID] = r
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !loaded && !cr.loaded {
+		for _, f := range firing {
+			if r, ok := live[f.RuleID]; ok {
+				cr.states[stateKey{ruleID: f.RuleID, deviceID: f.DeviceID}] = &ruleState{
+					since: f.Since, firing: true, version: r.UpdatedAt,
+				}
+			}
+		}
+		cr.loaded = true
+	}
+	if cr.gen != gen {
+		// Invalidated while loading, these may miss the change so the next
+		// reading loads again
+		return rules, nil
+	}
+
+	// Forget deleted rules
+	for key := range cr.states {
+		if _, ok := live[key.ruleID]; !ok {
+			delete(cr.states, key)
+		}
+	}
+	cr.rules = rules
+	return rules, nil
+}
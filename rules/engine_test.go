@@ -0,0 +1,163 @@
+package rules
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+func TestObserve(t *testing.T) {
+	type sample struct {
+		after time.Duration //since the first sample
+		value interface{}
+		want  State //event the sample causes, "" for none
+	}
+	tests := []struct {
+		name    string
+		expr    string
+		samples []sample
+	}{
+		{"fires and resolves", "temp > 80", []sample{
+			{0, 70.0, ""},
+			{time.Second, 85.0, StateFiring},
+			{2 * time.Second, 90.0, ""}, //still firing, no repeat
+			{3 * time.Second, 80.0, StateResolved},
+			{4 * time.Second, 70.0, ""},
+		}},
+		{"fires after holding for the duration", "temp > 80 for 1m", []sample{
+			{0, 85.0, ""},
+			{30 * time.Second, 90.0, ""},
+			{time.Minute, 95.0, StateFiring},
+			{2 * time.Minute, 70.0, StateResolved},
+		}},
+		{"a break restarts the duration", "temp > 80 for 1m", []sample{
+			{0, 85.0, ""},
+			{50 * time.Second, 70.0, ""}, //never fired, nothing to resolve
+			{55 * time.Second, 85.0, ""},
+			{time.Minute + 30*time.Second, 85.0, ""},
+			{time.Minute + 55*time.Second, 85.0, StateFiring},
+		}},
+		{"ints compare as numbers", "rpm >= 3000", []sample{
+			{0, int64(2999), ""},
+			{time.Second, int64(3000), StateFiring},
+			{2 * time.Second, 2999, StateResolved},
+		}},
+		{"values of another type resolve", "temp > 80", []sample{
+			{0, 85.0, StateFiring},
+			{time.Second, "hot", StateResolved},
+		}},
+		{"strings", `door == "open"`, []sample{
+			{0, "closed", ""},
+			{time.Second, "open", StateFiring},
+			{2 * time.Second, "closed", StateResolved},
+		}},
+		{"bools", "on != true", []sample{
+			{0, true, ""},
+			{time.Second, false, StateFiring},
+			{2 * time.Second, true, StateResolved},
+		}},
+	}
+
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCondition(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &Rule{ID: uuid.New(), Name: tt.name, Condition: c}
+			d := &metadata.Device{ID: uuid.New(), CompanyID: uuid.New()}
+			st := &ruleState{}
+
+			for i, s := range tt.samples {
+				at := start.Add(s.after)
+				ev := st.observe(r, d, s.value, at)
+				switch {
+				case s.want == "" && ev != nil:
+					t.Errorf("sample %d (%v): got a %s event, want none", i, s.value, ev.State)
+				case s.want != "" && ev == nil:
+					t.Errorf("sample %d (%v): got no event, want %s", i, s.value, s.want)
+				case ev != nil && (ev.State != s.want || !ev.At.Equal(at) || ev.Value != s.value ||
+					ev.RuleID != r.ID || ev.DeviceID != d.ID || ev.CompanyID != d.CompanyID):
+					t.Errorf("sample %d (%v): got %+v, want a %s event for it", i, s.value, ev, s.want)
+				}
+			}
+		})
+	}
+}
+
+// slowRuleStore blocks ListRules until release is closed
+type slowRuleStore struct {
+	RuleStore
+	rules   []*Rule
+	release chan struct{}
+
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (s *slowRuleStore) ListRules(ctx context.Context, companyID uuid.UUID) ([]*Rule, error) {
+	<-s.release
+	return s.rules, nil
+}
+
+func (s *slowRuleStore) ListFiring(ctx context.Context, companyID uuid.UUID) ([]*Firing, error) {
+	return nil, nil
+}
+
+func (s *slowRuleStore) RecordEvent(ctx context.Context, e *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestEvaluateLoadsRulesWithoutTheLock(t *testing.T) {
+	d := &metadata.Device{
+		ID:                  uuid.New(),
+		GrpID:               uuid.New(),
+		CompanyID:           uuid.New(),
+		TelemetryDataSchema: metadata.TelemetrySchema{"temp": "float"},
+	}
+	c, _ := ParseCondition("temp > 80")
+	store := &slowRuleStore{
+		rules:   []*Rule{{ID: uuid.New(), CompanyID: d.CompanyID, Scope: ScopeCompany, Enabled: true, Condition: c}},
+		release: make(chan struct{}),
+	}
+	e := NewEngine(store, log.New(io.Discard, "", 0))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Evaluate(context.Background(), d, []*storageengine.Reading{
+			{CompanyID: d.CompanyID, DeviceID: d.ID, Timestamp: time.Now(), Data: map[string]interface{}{"temp": 90.0}},
+		})
+	}()
+
+	// The company lock is free while the store is slow
+	locked := make(chan struct{})
+	go func() {
+		cr := e.company(d.CompanyID)
+		cr.mu.Lock()
+		cr.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the company lock is held while rules load")
+	}
+
+	close(store.release)
+	<-done
+	if len(store.events) != 1 || store.events[0].State != StateFiring {
+		t.Errorf("events %+v, want one firing", store.events)
+	}
+}
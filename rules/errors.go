@@ -0,0 +1,13 @@
+package rules
+
+import (
+	"errors"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+var (
+	ErrInvalidRule    = metadata.NewError(metadata.ErrValidation, "invalid rule")
+	ErrRuleNotFound   = metadata.NewError(metadata.ErrNotFound, "rule not found")
+	ErrDbErrorGeneric = errors.New("database error")
+)
@@ -0,0 +1,353 @@
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	auditlog "github.com/mukundvijay123/KCloud/metadata/auditLog"
+)
+
+const ruleColumns = `id, company_id, name, scope, target_id, expr, enabled, created_at, updated_at`
+
+// PgRuleStore keeps rules in the postgres "rule" table, events in "rule_event"
+// and the firing rules in "rule_state"
+type PgRuleStore struct {
+	dbConn *sql.DB
+	logger *log.Logger
+}
+
+func NewPgRuleStore(db *sql.DB, logger *log.Logger) *PgRuleStore {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &PgRuleStore{
+		dbConn: db,
+		logger: logger,
+	}
+}
+
+func (s *PgRuleStore) CreateRule(ctx context.Context, r *Rule) (err error) {
+	if err := validateRule(r); err != nil {
+		return err
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[CreateRule] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO rule (company_id, name, scope, target_id, expr, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at
+	`, r.CompanyID, r.Name, string(r.Scope), r.TargetID, r.Expr, r.Enabled).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		s.logger.Println("[CreateRule] failed to insert rule:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err = s.audit(ctx, tx, r.CompanyID, metadata.AuditRuleCreate, r.ID, nil, r); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[CreateRule] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	s.logger.Println("[CreateRule] rule created:", r.ID)
+	return nil
+}
+
+func (s *PgRuleStore) GetRule(ctx context.Context, companyID, id uuid.UUID) (*Rule, error) {
+	row := s.dbConn.QueryRowContext(ctx, `
+		SELECT `+ruleColumns+` FROM rule WHERE id = $1 AND company_id = $2
+	`, id, companyID)
+	r, err := scanRule(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrRuleNotFound, id)
+	}
+	if err != nil {
+		s.logger.Println("[GetRule] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return r, nil
+}
+
+func (s *PgRuleStore) ListRules(ctx context.Context, companyID uuid.UUID) ([]*Rule, error) {
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT `+ruleColumns+` FROM rule WHERE company_id = $1 ORDER BY created_at, id
+	`, companyID)
+	if err != nil {
+		s.logger.Println("[ListRules] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var rules []*Rule
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			s.logger.Println("[ListRules] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[ListRules] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return rules, nil
+}
+
+func (s *PgRuleStore) UpdateRule(ctx context.Context, r *Rule) (err error) {
+	if err := validateRule(r); err != nil {
+		return err
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[UpdateRule] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before, err := scanRule(tx.QueryRowContext(ctx, `
+		SELECT `+ruleColumns+` FROM rule WHERE id = $1 AND company_id = $2 FOR UPDATE
+	`, r.ID, r.CompanyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrRuleNotFound, r.ID)
+	}
+	if err != nil {
+		s.logger.Println("[UpdateRule] error reading rule:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE rule SET name = $3, expr = $4, enabled = $5, updated_at = now()
+		WHERE id = $1 AND company_id = $2
+		RETURNING updated_at
+	`, r.ID, r.CompanyID, r.Name, r.Expr, r.Enabled).Scan(&r.UpdatedAt)
+	if err != nil {
+		s.logger.Println("[UpdateRule] error:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	//scope and target never change
+	after := *before
+	after.Name, after.Expr, after.Enabled, after.UpdatedAt = r.Name, r.Expr, r.Enabled, r.UpdatedAt
+	if err = s.audit(ctx, tx, r.CompanyID, metadata.AuditRuleUpdate, r.ID, before, &after); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[UpdateRule] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgRuleStore) DeleteRule(ctx context.Context, companyID, id uuid.UUID) (err error) {
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[DeleteRule] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before, err := scanRule(tx.QueryRowContext(ctx, `
+		DELETE FROM rule WHERE id = $1 AND company_id = $2 RETURNING `+ruleColumns,
+		id, companyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrRuleNotFound, id)
+	}
+	if err != nil {
+		s.logger.Println("[DeleteRule] error:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err = s.audit(ctx, tx, companyID, metadata.AuditRuleDelete, id, before, nil); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[DeleteRule] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+// audit writes the event of a rule change into tx, see auditlog.Write
+func (s *PgRuleStore) audit(ctx context.Context, tx *sql.Tx, companyID uuid.UUID, action string, id uuid.UUID, before, after *Rule) error {
+	var b, a any
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	if err := auditlog.Write(ctx, tx, companyID, action, id, b, a); err != nil {
+		s.logger.Println("[audit] error writing event:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgRuleStore) RecordEvent(ctx context.Context, e *Event) (err error) {
+	value, err := json.Marshal(e.Value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[RecordEvent] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO rule_event (rule_id, company_id, device_id, state, value, at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, e.RuleID, e.CompanyID, e.DeviceID, string(e.State), value, e.At).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		s.logger.Println("[RecordEvent] failed to insert event:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if e.State == StateFiring {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO rule_state (rule_id, device_id, since) VALUES ($1, $2, $3)
+			ON CONFLICT (rule_id, device_id) DO UPDATE SET since = EXCLUDED.since
+		`, e.RuleID, e.DeviceID, e.At)
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM rule_state WHERE rule_id = $1 AND device_id = $2`, e.RuleID, e.DeviceID)
+	}
+	if err != nil {
+		s.logger.Println("[RecordEvent] failed to update rule state:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[RecordEvent] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgRuleStore) ListEvents(ctx context.Context, companyID uuid.UUID, f EventFilter) ([]*Event, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = metadata.DefaultListLimit
+	}
+	limit = min(limit, metadata.MaxListLimit)
+
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT e.id, e.rule_id, r.name, e.company_id, e.device_id, e.state, e.value, e.at, e.created_at
+		FROM rule_event e JOIN rule r ON r.id = e.rule_id
+		WHERE e.company_id = $1
+			AND ($2 = '00000000-0000-0000-0000-000000000000'::uuid OR e.rule_id = $2)
+			AND ($3 = '00000000-0000-0000-0000-000000000000'::uuid OR e.device_id = $3)
+			AND ($4 = '' OR e.state = $4)
+		ORDER BY e.created_at DESC, e.id
+		LIMIT $5
+	`, companyID, f.RuleID, f.DeviceID, string(f.State), limit)
+	if err != nil {
+		s.logger.Println("[ListEvents] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var events []*Event
+	for rows.Next() {
+		var (
+			e     Event
+			state string
+			value []byte
+		)
+		if err := rows.Scan(&e.ID, &e.RuleID, &e.RuleName, &e.CompanyID, &e.DeviceID, &state, &value, &e.At, &e.CreatedAt); err != nil {
+			s.logger.Println("[ListEvents] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		e.State = State(state)
+		if len(value) > 0 {
+			_ = json.Unmarshal(value, &e.Value)
+		}
+		events = append(events, &e)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[ListEvents] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return events, nil
+}
+
+func (s *PgRuleStore) ListFiring(ctx context.Context, companyID uuid.UUID) ([]*Firing, error) {
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT st.rule_id, st.device_id, st.since
+		FROM rule_state st JOIN rule r ON r.id = st.rule_id
+		WHERE r.company_id = $1
+	`, companyID)
+	if err != nil {
+		s.logger.Println("[ListFiring] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var firing []*Firing
+	for rows.Next() {
+		var f Firing
+		if err := rows.Scan(&f.RuleID, &f.DeviceID, &f.Since); err != nil {
+			s.logger.Println("[ListFiring] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		firing = append(firing, &f)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[ListFiring] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return firing, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanRule reads a rule row and parses its expression
+func scanRule(row scanner) (*Rule, error) {
+	var (
+		r     Rule
+		scope string
+	)
+	err := row.Scan(&r.ID, &r.CompanyID, &r.Name, &scope, &r.TargetID, &r.Expr, &r.Enabled, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	r.Scope = Scope(scope)
+	// A rule that no longer parses stays listed but is never evaluated
+	r.Condition, _ = ParseCondition(r.Expr)
+	return &r, nil
+}
@@ -0,0 +1,58 @@
+package rules
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+	metadatatest "github.com/mukundvijay123/KCloud/metadata/metadataTest"
+)
+
+func TestPgRuleStoreAudit(t *testing.T) {
+	db := metadatatest.OpenTestDb(t)
+	logger := log.New(io.Discard, "", 0)
+	mdb := metadatastore.NewMetadataDb(db, logger)
+	store := NewPgRuleStore(db, logger)
+
+	d := metadatatest.MustDevice(t, mdb)
+	userID := uuid.New()
+	ctx := metadata.WithActor(context.Background(), metadata.Actor{UserID: userID, RequestID: "req-rules"})
+
+	r := &Rule{CompanyID: d.CompanyID, Name: "hot", Scope: ScopeDevice, TargetID: d.ID, Expr: "temp > 80", Enabled: true}
+	if err := store.CreateRule(ctx, r); err != nil {
+		t.Fatalf("CreateRule: %v", err)
+	}
+	r.Expr = "temp > 90"
+	if err := store.UpdateRule(ctx, r); err != nil {
+		t.Fatalf("UpdateRule: %v", err)
+	}
+	// Failed changes leave no event
+	if err := store.UpdateRule(ctx, &Rule{ID: uuid.New(), CompanyID: d.CompanyID, Name: "gone", Scope: ScopeDevice, TargetID: d.ID, Expr: "temp > 1"}); err == nil {
+		t.Fatal("UpdateRule updated a missing rule")
+	}
+	if err := store.DeleteRule(ctx, r.CompanyID, r.ID); err != nil {
+		t.Fatalf("DeleteRule: %v", err)
+	}
+
+	events, actions := metadatatest.AuditActions(t, mdb, d.CompanyID.String())
+	want := strings.Join([]string{metadata.AuditRuleDelete, metadata.AuditRuleUpdate, metadata.AuditRuleCreate}, " ")
+	if !strings.HasPrefix(actions, want) {
+		t.Fatalf("audit log = %s, want it to start with %s", actions, want)
+	}
+	for _, e := range events[:3] {
+		if e.ResourceID != r.ID || e.ActorUserID != userID || e.RequestID != "req-rules" {
+			t.Errorf("%s event = %+v, want the rule, actor and request id", e.Action, e)
+		}
+	}
+	if update := events[1]; !strings.Contains(string(update.Before), "temp > 80") || !strings.Contains(string(update.After), "temp > 90") {
+		t.Errorf("rule.update event has before %s, after %s", update.Before, update.After)
+	}
+	if del := events[0]; del.Before == nil || del.After != nil {
+		t.Errorf("rule.delete event has before %s, after %s, want only before", del.Before, del.After)
+	}
+}
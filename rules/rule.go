@@ -0,0 +1,112 @@
+package rules
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+// Scope is what a rule applies to
+type Scope string
+
+const (
+	ScopeDevice  Scope = "device"
+	ScopeGroup   Scope = "group"
+	ScopeCompany Scope = "company"
+)
+
+// State of a rule for one device
+type State string
+
+const (
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+const MaxRuleNameLength = 128
+
+// Rule is a condition on one telemetry field, e.g. "temperature > 80 for 5m",
+// evaluated for every device in its scope
+type Rule struct {
+	ID        uuid.UUID `json:"id"`
+	CompanyID uuid.UUID `json:"company_id"`
+	Name      string    `json:"name"`
+	Scope     Scope     `json:"scope"`
+	TargetID  uuid.UUID `json:"target_id"` //device or group id, the company id for company rules
+	Expr      string    `json:"expr"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Condition *Condition `json:"-"` //parsed Expr
+}
+
+// Event is a change of a rule's state for a device
+type Event struct {
+	ID        uuid.UUID   `json:"id"`
+	RuleID    uuid.UUID   `json:"rule_id"`
+	RuleName  string      `json:"rule_name"`
+	CompanyID uuid.UUID   `json:"company_id"`
+	DeviceID  uuid.UUID   `json:"device_id"`
+	State     State       `json:"state"`
+	Value     interface{} `json:"value"` //field value of the sample that changed the state
+	At        time.Time   `json:"at"`    //timestamp of that sample
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// EventFilter narrows ListEvents, zero fields match everything
+type EventFilter struct {
+	RuleID   uuid.UUID
+	DeviceID uuid.UUID
+	State    State
+	Limit    int
+}
+
+// Firing is a rule firing for a device since Since
+type Firing struct {
+	RuleID   uuid.UUID
+	DeviceID uuid.UUID
+	Since    time.Time
+}
+
+// Applies reports whether r covers device d
+func (r *Rule) Applies(d *metadata.Device) bool {
+	switch r.Scope {
+	case ScopeDevice:
+		return r.TargetID == d.ID
+	case ScopeGroup:
+		return r.TargetID == d.GrpID
+	case ScopeCompany:
+		return r.CompanyID == d.CompanyID
+	}
+	return false
+}
+
+// RuleStore persists rules, their events and which of them are firing
+type RuleStore interface {
+	CreateRule(ctx context.Context, r *Rule) error
+	GetRule(ctx context.Context, companyID, id uuid.UUID) (*Rule, error)
+	ListRules(ctx context.Context, companyID uuid.UUID) ([]*Rule, error)
+	UpdateRule(ctx context.Context, r *Rule) error //updates name, expr and enabled
+	DeleteRule(ctx context.Context, companyID, id uuid.UUID) error
+
+	// RecordEvent stores e and marks the rule firing or not for the device, atomically
+	RecordEvent(ctx context.Context, e *Event) error
+	// ListEvents returns events of a company, newest first
+	ListEvents(ctx context.Context, companyID uuid.UUID, f EventFilter) ([]*Event, error)
+	// ListFiring returns what is firing in a company
+	ListFiring(ctx context.Context, companyID uuid.UUID) ([]*Firing, error)
+}
+
+// Evaluator checks freshly ingested readings of a device against the rules
+type Evaluator interface {
+	Evaluate(ctx context.Context, d *metadata.Device, readings []*storageengine.Reading)
+}
+
+// EventHandler is told about every recorded event, e.g. to notify someone
+type EventHandler interface {
+	HandleEvent(ctx context.Context, e *Event)
+}
@@ -0,0 +1,321 @@
+package rulesrouter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	"github.com/mukundvijay123/KCloud/rules"
+)
+
+type createRequest struct {
+	Name     string      `json:"name"`
+	Scope    rules.Scope `json:"scope"`
+	TargetID uuid.UUID   `json:"target_id"` //left out for company rules
+	Expr     string      `json:"expr"`
+	Enabled  *bool       `json:"enabled"` //true when left out
+}
+
+type updateRequest struct {
+	Name    *string `json:"name"`
+	Expr    *string `json:"expr"`
+	Enabled *bool   `json:"enabled"`
+}
+
+type ruleList struct {
+	Rules []*rules.Rule `json:"rules"`
+}
+
+type eventList struct {
+	Events []*rules.Event `json:"events"`
+}
+
+// createHandler adds a rule after type checking it against the schemas of the devices it covers
+func (rr *RulesRouter) createHandler(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	rule := &rules.Rule{
+		CompanyID: companyID,
+		Name:      req.Name,
+		Scope:     req.Scope,
+		TargetID:  req.TargetID,
+		Expr:      req.Expr,
+		Enabled:   req.Enabled == nil || *req.Enabled,
+	}
+	if rule.Scope == rules.ScopeCompany {
+		rule.TargetID = companyID
+	} else if rule.TargetID == uuid.Nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "target_id is required")
+		return
+	}
+	if !rr.typeCheck(w, r, rule) {
+		return
+	}
+
+	if err := rr.Rules.CreateRule(r.Context(), rule); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to create rule")
+		rr.logger.Println("[createHandler] error:", err)
+		return
+	}
+	rr.invalidate(companyID)
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// listHandler serves GET /api/rules?scope=&target_id=
+func (rr *RulesRouter) listHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, _ := metadatarouter.CompanyIDFromContext(r.Context())
+	scope := rules.Scope(r.URL.Query().Get("scope"))
+	var targetID uuid.UUID
+	if s := r.URL.Query().Get("target_id"); s != "" {
+		var err error
+		if targetID, err = uuid.Parse(s); err != nil {
+			metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid target_id")
+			return
+		}
+	}
+
+	all, err := rr.Rules.ListRules(r.Context(), companyID)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch rules")
+		rr.logger.Println("[listHandler] error:", err)
+		return
+	}
+	list := ruleList{Rules: []*rules.Rule{}}
+	for _, rule := range all {
+		if (scope == "" || rule.Scope == scope) && (targetID == uuid.Nil || rule.TargetID == targetID) {
+			list.Rules = append(list.Rules, rule)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (rr *RulesRouter) getHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := rr.fetchRule(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// updateHandler changes the name, expression or enabled flag of a rule. A new
+// expression is type checked again and restarts the rule's evaluation.
+func (rr *RulesRouter) updateHandler(w http.ResponseWriter, r *http.Request) {
+	var req updateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	rule, ok := rr.fetchRule(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Name != nil {
+		rule.Name = *req.Name
+	}
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+	if req.Expr != nil {
+		rule.Expr = *req.Expr
+		if !rr.typeCheck(w, r, rule) {
+			return
+		}
+	}
+
+	if err := rr.Rules.UpdateRule(r.Context(), rule); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to update rule")
+		rr.logger.Println("[updateHandler] error:", err)
+		return
+	}
+	rr.invalidate(rule.CompanyID)
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (rr *RulesRouter) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := rr.fetchRule(w, r)
+	if !ok {
+		return
+	}
+
+	if err := rr.Rules.DeleteRule(r.Context(), rule.CompanyID, rule.ID); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to delete rule")
+		rr.logger.Println("[deleteHandler] error:", err)
+		return
+	}
+	rr.invalidate(rule.CompanyID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventsHandler serves GET /api/rules/events?rule_id=&device_id=&state=&limit=, newest first
+func (rr *RulesRouter) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, _ := metadatarouter.CompanyIDFromContext(r.Context())
+	q := r.URL.Query()
+
+	var f rules.EventFilter
+	var err error
+	if s := q.Get("rule_id"); s != "" {
+		if f.RuleID, err = uuid.Parse(s); err != nil {
+			metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid rule_id")
+			return
+		}
+	}
+	if s := q.Get("device_id"); s != "" {
+		if f.DeviceID, err = uuid.Parse(s); err != nil {
+			metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid device_id")
+			return
+		}
+	}
+	switch f.State = rules.State(q.Get("state")); f.State {
+	case "", rules.StateFiring, rules.StateResolved:
+	default:
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid state")
+		return
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit <= 0 || f.Limit > metadata.MaxListLimit {
+			metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	events, err := rr.Rules.ListEvents(r.Context(), companyID, f)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch events")
+		rr.logger.Println("[eventsHandler] error:", err)
+		return
+	}
+	if events == nil {
+		events = []*rules.Event{}
+	}
+	writeJSON(w, http.StatusOK, eventList{Events: events})
+}
+
+// fetchRule loads the rule in the path, scoped to the caller. On failure it has already written the response.
+func (rr *RulesRouter) fetchRule(w http.ResponseWriter, r *http.Request) (*rules.Rule, bool) {
+	ruleID, err := uuid.Parse(mux.Vars(r)["ruleID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid rule id")
+		return nil, false
+	}
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return nil, false
+	}
+
+	rule, err := rr.Rules.GetRule(r.Context(), companyID, ruleID)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch rule")
+		rr.logger.Println("[fetchRule] error:", err)
+		return nil, false
+	}
+	return rule, true
+}
+
+// typeCheck parses the rule expression and checks it against every device
+// the rule covers: at least one has to have the field, none with another type.
+// On failure it has already written the response.
+func (rr *RulesRouter) typeCheck(w http.ResponseWriter, r *http.Request, rule *rules.Rule) bool {
+	cond, err := rules.ParseCondition(rule.Expr)
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	devices, err := rr.scopeDevices(r.Context(), rule)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch devices")
+		rr.logger.Println("[typeCheck] error:", err)
+		return false
+	}
+	if devices == nil {
+		// scopeDevices found a target of another company
+		metadatarouter.WriteJSONError(w, http.StatusForbidden, "Forbidden")
+		return false
+	}
+
+	found := false
+	for _, d := range devices {
+		if _, ok := d.TelemetryDataSchema[cond.Field]; !ok {
+			continue
+		}
+		if err := cond.Check(d.TelemetryDataSchema); err != nil {
+			metadatarouter.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("device %s: %v", d.ID, err))
+			return false
+		}
+		found = true
+	}
+	if !found {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("no device in scope has a field %q", cond.Field))
+		return false
+	}
+	rule.Condition = cond
+	return true
+}
+
+// scopeDevices returns the devices a rule covers, nil when its target belongs
+// to another company
+func (rr *RulesRouter) scopeDevices(ctx context.Context, rule *rules.Rule) ([]*metadata.Device, error) {
+	switch rule.Scope {
+	case rules.ScopeDevice:
+		d, err := rr.MdataStore.GetDeviceByID(ctx, rule.TargetID.String())
+		if err != nil {
+			return nil, err
+		}
+		if d.CompanyID != rule.CompanyID {
+			return nil, nil
+		}
+		return []*metadata.Device{d}, nil
+	case rules.ScopeGroup:
+		g, err := rr.MdataStore.GetGroupByID(ctx, rule.TargetID.String())
+		if err != nil {
+			return nil, err
+		}
+		if g.CompanyID != rule.CompanyID {
+			return nil, nil
+		}
+		return rr.allDevices(ctx, rr.MdataStore.ListDevicesByGroup, g.ID.String())
+	case rules.ScopeCompany:
+		return rr.allDevices(ctx, rr.MdataStore.ListDevicesByCompany, rule.CompanyID.String())
+	}
+	return nil, metadata.NewError(metadata.ErrValidation, "scope must be device, group or company")
+}
+
+// allDevices follows the pages of a device list
+func (rr *RulesRouter) allDevices(ctx context.Context, list func(context.Context, string, *metadata.ListOptions) ([]*metadata.Device, string, error), ownerID string) ([]*metadata.Device, error) {
+	opts := &metadata.ListOptions{Limit: metadata.MaxListLimit}
+	all := []*metadata.Device{}
+	for {
+		devices, next, err := list(ctx, ownerID, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, devices...)
+		if next == "" {
+			return all, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+func (rr *RulesRouter) invalidate(companyID uuid.UUID) {
+	if rr.Engine != nil {
+		rr.Engine.Invalidate(companyID)
+	}
+}
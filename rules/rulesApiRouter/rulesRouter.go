@@ -0,0 +1,57 @@
+package rulesrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	"github.com/mukundvijay123/KCloud/rules"
+)
+
+type RulesRouter struct {
+	logger     *log.Logger
+	MdataStore metadata.MetadataReader
+	Rules      rules.RuleStore
+	Engine     *rules.Engine //optional, told to reload a company's rules after a change
+}
+
+func NewRulesRouter(mdataStore metadata.MetadataReader, ruleStore rules.RuleStore, logger *log.Logger) *RulesRouter {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &RulesRouter{
+		logger:     logger,
+		MdataStore: mdataStore,
+		Rules:      ruleStore,
+	}
+}
+
+// AddRoutes registers the rule routes on router, guarded by userAuth.
+// Every role may read rules, changing them needs an admin. Rules span the
+// company, keys scoped to a group get none.
+func (rr *RulesRouter) AddRoutes(router *mux.Router, userAuth mux.MiddlewareFunc) error {
+	if router == nil || userAuth == nil {
+		return fmt.Errorf("rule routes need a router and an auth middleware")
+	}
+
+	rulesSubRouter := router.PathPrefix("/api/rules").Subrouter()
+	rulesSubRouter.Use(userAuth)
+	rulesSubRouter.HandleFunc("", metadatarouter.RequireRole(metadata.RoleAdmin, rr.createHandler)).Methods("POST")
+	rulesSubRouter.HandleFunc("", metadatarouter.RequireCompanyScope(rr.listHandler)).Methods("GET")
+	rulesSubRouter.HandleFunc("/events", metadatarouter.RequireCompanyScope(rr.eventsHandler)).Methods("GET")
+	rulesSubRouter.HandleFunc("/{ruleID}", metadatarouter.RequireCompanyScope(rr.getHandler)).Methods("GET")
+	rulesSubRouter.HandleFunc("/{ruleID}", metadatarouter.RequireRole(metadata.RoleAdmin, rr.updateHandler)).Methods("PUT")
+	rulesSubRouter.HandleFunc("/{ruleID}", metadatarouter.RequireRole(metadata.RoleAdmin, rr.deleteHandler)).Methods("DELETE")
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
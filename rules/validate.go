@@ -0,0 +1,32 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// validateRule checks the fields of r a store can check on its own and parses
+// its expression. Type checking against device schemas is up to the caller.
+func validateRule(r *Rule) error {
+	name := strings.TrimSpace(r.Name)
+	if name == "" || len(name) > MaxRuleNameLength {
+		return fmt.Errorf("%w: name must be 1-%d characters", ErrInvalidRule, MaxRuleNameLength)
+	}
+	if r.CompanyID == uuid.Nil || r.TargetID == uuid.Nil {
+		return fmt.Errorf("%w: company and target are required", ErrInvalidRule)
+	}
+	switch r.Scope {
+	case ScopeDevice, ScopeGroup, ScopeCompany:
+	default:
+		return fmt.Errorf("%w: scope must be device, group or company", ErrInvalidRule)
+	}
+
+	cond, err := ParseCondition(r.Expr)
+	if err != nil {
+		return err
+	}
+	r.Condition = cond
+	return nil
+}
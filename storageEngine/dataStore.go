@@ -1,4 +1,71 @@
 package storageengine
 
-type datastore interface {
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reading is a single telemetry sample reported by a device
+type Reading struct {
+	CompanyID     uuid.UUID              `json:"company_id"`
+	DeviceID      uuid.UUID              `json:"device_id"`
+	Timestamp     time.Time              `json:"timestamp"`
+	Data          map[string]interface{} `json:"data"`                     //colname:value, shaped by the device TelemetrySchema
+	SchemaVersion int                    `json:"schema_version,omitempty"` //Device schema version the data was validated against, 0 if older than versioning
+}
+
+// Aggregation is applied per field over each time bucket
+type Aggregation string
+
+const (
+	AggNone  Aggregation = ""
+	AggAvg   Aggregation = "avg"
+	AggMin   Aggregation = "min"
+	AggMax   Aggregation = "max"
+	AggSum   Aggregation = "sum"
+	AggCount Aggregation = "count"
+)
+
+// Query selects readings of one or more devices of a company in [From, To).
+// With an aggregation, readings of all devices are combined into buckets of
+// Bucket width aligned to the unix epoch. Limit caps the rows (readings or
+// buckets) returned, the result carries the From of the next page.
+type Query struct {
+	CompanyID uuid.UUID
+	DeviceIDs []uuid.UUID
+	From      time.Time
+	To        time.Time
+	Fields    []string //fields to return, all when empty (raw queries only)
+	Agg       Aggregation
+	Bucket    time.Duration
+	Limit     int
+}
+
+// Point is one raw reading or one aggregated bucket
+type Point struct {
+	Timestamp     time.Time              `json:"timestamp"` //bucket start for aggregates
+	DeviceID      *uuid.UUID             `json:"device_id,omitempty"`
+	Values        map[string]interface{} `json:"values"`
+	SchemaVersion int                    `json:"schema_version,omitempty"` //raw readings only
+}
+
+type QueryResult struct {
+	Points     []*Point
+	NextCursor *time.Time //From of the next page, nil when the range is exhausted
+}
+
+// DataStore defines the operations to persist and read back device telemetry.
+// Calls stop with ctx, like the metadata stores.
+type DataStore interface {
+	Write(ctx context.Context, r *Reading) error               //Writes a single reading
+	WriteBatch(ctx context.Context, readings []*Reading) error //Writes all readings atomically
+
+	// ReadRange returns readings of a device with from <= timestamp < to, oldest first
+	ReadRange(ctx context.Context, companyID, deviceID uuid.UUID, from, to time.Time) ([]*Reading, error)
+	// Latest returns the most recent reading of a device
+	Latest(ctx context.Context, companyID, deviceID uuid.UUID) (*Reading, error)
+	// Query returns one page of raw or aggregated readings
+	Query(ctx context.Context, q *Query) (*QueryResult, error)
 }
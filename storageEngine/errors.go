@@ -0,0 +1,10 @@
+package storageengine
+
+import "errors"
+
+var (
+	ErrInvalidReading = errors.New("invalid reading")
+	ErrNoReadings     = errors.New("no readings found")
+	ErrInvalidQuery   = errors.New("invalid query")
+	ErrDbErrorGeneric = errors.New("database error")
+)
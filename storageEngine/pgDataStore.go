@@ -0,0 +1,214 @@
+package storageengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// PgDataStore stores readings in the postgres "data" table, which is
+// partitioned by company_id. Partitions are created on first write.
+type PgDataStore struct {
+	dbConn     *sql.DB
+	logger     *log.Logger
+	partitions sync.Map //company_id -> struct{}, partitions known to exist
+}
+
+func NewPgDataStore(db *sql.DB, logger *log.Logger) *PgDataStore {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &PgDataStore{
+		dbConn: db,
+		logger: logger,
+	}
+}
+
+func (s *PgDataStore) Write(ctx context.Context, r *Reading) error {
+	return s.WriteBatch(ctx, []*Reading{r})
+}
+
+func (s *PgDataStore) WriteBatch(ctx context.Context, readings []*Reading) (err error) {
+	if len(readings) == 0 {
+		return nil
+	}
+	for _, r := range readings {
+		if err := validateReading(r); err != nil {
+			s.logger.Println("[WriteBatch] rejected reading:", err)
+			return err
+		}
+		if err := s.ensurePartition(ctx, r.CompanyID); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[WriteBatch] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// Re-sending a sample for the same instant replaces it, so retries are idempotent
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO data (company_id, device_id, timestamp, telemetry_data, schema_version)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (company_id, device_id, timestamp)
+		DO UPDATE SET telemetry_data = EXCLUDED.telemetry_data, schema_version = EXCLUDED.schema_version
+	`)
+	if err != nil {
+		s.logger.Println("[WriteBatch] failed to prepare insert:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer stmt.Close()
+
+	for _, r := range readings {
+		var dataJSON []byte
+		dataJSON, err = json.Marshal(r.Data)
+		if err != nil {
+			s.logger.Println("[WriteBatch] failed to marshal telemetry:", err)
+			return fmt.Errorf("%w: %v", ErrInvalidReading, err)
+		}
+		if _, err = stmt.ExecContext(ctx, r.CompanyID, r.DeviceID, r.Timestamp.UTC(), dataJSON, nullVersion(r.SchemaVersion)); err != nil {
+			s.logger.Println("[WriteBatch] failed to insert reading:", err)
+			return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[WriteBatch] failed to commit transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgDataStore) ReadRange(ctx context.Context, companyID, deviceID uuid.UUID, from, to time.Time) ([]*Reading, error) {
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT company_id, device_id, timestamp, telemetry_data, schema_version
+		FROM data
+		WHERE company_id=$1 AND device_id=$2 AND timestamp >= $3 AND timestamp < $4
+		ORDER BY timestamp
+	`, companyID, deviceID, from.UTC(), to.UTC())
+	if err != nil {
+		s.logger.Println("[ReadRange] query error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var readings []*Reading
+	for rows.Next() {
+		r, err := scanReading(rows)
+		if err != nil {
+			s.logger.Println("[ReadRange] row scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		readings = append(readings, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[ReadRange] rows iteration error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	return readings, nil
+}
+
+func (s *PgDataStore) Latest(ctx context.Context, companyID, deviceID uuid.UUID) (*Reading, error) {
+	row := s.dbConn.QueryRowContext(ctx, `
+		SELECT company_id, device_id, timestamp, telemetry_data, schema_version
+		FROM data
+		WHERE company_id=$1 AND device_id=$2
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`, companyID, deviceID)
+
+	r, err := scanReading(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoReadings
+		}
+		s.logger.Println("[Latest] query error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return r, nil
+}
+
+// ensurePartition creates the data partition of a company if it is not known to exist yet
+func (s *PgDataStore) ensurePartition(ctx context.Context, companyID uuid.UUID) error {
+	if _, ok := s.partitions.Load(companyID); ok {
+		return nil
+	}
+
+	partition := PartitionName(companyID)
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF data FOR VALUES IN ('%s')`,
+		pq.QuoteIdentifier(partition), companyID.String())
+	if _, err := s.dbConn.ExecContext(ctx, query); err != nil {
+		// Another writer may have created it between IF NOT EXISTS and CREATE
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code != "42P07" {
+			s.logger.Println("[ensurePartition] failed to create partition:", partition, err)
+			return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+	}
+
+	s.partitions.Store(companyID, struct{}{})
+	s.logger.Println("[ensurePartition] partition ready:", partition)
+	return nil
+}
+
+// PartitionName is the table holding the readings of a company. Identifiers
+// cant be bound as parameters; the name is derived from a parsed uuid so it is safe
+func PartitionName(companyID uuid.UUID) string {
+	return "data_" + strings.ReplaceAll(companyID.String(), "-", "")
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReading(row rowScanner) (*Reading, error) {
+	r := &Reading{}
+	var dataJSON []byte
+	var version sql.NullInt64
+	if err := row.Scan(&r.CompanyID, &r.DeviceID, &r.Timestamp, &dataJSON, &version); err != nil {
+		return nil, err
+	}
+	r.SchemaVersion = int(version.Int64)
+	if err := json.Unmarshal(dataJSON, &r.Data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// nullVersion stores readings without a schema version as NULL, like rows written before versioning
+func nullVersion(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: v > 0}
+}
+
+func validateReading(r *Reading) error {
+	switch {
+	case r == nil:
+		return fmt.Errorf("%w: nil reading", ErrInvalidReading)
+	case r.CompanyID == uuid.Nil || r.DeviceID == uuid.Nil:
+		return fmt.Errorf("%w: company_id and device_id are required", ErrInvalidReading)
+	case r.Timestamp.IsZero():
+		return fmt.Errorf("%w: timestamp is required", ErrInvalidReading)
+	case len(r.Data) == 0:
+		return fmt.Errorf("%w: telemetry data is empty", ErrInvalidReading)
+	}
+	return nil
+}
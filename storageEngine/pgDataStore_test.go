@@ -0,0 +1,115 @@
+package storageengine_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+func TestWriteBatch(t *testing.T) {
+	s, devices := newTestDataStore(t, 2)
+	a, b := devices[0], devices[1]
+	ctx := context.Background()
+
+	// One invalid reading rejects the whole batch
+	bad := []*storageengine.Reading{
+		reading(a, t0, map[string]interface{}{"temp": 1.0}),
+		reading(b, t0, nil),
+	}
+	if err := s.WriteBatch(ctx, bad); !errors.Is(err, storageengine.ErrInvalidReading) {
+		t.Fatalf("WriteBatch with an empty reading = %v, want ErrInvalidReading", err)
+	}
+	if _, err := s.Latest(ctx, a.CompanyID, a.ID); !errors.Is(err, storageengine.ErrNoReadings) {
+		t.Fatalf("Latest after a rejected batch = %v, want ErrNoReadings", err)
+	}
+
+	batch := []*storageengine.Reading{
+		reading(a, t0, map[string]interface{}{"temp": 1.0, "on": true}),
+		reading(b, t0, map[string]interface{}{"temp": 2.0}),
+		reading(a, t0.Add(time.Second), map[string]interface{}{"temp": 3.0}),
+	}
+	batch[0].SchemaVersion = 1
+	if err := s.WriteBatch(ctx, batch); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+
+	got, err := s.ReadRange(ctx, a.CompanyID, a.ID, t0, t0.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("ReadRange: %v", err)
+	}
+	want := []*storageengine.Reading{batch[0], batch[2]}
+	if len(got) != len(want) {
+		t.Fatalf("ReadRange returned %d readings, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !sameReading(got[i], want[i]) {
+			t.Errorf("reading %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLatest(t *testing.T) {
+	s, devices := newTestDataStore(t, 2)
+	a, b := devices[0], devices[1]
+	ctx := context.Background()
+
+	if _, err := s.Latest(ctx, a.CompanyID, a.ID); !errors.Is(err, storageengine.ErrNoReadings) {
+		t.Fatalf("Latest of a new device = %v, want ErrNoReadings", err)
+	}
+
+	// Written out of order, the newest timestamp wins over the last write
+	newest := reading(a, t0.Add(time.Minute), map[string]interface{}{"temp": 2.0})
+	for _, r := range []*storageengine.Reading{
+		newest,
+		reading(a, t0, map[string]interface{}{"temp": 1.0}),
+		reading(b, t0.Add(time.Hour), map[string]interface{}{"temp": 3.0}),
+	} {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	got, err := s.Latest(ctx, a.CompanyID, a.ID)
+	if err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	if !sameReading(got, newest) {
+		t.Errorf("Latest = %+v, want %+v", got, newest)
+	}
+}
+
+// A sample re-sent for the same instant replaces the first one
+func TestWriteReplacesDuplicateTimestamps(t *testing.T) {
+	s, devices := newTestDataStore(t, 1)
+	d := devices[0]
+	ctx := context.Background()
+
+	first := reading(d, t0, map[string]interface{}{"temp": 1.0, "on": true})
+	first.SchemaVersion = 1
+	if err := s.Write(ctx, first); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	second := reading(d, t0, map[string]interface{}{"temp": 2.0})
+	second.SchemaVersion = 2
+	if err := s.WriteBatch(ctx, []*storageengine.Reading{second}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+
+	got, err := s.ReadRange(ctx, d.CompanyID, d.ID, t0, t0.Add(time.Second))
+	if err != nil {
+		t.Fatalf("ReadRange: %v", err)
+	}
+	if len(got) != 1 || !sameReading(got[0], second) {
+		t.Errorf("ReadRange = %+v, want only %+v", got, second)
+	}
+}
+
+func sameReading(got, want *storageengine.Reading) bool {
+	return got.CompanyID == want.CompanyID && got.DeviceID == want.DeviceID &&
+		got.Timestamp.Equal(want.Timestamp) && got.SchemaVersion == want.SchemaVersion &&
+		reflect.DeepEqual(got.Data, want.Data)
+}
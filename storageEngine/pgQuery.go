@@ -0,0 +1,238 @@
+package storageengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	DefaultQueryLimit = 1000
+	MaxQueryLimit     = 10000
+)
+
+var aggFuncs = map[Aggregation]string{
+	AggAvg:   "avg",
+	AggMin:   "min",
+	AggMax:   "max",
+	AggSum:   "sum",
+	AggCount: "count",
+}
+
+func (s *PgDataStore) Query(ctx context.Context, q *Query) (*QueryResult, error) {
+	if err := validateQuery(q); err != nil {
+		s.logger.Println("[Query] rejected query:", err)
+		return nil, err
+	}
+	if q.Agg == AggNone {
+		return s.queryRaw(ctx, q)
+	}
+	return s.queryAggregate(ctx, q)
+}
+
+// queryRaw pages through readings ordered by (timestamp, device_id)
+func (s *PgDataStore) queryRaw(ctx context.Context, q *Query) (*QueryResult, error) {
+	// One row past the limit tells whether there is a next page
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT device_id, timestamp, telemetry_data, schema_version
+		FROM data
+		WHERE company_id=$1 AND device_id = ANY($2) AND timestamp >= $3 AND timestamp < $4
+		ORDER BY timestamp, device_id
+		LIMIT $5
+	`, q.CompanyID, pq.Array(uuidStrings(q.DeviceIDs)), q.From.UTC(), q.To.UTC(), q.Limit+1)
+	if err != nil {
+		s.logger.Println("[queryRaw] query error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	res := &QueryResult{}
+	for rows.Next() {
+		p := &Point{}
+		var deviceID uuid.UUID
+		var dataJSON []byte
+		var version sql.NullInt64
+		if err := rows.Scan(&deviceID, &p.Timestamp, &dataJSON, &version); err != nil {
+			s.logger.Println("[queryRaw] row scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		if err := json.Unmarshal(dataJSON, &p.Values); err != nil {
+			s.logger.Println("[queryRaw] failed to unmarshal telemetry:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		p.DeviceID = &deviceID
+		p.SchemaVersion = int(version.Int64)
+		p.Values = project(p.Values, q.Fields)
+		res.Points = append(res.Points, p)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[queryRaw] rows iteration error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if len(res.Points) > q.Limit {
+		// Readings sharing the boundary instant are all moved to the next page
+		// so a page never splits an instant, the cursor stays a plain timestamp
+		boundary := res.Points[q.Limit].Timestamp
+		res.Points = res.Points[:q.Limit]
+		for len(res.Points) > 0 && res.Points[len(res.Points)-1].Timestamp.Equal(boundary) {
+			res.Points = res.Points[:len(res.Points)-1]
+		}
+		if len(res.Points) == 0 {
+			// More devices than the limit reported at the same instant, return them all
+			return s.queryRawInstant(ctx, q, boundary)
+		}
+		res.NextCursor = &boundary
+	}
+	return res, nil
+}
+
+// queryRawInstant returns every reading at exactly ts, used when one instant overflows a page
+func (s *PgDataStore) queryRawInstant(ctx context.Context, q *Query, ts time.Time) (*QueryResult, error) {
+	instant := *q
+	instant.From = ts
+	instant.To = ts.Add(time.Microsecond)
+	instant.Limit = len(q.DeviceIDs)
+
+	res, err := s.queryRaw(ctx, &instant)
+	if err != nil {
+		return nil, err
+	}
+	next := instant.To
+	if next.Before(q.To) {
+		res.NextCursor = &next
+	}
+	return res, nil
+}
+
+// queryAggregate combines readings of all devices into epoch aligned buckets
+func (s *PgDataStore) queryAggregate(ctx context.Context, q *Query) (*QueryResult, error) {
+	bucketSecs := q.Bucket.Seconds()
+	args := []interface{}{q.CompanyID, pq.Array(uuidStrings(q.DeviceIDs)), q.From.UTC(), q.To.UTC(), bucketSecs, q.Limit + 1}
+
+	// Field names are bound as parameters, never spliced into the query
+	cols := make([]string, 0, len(q.Fields))
+	for _, field := range q.Fields {
+		args = append(args, field)
+		key := fmt.Sprintf("$%d", len(args))
+		if q.Agg == AggCount {
+			cols = append(cols, fmt.Sprintf("count(telemetry_data -> %s)::double precision", key))
+			continue
+		}
+		// Values of another type, left from before a schema change, are skipped
+		// rather than failing the cast
+		cols = append(cols, fmt.Sprintf(
+			"%s(CASE WHEN jsonb_typeof(telemetry_data -> %s) = 'number' THEN (telemetry_data ->> %s)::double precision END)",
+			aggFuncs[q.Agg], key, key))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT to_timestamp(floor(extract(epoch FROM timestamp)::double precision / $5::double precision) * $5::double precision) AS bucket, %s
+		FROM data
+		WHERE company_id=$1 AND device_id = ANY($2) AND timestamp >= $3 AND timestamp < $4
+		GROUP BY bucket
+		ORDER BY bucket
+		LIMIT $6
+	`, strings.Join(cols, ", "))
+
+	rows, err := s.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		s.logger.Println("[queryAggregate] query error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	res := &QueryResult{}
+	for rows.Next() {
+		p := &Point{Values: make(map[string]interface{}, len(q.Fields))}
+		values := make([]sql.NullFloat64, len(q.Fields))
+		dest := []interface{}{&p.Timestamp}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			s.logger.Println("[queryAggregate] row scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		for i, field := range q.Fields {
+			if values[i].Valid {
+				p.Values[field] = values[i].Float64
+			} else {
+				p.Values[field] = nil
+			}
+		}
+		p.Timestamp = p.Timestamp.UTC()
+		res.Points = append(res.Points, p)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[queryAggregate] rows iteration error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if len(res.Points) > q.Limit {
+		next := res.Points[q.Limit].Timestamp
+		res.Points = res.Points[:q.Limit]
+		res.NextCursor = &next
+	}
+	return res, nil
+}
+
+func validateQuery(q *Query) error {
+	switch {
+	case q == nil:
+		return fmt.Errorf("%w: nil query", ErrInvalidQuery)
+	case q.CompanyID == uuid.Nil || len(q.DeviceIDs) == 0:
+		return fmt.Errorf("%w: company and at least one device are required", ErrInvalidQuery)
+	case !q.From.Before(q.To):
+		return fmt.Errorf("%w: from must be before to", ErrInvalidQuery)
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultQueryLimit
+	}
+	if q.Limit > MaxQueryLimit {
+		q.Limit = MaxQueryLimit
+	}
+
+	if q.Agg == AggNone {
+		return nil
+	}
+	if _, ok := aggFuncs[q.Agg]; !ok {
+		return fmt.Errorf("%w: unknown aggregation '%s'", ErrInvalidQuery, q.Agg)
+	}
+	if q.Bucket < time.Second {
+		return fmt.Errorf("%w: bucket must be at least 1s", ErrInvalidQuery)
+	}
+	if len(q.Fields) == 0 {
+		return fmt.Errorf("%w: aggregation needs at least one field", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// project keeps only the requested fields, all of them when none are requested
+func project(values map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return values
+	}
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if v, ok := values[field]; ok {
+			projected[field] = v
+		}
+	}
+	return projected
+}
+
+func uuidStrings(ids []uuid.UUID) []string {
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = id.String()
+	}
+	return out
+}
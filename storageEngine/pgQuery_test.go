@@ -0,0 +1,239 @@
+package storageengine_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+	metadatatest "github.com/mukundvijay123/KCloud/metadata/metadataTest"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+var t0 = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// newTestDataStore returns a data store on the KCLOUD_TEST_DSN database and
+// n devices of a new company, ordered by id like raw queries order them
+func newTestDataStore(t *testing.T, n int) (*storageengine.PgDataStore, []*metadata.Device) {
+	t.Helper()
+	db := metadatatest.OpenTestDb(t)
+	logger := log.New(io.Discard, "", 0)
+	devices := metadatatest.MustDevices(t, metadatastore.NewMetadataDb(db, logger), n)
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID.String() < devices[j].ID.String() })
+	return storageengine.NewPgDataStore(db, logger), devices
+}
+
+func reading(d *metadata.Device, at time.Time, data map[string]interface{}) *storageengine.Reading {
+	return &storageengine.Reading{CompanyID: d.CompanyID, DeviceID: d.ID, Timestamp: at, Data: data}
+}
+
+func deviceIDs(devices []*metadata.Device) []uuid.UUID {
+	ids := make([]uuid.UUID, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func TestQueryRejectsInvalidQueries(t *testing.T) {
+	s := storageengine.NewPgDataStore(nil, log.New(io.Discard, "", 0))
+	valid := storageengine.Query{CompanyID: uuid.New(), DeviceIDs: []uuid.UUID{uuid.New()}, From: t0, To: t0.Add(time.Hour)}
+
+	tests := []struct {
+		name   string
+		change func(q *storageengine.Query)
+	}{
+		{"no company", func(q *storageengine.Query) { q.CompanyID = uuid.Nil }},
+		{"no devices", func(q *storageengine.Query) { q.DeviceIDs = nil }},
+		{"empty range", func(q *storageengine.Query) { q.To = q.From }},
+		{"unknown aggregation", func(q *storageengine.Query) { q.Agg, q.Bucket, q.Fields = "median", time.Minute, []string{"temp"} }},
+		{"bucket under a second", func(q *storageengine.Query) {
+			q.Agg, q.Bucket, q.Fields = storageengine.AggAvg, time.Millisecond, []string{"temp"}
+		}},
+		{"aggregate without fields", func(q *storageengine.Query) { q.Agg, q.Bucket = storageengine.AggAvg, time.Minute }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := valid
+			tt.change(&q)
+			if _, err := s.Query(context.Background(), &q); !errors.Is(err, storageengine.ErrInvalidQuery) {
+				t.Errorf("Query = %v, want ErrInvalidQuery", err)
+			}
+		})
+	}
+	if _, err := s.Query(context.Background(), nil); !errors.Is(err, storageengine.ErrInvalidQuery) {
+		t.Errorf("Query(nil) = %v, want ErrInvalidQuery", err)
+	}
+}
+
+// TestQueryRawPages walks every page size over readings that share instants:
+// three devices at t0, two at t0+1s and one at t0+2s. No page may split an
+// instant, drop or repeat a reading.
+func TestQueryRawPages(t *testing.T) {
+	s, devices := newTestDataStore(t, 3)
+	a, b, c := devices[0], devices[1], devices[2]
+	ctx := context.Background()
+
+	t1, t2 := t0.Add(time.Second), t0.Add(2*time.Second)
+	want := []*storageengine.Reading{
+		reading(a, t0, map[string]interface{}{"temp": 1.0}),
+		reading(b, t0, map[string]interface{}{"temp": 2.0}),
+		reading(c, t0, map[string]interface{}{"temp": 3.0}),
+		reading(a, t1, map[string]interface{}{"temp": 4.0}),
+		reading(b, t1, map[string]interface{}{"temp": 5.0}),
+		reading(a, t2, map[string]interface{}{"temp": 6.0}),
+	}
+	if err := s.WriteBatch(ctx, want); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+
+	for limit := 1; limit <= len(want)+1; limit++ {
+		q := &storageengine.Query{CompanyID: a.CompanyID, DeviceIDs: deviceIDs(devices), From: t0, To: t0.Add(time.Minute), Limit: limit}
+		var got []*storageengine.Point
+		for pages := 0; ; pages++ {
+			if pages > len(want) {
+				t.Fatalf("limit %d: pages never end", limit)
+			}
+			res, err := s.Query(ctx, q)
+			if err != nil {
+				t.Fatalf("limit %d: Query: %v", limit, err)
+			}
+			if len(res.Points) == 0 {
+				t.Fatalf("limit %d: empty page before the end", limit)
+			}
+			last := res.Points[len(res.Points)-1].Timestamp
+			if res.NextCursor != nil && !res.NextCursor.After(last) {
+				t.Errorf("limit %d: cursor %v does not move past the page ending at %v", limit, res.NextCursor, last)
+			}
+			got = append(got, res.Points...)
+			if res.NextCursor == nil {
+				break
+			}
+			q.From = *res.NextCursor
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("limit %d: %d readings over all pages, want %d", limit, len(got), len(want))
+		}
+		for i, p := range got {
+			if *p.DeviceID != want[i].DeviceID || !p.Timestamp.Equal(want[i].Timestamp) || p.Values["temp"] != want[i].Data["temp"] {
+				t.Errorf("limit %d: reading %d = %v %v %v, want %v %v %v", limit, i,
+					*p.DeviceID, p.Timestamp, p.Values, want[i].DeviceID, want[i].Timestamp, want[i].Data)
+			}
+		}
+	}
+}
+
+func TestQueryRawInstantOverflow(t *testing.T) {
+	s, devices := newTestDataStore(t, 3)
+	ctx := context.Background()
+
+	var readings []*storageengine.Reading
+	for _, d := range devices {
+		readings = append(readings, reading(d, t0, map[string]interface{}{"temp": 1.0}))
+	}
+	if err := s.WriteBatch(ctx, readings); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+
+	to := t0.Add(time.Minute)
+	res, err := s.Query(ctx, &storageengine.Query{CompanyID: devices[0].CompanyID, DeviceIDs: deviceIDs(devices), From: t0, To: to, Limit: 2})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(res.Points) != 3 {
+		t.Fatalf("%d readings, want all 3 of the instant", len(res.Points))
+	}
+	if next := t0.Add(time.Microsecond); res.NextCursor == nil || !res.NextCursor.Equal(next) {
+		t.Errorf("cursor %v, want %v", res.NextCursor, next)
+	}
+
+	// An instant at the end of the range leaves nothing to page to
+	res, err = s.Query(ctx, &storageengine.Query{CompanyID: devices[0].CompanyID, DeviceIDs: deviceIDs(devices), From: t0, To: t0.Add(time.Microsecond), Limit: 2})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(res.Points) != 3 || res.NextCursor != nil {
+		t.Errorf("%d readings and cursor %v, want 3 and none", len(res.Points), res.NextCursor)
+	}
+}
+
+func TestQueryAggregate(t *testing.T) {
+	s, devices := newTestDataStore(t, 2)
+	a, b := devices[0], devices[1]
+	ctx := context.Background()
+
+	readings := []*storageengine.Reading{
+		reading(a, t0.Add(10*time.Second), map[string]interface{}{"temp": 10.0, "on": true}),
+		reading(b, t0.Add(50*time.Second), map[string]interface{}{"temp": 20.0}),
+		reading(a, t0.Add(90*time.Second), map[string]interface{}{"temp": 30.0}),
+		// Written before temp became a number, skipped instead of failing the cast
+		reading(b, t0.Add(100*time.Second), map[string]interface{}{"temp": "hot"}),
+		reading(a, t0.Add(200*time.Second), map[string]interface{}{"on": false}),
+	}
+	if err := s.WriteBatch(ctx, readings); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	query := func(agg storageengine.Aggregation, bucket time.Duration, limit int, fields ...string) *storageengine.QueryResult {
+		t.Helper()
+		res, err := s.Query(ctx, &storageengine.Query{CompanyID: a.CompanyID, DeviceIDs: deviceIDs(devices),
+			From: t0, To: t0.Add(time.Hour), Agg: agg, Bucket: bucket, Fields: fields, Limit: limit})
+		if err != nil {
+			t.Fatalf("Query(%s, %v): %v", agg, bucket, err)
+		}
+		return res
+	}
+
+	type bucket struct {
+		at   time.Time
+		temp interface{}
+	}
+	check := func(name string, res *storageengine.QueryResult, want []bucket) {
+		t.Helper()
+		if len(res.Points) != len(want) {
+			t.Fatalf("%s: %d buckets, want %d", name, len(res.Points), len(want))
+		}
+		for i, p := range res.Points {
+			if !p.Timestamp.Equal(want[i].at) || p.Values["temp"] != want[i].temp {
+				t.Errorf("%s: bucket %d = %v %v, want %v %v", name, i, p.Timestamp, p.Values["temp"], want[i].at, want[i].temp)
+			}
+		}
+	}
+
+	minute := time.Minute
+	check("avg", query(storageengine.AggAvg, minute, 0, "temp"), []bucket{
+		{t0, 15.0}, {t0.Add(minute), 30.0}, {t0.Add(3 * minute), nil},
+	})
+	check("sum", query(storageengine.AggSum, minute, 0, "temp"), []bucket{
+		{t0, 30.0}, {t0.Add(minute), 30.0}, {t0.Add(3 * minute), nil},
+	})
+	// count counts every value, numbers or not
+	check("count", query(storageengine.AggCount, minute, 0, "temp"), []bucket{
+		{t0, 2.0}, {t0.Add(minute), 2.0}, {t0.Add(3 * minute), 0.0},
+	})
+
+	// Buckets align to the unix epoch, not to From
+	const width = 11 * time.Second
+	secs := int64(width / time.Second)
+	align := func(at time.Time) time.Time { return time.Unix(at.Unix()/secs*secs, 0).UTC() }
+	if align(t0).Equal(t0) {
+		t.Fatal("t0 is aligned to the bucket width, pick another width")
+	}
+	check("epoch aligned", query(storageengine.AggMax, width, 0, "temp"), []bucket{
+		{align(readings[0].Timestamp), 10.0}, {align(readings[1].Timestamp), 20.0},
+		{align(readings[2].Timestamp), 30.0}, {align(readings[3].Timestamp), nil}, {align(readings[4].Timestamp), nil},
+	})
+
+	// Pages of buckets continue at the first bucket left out
+	res := query(storageengine.AggAvg, minute, 2, "temp")
+	check("first page", res, []bucket{{t0, 15.0}, {t0.Add(minute), 30.0}})
+	if res.NextCursor == nil || !res.NextCursor.Equal(t0.Add(3*minute)) {
+		t.Errorf("cursor %v, want %v", res.NextCursor, t0.Add(3*minute))
+	}
+}
@@ -0,0 +1,89 @@
+package telemetry
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+// ResolveFields checks the requested fields of a query against the schemas of
+// every device queried and returns the field types. A field has to exist in
+// at least one schema and have the same type everywhere it exists. When no
+// fields are requested every field the aggregation can be applied to is used.
+// Only count can be applied to bool and string fields.
+func ResolveFields(schemas []metadata.TelemetrySchema, fields []string, agg storageengine.Aggregation) ([]string, map[string]string, error) {
+	types := make(map[string]string)
+	for _, schema := range schemas {
+		for field, typ := range schema {
+			if prev, ok := types[field]; ok && prev != typ {
+				if containsField(fields, field) || len(fields) == 0 {
+					return nil, nil, fmt.Errorf("%w: field '%s' is %s on some devices and %s on others",
+						storageengine.ErrInvalidQuery, field, prev, typ)
+				}
+			}
+			types[field] = typ
+		}
+	}
+
+	if len(fields) == 0 {
+		for field, typ := range types {
+			if aggregatable(agg, typ) {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		if len(fields) == 0 {
+			return nil, nil, fmt.Errorf("%w: no fields can be aggregated with %s", storageengine.ErrInvalidQuery, agg)
+		}
+	}
+
+	resolved := make(map[string]string, len(fields))
+	for _, field := range fields {
+		typ, ok := types[field]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: field '%s' is not in the device schema", storageengine.ErrInvalidQuery, field)
+		}
+		if !aggregatable(agg, typ) {
+			return nil, nil, fmt.Errorf("%w: cant apply %s to %s field '%s'", storageengine.ErrInvalidQuery, agg, typ, field)
+		}
+		resolved[field] = typ
+	}
+	return fields, resolved, nil
+}
+
+// ConvertAggregates restores the schema types of aggregated values, the storage
+// engine computes everything in float64. Counts and min/max/sum of int fields
+// become int64 again, averages stay float64.
+func ConvertAggregates(points []*storageengine.Point, types map[string]string, agg storageengine.Aggregation) {
+	for _, p := range points {
+		for field, v := range p.Values {
+			f, ok := v.(float64)
+			if !ok {
+				continue
+			}
+			if agg == storageengine.AggCount || (types[field] == "int" && agg != storageengine.AggAvg) {
+				p.Values[field] = int64(f)
+			}
+		}
+	}
+}
+
+func aggregatable(agg storageengine.Aggregation, typ string) bool {
+	switch agg {
+	case storageengine.AggNone, storageengine.AggCount:
+		return true
+	default:
+		return typ == "int" || typ == "float"
+	}
+}
+
+func containsField(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package telemetry
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+func TestResolveFields(t *testing.T) {
+	boiler := metadata.TelemetrySchema{"temp": "float", "rpm": "int", "on": "bool"}
+	pump := metadata.TelemetrySchema{"temp": "float", "mode": "string"}
+	legacy := metadata.TelemetrySchema{"rpm": "float"} //rpm as another type
+
+	tests := []struct {
+		name      string
+		schemas   []metadata.TelemetrySchema
+		fields    []string
+		agg       storageengine.Aggregation
+		want      []string
+		wantTypes map[string]string
+		wantErr   bool
+	}{
+		{"raw, all fields", []metadata.TelemetrySchema{boiler, pump}, nil, storageengine.AggNone,
+			[]string{"mode", "on", "rpm", "temp"}, map[string]string{"mode": "string", "on": "bool", "rpm": "int", "temp": "float"}, false},
+		{"raw, requested fields", []metadata.TelemetrySchema{boiler}, []string{"temp", "on"}, storageengine.AggNone,
+			[]string{"temp", "on"}, map[string]string{"temp": "float", "on": "bool"}, false},
+		{"field of one device only", []metadata.TelemetrySchema{boiler, pump}, []string{"mode"}, storageengine.AggNone,
+			[]string{"mode"}, map[string]string{"mode": "string"}, false},
+		{"avg picks the numeric fields", []metadata.TelemetrySchema{boiler, pump}, nil, storageengine.AggAvg,
+			[]string{"rpm", "temp"}, map[string]string{"rpm": "int", "temp": "float"}, false},
+		{"count takes every field", []metadata.TelemetrySchema{boiler}, []string{"on"}, storageengine.AggCount,
+			[]string{"on"}, map[string]string{"on": "bool"}, false},
+		{"sum of a bool", []metadata.TelemetrySchema{boiler}, []string{"on"}, storageengine.AggSum, nil, nil, true},
+		{"max of a string", []metadata.TelemetrySchema{pump}, []string{"mode"}, storageengine.AggMax, nil, nil, true},
+		{"nothing to aggregate", []metadata.TelemetrySchema{{"on": "bool", "mode": "string"}}, nil, storageengine.AggMin, nil, nil, true},
+		{"unknown field", []metadata.TelemetrySchema{boiler}, []string{"humidity"}, storageengine.AggNone, nil, nil, true},
+		{"conflicting types requested", []metadata.TelemetrySchema{boiler, legacy}, []string{"rpm"}, storageengine.AggNone, nil, nil, true},
+		{"conflicting types of all fields", []metadata.TelemetrySchema{boiler, legacy}, nil, storageengine.AggNone, nil, nil, true},
+		{"conflicting types not requested", []metadata.TelemetrySchema{boiler, legacy}, []string{"temp"}, storageengine.AggAvg,
+			[]string{"temp"}, map[string]string{"temp": "float"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, types, err := ResolveFields(tt.schemas, tt.fields, tt.agg)
+			if tt.wantErr {
+				if !errors.Is(err, storageengine.ErrInvalidQuery) {
+					t.Fatalf("err = %v, want ErrInvalidQuery", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveFields: %v", err)
+			}
+			if !reflect.DeepEqual(fields, tt.want) || !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("ResolveFields = %v, %v, want %v, %v", fields, types, tt.want, tt.wantTypes)
+			}
+		})
+	}
+}
+
+func TestConvertAggregates(t *testing.T) {
+	types := map[string]string{"temp": "float", "rpm": "int", "on": "bool"}
+	tests := []struct {
+		agg    storageengine.Aggregation
+		values map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{storageengine.AggAvg, map[string]interface{}{"temp": 21.5, "rpm": 2999.5}, map[string]interface{}{"temp": 21.5, "rpm": 2999.5}},
+		{storageengine.AggSum, map[string]interface{}{"temp": 43.0, "rpm": 6000.0}, map[string]interface{}{"temp": 43.0, "rpm": int64(6000)}},
+		{storageengine.AggMax, map[string]interface{}{"rpm": 3100.0}, map[string]interface{}{"rpm": int64(3100)}},
+		{storageengine.AggCount, map[string]interface{}{"temp": 2.0, "on": 3.0}, map[string]interface{}{"temp": int64(2), "on": int64(3)}},
+		{storageengine.AggMin, map[string]interface{}{"temp": nil, "rpm": nil}, map[string]interface{}{"temp": nil, "rpm": nil}}, //empty buckets
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.agg), func(t *testing.T) {
+			points := []*storageengine.Point{{Values: tt.values}}
+			ConvertAggregates(points, types, tt.agg)
+			if !reflect.DeepEqual(points[0].Values, tt.want) {
+				t.Errorf("ConvertAggregates = %#v, want %#v", points[0].Values, tt.want)
+			}
+		})
+	}
+}
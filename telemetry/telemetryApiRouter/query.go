@@ -0,0 +1,219 @@
+package telemetryrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+	"github.com/mukundvijay123/KCloud/telemetry"
+)
+
+const defaultQueryWindow = time.Hour
+
+type queryResponse struct {
+	DeviceID   *uuid.UUID             `json:"device_id,omitempty"`
+	GroupID    *uuid.UUID             `json:"group_id,omitempty"`
+	Agg        string                 `json:"agg,omitempty"`
+	Bucket     string                 `json:"bucket,omitempty"`
+	Points     []*storageengine.Point `json:"points"`
+	NextCursor *time.Time             `json:"next_cursor,omitempty"`
+}
+
+// queryDeviceHandler serves GET /api/telemetry/{deviceID}?from=&to=&fields=&agg=&bucket=&limit=&cursor=
+func (t *TelemetryRouter) queryDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(mux.Vars(r)["deviceID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid device id")
+		return
+	}
+
+	device, err := t.MdataStore.GetDeviceByID(r.Context(), deviceID.String())
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch device")
+		t.logger.Println("[queryDeviceHandler] error:", err)
+		return
+	}
+	if !metadatarouter.AuthorizeGroup(w, r, device.CompanyID, device.GrpID) {
+		return
+	}
+
+	resp, ok := t.runQuery(w, r, device.CompanyID, []*metadata.Device{device})
+	if !ok {
+		return
+	}
+	resp.DeviceID = &device.ID
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// queryGroupHandler serves GET /api/telemetry/group/{groupID}, combining every device of the group
+func (t *TelemetryRouter) queryGroupHandler(w http.ResponseWriter, r *http.Request) {
+	groupID, err := uuid.Parse(mux.Vars(r)["groupID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid group id")
+		return
+	}
+
+	group, err := t.MdataStore.GetGroupByID(r.Context(), groupID.String())
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch group")
+		t.logger.Println("[queryGroupHandler] error:", err)
+		return
+	}
+	if !metadatarouter.AuthorizeGroup(w, r, group.CompanyID, group.ID) {
+		return
+	}
+
+	devices, err := t.groupDevices(r.Context(), groupID.String())
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch devices")
+		t.logger.Println("[queryGroupHandler] error:", err)
+		return
+	}
+	if len(devices) == 0 {
+		metadatarouter.WriteJSONError(w, http.StatusNotFound, "Group has no devices")
+		return
+	}
+
+	resp, ok := t.runQuery(w, r, group.CompanyID, devices)
+	if !ok {
+		return
+	}
+	resp.GroupID = &group.ID
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// groupDevices returns every device of a group, following the list pages
+func (t *TelemetryRouter) groupDevices(ctx context.Context, groupID string) ([]*metadata.Device, error) {
+	opts := &metadata.ListOptions{Limit: metadata.MaxListLimit}
+	var all []*metadata.Device
+	for {
+		devices, next, err := t.MdataStore.ListDevicesByGroup(ctx, groupID, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, devices...)
+		if next == "" {
+			return all, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// runQuery parses the query string, checks it against the device schemas and
+// runs it. On failure it has already written the error response.
+func (t *TelemetryRouter) runQuery(w http.ResponseWriter, r *http.Request, companyID uuid.UUID, devices []*metadata.Device) (*queryResponse, bool) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	q.CompanyID = companyID
+
+	schemas := make([]metadata.TelemetrySchema, 0, len(devices))
+	for _, d := range devices {
+		q.DeviceIDs = append(q.DeviceIDs, d.ID)
+		schemas = append(schemas, d.TelemetryDataSchema)
+	}
+
+	requested := q.Fields
+	fields, types, err := telemetry.ResolveFields(schemas, requested, q.Agg)
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	if q.Agg != storageengine.AggNone || len(requested) > 0 {
+		q.Fields = fields
+	}
+
+	res, err := t.DataStore.Query(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, storageengine.ErrInvalidQuery) {
+			metadatarouter.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return nil, false
+		}
+		metadatarouter.StoreError(w, err, "Failed to query telemetry")
+		t.logger.Println("[runQuery] error:", err)
+		return nil, false
+	}
+	telemetry.ConvertAggregates(res.Points, types, q.Agg)
+
+	resp := &queryResponse{
+		Agg:        string(q.Agg),
+		Points:     res.Points,
+		NextCursor: res.NextCursor,
+	}
+	if q.Agg != storageengine.AggNone {
+		resp.Bucket = q.Bucket.String()
+	}
+	if resp.Points == nil {
+		resp.Points = []*storageengine.Point{}
+	}
+	return resp, true
+}
+
+// parseQuery reads from/to (RFC3339, default the last hour), fields (comma
+// separated), agg, bucket (e.g. 1m), limit and cursor (the next_cursor of the
+// previous page, it replaces from)
+func parseQuery(v url.Values) (*storageengine.Query, error) {
+	q := &storageengine.Query{
+		To:  time.Now().UTC(),
+		Agg: storageengine.Aggregation(strings.ToLower(v.Get("agg"))),
+	}
+
+	var err error
+	if s := v.Get("to"); s != "" {
+		if q.To, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	q.From = q.To.Add(-defaultQueryWindow)
+	if s := v.Get("from"); s != "" {
+		if q.From, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.From, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, fmt.Errorf("invalid cursor: %v", err)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	if s := v.Get("fields"); s != "" {
+		for _, field := range strings.Split(s, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				q.Fields = append(q.Fields, field)
+			}
+		}
+	}
+
+	if s := v.Get("bucket"); s != "" {
+		if q.Agg == storageengine.AggNone {
+			return nil, fmt.Errorf("bucket needs agg")
+		}
+		if q.Bucket, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("invalid bucket: %v", err)
+		}
+	} else if q.Agg != storageengine.AggNone {
+		return nil, fmt.Errorf("agg needs a bucket")
+	}
+
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+	}
+	return q, nil
+}
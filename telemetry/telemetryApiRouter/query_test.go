@@ -0,0 +1,62 @@
+package telemetryrouter
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+func TestParseQuery(t *testing.T) {
+	from := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Hour)
+	cursor := from.Add(30*time.Minute + 123*time.Microsecond)
+
+	tests := []struct {
+		name    string
+		query   string
+		want    *storageengine.Query
+		wantErr bool
+	}{
+		{"range and fields", "from=2024-05-01T10:00:00Z&to=2024-05-01T12:00:00Z&fields=temp,%20rpm,,&limit=50",
+			&storageengine.Query{From: from, To: to, Fields: []string{"temp", "rpm"}, Limit: 50}, false},
+		{"default window", "to=2024-05-01T12:00:00Z",
+			&storageengine.Query{From: to.Add(-defaultQueryWindow), To: to}, false},
+		{"cursor replaces from", "from=2024-05-01T10:00:00Z&to=2024-05-01T12:00:00Z&cursor=" + cursor.Format(time.RFC3339Nano),
+			&storageengine.Query{From: cursor, To: to}, false},
+		{"aggregate", "from=2024-05-01T10:00:00Z&to=2024-05-01T12:00:00Z&agg=AVG&bucket=5m",
+			&storageengine.Query{From: from, To: to, Agg: storageengine.AggAvg, Bucket: 5 * time.Minute}, false},
+		{"agg without bucket", "to=2024-05-01T12:00:00Z&agg=avg", nil, true},
+		{"bucket without agg", "to=2024-05-01T12:00:00Z&bucket=1m", nil, true},
+		{"invalid bucket", "to=2024-05-01T12:00:00Z&agg=avg&bucket=often", nil, true},
+		{"from after to", "from=2024-05-01T12:00:00Z&to=2024-05-01T10:00:00Z", nil, true},
+		{"cursor at to", "to=2024-05-01T12:00:00Z&cursor=2024-05-01T12:00:00Z", nil, true},
+		{"invalid cursor", "to=2024-05-01T12:00:00Z&cursor=next", nil, true},
+		{"invalid from", "from=yesterday", nil, true},
+		{"zero limit", "to=2024-05-01T12:00:00Z&limit=0", nil, true},
+		{"negative limit", "to=2024-05-01T12:00:00Z&limit=-1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := parseQuery(v)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseQuery accepted %q as %+v", tt.query, q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseQuery: %v", err)
+			}
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("parseQuery = %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
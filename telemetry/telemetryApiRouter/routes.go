@@ -0,0 +1,79 @@
+package telemetryrouter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	"github.com/mukundvijay123/KCloud/telemetry"
+)
+
+const maxIngestBodyBytes = 1 << 20
+
+type ingestErrorResponse struct {
+	Error string               `json:"error"`
+	Rows  []telemetry.RowError `json:"rows,omitempty"`
+}
+
+// ingestHandler accepts a single reading object or an array of readings
+func (t *TelemetryRouter) ingestHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(mux.Vars(r)["deviceID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid device id")
+		return
+	}
+
+	// A device may only report its own readings
+	device, ok := metadatarouter.DeviceFromContext(r.Context())
+	if !ok || device.ID != deviceID {
+		metadatarouter.WriteJSONError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodyBytes))
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+	rows, err := telemetry.DecodeRows(body)
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(rows) == 0 || len(rows) > telemetry.MaxBatchRows {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Batch must contain between 1 and 1000 readings")
+		return
+	}
+
+	readings, rowErrs := telemetry.BuildReadings(device, rows, time.Now())
+	if len(rowErrs) > 0 {
+		writeJSON(w, http.StatusBadRequest, ingestErrorResponse{
+			Error: "readings do not match the device schema",
+			Rows:  rowErrs,
+		})
+		return
+	}
+
+	if err := t.DataStore.WriteBatch(r.Context(), readings); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to store readings")
+		t.logger.Println("[ingestHandler] error:", err)
+		return
+	}
+	if t.Rules != nil {
+		t.Rules.Evaluate(r.Context(), device, readings)
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]int{
+		"accepted": len(readings),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
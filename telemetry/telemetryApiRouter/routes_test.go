@@ -0,0 +1,194 @@
+package telemetryrouter_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	metadatamemstore "github.com/mukundvijay123/KCloud/metadata/metadataMemStore"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+	"github.com/mukundvijay123/KCloud/telemetry"
+	telemetryrouter "github.com/mukundvijay123/KCloud/telemetry/telemetryApiRouter"
+)
+
+// memDataStore keeps the written readings
+type memDataStore struct {
+	mu       sync.Mutex
+	readings []*storageengine.Reading
+}
+
+func (s *memDataStore) Write(ctx context.Context, r *storageengine.Reading) error {
+	return s.WriteBatch(ctx, []*storageengine.Reading{r})
+}
+
+func (s *memDataStore) WriteBatch(ctx context.Context, readings []*storageengine.Reading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readings = append(s.readings, readings...)
+	return nil
+}
+
+func (s *memDataStore) ReadRange(ctx context.Context, companyID, deviceID uuid.UUID, from, to time.Time) ([]*storageengine.Reading, error) {
+	return nil, nil
+}
+
+func (s *memDataStore) Latest(ctx context.Context, companyID, deviceID uuid.UUID) (*storageengine.Reading, error) {
+	return nil, storageengine.ErrNoReadings
+}
+
+func (s *memDataStore) Query(ctx context.Context, q *storageengine.Query) (*storageengine.QueryResult, error) {
+	return &storageengine.QueryResult{}, nil
+}
+
+// countingEvaluator counts the readings handed to the rules
+type countingEvaluator struct {
+	mu       sync.Mutex
+	readings int
+}
+
+func (e *countingEvaluator) Evaluate(ctx context.Context, d *metadata.Device, readings []*storageengine.Reading) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.readings += len(readings)
+}
+
+func noUserAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorized")
+	})
+}
+
+// newTestDevices returns two devices of a company in store
+func newTestDevices(t *testing.T, store metadata.MetadataStore) (*metadata.Device, *metadata.Device) {
+	t.Helper()
+	ctx := context.Background()
+	c := &metadata.Company{CompanyName: "acme", Username: "acme", CompanyPassword: "correcthorse"}
+	if err := store.CreateCompany(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	g := &metadata.Grp{CompanyID: c.ID, GroupName: "plant"}
+	if err := store.CreateGroup(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	var devices []*metadata.Device
+	for _, name := range []string{"boiler", "pump"} {
+		d := &metadata.Device{
+			GrpID:               g.ID,
+			CompanyID:           c.ID,
+			DeviceName:          name,
+			DeviceType:          "sensor",
+			TelemetryDataSchema: metadata.TelemetrySchema{"temp": "float", "rpm": "int"},
+		}
+		if err := store.CreateDevice(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, d)
+	}
+	return devices[0], devices[1]
+}
+
+func TestIngest(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	store := metadatamemstore.NewMemStore(logger)
+	boiler, pump := newTestDevices(t, store)
+
+	tests := []struct {
+		name     string
+		device   uuid.UUID
+		secret   string
+		body     string
+		status   int
+		accepted int
+	}{
+		{"one reading", boiler.ID, boiler.DeviceSecret, `{"data": {"temp": 21.5}}`, http.StatusCreated, 1},
+		{"batch", boiler.ID, boiler.DeviceSecret, `[
+			{"data": {"temp": 21.5, "rpm": 3000}},
+			{"timestamp": "2024-05-01T10:00:00Z", "data": {"rpm": 3100}}
+		]`, http.StatusCreated, 2},
+		{"schema mismatch", boiler.ID, boiler.DeviceSecret, `[{"data": {"temp": 1}}, {"data": {"rpm": 1.5}}]`, http.StatusBadRequest, 0},
+		{"trailing data", boiler.ID, boiler.DeviceSecret, `{"data": {"temp": 1}}{"junk"`, http.StatusBadRequest, 0},
+		{"empty batch", boiler.ID, boiler.DeviceSecret, `[]`, http.StatusBadRequest, 0},
+		{"no key", boiler.ID, "", `{"data": {"temp": 1}}`, http.StatusUnauthorized, 0},
+		{"wrong key", boiler.ID, "not-the-secret", `{"data": {"temp": 1}}`, http.StatusUnauthorized, 0},
+		{"another device's readings", pump.ID, boiler.DeviceSecret, `{"data": {"temp": 1}}`, http.StatusForbidden, 0},
+		{"nil device id", uuid.Nil, boiler.DeviceSecret, `{"data": {"temp": 1}}`, http.StatusForbidden, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := &memDataStore{}
+			evaluator := &countingEvaluator{}
+			tr := telemetryrouter.NewTelemetryRouter(store, data, logger)
+			tr.Rules = evaluator
+			router := mux.NewRouter()
+			deviceAuth := metadatarouter.NewDeviceAuthMiddleWare(store, logger)
+			if err := tr.AddRoutes(router, deviceAuth.DeviceMiddleware, noUserAuth); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/api/telemetry/"+tt.device.String(), strings.NewReader(tt.body))
+			if tt.secret != "" {
+				req.Header.Set("X-Device-Key", tt.secret)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+			if len(data.readings) != tt.accepted || evaluator.readings != tt.accepted {
+				t.Errorf("%d readings stored and %d evaluated, want %d", len(data.readings), evaluator.readings, tt.accepted)
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+			var resp map[string]int
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp["accepted"] != tt.accepted {
+				t.Errorf("response %s, want %d accepted", rec.Body, tt.accepted)
+			}
+			for _, r := range data.readings {
+				if r.DeviceID != boiler.ID || r.CompanyID != boiler.CompanyID {
+					t.Errorf("reading %+v stored for the wrong device", r)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestRowErrors(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	store := metadatamemstore.NewMemStore(logger)
+	boiler, _ := newTestDevices(t, store)
+
+	tr := telemetryrouter.NewTelemetryRouter(store, &memDataStore{}, logger)
+	router := mux.NewRouter()
+	if err := tr.AddRoutes(router, metadatarouter.NewDeviceAuthMiddleWare(store, logger).DeviceMiddleware, noUserAuth); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/api/telemetry/"+boiler.ID.String(),
+		strings.NewReader(`[{"data": {"temp": 1}}, {"data": {"rpm": "fast", "humidity": 3}}]`))
+	req.Header.Set("Authorization", "Device "+boiler.DeviceSecret)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var resp struct {
+		Error string               `json:"error"`
+		Rows  []telemetry.RowError `json:"rows"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || len(resp.Rows) != 1 || resp.Rows[0].Index != 1 || len(resp.Rows[0].Errors) != 2 {
+		t.Errorf("got %d %s, want the two errors of row 1", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,50 @@
+package telemetryrouter
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+	"github.com/mukundvijay123/KCloud/rules"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+type TelemetryRouter struct {
+	logger     *log.Logger
+	MdataStore metadata.MetadataReader
+	DataStore  storageengine.DataStore
+	Rules      rules.Evaluator //optional, checks ingested readings against the rules
+}
+
+func NewTelemetryRouter(mdataStore metadata.MetadataReader, dataStore storageengine.DataStore, logger *log.Logger) *TelemetryRouter {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &TelemetryRouter{
+		logger:     logger,
+		MdataStore: mdataStore,
+		DataStore:  dataStore,
+	}
+}
+
+// AddRoutes registers the telemetry routes on router. Devices ingest with
+// deviceAuth, companies read back with userAuth.
+func (t *TelemetryRouter) AddRoutes(router *mux.Router, deviceAuth, userAuth mux.MiddlewareFunc) error {
+	if router == nil || deviceAuth == nil || userAuth == nil {
+		return fmt.Errorf("telemetry routes need a router and auth middlewares")
+	}
+
+	telemetrySubRouter := router.PathPrefix("/api/telemetry").Subrouter()
+
+	ingestRouter := telemetrySubRouter.NewRoute().Subrouter()
+	ingestRouter.Use(deviceAuth)
+	ingestRouter.HandleFunc("/{deviceID}", t.ingestHandler).Methods("POST")
+
+	queryRouter := telemetrySubRouter.NewRoute().Subrouter()
+	queryRouter.Use(userAuth)
+	queryRouter.HandleFunc("/group/{groupID}", t.queryGroupHandler).Methods("GET")
+	queryRouter.HandleFunc("/{deviceID}", t.queryDeviceHandler).Methods("GET")
+	return nil
+}
@@ -0,0 +1,205 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+	storageengine "github.com/mukundvijay123/KCloud/storageEngine"
+)
+
+const (
+	MaxClockSkew = 5 * time.Minute //How far in the future a device supplied timestamp may be
+	MaxBatchRows = 1000            //Most readings accepted in one message
+)
+
+// ErrTrailingData rejects a body with more than one JSON value
+var ErrTrailingData = errors.New("unexpected data after the readings")
+
+// Row is one reading as sent by a device. Values are expected to be decoded
+// with json.Decoder.UseNumber so ints and floats can be told apart.
+type Row struct {
+	Timestamp *time.Time             `json:"timestamp,omitempty"` //Server time is used when omitted
+	Data      map[string]interface{} `json:"data"`
+}
+
+// FieldError describes why a single field was rejected
+type FieldError struct {
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+// RowError collects every problem found in one row of a batch
+type RowError struct {
+	Index  int          `json:"index"`
+	Errors []FieldError `json:"errors"`
+}
+
+// DecodeRows decodes either one row object or an array of rows, keeping numbers
+// as json.Number. Anything after the first JSON value is an error.
+func DecodeRows(raw []byte) ([]Row, error) {
+	raw = bytes.TrimSpace(raw)
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+
+	var rows []Row
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := dec.Decode(&rows); err != nil {
+			return nil, err
+		}
+	} else {
+		var row Row
+		if err := dec.Decode(&row); err != nil {
+			return nil, err
+		}
+		rows = []Row{row}
+	}
+
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return nil, ErrTrailingData
+	}
+	return rows, nil
+}
+
+// ValidateRow type checks data against the schema and returns it with values
+// converted to int64, float64, bool or string. Unknown fields are rejected.
+func ValidateRow(schema metadata.TelemetrySchema, data map[string]interface{}) (map[string]interface{}, []FieldError) {
+	if len(data) == 0 {
+		return nil, []FieldError{{Error: "data is empty"}}
+	}
+
+	fields := make([]string, 0, len(data))
+	for field := range data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields) //stable error order for clients
+
+	converted := make(map[string]interface{}, len(data))
+	var errs []FieldError
+	for _, field := range fields {
+		typ, ok := schema[field]
+		if !ok {
+			errs = append(errs, FieldError{Field: field, Error: "field is not in the device schema"})
+			continue
+		}
+		v, err := convertValue(typ, data[field])
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Error: err.Error()})
+			continue
+		}
+		converted[field] = v
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return converted, nil
+}
+
+// BuildReadings validates every row of a batch against the device schema.
+// Either all rows are turned into readings or the per row errors are returned.
+func BuildReadings(device *metadata.Device, rows []Row, now time.Time) ([]*storageengine.Reading, []RowError) {
+	readings := make([]*storageengine.Reading, 0, len(rows))
+	var rowErrs []RowError
+
+	for i, row := range rows {
+		var errs []FieldError
+
+		ts := now
+		if row.Timestamp != nil {
+			ts = *row.Timestamp
+			if ts.After(now.Add(MaxClockSkew)) {
+				errs = append(errs, FieldError{Field: "timestamp", Error: "timestamp is in the future"})
+			}
+		}
+
+		data, fieldErrs := ValidateRow(device.TelemetryDataSchema, row.Data)
+		errs = append(errs, fieldErrs...)
+		if len(errs) > 0 {
+			rowErrs = append(rowErrs, RowError{Index: i, Errors: errs})
+			continue
+		}
+
+		readings = append(readings, &storageengine.Reading{
+			CompanyID:     device.CompanyID,
+			DeviceID:      device.ID,
+			Timestamp:     ts.UTC(),
+			Data:          data,
+			SchemaVersion: device.SchemaVersion,
+		})
+	}
+
+	if len(rowErrs) > 0 {
+		return nil, rowErrs
+	}
+	return readings, nil
+}
+
+func convertValue(typ string, v interface{}) (interface{}, error) {
+	switch typ {
+	case "int":
+		switch n := v.(type) {
+		case json.Number:
+			if i, err := n.Int64(); err == nil {
+				return i, nil
+			}
+		case float64:
+			if n == float64(int64(n)) {
+				return int64(n), nil
+			}
+		case int64:
+			return n, nil
+		case int:
+			return int64(n), nil
+		}
+	case "float":
+		switch n := v.(type) {
+		case json.Number:
+			if f, err := n.Float64(); err == nil {
+				return f, nil
+			}
+		case float64:
+			return n, nil
+		case int64:
+			return float64(n), nil
+		case int:
+			return float64(n), nil
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "string":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	default:
+		return nil, fmt.Errorf("schema has unknown type '%s'", typ)
+	}
+	return nil, fmt.Errorf("expected %s, got %s", typ, jsonType(v))
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case json.Number, float64, int64, int:
+		return "number"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,148 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+func TestDecodeRows(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		body    string
+		want    []Row
+		wantErr bool
+	}{
+		{"one row", `{"data": {"temp": 21.5}}`, []Row{{Data: map[string]interface{}{"temp": json.Number("21.5")}}}, false},
+		{"batch", `[{"data": {"rpm": 3000}}, {"timestamp": "2024-05-01T10:00:00Z", "data": {"rpm": 3100}}]`, []Row{
+			{Data: map[string]interface{}{"rpm": json.Number("3000")}},
+			{Timestamp: &ts, Data: map[string]interface{}{"rpm": json.Number("3100")}},
+		}, false},
+		{"surrounding space", "\n  {\"data\": {\"on\": true}}  \n", []Row{{Data: map[string]interface{}{"on": true}}}, false},
+		{"empty batch", `[]`, []Row{}, false},
+		{"unknown top level field", `{"data": {"temp": 1}, "device": "x"}`, nil, true},
+		{"second object", `{"data": {"temp": 1}}{"data": {"temp": 2}}`, nil, true},
+		{"trailing junk after object", `{"data": {"temp": 1}}{"junk"`, nil, true},
+		{"trailing junk after batch", `[{"data": {"temp": 1}}]garbage`, nil, true},
+		{"invalid json", `{"data": `, nil, true},
+		{"empty body", ``, nil, true},
+		{"bad timestamp", `{"timestamp": "yesterday", "data": {"temp": 1}}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := DecodeRows([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DecodeRows accepted %q as %+v", tt.body, rows)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeRows: %v", err)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("DecodeRows = %+v, want %+v", rows, tt.want)
+			}
+		})
+	}
+
+	if _, err := DecodeRows([]byte(`[{"data": {"temp": 1}}] []`)); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("second value: err = %v, want ErrTrailingData", err)
+	}
+}
+
+var testSchema = metadata.TelemetrySchema{"temp": "float", "rpm": "int", "on": "bool", "mode": "string"}
+
+func TestValidateRow(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       map[string]interface{}
+		want       map[string]interface{}
+		wantFields []string //fields with errors, in order
+	}{
+		{"all types", map[string]interface{}{
+			"temp": json.Number("21.5"), "rpm": json.Number("3000"), "on": true, "mode": "eco",
+		}, map[string]interface{}{"temp": 21.5, "rpm": int64(3000), "on": true, "mode": "eco"}, nil},
+		{"int is a float", map[string]interface{}{"temp": json.Number("21")}, map[string]interface{}{"temp": 21.0}, nil},
+		{"float is not an int", map[string]interface{}{"rpm": json.Number("3000.5")}, nil, []string{"rpm"}},
+		{"decoded without UseNumber", map[string]interface{}{"rpm": 3000.0, "temp": 1.5}, map[string]interface{}{"rpm": int64(3000), "temp": 1.5}, nil},
+		{"unknown field", map[string]interface{}{"temp": json.Number("1"), "humidity": json.Number("40")}, nil, []string{"humidity"}},
+		{"wrong types", map[string]interface{}{
+			"temp": "hot", "rpm": true, "on": json.Number("1"), "mode": nil,
+		}, nil, []string{"mode", "on", "rpm", "temp"}},
+		{"empty", map[string]interface{}{}, nil, []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := ValidateRow(testSchema, tt.data)
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Fatalf("errors %+v, want errors for %v", errs, tt.wantFields)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateRow = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildReadings(t *testing.T) {
+	device := &metadata.Device{ID: uuid.New(), CompanyID: uuid.New(), TelemetryDataSchema: testSchema, SchemaVersion: 3}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour).In(time.FixedZone("CEST", 2*60*60))
+	skewed := now.Add(MaxClockSkew - time.Second)
+	future := now.Add(MaxClockSkew + time.Second)
+
+	t.Run("timestamps", func(t *testing.T) {
+		rows := []Row{
+			{Data: map[string]interface{}{"temp": json.Number("1")}},
+			{Timestamp: &past, Data: map[string]interface{}{"temp": json.Number("2")}},
+			{Timestamp: &skewed, Data: map[string]interface{}{"temp": json.Number("3")}},
+		}
+		readings, errs := BuildReadings(device, rows, now)
+		if errs != nil {
+			t.Fatalf("BuildReadings: %+v", errs)
+		}
+		want := []time.Time{now, past.UTC(), skewed}
+		for i, r := range readings {
+			if !r.Timestamp.Equal(want[i]) || r.Timestamp.Location() != time.UTC {
+				t.Errorf("reading %d at %v, want %v in UTC", i, r.Timestamp, want[i])
+			}
+			if r.DeviceID != device.ID || r.CompanyID != device.CompanyID || r.SchemaVersion != 3 {
+				t.Errorf("reading %d = %+v, want the device's ids and schema version", i, r)
+			}
+		}
+	})
+
+	t.Run("per row errors", func(t *testing.T) {
+		rows := []Row{
+			{Data: map[string]interface{}{"temp": json.Number("1")}},
+			{Data: map[string]interface{}{"temp": "hot"}},
+			{Data: map[string]interface{}{"rpm": json.Number("1")}},
+			{Timestamp: &future, Data: map[string]interface{}{"humidity": json.Number("1")}},
+		}
+		readings, errs := BuildReadings(device, rows, now)
+		if readings != nil {
+			t.Errorf("BuildReadings returned readings %+v with errors", readings)
+		}
+		want := []RowError{
+			{Index: 1, Errors: []FieldError{{Field: "temp", Error: "expected float, got string"}}},
+			{Index: 3, Errors: []FieldError{
+				{Field: "timestamp", Error: "timestamp is in the future"},
+				{Field: "humidity", Error: "field is not in the device schema"},
+			}},
+		}
+		if !reflect.DeepEqual(errs, want) {
+			t.Errorf("errors %+v, want %+v", errs, want)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package webhooks
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// Ranges IsGlobalUnicast lets through that still do not reach the internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), //carrier grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), //benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), //NAT64, can embed any IPv4 address
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// IsPublicAddr reports whether a webhook may be sent to addr. Loopback,
+// private, link local (like the 169.254.169.254 cloud metadata endpoint) and
+// other special addresses are refused, so webhooks cannot reach the network
+// KCloud runs in.
+func IsPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialControl refuses connections to non public addresses. It runs on the
+// resolved address of every connection, redirects included, so a name that
+// resolves elsewhere at send time than when it was checked gets nowhere.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !IsPublicAddr(addr) {
+		return fmt.Errorf("%w: %s is not a public address", ErrForbiddenAddress, addr)
+	}
+	return nil
+}
+
+// NewClient returns the http client the dispatcher sends with, it only
+// connects to public addresses and never through a proxy
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   dialControl,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   timeout,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		if got := IsPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("IsPublicAddr(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://93.184.216.34:8080/hook", true},
+		{"ftp://example.com/hook", false},
+		{"/hook", false},
+		{"http://localhost/hook", false},
+		{"http://api.localhost./hook", false},
+		{"http://127.0.0.1:8080/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://10.0.0.5/hook", false},
+	}
+	for _, tt := range tests {
+		err := ValidateURL(tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateURL(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidWebhook) {
+			t.Errorf("ValidateURL(%q) = %v, want ErrInvalidWebhook", tt.url, err)
+		}
+	}
+}
+
+func TestClientRefusesNonPublicAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(time.Second).Post(srv.URL, "application/json", nil)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("got %v, want ErrForbiddenAddress", err)
+	}
+}
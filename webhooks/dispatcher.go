@@ -0,0 +1,213 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	"github.com/mukundvijay123/KCloud/presence"
+	"github.com/mukundvijay123/KCloud/rules"
+)
+
+const (
+	DefaultMaxAttempts = 10
+	DefaultBaseBackoff = 10 * time.Second
+	DefaultMaxBackoff  = time.Hour
+	DefaultTimeout     = 10 * time.Second
+	DefaultBatchSize   = 50
+)
+
+// Dispatcher queues event payloads in the outbox and POSTs them to the company
+// webhooks, retrying failures with exponential backoff
+type Dispatcher struct {
+	logger *log.Logger
+	Store  WebhookStore
+	Client *http.Client //NewClient by default, which only reaches public addresses
+
+	MaxAttempts int           //attempts before a delivery is failed
+	BaseBackoff time.Duration //wait after the first failure, doubled after each one
+	MaxBackoff  time.Duration
+	BatchSize   int //deliveries claimed per poll
+}
+
+func NewDispatcher(store WebhookStore, logger *log.Logger) *Dispatcher {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &Dispatcher{
+		logger:      logger,
+		Store:       store,
+		Client:      NewClient(DefaultTimeout),
+		MaxAttempts: DefaultMaxAttempts,
+		BaseBackoff: DefaultBaseBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		BatchSize:   DefaultBatchSize,
+	}
+}
+
+// Publish queues an event for the webhook of a company, if it has one
+func (d *Dispatcher) Publish(ctx context.Context, companyID uuid.UUID, eventType string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	p := Payload{
+		ID:        uuid.New(),
+		Type:      eventType,
+		CompanyID: companyID,
+		CreatedAt: time.Now().UTC(),
+		Data:      raw,
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	queued, err := d.Store.Enqueue(ctx, &Delivery{
+		ID:        p.ID,
+		CompanyID: companyID,
+		EventType: eventType,
+		Payload:   body,
+	})
+	if err != nil {
+		return err
+	}
+	if queued {
+		d.logger.Printf("[Publish] queued %s delivery %s", eventType, p.ID)
+	}
+	return nil
+}
+
+// HandleEvent queues rule events, it makes a Dispatcher a rules.EventHandler
+func (d *Dispatcher) HandleEvent(ctx context.Context, e *rules.Event) {
+	eventType := EventRuleFiring
+	if e.State == rules.StateResolved {
+		eventType = EventRuleResolved
+	}
+	if err := d.Publish(ctx, e.CompanyID, eventType, e); err != nil {
+		d.logger.Println("[HandleEvent] failed to queue rule event:", err)
+	}
+}
+
+// HandlePresence queues device online and offline events, it makes a Dispatcher a presence.EventHandler
+func (d *Dispatcher) HandlePresence(ctx context.Context, e *presence.Event) {
+	eventType := EventDeviceOffline
+	if e.Status == metadata.DeviceOnline {
+		eventType = EventDeviceOnline
+	}
+	if err := d.Publish(ctx, e.CompanyID, eventType, e); err != nil {
+		d.logger.Println("[HandlePresence] failed to queue presence event:", err)
+	}
+}
+
+// Run sends due deliveries every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep going while full batches come back so a backlog drains quickly
+			for {
+				n, err := d.RunOnce(ctx)
+				if err != nil {
+					d.logger.Println("[Run] error:", err)
+				}
+				if err != nil || n < d.BatchSize || ctx.Err() != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+// RunOnce claims one batch of due deliveries and sends them, returning how many it claimed
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, error) {
+	deliveries, err := d.Store.Claim(ctx, d.BatchSize, d.lease(d.BatchSize))
+	if err != nil {
+		return 0, err
+	}
+	for _, delivery := range deliveries {
+		d.send(ctx, delivery)
+	}
+	return len(deliveries), nil
+}
+
+// lease is how long n claimed deliveries stay with this process. They are sent
+// one after the other, so it outlasts n sends timing out and a claimed delivery
+// is only sent again by another process if this one dies.
+func (d *Dispatcher) lease(n int) time.Duration {
+	timeout := d.Client.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return time.Duration(n)*timeout + time.Minute
+}
+
+// send makes one attempt and records its outcome
+func (d *Dispatcher) send(ctx context.Context, delivery *Delivery) {
+	attempt := &Attempt{DeliveryID: delivery.ID, AttemptedAt: time.Now().UTC()}
+	err := d.post(ctx, delivery, attempt)
+	attempt.DurationMs = time.Since(attempt.AttemptedAt).Milliseconds()
+
+	status, next := DeliveryDelivered, (*time.Time)(nil)
+	if err != nil {
+		attempt.Error = err.Error()
+		status = DeliveryFailed
+		if attempts := delivery.Attempts + 1; attempts < d.MaxAttempts {
+			status = DeliveryPending
+			at := time.Now().Add(d.backoff(attempts))
+			next = &at
+		}
+		d.logger.Printf("[send] delivery %s attempt %d failed: %v", delivery.ID, delivery.Attempts+1, err)
+	}
+
+	if err := d.Store.RecordAttempt(ctx, attempt, status, next); err != nil {
+		d.logger.Println("[send] failed to record attempt:", err)
+	}
+}
+
+// post sends the payload, any answer but 2xx is a failure
+func (d *Dispatcher) post(ctx context.Context, delivery *Delivery, attempt *Attempt) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "KCloud-Webhook/1")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, delivery.ID.String())
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, attempt.AttemptedAt, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// backoff is the wait after the nth failed attempt
+func (d *Dispatcher) backoff(n int) time.Duration {
+	wait := d.BaseBackoff
+	for i := 1; i < n && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, d.MaxBackoff)
+}
@@ -0,0 +1,274 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memWebhookStore keeps one webhook and the outbox in memory
+type memWebhookStore struct {
+	mu         sync.Mutex
+	config     *Config
+	deliveries []*Delivery
+	attempts   []*Attempt
+	leases     []time.Duration
+}
+
+func (s *memWebhookStore) GetConfig(ctx context.Context, companyID uuid.UUID) (*Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config == nil || s.config.CompanyID != companyID {
+		return nil, ErrWebhookNotFound
+	}
+	c := *s.config
+	return &c, nil
+}
+
+func (s *memWebhookStore) SaveConfig(ctx context.Context, c *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *c
+	s.config = &cp
+	return nil
+}
+
+func (s *memWebhookStore) DeleteConfig(ctx context.Context, companyID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = nil
+	return nil
+}
+
+func (s *memWebhookStore) RotateSecret(ctx context.Context, companyID uuid.UUID) (string, error) {
+	return "", nil
+}
+
+func (s *memWebhookStore) Enqueue(ctx context.Context, d *Delivery) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config == nil || !s.config.Enabled || s.config.CompanyID != d.CompanyID {
+		return false, nil
+	}
+	now := time.Now()
+	cp := *d
+	cp.Status, cp.NextAttemptAt, cp.CreatedAt = DeliveryPending, &now, now
+	s.deliveries = append(s.deliveries, &cp)
+	return true, nil
+}
+
+func (s *memWebhookStore) Claim(ctx context.Context, n int, lease time.Duration) ([]*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases = append(s.leases, lease)
+	var claimed []*Delivery
+	for _, d := range s.deliveries {
+		if len(claimed) == n {
+			break
+		}
+		if d.Status != DeliveryPending || d.NextAttemptAt.After(time.Now()) {
+			continue
+		}
+		at := time.Now().Add(lease)
+		d.NextAttemptAt = &at
+		cp := *d
+		cp.URL, cp.Secret = s.config.URL, s.config.Secret
+		claimed = append(claimed, &cp)
+	}
+	return claimed, nil
+}
+
+func (s *memWebhookStore) RecordAttempt(ctx context.Context, a *Attempt, status DeliveryStatus, next *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts = append(s.attempts, a)
+	for _, d := range s.deliveries {
+		if d.ID == a.DeliveryID {
+			d.Status, d.NextAttemptAt, d.LastError = status, next, a.Error
+			d.Attempts++
+		}
+	}
+	return nil
+}
+
+func (s *memWebhookStore) ListDeliveries(ctx context.Context, companyID uuid.UUID, status DeliveryStatus, limit int) ([]*Delivery, error) {
+	return nil, nil
+}
+
+func (s *memWebhookStore) GetDelivery(ctx context.Context, companyID, id uuid.UUID) (*Delivery, []*Attempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.deliveries {
+		if d.ID == id {
+			cp := *d
+			var attempts []*Attempt
+			for _, a := range s.attempts {
+				if a.DeliveryID == id {
+					attempts = append(attempts, a)
+				}
+			}
+			return &cp, attempts, nil
+		}
+	}
+	return nil, nil, ErrDeliveryNotFound
+}
+
+// newTestDispatcher points a company's webhook at srv. The loopback server is
+// not public, so the dispatcher uses the server's own client.
+func newTestDispatcher(t *testing.T, srv *httptest.Server) (*Dispatcher, *memWebhookStore, uuid.UUID) {
+	t.Helper()
+	companyID := uuid.New()
+	store := &memWebhookStore{config: &Config{CompanyID: companyID, URL: srv.URL, Enabled: true, Secret: "whsec"}}
+	d := NewDispatcher(store, log.New(io.Discard, "", 0))
+	d.Client = srv.Client()
+	d.Client.Timeout = time.Second
+	d.BaseBackoff = time.Millisecond
+	return d, store, companyID
+}
+
+func TestDispatcherDeliversSignedPayloads(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.Header.Clone(), body}
+	}))
+	defer srv.Close()
+
+	d, store, companyID := newTestDispatcher(t, srv)
+	if err := d.Publish(context.Background(), companyID, EventDeviceOffline, map[string]string{"device": "boiler"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.RunOnce(context.Background()); err != nil || n != 1 {
+		t.Fatalf("RunOnce = %d, %v, want 1 delivery", n, err)
+	}
+
+	r := <-got
+	if err := Verify("whsec", r.header.Get(SignatureHeader), r.body, time.Minute, time.Now()); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+	if err := Verify("other", r.header.Get(SignatureHeader), r.body, time.Minute, time.Now()); err == nil {
+		t.Error("signature verifies with another secret")
+	}
+	var p Payload
+	if err := json.Unmarshal(r.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != EventDeviceOffline || p.CompanyID != companyID || string(p.Data) != `{"device":"boiler"}` {
+		t.Errorf("unexpected payload %s", r.body)
+	}
+	if r.header.Get(EventHeader) != EventDeviceOffline || r.header.Get(DeliveryHeader) != p.ID.String() {
+		t.Errorf("unexpected headers %v", r.header)
+	}
+
+	delivery, attempts, _ := store.GetDelivery(context.Background(), companyID, p.ID)
+	if delivery.Status != DeliveryDelivered || len(attempts) != 1 || attempts[0].StatusCode != http.StatusOK {
+		t.Errorf("delivery %+v with attempts %+v, want delivered after one 200", delivery, attempts)
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	d, store, companyID := newTestDispatcher(t, srv)
+	if err := d.Publish(context.Background(), companyID, EventRuleFiring, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			time.Sleep(10 * time.Millisecond) //past the backoff
+		}
+		if n, err := d.RunOnce(context.Background()); err != nil || n != 1 {
+			t.Fatalf("RunOnce %d = %d, %v, want 1 delivery", i, n, err)
+		}
+	}
+
+	delivery, attempts, _ := store.GetDelivery(context.Background(), companyID, store.deliveries[0].ID)
+	if delivery.Status != DeliveryDelivered || delivery.Attempts != 3 {
+		t.Fatalf("delivery %+v, want delivered on the third attempt", delivery)
+	}
+	for i, want := range []int{503, 503, 200} {
+		if attempts[i].StatusCode != want {
+			t.Errorf("attempt %d answered %d, want %d", i+1, attempts[i].StatusCode, want)
+		}
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	d, store, companyID := newTestDispatcher(t, srv)
+	d.MaxAttempts = 2
+	if err := d.Publish(context.Background(), companyID, EventRuleFiring, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if _, err := d.RunOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := d.RunOnce(context.Background()); n != 0 {
+		t.Errorf("a failed delivery was claimed again")
+	}
+	if got := store.deliveries[0].Status; got != DeliveryFailed {
+		t.Errorf("status %s, want failed", got)
+	}
+}
+
+func TestDispatcherLeaseCoversBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	d, store, _ := newTestDispatcher(t, srv)
+	if _, err := d.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Every delivery of a batch may time out before the last one is sent
+	if sends := time.Duration(d.BatchSize) * d.Client.Timeout; store.leases[0] <= sends {
+		t.Errorf("lease %v does not outlast %d sends timing out", store.leases[0], d.BatchSize)
+	}
+}
+
+func TestDispatcherRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached the loopback server")
+	}))
+	defer srv.Close()
+
+	d, store, companyID := newTestDispatcher(t, srv)
+	d.Client = NewClient(time.Second)
+	if err := d.Publish(context.Background(), companyID, EventRuleFiring, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a := store.attempts[0]; a.StatusCode != 0 || a.Error == "" {
+		t.Errorf("attempt %+v, want a dial error", a)
+	}
+}
@@ -0,0 +1,16 @@
+package webhooks
+
+import (
+	"errors"
+
+	"github.com/mukundvijay123/KCloud/metadata"
+)
+
+var (
+	ErrInvalidWebhook   = metadata.NewError(metadata.ErrValidation, "invalid webhook")
+	ErrWebhookNotFound  = metadata.NewError(metadata.ErrNotFound, "webhook not configured")
+	ErrDeliveryNotFound = metadata.NewError(metadata.ErrNotFound, "delivery not found")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrForbiddenAddress = errors.New("webhook address not allowed")
+	ErrDbErrorGeneric   = errors.New("database error")
+)
@@ -0,0 +1,415 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	auditlog "github.com/mukundvijay123/KCloud/metadata/auditLog"
+)
+
+const deliveryColumns = `id, company_id, event_type, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at`
+
+// PgWebhookStore keeps webhooks in the postgres "webhook" table and the outbox
+// in "webhook_delivery" and "webhook_attempt"
+type PgWebhookStore struct {
+	dbConn *sql.DB
+	logger *log.Logger
+}
+
+func NewPgWebhookStore(db *sql.DB, logger *log.Logger) *PgWebhookStore {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &PgWebhookStore{
+		dbConn: db,
+		logger: logger,
+	}
+}
+
+func (s *PgWebhookStore) GetConfig(ctx context.Context, companyID uuid.UUID) (*Config, error) {
+	c := &Config{CompanyID: companyID}
+	err := s.dbConn.QueryRowContext(ctx, `
+		SELECT url, enabled, created_at, updated_at FROM webhook WHERE company_id = $1
+	`, companyID).Scan(&c.URL, &c.Enabled, &c.CreatedAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		s.logger.Println("[GetConfig] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return c, nil
+}
+
+func (s *PgWebhookStore) SaveConfig(ctx context.Context, c *Config) (err error) {
+	if err := ValidateURL(c.URL); err != nil {
+		return err
+	}
+	secret, err := metadata.NewToken()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[SaveConfig] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var before *Config
+	old := Config{CompanyID: c.CompanyID}
+	err = tx.QueryRowContext(ctx, `
+		SELECT url, enabled, created_at, updated_at FROM webhook WHERE company_id = $1 FOR UPDATE
+	`, c.CompanyID).Scan(&old.URL, &old.Enabled, &old.CreatedAt, &old.UpdatedAt)
+	switch {
+	case err == nil:
+		before = &old
+	case !errors.Is(err, sql.ErrNoRows):
+		s.logger.Println("[SaveConfig] error reading webhook:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	// xmax is 0 only for a freshly inserted row, that is when the secret is new
+	var inserted bool
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO webhook (company_id, url, enabled, secret) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (company_id) DO UPDATE SET url = EXCLUDED.url, enabled = EXCLUDED.enabled, updated_at = now()
+		RETURNING created_at, updated_at, xmax = 0
+	`, c.CompanyID, c.URL, c.Enabled, secret).Scan(&c.CreatedAt, &c.UpdatedAt, &inserted)
+	if err != nil {
+		s.logger.Println("[SaveConfig] error:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	c.Secret = ""
+	after := *c
+	action := metadata.AuditWebhookUpdate
+	if inserted {
+		action, before = metadata.AuditWebhookCreate, nil
+	}
+	if err = s.audit(ctx, tx, c.CompanyID, action, before, &after); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[SaveConfig] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if inserted {
+		c.Secret = secret
+	}
+	return nil
+}
+
+func (s *PgWebhookStore) DeleteConfig(ctx context.Context, companyID uuid.UUID) (err error) {
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[DeleteConfig] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before := &Config{CompanyID: companyID}
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM webhook WHERE company_id = $1 RETURNING url, enabled, created_at, updated_at
+	`, companyID).Scan(&before.URL, &before.Enabled, &before.CreatedAt, &before.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrWebhookNotFound
+	}
+	if err != nil {
+		s.logger.Println("[DeleteConfig] error:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if err = s.audit(ctx, tx, companyID, metadata.AuditWebhookDelete, before, nil); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[DeleteConfig] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgWebhookStore) RotateSecret(ctx context.Context, companyID uuid.UUID) (_ string, err error) {
+	secret, err := metadata.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[RotateSecret] failed to begin transaction:", err)
+		return "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE webhook SET secret = $2, updated_at = now() WHERE company_id = $1
+	`, companyID, secret)
+	if err != nil {
+		s.logger.Println("[RotateSecret] error:", err)
+		return "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrWebhookNotFound
+	}
+	//secrets are never recorded
+	if err = s.audit(ctx, tx, companyID, metadata.AuditWebhookSecretRotate, nil, nil); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[RotateSecret] failed to commit:", err)
+		return "", fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return secret, nil
+}
+
+// audit writes the event of a webhook change into tx, see auditlog.Write.
+// A company has one webhook, the company id is its resource id.
+func (s *PgWebhookStore) audit(ctx context.Context, tx *sql.Tx, companyID uuid.UUID, action string, before, after *Config) error {
+	var b, a any
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	if err := auditlog.Write(ctx, tx, companyID, action, companyID, b, a); err != nil {
+		s.logger.Println("[audit] error writing event:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgWebhookStore) Enqueue(ctx context.Context, d *Delivery) (bool, error) {
+	err := s.dbConn.QueryRowContext(ctx, `
+		INSERT INTO webhook_delivery (id, company_id, event_type, payload)
+		SELECT $1, $2, $3, $4 FROM webhook WHERE company_id = $2 AND enabled
+		RETURNING status, next_attempt_at, created_at
+	`, d.ID, d.CompanyID, d.EventType, []byte(d.Payload)).Scan(new(string), &d.NextAttemptAt, &d.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		s.logger.Println("[Enqueue] error:", err)
+		return false, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	d.Status = DeliveryPending
+	return true, nil
+}
+
+func (s *PgWebhookStore) Claim(ctx context.Context, n int, lease time.Duration) ([]*Delivery, error) {
+	// Deliveries of a disabled or deleted webhook wait until it is enabled again
+	rows, err := s.dbConn.QueryContext(ctx, `
+		WITH due AS (
+			SELECT d.id FROM webhook_delivery d JOIN webhook w ON w.company_id = d.company_id
+			WHERE d.status = 'pending' AND d.next_attempt_at <= now() AND w.enabled
+			ORDER BY d.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF d SKIP LOCKED
+		)
+		UPDATE webhook_delivery d SET next_attempt_at = now() + $2 * interval '1 second'
+		FROM due, webhook w
+		WHERE d.id = due.id AND w.company_id = d.company_id
+		RETURNING d.id, d.company_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at,
+			d.last_error, d.created_at, d.delivered_at, w.url, w.secret
+	`, n, lease.Seconds())
+	if err != nil {
+		s.logger.Println("[Claim] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows, true)
+		if err != nil {
+			s.logger.Println("[Claim] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[Claim] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return deliveries, nil
+}
+
+func (s *PgWebhookStore) RecordAttempt(ctx context.Context, a *Attempt, status DeliveryStatus, next *time.Time) (err error) {
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Println("[RecordAttempt] failed to begin transaction:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO webhook_attempt (delivery_id, attempted_at, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, a.DeliveryID, a.AttemptedAt, nullInt(a.StatusCode), nullString(a.Error), a.DurationMs).Scan(&a.ID)
+	if err != nil {
+		s.logger.Println("[RecordAttempt] failed to insert attempt:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE webhook_delivery SET status = $2, attempts = attempts + 1, next_attempt_at = $3,
+			last_error = $4, delivered_at = CASE WHEN $2 = 'delivered' THEN now() END
+		WHERE id = $1
+	`, a.DeliveryID, string(status), next, nullString(a.Error))
+	if err != nil {
+		s.logger.Println("[RecordAttempt] failed to update delivery:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Println("[RecordAttempt] failed to commit:", err)
+		return fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return nil
+}
+
+func (s *PgWebhookStore) ListDeliveries(ctx context.Context, companyID uuid.UUID, status DeliveryStatus, limit int) ([]*Delivery, error) {
+	if limit <= 0 {
+		limit = metadata.DefaultListLimit
+	}
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT `+deliveryColumns+` FROM webhook_delivery
+		WHERE company_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC, id
+		LIMIT $3
+	`, companyID, string(status), min(limit, metadata.MaxListLimit))
+	if err != nil {
+		s.logger.Println("[ListDeliveries] error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows, false)
+		if err != nil {
+			s.logger.Println("[ListDeliveries] scan error:", err)
+			return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[ListDeliveries] rows error:", err)
+		return nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return deliveries, nil
+}
+
+func (s *PgWebhookStore) GetDelivery(ctx context.Context, companyID, id uuid.UUID) (*Delivery, []*Attempt, error) {
+	row := s.dbConn.QueryRowContext(ctx, `
+		SELECT `+deliveryColumns+` FROM webhook_delivery WHERE id = $1 AND company_id = $2
+	`, id, companyID)
+	d, err := scanDelivery(row, false)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrDeliveryNotFound, id)
+	}
+	if err != nil {
+		s.logger.Println("[GetDelivery] error:", err)
+		return nil, nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+
+	rows, err := s.dbConn.QueryContext(ctx, `
+		SELECT id, delivery_id, attempted_at, status_code, error, duration_ms
+		FROM webhook_attempt WHERE delivery_id = $1 ORDER BY attempted_at
+	`, id)
+	if err != nil {
+		s.logger.Println("[GetDelivery] attempts error:", err)
+		return nil, nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	defer rows.Close()
+
+	attempts := []*Attempt{}
+	for rows.Next() {
+		var (
+			a          Attempt
+			statusCode sql.NullInt64
+			errText    sql.NullString
+		)
+		if err := rows.Scan(&a.ID, &a.DeliveryID, &a.AttemptedAt, &statusCode, &errText, &a.DurationMs); err != nil {
+			s.logger.Println("[GetDelivery] scan error:", err)
+			return nil, nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+		}
+		a.StatusCode = int(statusCode.Int64)
+		a.Error = errText.String
+		attempts = append(attempts, &a)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Println("[GetDelivery] rows error:", err)
+		return nil, nil, fmt.Errorf("%w: %w", ErrDbErrorGeneric, err)
+	}
+	return d, attempts, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanDelivery reads deliveryColumns, followed by the webhook url and secret when withTarget
+func scanDelivery(row scanner, withTarget bool) (*Delivery, error) {
+	var (
+		d         Delivery
+		status    string
+		payload   []byte
+		next      sql.NullTime
+		lastError sql.NullString
+		delivered sql.NullTime
+	)
+	dest := []any{&d.ID, &d.CompanyID, &d.EventType, &payload, &status, &d.Attempts, &next, &lastError, &d.CreatedAt, &delivered}
+	if withTarget {
+		dest = append(dest, &d.URL, &d.Secret)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	d.Payload = payload
+	d.Status = DeliveryStatus(status)
+	d.LastError = lastError.String
+	if next.Valid {
+		d.NextAttemptAt = &next.Time
+	}
+	if delivered.Valid {
+		d.DeliveredAt = &delivered.Time
+	}
+	return &d, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
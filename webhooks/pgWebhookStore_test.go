@@ -0,0 +1,69 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatastore "github.com/mukundvijay123/KCloud/metadata/metadataStore"
+	metadatatest "github.com/mukundvijay123/KCloud/metadata/metadataTest"
+)
+
+func TestPgWebhookStoreAudit(t *testing.T) {
+	db := metadatatest.OpenTestDb(t)
+	logger := log.New(io.Discard, "", 0)
+	mdb := metadatastore.NewMetadataDb(db, logger)
+	store := NewPgWebhookStore(db, logger)
+
+	companyID := metadatatest.MustDevice(t, mdb).CompanyID
+	keyID := uuid.New()
+	ctx := metadata.WithActor(context.Background(), metadata.Actor{APIKeyID: keyID, RequestID: "req-webhook"})
+
+	c := &Config{CompanyID: companyID, URL: "https://example.com/hook", Enabled: true}
+	if err := store.SaveConfig(ctx, c); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	secret := c.Secret
+	c.Enabled = false
+	if err := store.SaveConfig(ctx, c); err != nil {
+		t.Fatalf("SaveConfig(update): %v", err)
+	}
+	rotated, err := store.RotateSecret(ctx, companyID)
+	if err != nil {
+		t.Fatalf("RotateSecret: %v", err)
+	}
+	if err := store.DeleteConfig(ctx, companyID); err != nil {
+		t.Fatalf("DeleteConfig: %v", err)
+	}
+	// Failed changes leave no event
+	if _, err := store.RotateSecret(ctx, companyID); err == nil {
+		t.Fatal("RotateSecret rotated a deleted webhook")
+	}
+
+	events, actions := metadatatest.AuditActions(t, mdb, companyID.String())
+	want := strings.Join([]string{metadata.AuditWebhookDelete, metadata.AuditWebhookSecretRotate,
+		metadata.AuditWebhookUpdate, metadata.AuditWebhookCreate}, " ")
+	if !strings.HasPrefix(actions, want) {
+		t.Fatalf("audit log = %s, want it to start with %s", actions, want)
+	}
+	for _, e := range events[:4] {
+		if e.ResourceID != companyID || e.ActorAPIKeyID != keyID || e.RequestID != "req-webhook" {
+			t.Errorf("%s event = %+v, want the webhook, actor and request id", e.Action, e)
+		}
+		for _, s := range []string{secret, rotated} {
+			if strings.Contains(string(e.Before), s) || strings.Contains(string(e.After), s) {
+				t.Errorf("%s event leaks the webhook secret", e.Action)
+			}
+		}
+	}
+	if create := events[3]; create.Before != nil || create.After == nil {
+		t.Errorf("webhook.create event has before %s, after %s, want only after", create.Before, create.After)
+	}
+	if update := events[2]; !strings.Contains(string(update.Before), `"enabled":true`) || !strings.Contains(string(update.After), `"enabled":false`) {
+		t.Errorf("webhook.update event has before %s, after %s", update.Before, update.After)
+	}
+}
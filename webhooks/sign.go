@@ -0,0 +1,83 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-KCloud-Signature"
+	EventHeader     = "X-KCloud-Event"
+	DeliveryHeader  = "X-KCloud-Delivery"
+
+	MaxURLLength = 2048
+)
+
+// Sign returns the signature header value for body sent at ts:
+// "t=<unix seconds>,v1=<hex hmac-sha256 of "<t>.<body>">". Signing the time
+// lets receivers refuse replays.
+func Sign(secret string, ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	return "t=" + t + ",v1=" + mac(secret, t, body)
+}
+
+// Verify checks a signature header against body and rejects it when older than tolerance
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			v1 = v
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidSignature)
+	}
+	if !hmac.Equal([]byte(v1), []byte(mac(secret, t, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func mac(secret, t string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(t))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidateURL checks a webhook url is an absolute http(s) url. Hosts that are
+// obviously not public are refused early, names are checked again on every
+// connection, see NewClient.
+func ValidateURL(raw string) error {
+	if len(raw) > MaxURLLength {
+		return fmt.Errorf("%w: url exceeds %d characters", ErrInvalidWebhook, MaxURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidWebhook)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: url must point to a public address", ErrInvalidWebhook)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !IsPublicAddr(addr) {
+		return fmt.Errorf("%w: url must point to a public address", ErrInvalidWebhook)
+	}
+	return nil
+}
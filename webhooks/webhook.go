@@ -0,0 +1,104 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types a webhook receives
+const (
+	EventRuleFiring    = "rule.firing"
+	EventRuleResolved  = "rule.resolved"
+	EventDeviceOffline = "device.offline"
+	EventDeviceOnline  = "device.online"
+)
+
+// DeliveryStatus of a queued payload
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed" //gave up after MaxAttempts
+)
+
+func (s DeliveryStatus) Valid() bool {
+	switch s {
+	case DeliveryPending, DeliveryDelivered, DeliveryFailed:
+		return true
+	}
+	return false
+}
+
+// Config is the webhook of a company. The secret signs every payload, it is
+// only shown when the webhook is created or the secret rotated.
+type Config struct {
+	CompanyID uuid.UUID `json:"company_id"`
+	URL       string    `json:"url"`
+	Enabled   bool      `json:"enabled"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Payload is the JSON body POSTed to a webhook
+type Payload struct {
+	ID        uuid.UUID       `json:"id"` //the delivery id, the same on every retry
+	Type      string          `json:"type"`
+	CompanyID uuid.UUID       `json:"company_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Delivery is a payload in the outbox with its retry state
+type Delivery struct {
+	ID            uuid.UUID       `json:"id"`
+	CompanyID     uuid.UUID       `json:"company_id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        DeliveryStatus  `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"` //nil once delivered or failed
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+
+	URL    string `json:"-"` //current webhook of the company, set by Claim
+	Secret string `json:"-"`
+}
+
+// Attempt is one try at sending a delivery
+type Attempt struct {
+	ID          uuid.UUID `json:"id"`
+	DeliveryID  uuid.UUID `json:"delivery_id"`
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  int       `json:"status_code,omitempty"` //0 when no response came back
+	Error       string    `json:"error,omitempty"`
+	DurationMs  int64     `json:"duration_ms"`
+}
+
+// WebhookStore persists webhook configs and the delivery outbox
+type WebhookStore interface {
+	GetConfig(ctx context.Context, companyID uuid.UUID) (*Config, error)
+	// SaveConfig creates or updates the webhook of c.CompanyID. A new webhook
+	// gets a secret, set on c; an update keeps the old one.
+	SaveConfig(ctx context.Context, c *Config) error
+	DeleteConfig(ctx context.Context, companyID uuid.UUID) error
+	RotateSecret(ctx context.Context, companyID uuid.UUID) (string, error)
+
+	// Enqueue adds d to the outbox if its company has an enabled webhook and
+	// reports whether it did
+	Enqueue(ctx context.Context, d *Delivery) (bool, error)
+	// Claim hands out up to n due deliveries and pushes their next attempt
+	// lease into the future, so concurrent dispatchers skip them
+	Claim(ctx context.Context, n int, lease time.Duration) ([]*Delivery, error)
+	// RecordAttempt stores a and the new state of its delivery: delivered,
+	// failed, or pending again at next
+	RecordAttempt(ctx context.Context, a *Attempt, status DeliveryStatus, next *time.Time) error
+
+	ListDeliveries(ctx context.Context, companyID uuid.UUID, status DeliveryStatus, limit int) ([]*Delivery, error)
+	GetDelivery(ctx context.Context, companyID, id uuid.UUID) (*Delivery, []*Attempt, error)
+}
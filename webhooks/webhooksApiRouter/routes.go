@@ -0,0 +1,174 @@
+package webhooksrouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	"github.com/mukundvijay123/KCloud/webhooks"
+)
+
+type saveRequest struct {
+	URL     string `json:"url"`
+	Enabled *bool  `json:"enabled"` //true when left out
+}
+
+type deliveryList struct {
+	Deliveries []*webhooks.Delivery `json:"deliveries"`
+}
+
+type deliveryDetail struct {
+	Delivery *webhooks.Delivery  `json:"delivery"`
+	Attempts []*webhooks.Attempt `json:"attempts"`
+}
+
+// saveHandler creates or replaces the caller's webhook. The secret is only in
+// the response when the webhook is created.
+func (wr *WebhooksRouter) saveHandler(w http.ResponseWriter, r *http.Request) {
+	var req saveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	c := &webhooks.Config{
+		CompanyID: companyID,
+		URL:       req.URL,
+		Enabled:   req.Enabled == nil || *req.Enabled,
+	}
+	if err := wr.Webhooks.SaveConfig(r.Context(), c); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to save webhook")
+		wr.logger.Println("[saveHandler] error:", err)
+		return
+	}
+
+	status := http.StatusOK
+	if c.Secret != "" {
+		status = http.StatusCreated
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	writeJSON(w, status, c)
+}
+
+func (wr *WebhooksRouter) getHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	c, err := wr.Webhooks.GetConfig(r.Context(), companyID)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch webhook")
+		wr.logger.Println("[getHandler] error:", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (wr *WebhooksRouter) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	if err := wr.Webhooks.DeleteConfig(r.Context(), companyID); err != nil {
+		metadatarouter.StoreError(w, err, "Failed to delete webhook")
+		wr.logger.Println("[deleteHandler] error:", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotateSecretHandler issues a new signing secret, it is only ever shown in this response
+func (wr *WebhooksRouter) rotateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	secret, err := wr.Webhooks.RotateSecret(r.Context(), companyID)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to rotate webhook secret")
+		wr.logger.Println("[rotateSecretHandler] error:", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"secret": secret})
+}
+
+// listDeliveriesHandler serves GET /api/webhook/deliveries?status=&limit=, newest first
+func (wr *WebhooksRouter) listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+
+	status := webhooks.DeliveryStatus(r.URL.Query().Get("status"))
+	if status != "" && !status.Valid() {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid status")
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := wr.Webhooks.ListDeliveries(r.Context(), companyID, status, limit)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch deliveries")
+		wr.logger.Println("[listDeliveriesHandler] error:", err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*webhooks.Delivery{}
+	}
+	writeJSON(w, http.StatusOK, deliveryList{Deliveries: deliveries})
+}
+
+// getDeliveryHandler returns a delivery with every attempt made to send it
+func (wr *WebhooksRouter) getDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	companyID, ok := metadatarouter.CompanyIDFromContext(r.Context())
+	if !ok {
+		metadatarouter.WriteJSONError(w, http.StatusUnauthorized, "Unauthorised")
+		return
+	}
+	deliveryID, err := uuid.Parse(mux.Vars(r)["deliveryID"])
+	if err != nil {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid delivery id")
+		return
+	}
+
+	delivery, attempts, err := wr.Webhooks.GetDelivery(r.Context(), companyID, deliveryID)
+	if err != nil {
+		metadatarouter.StoreError(w, err, "Failed to fetch delivery")
+		wr.logger.Println("[getDeliveryHandler] error:", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveryDetail{Delivery: delivery, Attempts: attempts})
+}
+
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 || limit > metadata.MaxListLimit {
+		metadatarouter.WriteJSONError(w, http.StatusBadRequest, "Invalid limit")
+		return 0, false
+	}
+	return limit, true
+}
@@ -0,0 +1,54 @@
+package webhooksrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mukundvijay123/KCloud/metadata"
+	metadatarouter "github.com/mukundvijay123/KCloud/metadata/metadataApiRouter"
+	"github.com/mukundvijay123/KCloud/webhooks"
+)
+
+type WebhooksRouter struct {
+	logger   *log.Logger
+	Webhooks webhooks.WebhookStore
+}
+
+func NewWebhooksRouter(store webhooks.WebhookStore, logger *log.Logger) *WebhooksRouter {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return &WebhooksRouter{
+		logger:   logger,
+		Webhooks: store,
+	}
+}
+
+// AddRoutes registers the webhook routes on router, guarded by userAuth.
+// Every role may read the webhook, changing it needs an admin. Keys scoped to
+// a group get none.
+func (wr *WebhooksRouter) AddRoutes(router *mux.Router, userAuth mux.MiddlewareFunc) error {
+	if router == nil || userAuth == nil {
+		return fmt.Errorf("webhook routes need a router and an auth middleware")
+	}
+
+	webhookSubRouter := router.PathPrefix("/api/webhook").Subrouter()
+	webhookSubRouter.Use(userAuth)
+	webhookSubRouter.HandleFunc("", metadatarouter.RequireRole(metadata.RoleAdmin, wr.saveHandler)).Methods("PUT")
+	webhookSubRouter.HandleFunc("", metadatarouter.RequireCompanyScope(wr.getHandler)).Methods("GET")
+	webhookSubRouter.HandleFunc("", metadatarouter.RequireRole(metadata.RoleAdmin, wr.deleteHandler)).Methods("DELETE")
+	webhookSubRouter.HandleFunc("/rotateSecret", metadatarouter.RequireRole(metadata.RoleAdmin, wr.rotateSecretHandler)).Methods("POST")
+	webhookSubRouter.HandleFunc("/deliveries", metadatarouter.RequireCompanyScope(wr.listDeliveriesHandler)).Methods("GET")
+	webhookSubRouter.HandleFunc("/deliveries/{deliveryID}", metadatarouter.RequireCompanyScope(wr.getDeliveryHandler)).Methods("GET")
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}